@@ -6,140 +6,671 @@ import (
 	"math"
 	"os"
 	"path"
+	"sync"
+	"time"
 
 	"github.com/nbroyles/nbdb/internal/manifest"
 	"github.com/nbroyles/nbdb/internal/sstable"
 	"github.com/nbroyles/nbdb/internal/storage"
+	"github.com/nbroyles/nbdb/internal/util"
 	log "github.com/sirupsen/logrus"
 )
 
-// TODO: make this an interface or add the ability to provide compaction strategies to enable
-// different compaction behavior
-type Compactor struct {
+// Compactor merges the sstables of a single column family as they accumulate, following one of the
+// compaction strategies. Compactions of different sstables can run in parallel
+type Compactor interface {
+	// Compact runs compactions until none are needed. snapshots are the sequence numbers of every live snapshot
+	// in ascending order; versions they can see are preserved
+	Compact(snapshots []uint64) error
+	// Pick reserves and returns a compaction that's needed, or nil if none is. Compactions that would touch
+	// sstables, or key ranges of an output level, that compactions already underway are working on aren't
+	// picked, so the compaction returned can run alongside them. It must be passed to Run
+	Pick() (*Compaction, error)
+	// Run runs a compaction returned by Pick, releasing its inputs once it's done. snapshots are the sequence
+	// numbers of every live snapshot in ascending order
+	Run(compaction *Compaction, snapshots []uint64) error
+	// Wait blocks until no compactions are underway, returning true if it had to wait for any
+	Wait() bool
+	// CompactRange compacts every sstable holding keys between start and end, inclusive, as far as the strategy
+	// allows, dropping the deletes and overwritten versions no snapshot can see. A nil start or end leaves that
+	// side of the range unbounded. No other compaction runs meanwhile
+	CompactRange(start []byte, end []byte, snapshots []uint64) error
+	// LevelSize returns the total size in bytes of the sstables in level
+	LevelSize(level int) (int64, error)
+	// Scores returns each level's compaction score, indexed by level. A level needs compacting once its score
+	// reaches 1, and the highest scoring level is compacted first
+	Scores() ([]float64, error)
+	// PendingCompactionBytes estimates the number of bytes that need compacting before no more compactions
+	// are needed
+	PendingCompactionBytes() (int64, error)
+	// Stats returns the work the compactor has done so far
+	Stats() Stats
+}
+
+// base holds what every compaction strategy shares: keeping track of the compactions underway and merging
+// sstables. Strategies decide which sstables to compact, and when
+type base struct {
 	manifest *manifest.Manifest
+	family   uint32
 	dataDir  string
 	dbName   string
 	codec    *storage.Codec
+	opts     Options
+	// pick is the strategy's Pick
+	pick func() (*Compaction, error)
+
+	statsMutex sync.Mutex
+	stats      Stats
+
+	// mutex guards the compactions underway so that those running in parallel never merge the same sstables
+	mutex sync.Mutex
+	// running holds the compactions underway
+	running map[*Compaction]bool
+	// compacting holds the filenames of the sstables being merged by the compactions underway
+	compacting map[string]bool
+	// manual is set while CompactRange runs. No other compaction starts until it's done
+	manual bool
+	// finished is broadcast whenever a compaction finishes
+	finished *sync.Cond
 }
 
-func New(manifest *manifest.Manifest, dataDir string, dbName string) *Compactor {
-	return &Compactor{manifest: manifest, dataDir: dataDir, dbName: dbName, codec: &storage.Codec{}}
+// Compaction is a merge of sstables from one level into another, picked by Pick. Its inputs are reserved
+// until it's run so that no other compaction merges them in the meantime
+type Compaction struct {
+	Level       int
+	OutputLevel int
+	Inputs      []*sstable.Metadata
+	// drop is set if the inputs are removed without being merged
+	drop bool
 }
 
-func (c *Compactor) Compact() error {
-	// Look at other levels to see if files need to be merged
-	for i := 0; i < c.manifest.Levels(); i++ {
-		if compact, err := c.shouldCompact(i); err != nil {
-			return fmt.Errorf("could not determine if should compact: %w", err)
-		} else if compact {
-			ssts := c.identifyMergeCandidates(i)
-			// TODO: need to provide these metadata to the merger in the correct order of most recent to least recent
-			newSsts, err := c.merge(i, ssts)
-			if err != nil {
-				return fmt.Errorf("failed performing compaction for %v: %w", ssts, err)
-			}
+// Stats counts the work a compactor has done since it was created
+type Stats struct {
+	// Compactions is the number of merges performed
+	Compactions int64
+	// BytesRead is the total size of the sstables merged
+	BytesRead int64
+	// BytesWritten is the total size of the sstables produced by merging
+	BytesWritten int64
+}
 
-			if err = c.updateManifest(ssts, newSsts); err != nil {
-				return fmt.Errorf("failed to update manifest with new sstables: %w", err)
-			}
+// Strategy decides which sstables are compacted, and when
+type Strategy int
+
+const (
+	// Leveled keeps each level below 0 a single sorted run of sstables that don't overlap, merging sstables
+	// down into it as the level above grows past its size threshold. Reads check at most one sstable per
+	// level and little space is held by overwritten versions, but data is rewritten each time a level above
+	// is merged into its level
+	Leveled Strategy = iota
+	// Tiered lets each level hold several sorted runs of similar size. Once a level has L0CompactionTrigger
+	// runs, they're merged into a single run in the next level, so data is rewritten about once per level.
+	// That makes writes cheaper than under Leveled at the cost of reads checking more sstables and more
+	// space held by overwritten versions. Each run is a single sstable, so Table.MaxFileSize and
+	// MaxSubcompactions don't apply
+	Tiered
+	// FIFO never merges sstables. They all stay in level 0 and the oldest are dropped once their total size
+	// passes MaxTotalSize, which suits data that's only useful for a while, like metrics
+	FIFO
+)
+
+const (
+	// DefaultL0CompactionTrigger is the number of level 0 sstables that triggers a compaction unless
+	// configured otherwise
+	DefaultL0CompactionTrigger = 4
+	// DefaultLevelSizeBase is the size in bytes that level sizes are based on unless configured otherwise
+	DefaultLevelSizeBase = 1_000_000
+	// DefaultLevelSizeMultiplier is how many times larger each level can grow than the one above it unless
+	// configured otherwise
+	DefaultLevelSizeMultiplier = 10
+	// DefaultMaxTotalSize is the size in bytes FIFO compaction lets sstables grow to unless configured otherwise
+	DefaultMaxTotalSize = int64(1) << 30
+	// DefaultTombstoneRatio is the share of an sstable's records that must be deletes for it to be compacted
+	// ahead of its turn unless configured otherwise
+	DefaultTombstoneRatio = 0.5
+)
+
+// Options configures when and how the compactor merges sstables. Zero values use the defaults
+type Options struct {
+	// Strategy is the compaction strategy. Defaults to Leveled
+	Strategy Strategy
+	// L0CompactionTrigger is the number of level 0 sstables that triggers compacting them into level 1.
+	// Under Tiered, it's the number of sorted runs that triggers merging any level
+	L0CompactionTrigger int
+	// LevelSizeBase determines how large each level can grow before it's compacted into the next one.
+	// Level L can hold LevelSizeBase * LevelSizeMultiplier^L bytes. Only used by Leveled
+	LevelSizeBase int64
+	// LevelSizeMultiplier is how many times larger each level can grow than the one above it. Only used by
+	// Leveled
+	LevelSizeMultiplier int
+	// DynamicLevelBytes sizes the levels above the last one off how much the last one holds, rather than
+	// how much it can hold, so that they're always a fraction of it. The last level is never compacted out of.
+	// Only used by Leveled
+	DynamicLevelBytes bool
+	// TombstoneRatio is the share of an sstable's records that must be deletes for it to be merged into the
+	// next level ahead of its turn. A ratio above 1 disables it. Only used by Leveled
+	TombstoneRatio float64
+	// MaxTotalSize is the total size in bytes of sstables after which FIFO drops the oldest. Only used by FIFO
+	MaxTotalSize int64
+	// MaxSubcompactions is the number of shards a single merge can be split into by key range. Shards are
+	// merged in parallel, each reading at least Table.MaxFileSize bytes of input
+	MaxSubcompactions int
+	// Table configures the sstables written by compaction
+	Table sstable.TableOpts
+	// MergeOperator is used to collapse merge operands. If nil, they're left as is
+	MergeOperator storage.MergeOperator
+	// Listener, if not nil, is notified of each compaction as it starts and finishes
+	Listener Listener
+	// RemoveTables, if not nil, deletes the sstables a compaction has replaced once the manifest no longer lists
+	// them. It's called before the listener is told that the compaction completed. If nil, they're left in place
+	RemoveTables func(metas []*sstable.Metadata) error
+}
+
+// Listener is notified of the merges a compactor performs. It's called from the goroutine running Compact
+type Listener interface {
+	// CompactionBegin is called before the input sstables are merged
+	CompactionBegin(info Info)
+	// CompactionCompleted is called once the output sstables have replaced the inputs in the manifest and the
+	// inputs have been removed, or with the error that stopped the compaction
+	CompactionCompleted(info Info, err error)
+}
+
+// Info describes a single compaction. Outputs and BytesWritten are only set once it has completed
+type Info struct {
+	// Family is the id of the column family being compacted
+	Family uint32
+	// Level is the level being compacted into OutputLevel
+	Level       int
+	OutputLevel int
+	Inputs      []*sstable.Metadata
+	Outputs     []*sstable.Metadata
+	BytesRead   int64
+	// BytesWritten is the total size of the outputs
+	BytesWritten int64
+	// Duration is how long the merge took
+	Duration time.Duration
+}
+
+func (o *Options) applyDefaults() {
+	if o.L0CompactionTrigger <= 0 {
+		o.L0CompactionTrigger = DefaultL0CompactionTrigger
+	}
+
+	if o.LevelSizeBase <= 0 {
+		o.LevelSizeBase = DefaultLevelSizeBase
+	}
+
+	if o.LevelSizeMultiplier <= 1 {
+		o.LevelSizeMultiplier = DefaultLevelSizeMultiplier
+	}
+
+	if o.TombstoneRatio <= 0 {
+		o.TombstoneRatio = DefaultTombstoneRatio
+	}
+
+	if o.MaxTotalSize <= 0 {
+		o.MaxTotalSize = DefaultMaxTotalSize
+	}
+
+	if o.MaxSubcompactions <= 0 {
+		o.MaxSubcompactions = 1
+	}
+}
+
+// New returns a compactor for the sstables of a single column family in manifest that follows opts.Strategy
+func New(manifest *manifest.Manifest, family uint32, dataDir string, dbName string, opts Options) Compactor {
+	opts.applyDefaults()
+	if opts.Strategy == Tiered {
+		opts.Table.MaxFileSize = math.MaxInt32
+		opts.MaxSubcompactions = 1
+	}
+
+	b := &base{manifest: manifest, family: family, dataDir: dataDir, dbName: dbName, codec: &storage.Codec{},
+		opts: opts, running: make(map[*Compaction]bool), compacting: make(map[string]bool)}
+	b.finished = sync.NewCond(&b.mutex)
+
+	var c Compactor
+	switch opts.Strategy {
+	case Tiered:
+		t := &tiered{base: b}
+		b.pick, c = t.Pick, t
+	case FIFO:
+		f := &fifo{base: b}
+		b.pick, c = f.Pick, f
+	default:
+		l := &leveled{base: b}
+		b.pick, c = l.Pick, l
+	}
+
+	return c
+}
+
+// Compact runs the compactions the strategy picks until none are needed. snapshots are the sequence numbers
+// of every live snapshot in ascending order; versions they can see are preserved
+func (c *base) Compact(snapshots []uint64) error {
+	for {
+		compaction, err := c.pick()
+		if err != nil || compaction == nil {
+			return err
+		}
+
+		if err := c.Run(compaction, snapshots); err != nil {
+			return err
 		}
 	}
+}
 
-	return nil
+// Run merges the compaction's inputs, releasing them once it's done. snapshots are the sequence numbers of
+// every live snapshot in ascending order
+func (c *base) Run(compaction *Compaction, snapshots []uint64) error {
+	defer c.release(compaction)
+
+	_, err := c.compact(compaction, snapshots)
+	return err
 }
 
-func (c *Compactor) shouldCompact(level int) (bool, error) {
-	if level == 0 {
-		return len(c.manifest.MetadataForLevel(level)) >= 4, nil
+// Wait blocks until no compactions are underway, returning true if it had to wait for any
+func (c *base) Wait() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	waited := false
+	for len(c.running) > 0 || c.manual {
+		waited = true
+		c.finished.Wait()
 	}
 
-	above, err := c.aboveCompactionThreshold(level)
+	return waited
+}
+
+// reserveFirst reserves and returns the first of the candidate compactions that doesn't conflict with the
+// compactions underway, or nil if they all do. candidates is called while holding the mutex so that none
+// of the sstables it returns can be merged away before they're reserved
+func (c *base) reserveFirst(candidates func() ([]*Compaction, error)) (*Compaction, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.manual {
+		return nil, nil
+	}
+
+	compactions, err := candidates()
 	if err != nil {
-		return false, fmt.Errorf("failed checking if level %d is above compaction threshold: %w", level, err)
+		return nil, err
 	}
 
-	return above, nil
+	for _, compaction := range compactions {
+		if !c.conflicts(compaction) {
+			c.reserve(compaction)
+			return compaction, nil
+		}
+	}
+
+	return nil, nil
 }
 
-func (c *Compactor) aboveCompactionThreshold(level int) (bool, error) {
-	lvlSz := int64(0)
-	for _, meta := range c.manifest.MetadataForLevel(level) {
+// conflicts returns true if the compaction would touch an sstable being merged by a compaction underway, or
+// write keys into its output level in a range that one is writing to. Dropped sstables write nothing, so
+// drops only conflict over their inputs. Must be called while holding the mutex
+func (c *base) conflicts(compaction *Compaction) bool {
+	for _, meta := range compaction.Inputs {
+		if c.compacting[meta.Filename] {
+			return true
+		}
+	}
+	if compaction.drop {
+		return false
+	}
+
+	start, end := keyRange(compaction.Inputs)
+	for running := range c.running {
+		if running.drop || running.OutputLevel != compaction.OutputLevel {
+			continue
+		}
+
+		runningStart, runningEnd := keyRange(running.Inputs)
+		if bytes.Compare(start, runningEnd) <= 0 && bytes.Compare(end, runningStart) >= 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reserve records a compaction as underway. Must be called while holding the mutex
+func (c *base) reserve(compaction *Compaction) {
+	c.running[compaction] = true
+	for _, meta := range compaction.Inputs {
+		c.compacting[meta.Filename] = true
+	}
+}
+
+// release records a compaction as finished
+func (c *base) release(compaction *Compaction) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.running, compaction)
+	for _, meta := range compaction.Inputs {
+		delete(c.compacting, meta.Filename)
+	}
+	c.finished.Broadcast()
+}
+
+// exclusive waits for the compactions underway to finish and then runs fn, starting no other compaction
+// until it's done
+func (c *base) exclusive(fn func() error) error {
+	c.mutex.Lock()
+	for len(c.running) > 0 || c.manual {
+		c.finished.Wait()
+	}
+	c.manual = true
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		c.manual = false
+		c.finished.Broadcast()
+		c.mutex.Unlock()
+	}()
+
+	return fn()
+}
+
+// compact merges the compaction's inputs from its level into its output level, or drops them, removing the
+// inputs once they're replaced and notifying the listener if there is one
+func (c *base) compact(compaction *Compaction, snapshots []uint64) (Info, error) {
+	info := Info{Family: c.family, Level: compaction.Level, OutputLevel: compaction.OutputLevel,
+		Inputs: compaction.Inputs}
+	if c.opts.Listener != nil {
+		c.opts.Listener.CompactionBegin(info)
+	}
+
+	start := time.Now()
+	err := c.mergeLevel(&info, compaction.drop, snapshots)
+	info.Duration = time.Since(start)
+	if err == nil && c.opts.RemoveTables != nil {
+		if err = c.opts.RemoveTables(info.Inputs); err != nil {
+			err = fmt.Errorf("failed removing compacted sstables: %w", err)
+		}
+	}
+	if c.opts.Listener != nil {
+		c.opts.Listener.CompactionCompleted(info, err)
+	}
+
+	return info, err
+}
+
+// mergeLevel merges info's inputs into new sstables in its output level, replacing them in the manifest. If
+// drop is set, the inputs are removed from the manifest without being merged
+func (c *base) mergeLevel(info *Info, drop bool, snapshots []uint64) error {
+	if drop {
+		if err := c.updateManifest(info, nil); err != nil {
+			return fmt.Errorf("failed to remove dropped sstables from manifest: %w", err)
+		}
+
+		c.statsMutex.Lock()
+		c.stats.Compactions++
+		c.statsMutex.Unlock()
+
+		return nil
+	}
+
+	var err error
+	if info.BytesRead, err = c.tablesSize(info.Inputs); err != nil {
+		return err
+	}
+
+	newSsts, err := c.merge(info.Level, info.OutputLevel, info.Inputs, info.BytesRead, snapshots)
+	if err != nil {
+		return fmt.Errorf("failed performing compaction for %v: %w", info.Inputs, err)
+	}
+
+	bytesWritten, err := c.tablesSize(newSsts)
+	if err != nil {
+		return err
+	}
+
+	// The manifest mustn't list sstables a crash could lose, since their inputs are removed once it does
+	if err = util.SyncDir(c.dbName, c.dataDir); err != nil {
+		return err
+	}
+
+	if err = c.updateManifest(info, newSsts); err != nil {
+		return fmt.Errorf("failed to update manifest with new sstables: %w", err)
+	}
+	info.Outputs, info.BytesWritten = newSsts, bytesWritten
+
+	c.statsMutex.Lock()
+	c.stats.Compactions++
+	c.stats.BytesRead += info.BytesRead
+	c.stats.BytesWritten += bytesWritten
+	c.statsMutex.Unlock()
+
+	return nil
+}
+
+// LevelSize returns the total size in bytes of the sstables in level
+func (c *base) LevelSize(level int) (int64, error) {
+	size, err := c.tablesSize(c.manifest.MetadataForLevel(c.family, level))
+	if err != nil {
+		return 0, fmt.Errorf("failed calculating level %d size: %w", level, err)
+	}
+
+	return size, nil
+}
+
+// Stats returns the work the compactor has done so far
+func (c *base) Stats() Stats {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+
+	return c.stats
+}
+
+func (c *base) tablesSize(metas []*sstable.Metadata) (int64, error) {
+	size := int64(0)
+	for _, meta := range metas {
 		info, err := os.Stat(path.Join(c.dataDir, c.dbName, meta.Filename))
-		if err != nil {
-			return false, fmt.Errorf("failed calculating level %d size: %w", level, err)
+		if os.IsNotExist(err) {
+			// Merged away by a compaction running alongside, so its data is counted in the tables that replaced it
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("failed reading size of sstable %s: %w", meta.Filename, err)
 		}
 
-		lvlSz += info.Size()
+		size += info.Size()
 	}
 
-	// level size > 10^L * 1 MB
-	return lvlSz > int64(math.Pow(10, float64(level)))*1_000_000, nil
+	return size, nil
 }
 
-func (c *Compactor) identifyMergeCandidates(level int) []*sstable.Metadata {
-	var candidates []*sstable.Metadata
-	lvlMeta := c.manifest.MetadataForLevel(level)
-	if len(lvlMeta) == 0 {
-		log.Panicf("should not have no metadata for level (%d) we're attempting compaction on", level)
+// bottommost returns true if no sstable other than metas holds keys they do, at level or any level below it
+func (c *base) bottommost(level int, metas []*sstable.Metadata) bool {
+	merging := make(map[string]bool)
+	for _, m := range metas {
+		merging[m.Filename] = true
+	}
+
+	// The sstables left in level are ones that don't overlap metas, except under tiered compaction where they
+	// can be older sorted runs
+	for _, m := range c.manifest.MetadataForLevel(c.family, level) {
+		if merging[m.Filename] {
+			continue
+		}
+
+		for _, meta := range metas {
+			if overlaps(m, meta.StartKey, meta.EndKey) {
+				return false
+			}
+		}
 	}
 
-	if level == 0 {
-		candidates = append(candidates, lvlMeta...)
-	} else {
-		candidates = append(candidates, lvlMeta[0])
+	startKey, endKey := keyRange(metas)
+	for l := level + 1; l < c.manifest.Levels(c.family); l++ {
+		for _, m := range c.manifest.MetadataForLevel(c.family, l) {
+			if overlaps(m, startKey, endKey) {
+				return false
+			}
+		}
 	}
 
-	// Find min key and max key from all potential candidates
-	// This allows us to find all files in the next level that overlap
+	return true
+}
+
+// keyRange returns the smallest and largest keys in metas
+func keyRange(metas []*sstable.Metadata) ([]byte, []byte) {
 	var startKey []byte
 	var endKey []byte
-	for _, c := range candidates {
+	for _, m := range metas {
 		if startKey == nil {
-			startKey = c.StartKey
-			endKey = c.EndKey
+			startKey = m.StartKey
+			endKey = m.EndKey
 			continue
 		}
 
-		if bytes.Compare(c.StartKey, startKey) < 0 {
-			startKey = c.StartKey
+		if bytes.Compare(m.StartKey, startKey) < 0 {
+			startKey = m.StartKey
 		}
 
-		if bytes.Compare(c.EndKey, endKey) > 0 {
-			endKey = c.EndKey
+		if bytes.Compare(m.EndKey, endKey) > 0 {
+			endKey = m.EndKey
 		}
 	}
 
-	totalRange := sstable.Metadata{
-		StartKey: startKey,
-		EndKey:   endKey,
+	return startKey, endKey
+}
+
+// overlaps returns true if meta holds keys between start and end, inclusive. A nil start or end leaves that
+// side of the range unbounded
+func overlaps(meta *sstable.Metadata, start []byte, end []byte) bool {
+	return (end == nil || bytes.Compare(meta.StartKey, end) <= 0) &&
+		(start == nil || bytes.Compare(meta.EndKey, start) >= 0)
+}
+
+// newestFirst returns metas, which are ordered from oldest to newest like the sstables in a level, in reverse
+func newestFirst(metas []*sstable.Metadata) []*sstable.Metadata {
+	reversed := make([]*sstable.Metadata, len(metas))
+	for i, meta := range metas {
+		reversed[len(metas)-1-i] = meta
 	}
-	for _, m := range c.manifest.MetadataForLevel(level + 1) {
-		if totalRange.ContainsKey(m.StartKey) || totalRange.ContainsKey(m.EndKey) {
-			candidates = append(candidates, m)
+
+	return reversed
+}
+
+// merge merges meta into outputLevel. Large merges are split into subcompactions by key range, which are merged
+// in parallel. The tables they write are returned in key order
+func (c *base) merge(level int, outputLevel int, meta []*sstable.Metadata, size int64,
+	snapshots []uint64) ([]*sstable.Metadata, error) {
+	bottommost := c.bottommost(outputLevel, meta)
+
+	var splits [][]byte
+	if shards := c.subcompactions(size); shards > 1 {
+		var err error
+		if splits, err = sstable.SplitKeys(meta, shards, c.dataDir, c.dbName); err != nil {
+			return nil, err
 		}
 	}
 
-	return candidates
+	results := make([][]*sstable.Metadata, len(splits)+1)
+	errs := make([]error, len(splits)+1)
+	var wg sync.WaitGroup
+	for i := range results {
+		var start, end []byte
+		if i > 0 {
+			start = splits[i-1]
+		}
+		if i < len(splits) {
+			end = splits[i]
+		}
+
+		merger := sstable.NewMerger(level, outputLevel, meta, snapshots, c.opts.MergeOperator, c.opts.Table,
+			c.dataDir, c.dbName)
+		merger.SetBottommost(bottommost)
+		merger.SetBounds(start, end)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = merger.Merge()
+		}(i)
+	}
+	wg.Wait()
+
+	var merged []*sstable.Metadata
+	for _, result := range results {
+		merged = append(merged, result...)
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			// The tables written by the subcompactions that succeeded aren't needed anymore
+			c.remove(merged)
+			return nil, err
+		}
+	}
+
+	return merged, nil
 }
 
-func (c *Compactor) merge(level int, meta []*sstable.Metadata) ([]*sstable.Metadata, error) {
-	return sstable.NewMerger(level, level+1, meta, c.dataDir, c.dbName).Merge()
+// subcompactions returns the number of shards to split a merge of size bytes into
+func (c *base) subcompactions(size int64) int {
+	maxFileSize := c.opts.Table.MaxFileSize
+	if maxFileSize <= 0 {
+		maxFileSize = sstable.DefaultMaxFileSize
+	}
+
+	shards := int(size / int64(maxFileSize))
+	if shards > c.opts.MaxSubcompactions {
+		shards = c.opts.MaxSubcompactions
+	}
+
+	return shards
 }
 
-func (c *Compactor) updateManifest(oldSsts []*sstable.Metadata, newSsts []*sstable.Metadata) error {
-	for _, m := range oldSsts {
-		err := c.manifest.AddEntry(manifest.NewEntry(m, true))
-		if err != nil {
-			return fmt.Errorf("failed marking merged sstables as deleted in manifest: %w", err)
+// remove deletes sstables that were written but never added to the manifest
+func (c *base) remove(metas []*sstable.Metadata) {
+	for _, meta := range metas {
+		if err := os.Remove(path.Join(c.dataDir, c.dbName, meta.Filename)); err != nil {
+			log.Warnf("failed removing sstable %s from failed compaction: %v", meta.Filename, err)
 		}
 	}
+}
 
+func (c *base) updateManifest(info *Info, newSsts []*sstable.Metadata) error {
+	// Recorded in one update so that readers never see the keys being compacted go missing or show up twice
+	var entries []*manifest.Entry
+	for _, m := range info.Inputs {
+		entries = append(entries, manifest.NewEntry(m, true))
+	}
 	for _, m := range newSsts {
-		err := c.manifest.AddEntry(manifest.NewEntry(m, false))
-		if err != nil {
-			return fmt.Errorf("failed adding new sstables to manifest: %w", err)
-		}
+		entries = append(entries, manifest.NewEntry(m, false))
+	}
+	if pointer := c.compactionPointer(info); pointer != nil {
+		entries = append(entries, pointer)
+	}
+
+	if err := c.manifest.AddEntries(entries); err != nil {
+		return fmt.Errorf("failed replacing merged sstables in manifest: %w", err)
 	}
 
 	return nil
 }
+
+// compactionPointer returns an entry moving the compaction pointer of the level info merged sstables from
+// past the last of them, or nil if the level doesn't keep one. Only levels below 0 that are merged into the
+// next one under leveled compaction do
+func (c *base) compactionPointer(info *Info) *manifest.Entry {
+	if c.opts.Strategy != Leveled || info.Level == 0 || info.OutputLevel == info.Level {
+		return nil
+	}
+
+	var key []byte
+	for _, meta := range info.Inputs {
+		if int(meta.Level) == info.Level && bytes.Compare(meta.EndKey, key) > 0 {
+			key = meta.EndKey
+		}
+	}
+
+	return manifest.NewCompactionPointerEntry(c.family, info.Level, key)
+}
@@ -1,12 +1,17 @@
 package compaction
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
 	"path"
 	"testing"
 
 	"github.com/nbroyles/nbdb/internal/manifest"
 	"github.com/nbroyles/nbdb/internal/memtable/interfaces"
 	"github.com/nbroyles/nbdb/internal/sstable"
+	"github.com/nbroyles/nbdb/internal/storage"
 	"github.com/nbroyles/nbdb/internal/test"
 	"github.com/nbroyles/nbdb/internal/util"
 	"github.com/stretchr/testify/assert"
@@ -42,11 +47,33 @@ func TestCompactor_Compact_Level0NotFull(t *testing.T) {
 	assert.NoError(t, man.AddEntry(manifest.NewEntry(md2, false)))
 	assert.NoError(t, man.AddEntry(manifest.NewEntry(md3, false)))
 
-	c := New(man, dataDir, dbName)
+	c := New(man, 0, dataDir, dbName, Options{})
 
-	assert.NoError(t, c.Compact())
+	assert.NoError(t, c.Compact(nil))
 
-	assert.Equal(t, []*sstable.Metadata{md1, md2, md3}, man.MetadataForLevel(0))
+	assert.Equal(t, []*sstable.Metadata{md1, md2, md3}, man.MetadataForLevel(0, 0))
+}
+
+func TestCompactor_Compact_L0CompactionTrigger(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	for _, name := range []string{"sst1", "sst2", "sst3"} {
+		md := writeTable(t, 0, name, test.NewStaticIterator(map[string]string{name: "value"}), dataDir, dbName)
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	// The same three tables that aren't enough to trigger a compaction by default are with a lower trigger
+	c := New(man, 0, dataDir, dbName, Options{L0CompactionTrigger: 3})
+
+	assert.NoError(t, c.Compact(nil))
+
+	assert.Empty(t, man.MetadataForLevel(0, 0))
+	assert.Len(t, man.MetadataForLevel(0, 1), 1)
 }
 
 func TestCompactor_Compact_Level0Full(t *testing.T) {
@@ -81,19 +108,20 @@ func TestCompactor_Compact_Level0Full(t *testing.T) {
 	assert.NoError(t, man.AddEntry(manifest.NewEntry(md3, false)))
 	assert.NoError(t, man.AddEntry(manifest.NewEntry(md4, false)))
 
-	c := New(man, dataDir, dbName)
+	c := New(man, 0, dataDir, dbName, Options{})
 
-	assert.NoError(t, c.Compact())
+	assert.NoError(t, c.Compact(nil))
 
-	assert.Equal(t, 0, len(man.MetadataForLevel(0)))
-	assert.Equal(t, 1, len(man.MetadataForLevel(1)))
+	assert.Equal(t, 0, len(man.MetadataForLevel(0, 0)))
+	assert.Equal(t, 1, len(man.MetadataForLevel(0, 1)))
 
-	actual := man.MetadataForLevel(1)[0]
+	actual := man.MetadataForLevel(0, 1)[0]
 	assert.Equal(t, &sstable.Metadata{
 		Level:    1,
 		Filename: actual.Filename,
 		StartKey: []byte("aaa"),
 		EndKey:   []byte("whoomp"),
+		Records:  7,
 	}, actual)
 }
 
@@ -135,19 +163,20 @@ func TestCompactor_Compact_Level0FullExistingLevel1WithOverlap(t *testing.T) {
 	assert.NoError(t, man.AddEntry(manifest.NewEntry(md4, false)))
 	assert.NoError(t, man.AddEntry(manifest.NewEntry(md5, false)))
 
-	c := New(man, dataDir, dbName)
+	c := New(man, 0, dataDir, dbName, Options{})
 
-	assert.NoError(t, c.Compact())
+	assert.NoError(t, c.Compact(nil))
 
-	assert.Equal(t, 0, len(man.MetadataForLevel(0)))
-	assert.Equal(t, 1, len(man.MetadataForLevel(1)))
+	assert.Equal(t, 0, len(man.MetadataForLevel(0, 0)))
+	assert.Equal(t, 1, len(man.MetadataForLevel(0, 1)))
 
-	actual := man.MetadataForLevel(1)[0]
+	actual := man.MetadataForLevel(0, 1)[0]
 	assert.Equal(t, &sstable.Metadata{
 		Level:    1,
 		Filename: actual.Filename,
 		StartKey: []byte("aaa"),
 		EndKey:   []byte("zig"),
+		Records:  9,
 	}, actual)
 }
 
@@ -189,34 +218,520 @@ func TestCompactor_Compact_Level0FullExistingLevel1WithNoOverlap(t *testing.T) {
 	assert.NoError(t, man.AddEntry(manifest.NewEntry(md4, false)))
 	assert.NoError(t, man.AddEntry(manifest.NewEntry(md5, false)))
 
-	c := New(man, dataDir, dbName)
+	c := New(man, 0, dataDir, dbName, Options{})
 
-	assert.NoError(t, c.Compact())
+	assert.NoError(t, c.Compact(nil))
 
-	assert.Equal(t, 0, len(man.MetadataForLevel(0)))
-	assert.Equal(t, 2, len(man.MetadataForLevel(1)))
+	assert.Equal(t, 0, len(man.MetadataForLevel(0, 0)))
+	assert.Equal(t, 2, len(man.MetadataForLevel(0, 1)))
 
-	actuals := man.MetadataForLevel(1)
+	actuals := man.MetadataForLevel(0, 1)
 	assert.Equal(t, []*sstable.Metadata{
 		{
 			Level:    1,
 			Filename: actuals[0].Filename,
 			StartKey: []byte("zig"),
 			EndKey:   []byte("zzzzz"),
+			Records:  2,
 		},
 		{
 			Level:    1,
 			Filename: actuals[1].Filename,
 			StartKey: []byte("aaa"),
 			EndKey:   []byte("whoomp"),
+			Records:  7,
 		},
 	}, actuals)
 }
 
+func TestCompactor_Compact_Level0FullExistingLevel1SpansRange(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	md1 := writeTable(t, 0, "sst1", test.NewStaticIterator(map[string]string{
+		"baz": "bax",
+	}), dataDir, dbName)
+
+	md2 := writeTable(t, 0, "sst2", test.NewStaticIterator(map[string]string{
+		"foo": "butt",
+	}), dataDir, dbName)
+
+	md3 := writeTable(t, 0, "sst3", test.NewStaticIterator(map[string]string{
+		"howdy": "time",
+	}), dataDir, dbName)
+
+	md4 := writeTable(t, 0, "sst4", test.NewStaticIterator(map[string]string{
+		"full": "af",
+	}), dataDir, dbName)
+
+	// Neither the start nor the end key of this table falls within level 0's range, but the table
+	// still overlaps it
+	md5 := writeTable(t, 1, "sst5", test.NewStaticIterator(map[string]string{
+		"aaa":   "blarg",
+		"zzzzz": "sadman",
+	}), dataDir, dbName)
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	for _, md := range []*sstable.Metadata{md1, md2, md3, md4, md5} {
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	c := New(man, 0, dataDir, dbName, Options{})
+
+	assert.NoError(t, c.Compact(nil))
+
+	assert.Equal(t, 0, len(man.MetadataForLevel(0, 0)))
+	assert.Equal(t, 1, len(man.MetadataForLevel(0, 1)))
+
+	actual := man.MetadataForLevel(0, 1)[0]
+	assert.Equal(t, &sstable.Metadata{
+		Level:    1,
+		Filename: actual.Filename,
+		StartKey: []byte("aaa"),
+		EndKey:   []byte("zzzzz"),
+		Records:  6,
+	}, actual)
+}
+
+func TestCompactor_Stats(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	for _, name := range []string{"sst1", "sst2", "sst3"} {
+		md := writeTable(t, 0, name, test.NewStaticIterator(map[string]string{name: "value"}), dataDir, dbName)
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	listener := &recordingListener{}
+	var removed []*sstable.Metadata
+	removeTables := func(metas []*sstable.Metadata) error {
+		// The inputs are removed before the listener hears that the compaction completed
+		assert.Empty(t, listener.completed)
+		removed = metas
+		return nil
+	}
+	c := New(man, 0, dataDir, dbName, Options{L0CompactionTrigger: 3, Listener: listener,
+		RemoveTables: removeTables}).(*leveled)
+	inputs := c.mergeCandidates(0)[0]
+
+	l0Size, err := c.LevelSize(0)
+	assert.NoError(t, err)
+	assert.True(t, l0Size > 0)
+
+	// Level 0 is pending compaction in full once it has enough tables
+	pending, err := c.PendingCompactionBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, l0Size, pending)
+
+	assert.NoError(t, c.Compact(nil))
+
+	l1Size, err := c.LevelSize(1)
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{Compactions: 1, BytesRead: l0Size, BytesWritten: l1Size}, c.Stats())
+
+	assert.Equal(t, []Info{{Level: 0, OutputLevel: 1, Inputs: inputs}}, listener.begun)
+	assert.True(t, listener.completed[0].Duration > 0)
+	listener.completed[0].Duration = 0
+	assert.Equal(t, []Info{{Level: 0, OutputLevel: 1, Inputs: inputs, Outputs: man.MetadataForLevel(0, 1),
+		BytesRead: l0Size, BytesWritten: l1Size}}, listener.completed)
+	assert.Equal(t, []error{nil}, listener.errs)
+	assert.Equal(t, inputs, removed)
+
+	pending, err = c.PendingCompactionBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pending)
+}
+
+func TestCompactor_CompactRange(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	for _, md := range []*sstable.Metadata{
+		writeTable(t, 0, "sst1", test.NewStaticIterator(map[string]string{"a": "v1", "b": "v1"}), dataDir, dbName),
+		writeTable(t, 0, "sst2", test.NewStaticIterator(map[string]string{"m": "v2"}), dataDir, dbName),
+		writeTable(t, 1, "sst3", test.NewStaticIterator(map[string]string{"x": "v3", "y": "v3"}), dataDir, dbName),
+		writeTable(t, 2, "sst4", test.NewStaticIterator(map[string]string{"c": "v4"}), dataDir, dbName),
+		writeTable(t, 2, "sst5", test.NewStaticIterator(map[string]string{"z": "v5"}), dataDir, dbName),
+	} {
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	listener := &recordingListener{}
+	c := New(man, 0, dataDir, dbName, Options{Listener: listener})
+
+	// Every level 0 table is compacted since they can overlap, while x, y and z are left where they are
+	assert.NoError(t, c.CompactRange([]byte("a"), []byte("c"), nil))
+
+	assert.Empty(t, man.MetadataForLevel(0, 0))
+	assert.Equal(t, []string{"sst3"}, filenames(man.MetadataForLevel(0, 1)))
+
+	l2 := man.MetadataForLevel(0, 2)
+	assert.Len(t, l2, 2)
+	assert.Equal(t, "sst5", l2[0].Filename)
+	assert.Equal(t, []byte("a"), l2[1].StartKey)
+	assert.Equal(t, []byte("m"), l2[1].EndKey)
+
+	assert.Len(t, listener.completed, 2)
+	assert.Equal(t, []string{"sst2", "sst1"}, filenames(listener.completed[0].Inputs))
+	assert.Equal(t, 1, listener.completed[1].Level)
+	assert.Equal(t, 2, listener.completed[1].OutputLevel)
+
+	// Tables already in the bottom level are rewritten in place
+	assert.NoError(t, c.CompactRange([]byte("z"), nil, nil))
+	assert.Len(t, listener.completed, 3)
+	assert.Equal(t, []string{"sst5"}, filenames(listener.completed[2].Inputs))
+	assert.Equal(t, 2, listener.completed[2].OutputLevel)
+	assert.Len(t, man.MetadataForLevel(0, 2), 2)
+}
+
+func TestCompactor_Pick(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	for _, md := range []*sstable.Metadata{
+		writeTable(t, 1, "sst1", test.NewStaticIterator(map[string]string{"a": "v1", "b": "v1"}), dataDir, dbName),
+		writeTable(t, 1, "sst2", test.NewStaticIterator(map[string]string{"c": "v2"}), dataDir, dbName),
+		writeTable(t, 1, "sst3", test.NewStaticIterator(map[string]string{"x": "v3"}), dataDir, dbName),
+		writeTable(t, 2, "sst4", test.NewStaticIterator(map[string]string{"b": "v4", "c": "v4"}), dataDir, dbName),
+	} {
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	c := New(man, 0, dataDir, dbName, Options{LevelSizeBase: 1})
+
+	first, err := c.Pick()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, first.Level)
+	assert.Equal(t, 2, first.OutputLevel)
+	assert.Equal(t, []string{"sst1", "sst4"}, filenames(first.Inputs))
+
+	// sst2 overlaps sst4, which is already being merged, so sst3 is merged alongside instead
+	second, err := c.Pick()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sst3"}, filenames(second.Inputs))
+
+	none, err := c.Pick()
+	assert.NoError(t, err)
+	assert.Nil(t, none)
+
+	// Once the first merge is done sst2 is free to be merged with its output
+	assert.NoError(t, c.Run(first, nil))
+	third, err := c.Pick()
+	assert.NoError(t, err)
+	assert.Equal(t, "sst2", third.Inputs[0].Filename)
+	assert.Len(t, third.Inputs, 2)
+
+	assert.NoError(t, c.Run(second, nil))
+	assert.NoError(t, c.Run(third, nil))
+	assert.Empty(t, man.MetadataForLevel(0, 1))
+	assert.False(t, c.Wait())
+}
+
+func TestCompactor_Subcompactions(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	expected := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		entries := make(map[string]string)
+		for j := 0; j < 20; j++ {
+			key := fmt.Sprintf("key%02d", j*3+i)
+			entries[key] = fmt.Sprintf("value%d", i)
+			expected[key] = entries[key]
+		}
+
+		// An index entry for every record gives plenty of keys to split on
+		name := fmt.Sprintf("sst%d", i)
+		file, err := util.CreateFile(name, dbName, dataDir)
+		assert.NoError(t, err)
+		md, err := sstable.NewBuilder(name, test.NewStaticIterator(entries), nil, 0, file, 1).WriteTable()
+		assert.NoError(t, err)
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	c := New(man, 0, dataDir, dbName, Options{L0CompactionTrigger: 3, MaxSubcompactions: 4,
+		Table: sstable.TableOpts{MaxFileSize: 200}}).(*leveled)
+
+	l0Size, err := c.LevelSize(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, c.subcompactions(l0Size))
+
+	assert.NoError(t, c.Compact(nil))
+	assert.Empty(t, man.MetadataForLevel(0, 0))
+
+	// The tables written by each subcompaction are in key order and don't overlap
+	l1 := man.MetadataForLevel(0, 1)
+	assert.True(t, len(l1) >= 4)
+	for i := 1; i < len(l1); i++ {
+		assert.True(t, bytes.Compare(l1[i-1].EndKey, l1[i].StartKey) < 0)
+	}
+
+	actual := make(map[string]string)
+	for _, meta := range l1 {
+		handle, err := os.Open(path.Join(dataDir, dbName, meta.Filename))
+		assert.NoError(t, err)
+
+		iter, err := sstable.NewIterator(handle)
+		assert.NoError(t, err)
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			actual[string(iter.Record().Key)] = string(iter.Record().Value)
+		}
+		assert.NoError(t, iter.Close())
+	}
+	assert.Equal(t, expected, actual)
+}
+
+func TestCompactor_PicksHighestScore(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	entries := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		entries[fmt.Sprintf("key%02d", i)] = "value"
+	}
+	for _, md := range []*sstable.Metadata{
+		writeTable(t, 0, "sst1", test.NewStaticIterator(map[string]string{"a": "v1"}), dataDir, dbName),
+		writeTable(t, 0, "sst2", test.NewStaticIterator(map[string]string{"b": "v2"}), dataDir, dbName),
+		writeTable(t, 1, "sst3", test.NewStaticIterator(entries), dataDir, dbName),
+	} {
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	info, err := os.Stat(path.Join(dataDir, dbName, "sst3"))
+	assert.NoError(t, err)
+
+	// Level 1 is twice its target of a quarter of its size times the multiplier of two, while level 0 has
+	// just enough sstables to be compacted
+	c := New(man, 0, dataDir, dbName, Options{L0CompactionTrigger: 2, LevelSizeBase: info.Size() / 4,
+		LevelSizeMultiplier: 2})
+	scores, err := c.Scores()
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{1, float64(info.Size()) / float64(info.Size()/4*2)}, scores)
+
+	compaction, err := c.Pick()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, compaction.Level)
+	assert.Equal(t, []string{"sst3"}, filenames(compaction.Inputs))
+	assert.NoError(t, c.Run(compaction, nil))
+}
+
+func TestCompactor_DynamicLevelBytes(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	entries := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		entries[fmt.Sprintf("key%03d", i)] = "value"
+	}
+	for _, md := range []*sstable.Metadata{
+		writeTable(t, 0, "sst0", test.NewStaticIterator(map[string]string{"a": "v0"}), dataDir, dbName),
+		writeTable(t, 1, "sst1", test.NewStaticIterator(map[string]string{"a": "v1"}), dataDir, dbName),
+		writeTable(t, 2, "sst2", test.NewStaticIterator(map[string]string{"b": "v2"}), dataDir, dbName),
+		writeTable(t, 3, "sst3", test.NewStaticIterator(entries), dataDir, dbName),
+	} {
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	static := New(man, 0, dataDir, dbName, Options{LevelSizeBase: 1}).(*leveled)
+	targets, err := static.levelTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, 10, 100, 1000}, targets)
+
+	// Levels above the last are sized off what it holds, but never below level 1's static target
+	bottom, err := static.LevelSize(3)
+	assert.NoError(t, err)
+
+	// The last level holds more than its static target, which would have it compacted into a new level. Its
+	// target follows what it holds instead, so it never needs compacting
+	assert.True(t, bottom > 1000)
+	dynamic := New(man, 0, dataDir, dbName, Options{LevelSizeBase: 1, DynamicLevelBytes: true}).(*leveled)
+	targets, err = dynamic.levelTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, bottom / 100, bottom / 10, bottom}, targets)
+
+	scores, err := dynamic.Scores()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), scores[3])
+	pending, err := dynamic.PendingCompactionBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pending)
+
+	dynamic = New(man, 0, dataDir, dbName, Options{LevelSizeBase: bottom / 50, DynamicLevelBytes: true}).(*leveled)
+	targets, err = dynamic.levelTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, bottom / 50 * 10, bottom / 50 * 10, bottom}, targets)
+}
+
+func TestCompactor_LevelTargetsOverflow(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	for _, md := range []*sstable.Metadata{
+		writeTable(t, 0, "sst0", test.NewStaticIterator(map[string]string{"a": "v0"}), dataDir, dbName),
+		writeTable(t, 1, "sst1", test.NewStaticIterator(map[string]string{"a": "v1"}), dataDir, dbName),
+		writeTable(t, 2, "sst2", test.NewStaticIterator(map[string]string{"b": "v2"}), dataDir, dbName),
+		writeTable(t, 3, "sst3", test.NewStaticIterator(map[string]string{"c": "v3"}), dataDir, dbName),
+	} {
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	// Targets are capped rather than overflowing once they'd pass the largest size that can be represented
+	c := New(man, 0, dataDir, dbName, Options{LevelSizeBase: math.MaxInt32,
+		LevelSizeMultiplier: math.MaxInt32}).(*leveled)
+	targets, err := c.levelTargets()
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, math.MaxInt32 * math.MaxInt32, math.MaxInt64, math.MaxInt64}, targets)
+
+	scores, err := c.Scores()
+	assert.NoError(t, err)
+	for _, score := range scores {
+		assert.True(t, score >= 0 && score < 1)
+	}
+}
+
+func TestCompactor_CompactionPointer(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	for _, md := range []*sstable.Metadata{
+		writeTable(t, 0, "sst0", test.NewStaticIterator(map[string]string{"0": "v0"}), dataDir, dbName),
+		writeTable(t, 1, "sst1", test.NewStaticIterator(map[string]string{"x": "v1"}), dataDir, dbName),
+		writeTable(t, 1, "sst2", test.NewStaticIterator(map[string]string{"a": "v2"}), dataDir, dbName),
+		writeTable(t, 1, "sst3", test.NewStaticIterator(map[string]string{"m": "v3"}), dataDir, dbName),
+	} {
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	c := New(man, 0, dataDir, dbName, Options{LevelSizeBase: 1}).(*leveled)
+
+	// Level 1 is merged in key order, whatever order its sstables were added in, and the pointer moves past
+	// each sstable as it's merged
+	for _, expected := range []string{"sst2", "sst3"} {
+		compaction, err := c.Pick()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{expected}, filenames(compaction.Inputs))
+		assert.NoError(t, c.Run(compaction, nil))
+		assert.Equal(t, compaction.Inputs[0].EndKey, man.CompactionPointer(0, 1))
+	}
+
+	// Merging past the last sstable wraps around to the first
+	md4 := writeTable(t, 1, "sst4", test.NewStaticIterator(map[string]string{"b": "v4"}), dataDir, dbName)
+	assert.NoError(t, man.AddEntry(manifest.NewEntry(md4, false)))
+	assert.NoError(t, man.AddEntry(manifest.NewCompactionPointerEntry(0, 1, []byte("x"))))
+	assert.Equal(t, []string{"sst4", "sst1"}, filenames(c.mergeOrder(1, man.MetadataForLevel(0, 1))))
+
+	// sstables that are mostly deletes jump the queue
+	md5 := writeTable(t, 1, "sst5", test.NewStaticIterator(map[string]string{"n": "", "o": "", "p": "v5"}),
+		dataDir, dbName)
+	md6 := writeTable(t, 1, "sst6", test.NewStaticIterator(map[string]string{"q": "", "r": ""}), dataDir, dbName)
+	assert.NoError(t, man.AddEntries([]*manifest.Entry{manifest.NewEntry(md5, false), manifest.NewEntry(md6, false)}))
+	assert.Equal(t, uint64(2), md5.Deletes)
+	assert.Equal(t, []string{"sst6", "sst5", "sst4", "sst1"}, filenames(c.mergeOrder(1, man.MetadataForLevel(0, 1))))
+
+	c = New(man, 0, dataDir, dbName, Options{LevelSizeBase: 1, TombstoneRatio: 2}).(*leveled)
+	assert.Equal(t, []string{"sst4", "sst5", "sst6", "sst1"}, filenames(c.mergeOrder(1, man.MetadataForLevel(0, 1))))
+}
+
+func TestCompactor_MergeOrderRangeDeletes(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	// sst2 holds a single range delete among its records, which on its own is too few deletes to jump the queue.
+	// sst3 in the next level reaches past the range delete's end, so it isn't covered
+	file, err := util.CreateFile("sst2", dbName, dataDir)
+	assert.NoError(t, err)
+	iter := test.NewStaticIterator(map[string]string{"c": "v2", "e": "v2", "f": "v2", "g": "v2"})
+	rd := storage.NewRangeDelete([]byte("c"), []byte("d"))
+	md2, err := sstable.NewBuilder("sst2", iter, []*storage.Record{rd}, 1, file, 0).WriteTable()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), md2.RangeDeletes)
+
+	for _, md := range []*sstable.Metadata{
+		writeTable(t, 1, "sst1", test.NewStaticIterator(map[string]string{"a": "v1"}), dataDir, dbName),
+		md2,
+		writeTable(t, 2, "sst3", test.NewStaticIterator(map[string]string{"cx": "v3", "dx": "v3"}), dataDir,
+			dbName),
+	} {
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	c := New(man, 0, dataDir, dbName, Options{}).(*leveled)
+	assert.Equal(t, []string{"sst1", "sst2"}, filenames(c.mergeOrder(1, man.MetadataForLevel(0, 1))))
+
+	// Once the range delete covers a table in the next level, the records it hides there count as deletes
+	md4 := writeTable(t, 2, "sst4", test.NewStaticIterator(map[string]string{"ca": "v4", "cb": "v4", "cc": "v4",
+		"cd": "v4"}), dataDir, dbName)
+	assert.NoError(t, man.AddEntry(manifest.NewEntry(md4, false)))
+	assert.Equal(t, float64(1+4)/float64(5+4), c.deleteRatio(1, md2))
+	assert.Equal(t, []string{"sst2", "sst1"}, filenames(c.mergeOrder(1, man.MetadataForLevel(0, 1))))
+}
+
+func filenames(metas []*sstable.Metadata) []string {
+	var names []string
+	for _, meta := range metas {
+		names = append(names, meta.Filename)
+	}
+	return names
+}
+
+type recordingListener struct {
+	begun     []Info
+	completed []Info
+	errs      []error
+}
+
+func (r *recordingListener) CompactionBegin(info Info) {
+	r.begun = append(r.begun, info)
+}
+
+func (r *recordingListener) CompactionCompleted(info Info, err error) {
+	r.completed = append(r.completed, info)
+	r.errs = append(r.errs, err)
+}
+
 func writeTable(t *testing.T, level int, filename string, iter interfaces.InternalIterator, dataDir string, dbName string) *sstable.Metadata {
 	file, err := util.CreateFile(filename, dbName, dataDir)
 	assert.NoError(t, err)
-	bldr := sstable.NewBuilder(filename, iter, level, file)
+	bldr := sstable.NewBuilder(filename, iter, nil, level, file, 0)
 
 	meta, err := bldr.WriteTable()
 	assert.NoError(t, err)
@@ -0,0 +1,97 @@
+package compaction
+
+import (
+	"fmt"
+
+	"github.com/nbroyles/nbdb/internal/sstable"
+)
+
+// fifo implements FIFO compaction. Flushed sstables stay in level 0 and are never merged. Once their total
+// size passes MaxTotalSize, the oldest are dropped until it's back under
+type fifo struct {
+	*base
+}
+
+// Pick reserves and returns a compaction that drops the oldest sstables if their total size is over the cap,
+// or nil if it isn't
+func (c *fifo) Pick() (*Compaction, error) {
+	return c.reserveFirst(func() ([]*Compaction, error) {
+		compaction, err := c.expired()
+		if err != nil || compaction == nil {
+			return nil, err
+		}
+
+		return []*Compaction{compaction}, nil
+	})
+}
+
+// CompactRange drops the oldest sstables if their total size is over the cap. sstables are never merged, so
+// the range only matters to the strategies that do
+func (c *fifo) CompactRange(start []byte, end []byte, snapshots []uint64) error {
+	return c.exclusive(func() error {
+		compaction, err := c.expired()
+		if err != nil || compaction == nil {
+			return err
+		}
+
+		_, err = c.compact(compaction, snapshots)
+		return err
+	})
+}
+
+// expired returns a compaction that drops the oldest sstables until their total size is back under the cap,
+// or nil if it isn't over. sstables already being dropped are as good as gone, so they neither count towards
+// the cap nor get picked again. Must be called while holding the mutex, or with no other compaction running
+func (c *fifo) expired() (*Compaction, error) {
+	metas := c.manifest.MetadataForLevel(c.family, 0)
+	sizes := make([]int64, len(metas))
+	total := int64(0)
+	for i, meta := range metas {
+		size, err := c.tablesSize([]*sstable.Metadata{meta})
+		if err != nil {
+			return nil, fmt.Errorf("failed calculating size of level 0: %w", err)
+		}
+		sizes[i] = size
+		if !c.compacting[meta.Filename] {
+			total += size
+		}
+	}
+
+	var inputs []*sstable.Metadata
+	for i := 0; i < len(metas) && total > c.opts.MaxTotalSize; i++ {
+		if c.compacting[metas[i].Filename] {
+			continue
+		}
+		inputs = append(inputs, metas[i])
+		total -= sizes[i]
+	}
+	if len(inputs) == 0 {
+		return nil, nil
+	}
+
+	return &Compaction{Level: 0, OutputLevel: 0, Inputs: inputs, drop: true}, nil
+}
+
+// Scores returns level 0's size over the cap. sstables are only ever in level 0
+func (c *fifo) Scores() ([]float64, error) {
+	size, err := c.LevelSize(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return []float64{float64(size) / float64(c.opts.MaxTotalSize)}, nil
+}
+
+// PendingCompactionBytes returns the number of bytes over the cap the sstables are
+func (c *fifo) PendingCompactionBytes() (int64, error) {
+	size, err := c.LevelSize(0)
+	if err != nil {
+		return 0, err
+	}
+
+	if size > c.opts.MaxTotalSize {
+		return size - c.opts.MaxTotalSize, nil
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,117 @@
+package compaction
+
+import (
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/nbroyles/nbdb/internal/manifest"
+	"github.com/nbroyles/nbdb/internal/sstable"
+	"github.com/nbroyles/nbdb/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFIFO_Compact(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	var metas []*sstable.Metadata
+	for _, name := range []string{"sst1", "sst2", "sst3", "sst4", "sst5"} {
+		md := writeTable(t, 0, name, test.NewStaticIterator(map[string]string{"key": name}), dataDir, dbName)
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+		metas = append(metas, md)
+	}
+
+	listener := &recordingListener{}
+	c := New(man, 0, dataDir, dbName, Options{Strategy: FIFO, L0CompactionTrigger: 2, Listener: listener})
+	tableSize, err := c.LevelSize(0)
+	assert.NoError(t, err)
+	tableSize /= 5
+
+	// Nothing is dropped while the tables are within the cap, however many there are
+	assert.NoError(t, c.Compact(nil))
+	assert.Equal(t, metas, man.MetadataForLevel(0, 0))
+
+	// Once they're over it the oldest are dropped until they're back within it
+	c = New(man, 0, dataDir, dbName, Options{Strategy: FIFO, MaxTotalSize: 3*tableSize + 1, Listener: listener})
+	pending, err := c.PendingCompactionBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, 2*tableSize-1, pending)
+
+	assert.NoError(t, c.Compact(nil))
+	assert.Equal(t, metas[2:], man.MetadataForLevel(0, 0))
+	assert.Empty(t, man.MetadataForLevel(0, 1))
+
+	pending, err = c.PendingCompactionBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pending)
+
+	assert.Len(t, listener.completed, 1)
+	assert.Equal(t, []string{"sst1", "sst2"}, filenames(listener.completed[0].Inputs))
+	assert.Empty(t, listener.completed[0].Outputs)
+	assert.Equal(t, int64(1), c.Stats().Compactions)
+}
+
+func TestFIFO_PickConcurrently(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	var metas []*sstable.Metadata
+	for _, name := range []string{"sst1", "sst2", "sst3", "sst4", "sst5"} {
+		md := writeTable(t, 0, name, test.NewStaticIterator(map[string]string{"key": name}), dataDir, dbName)
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+		metas = append(metas, md)
+	}
+
+	c := New(man, 0, dataDir, dbName, Options{Strategy: FIFO, L0CompactionTrigger: 2})
+	tableSize, err := c.LevelSize(0)
+	assert.NoError(t, err)
+	tableSize /= 5
+
+	maxTotalSize := 3*tableSize + 1
+	c = New(man, 0, dataDir, dbName, Options{Strategy: FIFO, MaxTotalSize: maxTotalSize})
+	first, err := c.Pick()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sst1", "sst2"}, filenames(first.Inputs))
+
+	// The tables being dropped no longer count towards the cap, so nothing more needs dropping yet
+	none, err := c.Pick()
+	assert.NoError(t, err)
+	assert.Nil(t, none)
+
+	// One more table takes the rest back over it, and only the oldest of them needs dropping
+	md := writeTable(t, 0, "sst6", test.NewStaticIterator(map[string]string{"key": "sst6"}), dataDir, dbName)
+	assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	metas = append(metas, md)
+
+	second, err := c.Pick()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sst3"}, filenames(second.Inputs))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, compaction := range []*Compaction{first, second} {
+		wg.Add(1)
+		go func(i int, compaction *Compaction) {
+			defer wg.Done()
+			errs[i] = c.Run(compaction, nil)
+		}(i, compaction)
+	}
+	wg.Wait()
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+
+	assert.Equal(t, metas[3:], man.MetadataForLevel(0, 0))
+	size, err := c.LevelSize(0)
+	assert.NoError(t, err)
+	assert.True(t, size <= maxTotalSize)
+	assert.True(t, size > maxTotalSize-tableSize)
+}
@@ -0,0 +1,362 @@
+package compaction
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/nbroyles/nbdb/internal/sstable"
+	"github.com/nbroyles/nbdb/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// leveled implements Leveled compaction. Each level can grow LevelSizeMultiplier times larger than the one
+// above it before its sstables are merged into the next level along with the ones there that they overlap
+type leveled struct {
+	*base
+}
+
+// Pick reserves and returns a merge for the level with the highest compaction score, or nil if none needs
+// merging. Levels whose merges would all conflict with the compactions underway are passed over for the next
+// highest scoring one
+func (c *leveled) Pick() (*Compaction, error) {
+	scores, err := c.Scores()
+	if err != nil {
+		return nil, fmt.Errorf("could not determine if should compact: %w", err)
+	}
+
+	levels := make([]int, len(scores))
+	for i := range levels {
+		levels[i] = i
+	}
+	sort.SliceStable(levels, func(i, j int) bool {
+		return scores[levels[i]] > scores[levels[j]]
+	})
+
+	for _, level := range levels {
+		if scores[level] < 1 {
+			break
+		}
+
+		if compaction, err := c.pickLevel(level); err != nil || compaction != nil {
+			return compaction, err
+		}
+	}
+
+	return nil, nil
+}
+
+// pickLevel reserves and returns a merge of sstables from level into the next level if one that doesn't
+// conflict with the compactions underway can be found
+func (c *leveled) pickLevel(level int) (*Compaction, error) {
+	return c.reserveFirst(func() ([]*Compaction, error) {
+		var compactions []*Compaction
+		for _, inputs := range c.mergeCandidates(level) {
+			compactions = append(compactions, &Compaction{Level: level, OutputLevel: level + 1, Inputs: inputs})
+		}
+
+		return compactions, nil
+	})
+}
+
+// CompactRange merges every sstable holding keys between start and end, inclusive, down into the bottom level,
+// dropping the deletes and overwritten versions no snapshot can see. A nil start or end leaves that side of
+// the range unbounded. snapshots are the sequence numbers of every live snapshot in ascending order
+func (c *leveled) CompactRange(start []byte, end []byte, snapshots []uint64) error {
+	// No other compaction runs meanwhile since the levels are merged down one after the other
+	return c.exclusive(func() error {
+		return c.compactRange(start, end, snapshots)
+	})
+}
+
+func (c *leveled) compactRange(start []byte, end []byte, snapshots []uint64) error {
+	bottom := c.manifest.Levels(c.family) - 1
+	if bottom < 1 {
+		bottom = 1
+	}
+
+	merged := make(map[string]bool)
+	for level := 0; level < bottom; level++ {
+		inputs := c.rangeCandidates(level, start, end)
+		if len(inputs) == 0 {
+			continue
+		}
+
+		compaction := &Compaction{Level: level, OutputLevel: level + 1, Inputs: c.withOverlapping(level+1, inputs)}
+		info, err := c.compact(compaction, snapshots)
+		if err != nil {
+			return err
+		}
+
+		if level+1 == bottom {
+			for _, meta := range info.Outputs {
+				merged[meta.Filename] = true
+			}
+		}
+	}
+
+	// Tables in the bottom level are rewritten in place so that the deletes in them are dropped too. Tables
+	// that were just merged into it have already had theirs dropped
+	var inputs []*sstable.Metadata
+	for _, meta := range c.rangeCandidates(bottom, start, end) {
+		if !merged[meta.Filename] {
+			inputs = append(inputs, meta)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	_, err := c.compact(&Compaction{Level: bottom, OutputLevel: bottom, Inputs: inputs}, snapshots)
+	return err
+}
+
+// Scores returns each level's compaction score, indexed by level. A level needs compacting once its score
+// reaches 1. Level 0's is its number of sstables over L0CompactionTrigger, since they overlap and each one
+// adds to the work of every read. Every other level's is its size over its target size
+func (c *leveled) Scores() ([]float64, error) {
+	targets, err := c.levelTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make([]float64, len(targets))
+	for level, target := range targets {
+		if level == 0 {
+			files := len(c.manifest.MetadataForLevel(c.family, level))
+			scores[level] = float64(files) / float64(c.opts.L0CompactionTrigger)
+			continue
+		} else if level == len(targets)-1 && c.dynamic(len(targets)) {
+			// The last level's target is whatever it holds, so nothing ever needs compacting out of it
+			continue
+		}
+
+		size, err := c.LevelSize(level)
+		if err != nil {
+			return nil, fmt.Errorf("failed calculating level %d score: %w", level, err)
+		}
+		scores[level] = float64(size) / float64(target)
+	}
+
+	return scores, nil
+}
+
+// levelTargets returns the size in bytes each level can grow to before it's compacted into the next level,
+// indexed by level. Level L's target is LevelSizeBase * LevelSizeMultiplier^L, up to math.MaxInt64. Level 0
+// is compacted by its number of sstables rather than its size, so its target is 0
+func (c *leveled) levelTargets() ([]int64, error) {
+	levels := c.manifest.Levels(c.family)
+	targets := make([]int64, levels)
+	target := c.opts.LevelSizeBase
+	for level := 1; level < levels; level++ {
+		// Deep levels with a large multiplier would overflow, so their targets are capped instead
+		if target > math.MaxInt64/int64(c.opts.LevelSizeMultiplier) {
+			target = math.MaxInt64
+		} else {
+			target *= int64(c.opts.LevelSizeMultiplier)
+		}
+		targets[level] = target
+	}
+
+	if !c.dynamic(levels) {
+		return targets, nil
+	}
+
+	// The levels above the last are sized off what the last actually holds rather than what it could hold,
+	// so that each stays a fraction of the one below it however much data there is. That keeps the space
+	// taken by versions that have been overwritten in the last level bounded. Level 1's target is the
+	// smallest any of them gets, so that small databases don't compact small levels over and over. The last
+	// level's own target is what it holds, since it grows rather than being compacted into a new level
+	bottom := levels - 1
+	target, err := c.LevelSize(bottom)
+	if err != nil {
+		return nil, fmt.Errorf("failed calculating level targets: %w", err)
+	}
+
+	floor := targets[1]
+	if target < floor {
+		target = floor
+	}
+	targets[bottom] = target
+	for level := bottom - 1; level > 0; level-- {
+		target /= int64(c.opts.LevelSizeMultiplier)
+		if target < floor {
+			target = floor
+		}
+		targets[level] = target
+	}
+
+	return targets, nil
+}
+
+// dynamic returns true if the levels above the last are sized off what the last holds, which takes at least
+// three levels
+func (c *leveled) dynamic(levels int) bool {
+	return c.opts.DynamicLevelBytes && levels >= 3
+}
+
+// PendingCompactionBytes estimates the number of bytes that need compacting before every level is
+// back within its threshold. Level 0 counts in full once it has enough sstables to be compacted
+func (c *leveled) PendingCompactionBytes() (int64, error) {
+	targets, err := c.levelTargets()
+	if err != nil {
+		return 0, err
+	}
+
+	pending := int64(0)
+	for level, target := range targets {
+		size, err := c.LevelSize(level)
+		if err != nil {
+			return 0, err
+		}
+
+		if level == 0 {
+			if len(c.manifest.MetadataForLevel(c.family, level)) >= c.opts.L0CompactionTrigger {
+				pending += size
+			}
+		} else if size > target {
+			pending += size - target
+		}
+	}
+
+	return pending, nil
+}
+
+// mergeCandidates returns the sets of sstables that could be merged from level into the next level, in order
+// of preference. Level 0 sstables can overlap each other, so they're always merged together. sstables in
+// other levels are taken one at a time in the order given by mergeOrder
+func (c *leveled) mergeCandidates(level int) [][]*sstable.Metadata {
+	lvlMeta := c.manifest.MetadataForLevel(c.family, level)
+	if len(lvlMeta) == 0 {
+		// A compaction running alongside may have emptied the level since it was found to need compacting
+		return nil
+	}
+
+	if level == 0 {
+		// Provide level 0 tables most recent first so the merger can break ties between them
+		return [][]*sstable.Metadata{c.withOverlapping(level+1, newestFirst(lvlMeta))}
+	}
+
+	ordered := c.mergeOrder(level, lvlMeta)
+	candidates := make([][]*sstable.Metadata, len(ordered))
+	for i, meta := range ordered {
+		candidates[i] = c.withOverlapping(level+1, []*sstable.Metadata{meta})
+	}
+
+	return candidates
+}
+
+// mergeOrder returns the sstables of level in the order they should be merged into the next level. They're
+// taken in key order starting after the level's compaction pointer, wrapping around to the start of the
+// key space, so that every key range is rewritten in turn rather than the same sstables over and over.
+// sstables whose share of deletes reaches TombstoneRatio come first though, most deletes first, so that the
+// space held by deleted keys is given back sooner. Range deletes are weighed by the records they hide in the
+// next level, as found by deleteRatio
+func (c *leveled) mergeOrder(level int, lvlMeta []*sstable.Metadata) []*sstable.Metadata {
+	sorted := append([]*sstable.Metadata{}, lvlMeta...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].StartKey, sorted[j].StartKey) < 0
+	})
+
+	next := 0
+	if pointer := c.manifest.CompactionPointer(c.family, level); pointer != nil {
+		next = sort.Search(len(sorted), func(i int) bool {
+			return bytes.Compare(sorted[i].StartKey, pointer) > 0
+		})
+	}
+
+	ordered := append(append([]*sstable.Metadata{}, sorted[next:]...), sorted[:next]...)
+	ratios := make(map[*sstable.Metadata]float64, len(ordered))
+	for _, meta := range ordered {
+		ratios[meta] = c.deleteRatio(level, meta)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ratios[ordered[i]] >= c.opts.TombstoneRatio && ratios[ordered[i]] > ratios[ordered[j]]
+	})
+
+	return ordered
+}
+
+// deleteRatio returns the share of meta's records that are deletes. A range delete hides far more than the one
+// record it takes up, so the records of the sstables in the next level that it covers entirely count as both
+// records and deletes of meta too
+func (c *leveled) deleteRatio(level int, meta *sstable.Metadata) float64 {
+	if meta.RangeDeletes == 0 {
+		return meta.DeleteRatio()
+	}
+
+	rangeDeletes, err := c.rangeDeletes(meta)
+	if err != nil {
+		log.Warnf("failed reading range deletes of sstable %s. counting them as single deletes: %v",
+			meta.Filename, err)
+		return meta.DeleteRatio()
+	}
+
+	covered := uint64(0)
+	for _, next := range c.manifest.MetadataForLevel(c.family, level+1) {
+		for _, rd := range rangeDeletes {
+			// The end of a range delete is exclusive
+			if bytes.Compare(rd.Key, next.StartKey) <= 0 && bytes.Compare(next.EndKey, rd.Value) < 0 {
+				covered += next.Records
+				break
+			}
+		}
+	}
+
+	return float64(meta.Deletes+covered) / float64(meta.Records+covered)
+}
+
+// rangeDeletes returns the range deletes stored in meta's sstable
+func (c *leveled) rangeDeletes(meta *sstable.Metadata) ([]*storage.Record, error) {
+	file, err := os.Open(path.Join(c.dataDir, c.dbName, meta.Filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed opening sstable %s: %w", meta.Filename, err)
+	}
+
+	it, err := sstable.NewIterator(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	defer it.Close()
+
+	return it.RangeDeletes(), nil
+}
+
+// rangeCandidates returns the sstables in level that hold keys between start and end, inclusive. Since level 0
+// sstables can overlap each other, every one of them is returned, most recent first, if any are in range.
+// Otherwise older versions of a key could end up in a lower level than the newer ones left behind
+func (c *leveled) rangeCandidates(level int, start []byte, end []byte) []*sstable.Metadata {
+	lvlMeta := c.manifest.MetadataForLevel(c.family, level)
+
+	var candidates []*sstable.Metadata
+	for _, m := range lvlMeta {
+		if overlaps(m, start, end) {
+			candidates = append(candidates, m)
+		}
+	}
+
+	if level == 0 && len(candidates) > 0 {
+		candidates = newestFirst(lvlMeta)
+	}
+
+	return candidates
+}
+
+// withOverlapping returns candidates along with every sstable in level that overlaps them
+func (c *leveled) withOverlapping(level int, candidates []*sstable.Metadata) []*sstable.Metadata {
+	startKey, endKey := keyRange(candidates)
+
+	// Every overlapping file must be included, including ones that span the entire range. Otherwise
+	// the merged output could overlap them and a delete could end up ordered behind the value it hides
+	for _, m := range c.manifest.MetadataForLevel(c.family, level) {
+		if overlaps(m, startKey, endKey) {
+			candidates = append(candidates, m)
+		}
+	}
+
+	return candidates
+}
@@ -0,0 +1,157 @@
+package compaction
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/nbroyles/nbdb/internal/sstable"
+)
+
+// tieredLevels is the number of levels tiered compaction uses. Runs that reach the last level are merged
+// with each other in place
+const tieredLevels = 7
+
+// tiered implements Tiered compaction. Each level holds sorted runs ordered from oldest to newest, and every
+// run in a level is older than those in the levels above it. Once a level has enough runs, they're merged into
+// a single run that's added to the next level as its newest
+type tiered struct {
+	*base
+}
+
+// Pick reserves and returns a merge of the runs in the lowest numbered level that has enough of them, or nil
+// if none does
+func (c *tiered) Pick() (*Compaction, error) {
+	return c.reserveFirst(func() ([]*Compaction, error) {
+		var compactions []*Compaction
+		for level := 0; level < c.manifest.Levels(c.family); level++ {
+			if c.shouldCompact(level) {
+				compactions = append(compactions, c.levelCompaction(level))
+			}
+		}
+
+		return compactions, nil
+	})
+}
+
+// levelCompaction returns a merge of every run in level into the next level. Runs in the last level are
+// merged in place
+func (c *tiered) levelCompaction(level int) *Compaction {
+	outputLevel := level + 1
+	if outputLevel == tieredLevels {
+		outputLevel = level
+	}
+
+	// Provide runs most recent first so the merger can break ties between them
+	return &Compaction{Level: level, OutputLevel: outputLevel,
+		Inputs: newestFirst(c.manifest.MetadataForLevel(c.family, level))}
+}
+
+// shouldCompact returns true if level has enough runs to be merged
+func (c *tiered) shouldCompact(level int) bool {
+	runs := len(c.manifest.MetadataForLevel(c.family, level))
+	if level == tieredLevels-1 {
+		// Merging a single run in place would only rewrite it
+		return runs >= c.opts.L0CompactionTrigger && runs > 1
+	}
+
+	return runs >= c.opts.L0CompactionTrigger
+}
+
+// Scores returns each level's number of runs over the number that triggers merging them, indexed by level.
+// Levels are merged once their score reaches 1, the lowest numbered first since its runs are the smallest
+func (c *tiered) Scores() ([]float64, error) {
+	scores := make([]float64, c.manifest.Levels(c.family))
+	for level := range scores {
+		if level == tieredLevels-1 && !c.shouldCompact(level) {
+			// A single run in the last level has nothing to be merged with
+			continue
+		}
+		runs := len(c.manifest.MetadataForLevel(c.family, level))
+		scores[level] = float64(runs) / float64(c.opts.L0CompactionTrigger)
+	}
+
+	return scores, nil
+}
+
+// CompactRange merges every run holding keys between start and end, inclusive, into a single run in the
+// deepest level, dropping the deletes and overwritten versions no snapshot can see. Runs overlapping those
+// are merged too, so that no older version of a key is left in a level above a newer one. A nil start or end
+// leaves that side of the range unbounded. snapshots are the sequence numbers of every live snapshot in
+// ascending order
+func (c *tiered) CompactRange(start []byte, end []byte, snapshots []uint64) error {
+	return c.exclusive(func() error {
+		bottom := c.manifest.Levels(c.family) - 1
+		if bottom < 1 {
+			bottom = 1
+		}
+
+		inputs, level := c.rangeCandidates(start, end)
+		if len(inputs) == 0 {
+			return nil
+		}
+
+		_, err := c.compact(&Compaction{Level: level, OutputLevel: bottom, Inputs: inputs}, snapshots)
+		return err
+	})
+}
+
+// rangeCandidates returns the runs holding keys between start and end, inclusive, along with every run that
+// overlaps those, most recent first. The lowest numbered level any of them is in is returned too
+func (c *tiered) rangeCandidates(start []byte, end []byte) ([]*sstable.Metadata, int) {
+	var runs []*sstable.Metadata
+	var levels []int
+	for level := 0; level < c.manifest.Levels(c.family); level++ {
+		for _, meta := range newestFirst(c.manifest.MetadataForLevel(c.family, level)) {
+			runs = append(runs, meta)
+			levels = append(levels, level)
+		}
+	}
+
+	// Keep taking in overlapping runs until the key range of the inputs stops growing
+	included := make([]bool, len(runs))
+	for added := true; added; {
+		added = false
+		for i, meta := range runs {
+			if !included[i] && overlaps(meta, start, end) {
+				included[i], added = true, true
+				if start != nil && bytes.Compare(meta.StartKey, start) < 0 {
+					start = meta.StartKey
+				}
+				if end != nil && bytes.Compare(meta.EndKey, end) > 0 {
+					end = meta.EndKey
+				}
+			}
+		}
+	}
+
+	var inputs []*sstable.Metadata
+	level := 0
+	for i, meta := range runs {
+		if included[i] {
+			if len(inputs) == 0 {
+				level = levels[i]
+			}
+			inputs = append(inputs, meta)
+		}
+	}
+
+	return inputs, level
+}
+
+// PendingCompactionBytes returns the total size of the levels that have enough runs to be merged
+func (c *tiered) PendingCompactionBytes() (int64, error) {
+	pending := int64(0)
+	for level := 0; level < c.manifest.Levels(c.family); level++ {
+		if !c.shouldCompact(level) {
+			continue
+		}
+
+		size, err := c.LevelSize(level)
+		if err != nil {
+			return 0, fmt.Errorf("failed calculating pending compaction bytes: %w", err)
+		}
+		pending += size
+	}
+
+	return pending, nil
+}
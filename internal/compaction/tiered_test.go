@@ -0,0 +1,103 @@
+package compaction
+
+import (
+	"path"
+	"testing"
+
+	"github.com/nbroyles/nbdb/internal/manifest"
+	"github.com/nbroyles/nbdb/internal/sstable"
+	"github.com/nbroyles/nbdb/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTiered_Compact(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	c := New(man, 0, dataDir, dbName, Options{Strategy: Tiered, L0CompactionTrigger: 2,
+		Table: sstable.TableOpts{MaxFileSize: 1}})
+
+	md1 := writeTable(t, 0, "sst1", test.NewStaticIterator(map[string]string{"a": "old", "b": "old"}),
+		dataDir, dbName)
+	md2 := writeTable(t, 0, "sst2", test.NewStaticIterator(map[string]string{"a": "new", "c": "new"}),
+		dataDir, dbName)
+	assert.NoError(t, man.AddEntries([]*manifest.Entry{manifest.NewEntry(md1, false), manifest.NewEntry(md2, false)}))
+
+	// Level 0's runs are merged into a single run in level 1, however large it is
+	assert.NoError(t, c.Compact(nil))
+	assert.Empty(t, man.MetadataForLevel(0, 0))
+	assert.Len(t, man.MetadataForLevel(0, 1), 1)
+
+	run := man.MetadataForLevel(0, 1)[0]
+	test.AssertTable(t, map[string]string{"a": "new", "b": "old", "c": "new"}, run.Filename,
+		path.Join(dataDir, dbName))
+
+	// A single run in level 1 isn't enough to merge, but a second one is
+	md3 := writeTable(t, 0, "sst3", test.NewStaticIterator(map[string]string{"b": "newer"}), dataDir, dbName)
+	assert.NoError(t, man.AddEntry(manifest.NewEntry(md3, false)))
+	assert.NoError(t, c.Compact(nil))
+	assert.Equal(t, []*sstable.Metadata{md3}, man.MetadataForLevel(0, 0))
+
+	pending, err := c.PendingCompactionBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pending)
+
+	md4 := writeTable(t, 0, "sst4", test.NewStaticIterator(map[string]string{"c": "newer", "d": "newer"}),
+		dataDir, dbName)
+	assert.NoError(t, man.AddEntry(manifest.NewEntry(md4, false)))
+
+	pending, err = c.PendingCompactionBytes()
+	assert.NoError(t, err)
+	assert.True(t, pending > 0)
+
+	assert.NoError(t, c.Compact(nil))
+	assert.Empty(t, man.MetadataForLevel(0, 0))
+	assert.Empty(t, man.MetadataForLevel(0, 1))
+	assert.Len(t, man.MetadataForLevel(0, 2), 1)
+
+	run = man.MetadataForLevel(0, 2)[0]
+	test.AssertTable(t, map[string]string{"a": "new", "b": "newer", "c": "newer", "d": "newer"}, run.Filename,
+		path.Join(dataDir, dbName))
+}
+
+func TestTiered_CompactRange(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mfile, err := manifest.CreateManifestFile(dbName, dataDir)
+	assert.NoError(t, err)
+	man := manifest.NewManifest(mfile)
+
+	md1 := writeTable(t, 1, "sst1", test.NewStaticIterator(map[string]string{"a": "old", "f": "old"}),
+		dataDir, dbName)
+	md2 := writeTable(t, 1, "sst2", test.NewStaticIterator(map[string]string{"x": "old", "z": "old"}),
+		dataDir, dbName)
+	md3 := writeTable(t, 0, "sst3", test.NewStaticIterator(map[string]string{"e": "new", "g": ""}),
+		dataDir, dbName)
+	md4 := writeTable(t, 0, "sst4", test.NewStaticIterator(map[string]string{"m": "new"}), dataDir, dbName)
+	for _, md := range []*sstable.Metadata{md1, md2, md3, md4} {
+		assert.NoError(t, man.AddEntry(manifest.NewEntry(md, false)))
+	}
+
+	listener := &recordingListener{}
+	c := New(man, 0, dataDir, dbName, Options{Strategy: Tiered, Listener: listener})
+
+	// sst1 doesn't hold keys in the range but overlaps sst3, which does, so it has to be merged too
+	assert.NoError(t, c.CompactRange([]byte("g"), []byte("h"), nil))
+	assert.Equal(t, []*sstable.Metadata{md4}, man.MetadataForLevel(0, 0))
+
+	l1 := man.MetadataForLevel(0, 1)
+	assert.Len(t, l1, 2)
+	assert.Equal(t, md2, l1[0])
+	test.AssertTable(t, map[string]string{"a": "old", "e": "new", "f": "old"}, l1[1].Filename,
+		path.Join(dataDir, dbName))
+
+	assert.Len(t, listener.completed, 1)
+	assert.Equal(t, 0, listener.completed[0].Level)
+	assert.Equal(t, 1, listener.completed[0].OutputLevel)
+	assert.Equal(t, []string{"sst3", "sst1"}, filenames(listener.completed[0].Inputs))
+}
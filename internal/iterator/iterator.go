@@ -0,0 +1,35 @@
+package iterator
+
+import "github.com/nbroyles/nbdb/internal/storage"
+
+// Iterator is implemented by any structure whose records can be traversed in key order. Unlike
+// interfaces.InternalIterator, an Iterator can be repositioned at any point via its Seek methods,
+// which makes it suitable for serving range scans. Not threadsafe
+type Iterator interface {
+	// Valid returns true if the iterator is currently positioned at a record
+	Valid() bool
+
+	// SeekToFirst positions the iterator at the first record
+	SeekToFirst()
+
+	// SeekToLast positions the iterator at the last record
+	SeekToLast()
+
+	// Seek positions the iterator at the first record with a key greater than or equal to key
+	Seek(key []byte)
+
+	// Next advances the iterator to the next record. Iterator must be valid
+	Next()
+
+	// Prev moves the iterator back to the previous record. Iterator must be valid
+	Prev()
+
+	// Record returns the record the iterator is positioned at. Iterator must be valid
+	Record() *storage.Record
+
+	// Error returns the first error encountered while iterating, if any
+	Error() error
+
+	// Close releases any resources held by the iterator
+	Close() error
+}
@@ -0,0 +1,165 @@
+package iterator
+
+import "github.com/nbroyles/nbdb/internal/storage"
+
+type direction int8
+
+const (
+	forward direction = iota
+	reverse
+)
+
+// mergingIterator merges the output of several iterators into a single ordered stream. Records
+// are ordered by key and then by sequence number such that more recent versions of a key are
+// returned first. When more than one child is positioned at the same version of a key, the child
+// that appears earliest in the list of children is returned first. Iterating in reverse returns
+// records in exactly the opposite order
+type mergingIterator struct {
+	children  []Iterator
+	current   int
+	direction direction
+}
+
+var _ Iterator = &mergingIterator{}
+
+// NewMergingIterator returns an iterator over the union of the records in children. Children should
+// be provided in order of precedence (e.g. most recently written data first)
+func NewMergingIterator(children []Iterator) Iterator {
+	return &mergingIterator{children: children, current: -1}
+}
+
+func (m *mergingIterator) Valid() bool {
+	return m.current != -1
+}
+
+func (m *mergingIterator) SeekToFirst() {
+	for _, child := range m.children {
+		child.SeekToFirst()
+	}
+	m.direction = forward
+	m.findSmallest()
+}
+
+func (m *mergingIterator) SeekToLast() {
+	for _, child := range m.children {
+		child.SeekToLast()
+	}
+	m.direction = reverse
+	m.findLargest()
+}
+
+func (m *mergingIterator) Seek(key []byte) {
+	for _, child := range m.children {
+		child.Seek(key)
+	}
+	m.direction = forward
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Next() {
+	// When changing direction, every child other than the current one is positioned before the
+	// current record. Move them so they're positioned after it instead
+	if m.direction != forward {
+		current := m.Record()
+		for i, child := range m.children {
+			if i == m.current {
+				continue
+			}
+
+			for child.Seek(current.Key); child.Valid() && m.precedes(child.Record(), i, current); {
+				child.Next()
+			}
+		}
+		m.direction = forward
+	}
+
+	m.children[m.current].Next()
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Prev() {
+	// When changing direction, every child other than the current one is positioned after the
+	// current record. Move them so they're positioned before it instead
+	if m.direction != reverse {
+		current := m.Record()
+		for i, child := range m.children {
+			if i == m.current {
+				continue
+			}
+
+			// Find the first record that comes after the current one and then step back
+			for child.Seek(current.Key); child.Valid() && m.precedes(child.Record(), i, current); {
+				child.Next()
+			}
+
+			if child.Valid() {
+				child.Prev()
+			} else {
+				// Every record in the child comes before the current one
+				child.SeekToLast()
+			}
+		}
+		m.direction = reverse
+	}
+
+	m.children[m.current].Prev()
+	m.findLargest()
+}
+
+func (m *mergingIterator) Record() *storage.Record {
+	return m.children[m.current].Record()
+}
+
+func (m *mergingIterator) Error() error {
+	for _, child := range m.children {
+		if err := child.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mergingIterator) Close() error {
+	var firstErr error
+	for _, child := range m.children {
+		if err := child.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m *mergingIterator) findSmallest() {
+	m.current = -1
+	for i, child := range m.children {
+		if !child.Valid() {
+			continue
+		}
+
+		// Strictly less than so that ties go to the child with the highest precedence
+		if m.current == -1 || storage.Compare(child.Record(), m.children[m.current].Record()) < 0 {
+			m.current = i
+		}
+	}
+}
+
+func (m *mergingIterator) findLargest() {
+	m.current = -1
+	for i, child := range m.children {
+		if !child.Valid() {
+			continue
+		}
+
+		// Greater than or equal to so that ties go to the child with the lowest precedence
+		if m.current == -1 || storage.Compare(child.Record(), m.children[m.current].Record()) >= 0 {
+			m.current = i
+		}
+	}
+}
+
+// precedes returns true if record, belonging to the child at index idx, is ordered before the
+// record the iterator is currently positioned at
+func (m *mergingIterator) precedes(record *storage.Record, idx int, current *storage.Record) bool {
+	c := storage.Compare(record, current)
+	return c < 0 || (c == 0 && idx < m.current)
+}
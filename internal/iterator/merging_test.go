@@ -0,0 +1,213 @@
+package iterator
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nbroyles/nbdb/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergingIterator_SeekToFirst(t *testing.T) {
+	iter := NewMergingIterator([]Iterator{
+		newSliceIterator(record("b", "1"), record("d", "1")),
+		newSliceIterator(record("a", "2"), record("c", "2"), record("e", "2")),
+	})
+
+	iter.SeekToFirst()
+	assertKeys(t, iter, "a", "b", "c", "d", "e")
+}
+
+func TestMergingIterator_Seek(t *testing.T) {
+	iter := NewMergingIterator([]Iterator{
+		newSliceIterator(record("b", "1"), record("d", "1")),
+		newSliceIterator(record("a", "2"), record("c", "2"), record("e", "2")),
+	})
+
+	iter.Seek([]byte("bb"))
+	assertKeys(t, iter, "c", "d", "e")
+
+	iter.Seek([]byte("f"))
+	assert.False(t, iter.Valid())
+}
+
+func TestMergingIterator_DuplicateKeys(t *testing.T) {
+	iter := NewMergingIterator([]Iterator{
+		newSliceIterator(record("a", "new")),
+		newSliceIterator(record("a", "old")),
+	})
+
+	iter.SeekToFirst()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("new"), iter.Record().Value)
+
+	iter.Next()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("old"), iter.Record().Value)
+
+	iter.Next()
+	assert.False(t, iter.Valid())
+}
+
+func TestMergingIterator_Reverse(t *testing.T) {
+	iter := NewMergingIterator([]Iterator{
+		newSliceIterator(record("b", "1"), record("d", "1")),
+		newSliceIterator(record("a", "2"), record("c", "2"), record("e", "2")),
+	})
+
+	iter.SeekToLast()
+	for _, key := range []string{"e", "d", "c", "b", "a"} {
+		assert.True(t, iter.Valid())
+		assert.Equal(t, []byte(key), iter.Record().Key)
+		iter.Prev()
+	}
+	assert.False(t, iter.Valid())
+}
+
+func TestMergingIterator_ChangeDirection(t *testing.T) {
+	iter := NewMergingIterator([]Iterator{
+		newSliceIterator(record("a", "new"), record("c", "new")),
+		newSliceIterator(record("a", "old"), record("b", "old"), record("c", "old")),
+	})
+
+	// Forward order is a/new, a/old, b/old, c/new, c/old
+	iter.Seek([]byte("c"))
+	assert.Equal(t, []byte("new"), iter.Record().Value)
+
+	iter.Prev()
+	assert.Equal(t, []byte("b"), iter.Record().Key)
+
+	iter.Prev()
+	assert.Equal(t, []byte("a"), iter.Record().Key)
+	assert.Equal(t, []byte("old"), iter.Record().Value)
+
+	iter.Next()
+	assert.Equal(t, []byte("b"), iter.Record().Key)
+
+	iter.Next()
+	assert.Equal(t, []byte("c"), iter.Record().Key)
+	assert.Equal(t, []byte("new"), iter.Record().Value)
+
+	iter.Next()
+	assert.Equal(t, []byte("c"), iter.Record().Key)
+	assert.Equal(t, []byte("old"), iter.Record().Value)
+
+	iter.Prev()
+	assert.Equal(t, []byte("c"), iter.Record().Key)
+	assert.Equal(t, []byte("new"), iter.Record().Value)
+
+	iter.Prev()
+	assert.Equal(t, []byte("b"), iter.Record().Key)
+}
+
+func TestMergingIterator_Versions(t *testing.T) {
+	iter := NewMergingIterator([]Iterator{
+		newSliceIterator(versioned("a", 4), versioned("a", 1), versioned("b", 2)),
+		newSliceIterator(versioned("a", 3), versioned("b", 5)),
+	})
+
+	// Most recent versions of a key come first regardless of which child they're in
+	iter.SeekToFirst()
+	for _, seq := range []uint64{4, 3, 1, 5, 2} {
+		assert.True(t, iter.Valid())
+		assert.Equal(t, seq, iter.Record().Seq)
+		iter.Next()
+	}
+	assert.False(t, iter.Valid())
+
+	// Change direction in the middle of a key's versions
+	iter.Seek([]byte("a"))
+	iter.Next()
+	assert.Equal(t, uint64(3), iter.Record().Seq)
+
+	iter.Prev()
+	assert.Equal(t, uint64(4), iter.Record().Seq)
+
+	iter.Next()
+	iter.Next()
+	assert.Equal(t, uint64(1), iter.Record().Seq)
+
+	iter.Prev()
+	assert.Equal(t, uint64(3), iter.Record().Seq)
+
+	iter.Next()
+	iter.Next()
+	assert.Equal(t, uint64(5), iter.Record().Seq)
+}
+
+func TestMergingIterator_NoChildren(t *testing.T) {
+	iter := NewMergingIterator(nil)
+
+	iter.SeekToFirst()
+	assert.False(t, iter.Valid())
+
+	iter.SeekToLast()
+	assert.False(t, iter.Valid())
+	assert.NoError(t, iter.Close())
+}
+
+func assertKeys(t *testing.T, iter Iterator, keys ...string) {
+	for _, key := range keys {
+		assert.True(t, iter.Valid())
+		assert.Equal(t, []byte(key), iter.Record().Key)
+		iter.Next()
+	}
+	assert.False(t, iter.Valid())
+}
+
+func versioned(key string, seq uint64) *storage.Record {
+	rec := storage.NewRecord([]byte(key), []byte(key), false)
+	rec.Seq = seq
+	return rec
+}
+
+func record(key string, value string) *storage.Record {
+	return storage.NewRecord([]byte(key), []byte(value), false)
+}
+
+// sliceIterator is a simple Iterator over a sorted slice of records
+type sliceIterator struct {
+	records []*storage.Record
+	pos     int
+}
+
+func newSliceIterator(records ...*storage.Record) *sliceIterator {
+	return &sliceIterator{records: records, pos: len(records)}
+}
+
+func (s *sliceIterator) Valid() bool {
+	return s.pos >= 0 && s.pos < len(s.records)
+}
+
+func (s *sliceIterator) SeekToFirst() {
+	s.pos = 0
+}
+
+func (s *sliceIterator) SeekToLast() {
+	s.pos = len(s.records) - 1
+}
+
+func (s *sliceIterator) Seek(key []byte) {
+	for s.pos = 0; s.pos < len(s.records) && bytes.Compare(s.records[s.pos].Key, key) < 0; s.pos++ {
+	}
+}
+
+func (s *sliceIterator) Next() {
+	s.pos++
+}
+
+func (s *sliceIterator) Prev() {
+	s.pos--
+}
+
+func (s *sliceIterator) Record() *storage.Record {
+	return s.records[s.pos]
+}
+
+func (s *sliceIterator) Error() error {
+	return nil
+}
+
+func (s *sliceIterator) Close() error {
+	return nil
+}
@@ -11,17 +11,44 @@ import (
 
 type Codec struct{}
 
+type entryType uint8
+
+const (
+	tableEntry             entryType = iota // indicates that the entry adds or removes an sstable
+	columnFamilyEntry                       // indicates that the entry creates a column family
+	compactionPointerEntry                  // indicates that the entry moves the compaction pointer of a level
+)
+
 func (c *Codec) EncodeEntry(entry *Entry) ([]byte, error) {
+	if entry.family != nil {
+		return c.encodeColumnFamilyEntry(entry.family)
+	} else if entry.pointer != nil {
+		return c.encodeCompactionPointerEntry(entry.pointer)
+	}
+
 	buf := bytes.Buffer{}
 
-	// 1 deleted byte + 1 level byte + 1 byte for filename length + len(filename) bytes
+	// 1 entry type byte + 4 column family bytes
+	// + 1 deleted byte + 1 level byte + 1 byte for filename length + len(filename) bytes
 	// + 4 bytes for start key len + len(start_key) bytes
 	// + 4 bytes for end key len + len(end_key) bytes
-	totalLen := 3 + len(entry.metadata.Filename) + 4 + len(entry.metadata.StartKey) + 4 + len(entry.metadata.EndKey)
+	// + 8 bytes for min seq + 8 bytes for max seq
+	// + 8 bytes for the number of records + 8 bytes for the number of deletes + 8 bytes for the number of
+	// range deletes
+	totalLen := 5 + 3 + len(entry.metadata.Filename) + 4 + len(entry.metadata.StartKey) + 4 +
+		len(entry.metadata.EndKey) + 16 + 24
 	if err := binary.Write(&buf, binary.BigEndian, uint32(totalLen)); err != nil {
 		return nil, fmt.Errorf("failed to encode total entry length: %w", err)
 	}
 
+	if err := binary.Write(&buf, binary.BigEndian, tableEntry); err != nil {
+		return nil, fmt.Errorf("failed to encode type of entry: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, entry.metadata.ColumnFamily); err != nil {
+		return nil, fmt.Errorf("failed to encode column family for entry: %w", err)
+	}
+
 	if err := binary.Write(&buf, binary.BigEndian, entry.metadata.Level); err != nil {
 		return nil, fmt.Errorf("failed to encode level for entry: %w", err)
 	}
@@ -38,10 +65,82 @@ func (c *Codec) EncodeEntry(entry *Entry) ([]byte, error) {
 		return nil, fmt.Errorf("failed to encode endKey for entry: %w", err)
 	}
 
+	if err := binary.Write(&buf, binary.BigEndian, entry.metadata.MinSeq); err != nil {
+		return nil, fmt.Errorf("failed to encode minSeq for entry: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, entry.metadata.MaxSeq); err != nil {
+		return nil, fmt.Errorf("failed to encode maxSeq for entry: %w", err)
+	}
+
 	if err := binary.Write(&buf, binary.BigEndian, entry.deleted); err != nil {
 		return nil, fmt.Errorf("failed to encode deleted status for entry: %w", err)
 	}
 
+	if err := binary.Write(&buf, binary.BigEndian, entry.metadata.Records); err != nil {
+		return nil, fmt.Errorf("failed to encode records for entry: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, entry.metadata.Deletes); err != nil {
+		return nil, fmt.Errorf("failed to encode deletes for entry: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, entry.metadata.RangeDeletes); err != nil {
+		return nil, fmt.Errorf("failed to encode range deletes for entry: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *Codec) encodeColumnFamilyEntry(family *ColumnFamily) ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	// 1 entry type byte + 4 id bytes + 1 byte for name length + len(name) bytes
+	totalLen := 1 + 4 + 1 + len(family.Name)
+	if err := binary.Write(&buf, binary.BigEndian, uint32(totalLen)); err != nil {
+		return nil, fmt.Errorf("failed to encode total entry length: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, columnFamilyEntry); err != nil {
+		return nil, fmt.Errorf("failed to encode type of entry: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, family.ID); err != nil {
+		return nil, fmt.Errorf("failed to encode column family id for entry: %w", err)
+	}
+
+	if err := encodeVarLengthField(&buf, []byte(family.Name), 1); err != nil {
+		return nil, fmt.Errorf("failed to encode column family name for entry: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *Codec) encodeCompactionPointerEntry(pointer *CompactionPointer) ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	// 1 entry type byte + 4 column family bytes + 1 level byte + 4 bytes for key len + len(key) bytes
+	totalLen := 1 + 4 + 1 + 4 + len(pointer.Key)
+	if err := binary.Write(&buf, binary.BigEndian, uint32(totalLen)); err != nil {
+		return nil, fmt.Errorf("failed to encode total entry length: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, compactionPointerEntry); err != nil {
+		return nil, fmt.Errorf("failed to encode type of entry: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, pointer.Family); err != nil {
+		return nil, fmt.Errorf("failed to encode column family for entry: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, uint8(pointer.Level)); err != nil {
+		return nil, fmt.Errorf("failed to encode level for entry: %w", err)
+	}
+
+	if err := encodeVarLengthField(&buf, pointer.Key, 4); err != nil {
+		return nil, fmt.Errorf("failed to encode compaction pointer key for entry: %w", err)
+	}
+
 	return buf.Bytes(), nil
 }
 
@@ -75,11 +174,39 @@ func encodeVarLengthField(buf io.Writer, data []byte, lenBytes int) error {
 func (c *Codec) DecodeEntry(data []byte) (*Entry, error) {
 	reader := bytes.NewReader(data)
 
+	var eType entryType
+	if err := binary.Read(reader, binary.BigEndian, &eType); err != nil {
+		return nil, fmt.Errorf("failed to decode type of entry: %w", err)
+	}
+
+	var family uint32
+	if err := binary.Read(reader, binary.BigEndian, &family); err != nil {
+		return nil, fmt.Errorf("failed to decode column family of entry: %w", err)
+	}
+
+	if eType == columnFamilyEntry {
+		name, err := decodeVarLengthField(reader, 1)
+		if err != nil {
+			return nil, fmt.Errorf("failed decoding column family name field: %w", err)
+		}
+
+		return NewColumnFamilyEntry(family, string(name)), nil
+	}
+
 	var level uint8
 	if err := binary.Read(reader, binary.BigEndian, &level); err != nil {
 		return nil, fmt.Errorf("failed to decode level of entry: %w", err)
 	}
 
+	if eType == compactionPointerEntry {
+		key, err := decodeVarLengthField(reader, 4)
+		if err != nil {
+			return nil, fmt.Errorf("failed decoding compaction pointer key field: %w", err)
+		}
+
+		return NewCompactionPointerEntry(family, int(level), key), nil
+	}
+
 	fileName, err := decodeVarLengthField(reader, 1)
 	if err != nil {
 		return nil, fmt.Errorf("failed decoding filename field: %w", err)
@@ -95,17 +222,45 @@ func (c *Codec) DecodeEntry(data []byte) (*Entry, error) {
 		return nil, fmt.Errorf("failed decoding endKey field: %w", err)
 	}
 
+	var minSeq, maxSeq uint64
+	if err := binary.Read(reader, binary.BigEndian, &minSeq); err != nil {
+		return nil, fmt.Errorf("failed to decode minSeq of entry: %w", err)
+	}
+
+	if err := binary.Read(reader, binary.BigEndian, &maxSeq); err != nil {
+		return nil, fmt.Errorf("failed to decode maxSeq of entry: %w", err)
+	}
+
 	var deleted bool
 	if err := binary.Read(reader, binary.BigEndian, &deleted); err != nil {
 		return nil, fmt.Errorf("failed to decode deletion status of entry: %w", err)
 	}
 
+	var records, deletes, rangeDeletes uint64
+	if err := binary.Read(reader, binary.BigEndian, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode records of entry: %w", err)
+	}
+
+	if err := binary.Read(reader, binary.BigEndian, &deletes); err != nil {
+		return nil, fmt.Errorf("failed to decode deletes of entry: %w", err)
+	}
+
+	if err := binary.Read(reader, binary.BigEndian, &rangeDeletes); err != nil {
+		return nil, fmt.Errorf("failed to decode range deletes of entry: %w", err)
+	}
+
 	return &Entry{
 		metadata: &sstable.Metadata{
-			Level:    level,
-			Filename: string(fileName),
-			StartKey: startKey,
-			EndKey:   endKey,
+			ColumnFamily: family,
+			Level:        level,
+			Filename:     string(fileName),
+			StartKey:     startKey,
+			EndKey:       endKey,
+			MinSeq:       minSeq,
+			MaxSeq:       maxSeq,
+			Records:      records,
+			Deletes:      deletes,
+			RangeDeletes: rangeDeletes,
 		},
 		deleted: deleted,
 	}, nil
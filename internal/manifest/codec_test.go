@@ -10,10 +10,16 @@ import (
 
 func TestCodec_RoundTrip(t *testing.T) {
 	entry := NewEntry(&sstable.Metadata{
-		Level:    3,
-		Filename: "foo",
-		StartKey: []byte("foo"),
-		EndKey:   []byte("bar"),
+		ColumnFamily: 2,
+		Level:        3,
+		Filename:     "foo",
+		StartKey:     []byte("foo"),
+		EndKey:       []byte("bar"),
+		MinSeq:       7,
+		MaxSeq:       42,
+		Records:      10,
+		Deletes:      3,
+		RangeDeletes: 1,
 	}, false)
 
 	codec := Codec{}
@@ -29,3 +35,51 @@ func TestCodec_RoundTrip(t *testing.T) {
 
 	assert.Equal(t, entry, actual)
 }
+
+func TestCodec_RoundTripColumnFamily(t *testing.T) {
+	entry := NewColumnFamilyEntry(3, "users")
+
+	codec := Codec{}
+
+	eBytes, err := codec.EncodeEntry(entry)
+	assert.NoError(t, err)
+
+	totalLen := binary.BigEndian.Uint32(eBytes[0:4])
+	assert.Equal(t, totalLen, uint32(len(eBytes)-4))
+
+	actual, err := codec.DecodeEntry(eBytes[4:])
+	assert.NoError(t, err)
+
+	assert.Equal(t, entry, actual)
+}
+
+func TestCodec_RoundTripCompactionPointer(t *testing.T) {
+	entry := NewCompactionPointerEntry(2, 3, []byte("foo"))
+
+	codec := Codec{}
+
+	eBytes, err := codec.EncodeEntry(entry)
+	assert.NoError(t, err)
+
+	totalLen := binary.BigEndian.Uint32(eBytes[0:4])
+	assert.Equal(t, totalLen, uint32(len(eBytes)-4))
+
+	actual, err := codec.DecodeEntry(eBytes[4:])
+	assert.NoError(t, err)
+
+	assert.Equal(t, entry, actual)
+}
+
+func TestCodec_DecodeTruncated(t *testing.T) {
+	entry := NewEntry(&sstable.Metadata{Filename: "foo", StartKey: []byte("a"), EndKey: []byte("b"), Records: 10,
+		Deletes: 3}, false)
+
+	codec := Codec{}
+
+	eBytes, err := codec.EncodeEntry(entry)
+	assert.NoError(t, err)
+
+	// Every field is required, record counts included
+	_, err = codec.DecodeEntry(eBytes[4 : len(eBytes)-8])
+	assert.Error(t, err)
+}
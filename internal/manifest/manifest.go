@@ -1,6 +1,7 @@
 package manifest
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -8,23 +9,48 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/nbroyles/nbdb/internal/sstable"
+	"github.com/nbroyles/nbdb/internal/storage"
 	"github.com/nbroyles/nbdb/internal/util"
 	log "github.com/sirupsen/logrus"
 )
 
 type Manifest struct {
+	mutex   sync.RWMutex
 	entries []*Entry
-	levels  map[int][]*sstable.Metadata
-	writer  io.Writer
-	codec   Codec
+	// levels holds the live sstables at each level of each column family, keyed by column family id
+	levels   map[uint32]map[int][]*sstable.Metadata
+	families map[string]uint32
+	// pointers holds the compaction pointer of each level of each column family, keyed by column family id
+	pointers map[uint32]map[int][]byte
+	writer   io.Writer
+	codec    Codec
 }
 
+// Entry records either a change to the set of live sstables, the creation of a column family or a move of a
+// compaction pointer
 type Entry struct {
 	metadata *sstable.Metadata
 	deleted  bool
+	family   *ColumnFamily
+	pointer  *CompactionPointer
+}
+
+// ColumnFamily identifies a column family created in the database
+type ColumnFamily struct {
+	ID   uint32
+	Name string
+}
+
+// CompactionPointer is the key that compaction of a level of a column family last stopped at. The next
+// compaction of the level picks up after it so that every key range is compacted in turn
+type CompactionPointer struct {
+	Family uint32
+	Level  int
+	Key    []byte
 }
 
 const (
@@ -33,16 +59,55 @@ const (
 )
 
 func NewManifest(writer io.Writer) *Manifest {
-	return &Manifest{writer: writer, levels: make(map[int][]*sstable.Metadata)}
+	return &Manifest{
+		writer:   writer,
+		levels:   make(map[uint32]map[int][]*sstable.Metadata),
+		families: make(map[string]uint32),
+		pointers: make(map[uint32]map[int][]byte),
+	}
 }
 
 func NewEntry(metadata *sstable.Metadata, deleted bool) *Entry {
 	return &Entry{metadata: metadata, deleted: deleted}
 }
 
+// NewColumnFamilyEntry returns an entry recording the creation of a column family
+func NewColumnFamilyEntry(id uint32, name string) *Entry {
+	return &Entry{family: &ColumnFamily{ID: id, Name: name}}
+}
+
+// NewCompactionPointerEntry returns an entry recording that compaction of a level of a column family last
+// stopped at key
+func NewCompactionPointerEntry(family uint32, level int, key []byte) *Entry {
+	return &Entry{pointer: &CompactionPointer{Family: family, Level: level, Key: key}}
+}
+
+// CreateManifestFile creates a new manifest file, starting with a header recording the format version it's
+// written in
 func CreateManifestFile(dbName string, dataDir string) (*os.File, error) {
-	return util.CreateFile(fmt.Sprintf("%s_%s_%d", manifestPrefix, dbName, time.Now().UnixNano()/1_000_000_000),
+	file, err := util.CreateFile(fmt.Sprintf("%s_%s_%d", manifestPrefix, dbName, time.Now().UnixNano()/1_000_000_000),
 		dbName, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeHeader(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// writeHeader writes the header identifying file as a manifest written in the current format version
+func writeHeader(file *os.File) error {
+	codec := storage.Codec{}
+	if _, err := file.Write(codec.EncodeHeader(storage.ManifestMagic)); err != nil {
+		return fmt.Errorf("failed writing manifest header: %w", err)
+	}
+
+	return nil
 }
 
 func LoadLatest(dbName string, dataDir string) (bool, *Manifest, error) {
@@ -57,20 +122,43 @@ func LoadLatest(dbName string, dataDir string) (bool, *Manifest, error) {
 	sort.Strings(matches)
 	latest := matches[len(matches)-1]
 
-	file, err := os.Open(latest)
+	// Opened for appending so that the database can keep adding entries after it's reopened
+	file, err := os.OpenFile(latest, os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return false, nil, fmt.Errorf("could not open latest manifest file: %w", err)
 	}
 
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return false, nil, fmt.Errorf("error retrieving file info for manifest: %w", err)
+	}
+
+	codec := storage.Codec{}
+	if info.Size() < storage.HeaderLen {
+		// Created just before a crash. Nothing can have been written after a partial header, so start afresh
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return false, nil, fmt.Errorf("error truncating partially written manifest header: %w", err)
+		} else if err := writeHeader(file); err != nil {
+			file.Close()
+			return false, nil, err
+		}
+	} else if err := codec.DecodeHeader(file, storage.ManifestMagic); err != nil {
+		file.Close()
+		return false, nil, fmt.Errorf("error reading header of manifest %s: %w", latest, err)
+	}
+
 	m := NewManifest(file)
 
+	// offset is where the last complete entry read ends
+	offset := int64(storage.HeaderLen)
 	for {
 		data := make([]byte, uint32size)
-		if n, err := file.Read(data); err == io.EOF {
+		if _, err := io.ReadFull(file, data); err == io.EOF {
 			break
-		} else if n != len(data) {
-			return false, nil, fmt.Errorf("failed to read expected amount of data from manifest."+
-				" read=%d, expected=%d", n, len(data))
+		} else if err == io.ErrUnexpectedEOF {
+			return m.truncate(file, offset)
 		} else if err != nil {
 			return false, nil, fmt.Errorf("failed to read record: %w", err)
 		}
@@ -78,58 +166,221 @@ func LoadLatest(dbName string, dataDir string) (bool, *Manifest, error) {
 		eLen := binary.BigEndian.Uint32(data)
 
 		entryBytes := make([]byte, eLen)
-		if n, err := file.Read(entryBytes); uint32(n) != eLen {
-			return false, nil, fmt.Errorf("failed to read expected amount of entry data from manifest."+
-				" read=%d, expected=%d", n, eLen)
+		if _, err := io.ReadFull(file, entryBytes); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return m.truncate(file, offset)
 		} else if err != nil {
 			return false, nil, fmt.Errorf("failed to read record: %w", err)
 		}
 
 		entry, err := m.codec.DecodeEntry(entryBytes)
 		if err != nil {
-			return false, nil, fmt.Errorf("failure decoding manifest entry: %w", err)
+			return false, nil, storage.Corruptf("failure decoding manifest entry: %v", err)
 		}
 
 		m.addToLevel(entry)
+		offset += int64(uint32size) + int64(eLen)
+	}
+
+	return true, m, nil
+}
+
+// truncate cuts an entry that was only partially written to the end of the manifest (e.g. due to a crash
+// mid-write) off file, which ends at offset without it, and returns the manifest loaded so far. The entry
+// was never acknowledged, so the sstables it recorded aren't relied on
+func (m *Manifest) truncate(file *os.File, offset int64) (bool, *Manifest, error) {
+	log.Warnf("found partially written entry at end of manifest %s. truncating", file.Name())
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return false, nil, fmt.Errorf("failed truncating partially written manifest entry: %w", err)
 	}
 
 	return true, m, nil
 }
 
 func (m *Manifest) AddEntry(entry *Entry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.addEntry(entry)
+}
+
+// AddEntries records several changes at once. They're written to the manifest together and readers see
+// either none or all of them, so sstables can be swapped for the ones that replace them without their keys
+// going missing in between
+func (m *Manifest) AddEntries(entries []*Entry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		data, err := m.codec.EncodeEntry(entry)
+		if err != nil {
+			return fmt.Errorf("failed encoding manifest entry %v: %w", entry, err)
+		}
+		buf.Write(data)
+	}
+
+	if err := m.write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		m.addToLevel(entry)
+	}
+
+	return nil
+}
+
+func (m *Manifest) addEntry(entry *Entry) error {
 	bytes, err := m.codec.EncodeEntry(entry)
 	if err != nil {
 		return fmt.Errorf("failed encoding manifest entry %v: %w", entry, err)
 	}
 
-	if written, err := m.writer.Write(bytes); written < len(bytes) {
+	if err := m.write(bytes); err != nil {
+		return err
+	}
+
+	m.addToLevel(entry)
+
+	return nil
+}
+
+func (m *Manifest) write(data []byte) error {
+	if written, err := m.writer.Write(data); written < len(data) {
 		// TODO: Manifest state corrupted at this point?
-		return fmt.Errorf("failed writing to manifest. wrote %d bytes, expected %d bytes", written, len(bytes))
+		return fmt.Errorf("failed writing to manifest. wrote %d bytes, expected %d bytes", written, len(data))
 	} else if err != nil {
 		return fmt.Errorf("failed writing to manifest: %w", err)
 	}
 
-	m.addToLevel(entry)
+	// sstables are removed once entries replacing them are written, so the entries have to be on disk first
+	if file, ok := m.writer.(*os.File); ok {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed syncing manifest: %w", err)
+		}
+	}
 
 	return nil
 }
 
-// MetadataForLevel returns metadata for all active sstables at the specified level
-func (m *Manifest) MetadataForLevel(level int) []*sstable.Metadata {
-	return m.levels[level]
+// Close syncs the manifest to disk and closes it if it's backed by a file. The manifest must not be
+// used afterwards
+func (m *Manifest) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if file, ok := m.writer.(*os.File); ok {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed syncing manifest: %w", err)
+		}
+	}
+
+	if closer, ok := m.writer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("failed closing manifest: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// MetadataForLevel returns metadata for all active sstables at the specified level of a column family.
+// The slice returned is a copy and is safe to use while the manifest is being updated
+func (m *Manifest) MetadataForLevel(family uint32, level int) []*sstable.Metadata {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.levels[family][level] == nil {
+		return nil
+	}
+
+	return append([]*sstable.Metadata{}, m.levels[family][level]...)
+}
+
+// Levels returns the number of levels in a column family
+func (m *Manifest) Levels(family uint32) int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.levels[family])
 }
 
-func (m *Manifest) Levels() int {
-	return len(m.levels)
+// CompactionPointer returns the key that compaction of a level of a column family last stopped at, or nil if
+// the level has never been compacted
+func (m *Manifest) CompactionPointer(family uint32, level int) []byte {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.pointers[family][level]
+}
+
+// AddColumnFamily records the creation of a column family and returns its id. Ids start at 1; 0 is
+// reserved for the default column family, which always exists
+func (m *Manifest) AddColumnFamily(name string) (uint32, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.families[name]; ok {
+		return 0, fmt.Errorf("column family %s already exists", name)
+	}
+
+	id := uint32(1)
+	for _, existing := range m.families {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+
+	if err := m.addEntry(NewColumnFamilyEntry(id, name)); err != nil {
+		return 0, fmt.Errorf("failed adding column family %s: %w", name, err)
+	}
+
+	return id, nil
+}
+
+// ColumnFamilies returns every column family created in the database, ordered by id
+func (m *Manifest) ColumnFamilies() []*ColumnFamily {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var families []*ColumnFamily
+	for name, id := range m.families {
+		families = append(families, &ColumnFamily{ID: id, Name: name})
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].ID < families[j].ID
+	})
+
+	return families
 }
 
 func (m *Manifest) addToLevel(entry *Entry) {
 	m.entries = append(m.entries, entry)
+	if entry.family != nil {
+		m.families[entry.family.Name] = entry.family.ID
+		return
+	} else if entry.pointer != nil {
+		pointers := m.pointers[entry.pointer.Family]
+		if pointers == nil {
+			pointers = make(map[int][]byte)
+			m.pointers[entry.pointer.Family] = pointers
+		}
+		pointers[entry.pointer.Level] = entry.pointer.Key
+		return
+	}
+
+	levels := m.levels[entry.metadata.ColumnFamily]
+	if levels == nil {
+		levels = make(map[int][]*sstable.Metadata)
+		m.levels[entry.metadata.ColumnFamily] = levels
+	}
+
 	if !entry.deleted {
-		m.levels[int(entry.metadata.Level)] = append(m.levels[int(entry.metadata.Level)], entry.metadata)
+		levels[int(entry.metadata.Level)] = append(levels[int(entry.metadata.Level)], entry.metadata)
 	} else {
 		// Find entry and remove from in memory structure tracking metadata for each level
-		entries := m.levels[int(entry.metadata.Level)]
+		entries := levels[int(entry.metadata.Level)]
 		loc := -1
 		for idx, m := range entries {
 			if m.Filename == entry.metadata.Filename {
@@ -140,6 +391,6 @@ func (m *Manifest) addToLevel(entry *Entry) {
 		if loc == -1 {
 			log.Panicf("missing metadata entry %v in manifest", entry.metadata)
 		}
-		m.levels[int(entry.metadata.Level)] = append(entries[:loc], entries[loc+1:]...)
+		levels[int(entry.metadata.Level)] = append(entries[:loc], entries[loc+1:]...)
 	}
 }
@@ -3,11 +3,14 @@ package manifest
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
 
 	"github.com/nbroyles/nbdb/internal/sstable"
+	"github.com/nbroyles/nbdb/internal/storage"
 
 	"github.com/nbroyles/nbdb/test"
 	"github.com/stretchr/testify/assert"
@@ -61,11 +64,73 @@ func TestManifest_AddEntry(t *testing.T) {
 
 	assert.NoError(t, man.AddEntry(entry3))
 
-	meta := man.MetadataForLevel(0)
+	meta := man.MetadataForLevel(0, 0)
 	assert.Equal(t, 1, len(meta))
 	assert.Equal(t, entry1.metadata, meta[0])
 }
 
+func TestManifest_AddEntries(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "manifest_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	m, err := CreateManifestFile(dbName, dir)
+	assert.NoError(t, err)
+	man := NewManifest(m)
+
+	md0_1 := &sstable.Metadata{Level: 0, Filename: "sst1", StartKey: []byte("a"), EndKey: []byte("c")}
+	md1_1 := &sstable.Metadata{Level: 1, Filename: "sst2", StartKey: []byte("a"), EndKey: []byte("b")}
+	md1_2 := &sstable.Metadata{Level: 1, Filename: "sst3", StartKey: []byte("b"), EndKey: []byte("c")}
+	assert.NoError(t, man.AddEntry(NewEntry(md0_1, false)))
+
+	// The level 0 table is swapped for the level 1 tables that replace it in one go
+	assert.NoError(t, man.AddEntries([]*Entry{NewEntry(md0_1, true), NewEntry(md1_1, false), NewEntry(md1_2, false)}))
+	assert.Empty(t, man.MetadataForLevel(0, 0))
+	assert.Equal(t, []*sstable.Metadata{md1_1, md1_2}, man.MetadataForLevel(0, 1))
+
+	_, man2, err := LoadLatest(dbName, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, man.entries, man2.entries)
+	assert.Equal(t, []*sstable.Metadata{md1_1, md1_2}, man2.MetadataForLevel(0, 1))
+}
+
+func TestManifest_CompactionPointer(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "manifest_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	m, err := CreateManifestFile(dbName, dir)
+	assert.NoError(t, err)
+	man := NewManifest(m)
+
+	assert.Nil(t, man.CompactionPointer(0, 1))
+
+	md := &sstable.Metadata{Level: 1, Filename: "sst1", StartKey: []byte("a"), EndKey: []byte("c")}
+	assert.NoError(t, man.AddEntries([]*Entry{NewEntry(md, false), NewCompactionPointerEntry(0, 1, []byte("c"))}))
+	assert.NoError(t, man.AddEntry(NewCompactionPointerEntry(2, 1, []byte("x"))))
+	assert.NoError(t, man.AddEntry(NewCompactionPointerEntry(0, 1, []byte("m"))))
+
+	// Each level of each column family has its own pointer, and it survives reopening the manifest
+	_, man2, err := LoadLatest(dbName, dir)
+	assert.NoError(t, err)
+	for _, loaded := range []*Manifest{man, man2} {
+		assert.Equal(t, []byte("m"), loaded.CompactionPointer(0, 1))
+		assert.Equal(t, []byte("x"), loaded.CompactionPointer(2, 1))
+		assert.Nil(t, loaded.CompactionPointer(0, 2))
+		assert.Equal(t, []*sstable.Metadata{md}, loaded.MetadataForLevel(0, 1))
+	}
+}
+
 func TestCreateManifestFile(t *testing.T) {
 	dir, err := os.Getwd()
 	assert.NoError(t, err)
@@ -107,7 +172,7 @@ func TestLoadLatest(t *testing.T) {
 	assert.NoError(t, err)
 
 	assert.Equal(t, man.entries, man2.entries)
-	assert.Equal(t, 0, len(man.MetadataForLevel(0)))
+	assert.Equal(t, 0, len(man.MetadataForLevel(0, 0)))
 }
 
 func TestManifest_MetadataForLevel(t *testing.T) {
@@ -134,8 +199,8 @@ func TestManifest_MetadataForLevel(t *testing.T) {
 	assert.NoError(t, man.AddEntry(&Entry{metadata: md0_2, deleted: false}))
 	assert.NoError(t, man.AddEntry(&Entry{metadata: md1_1, deleted: false}))
 
-	l0Meta := man.MetadataForLevel(0)
-	l1Meta := man.MetadataForLevel(1)
+	l0Meta := man.MetadataForLevel(0, 0)
+	l1Meta := man.MetadataForLevel(0, 1)
 
 	assert.Equal(t, 2, len(l0Meta))
 	assert.Equal(t, []*sstable.Metadata{md0_1, md0_2}, l0Meta)
@@ -143,3 +208,184 @@ func TestManifest_MetadataForLevel(t *testing.T) {
 	assert.Equal(t, 1, len(l1Meta))
 	assert.Equal(t, []*sstable.Metadata{md1_1}, l1Meta)
 }
+
+func TestManifest_ColumnFamilies(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "manifest_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	m, err := CreateManifestFile(dbName, dir)
+	assert.NoError(t, err)
+	man := NewManifest(m)
+
+	id, err := man.AddColumnFamily("users")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), id)
+
+	id, err = man.AddColumnFamily("orders")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), id)
+
+	_, err = man.AddColumnFamily("users")
+	assert.EqualError(t, err, "column family users already exists")
+
+	// Tables are tracked separately for each column family
+	md := &sstable.Metadata{ColumnFamily: 2, Level: 0, Filename: "foo", StartKey: []byte("a"), EndKey: []byte("b")}
+	assert.NoError(t, man.AddEntry(NewEntry(md, false)))
+	assert.Empty(t, man.MetadataForLevel(0, 0))
+	assert.Equal(t, []*sstable.Metadata{md}, man.MetadataForLevel(2, 0))
+	assert.Equal(t, 0, man.Levels(1))
+	assert.Equal(t, 1, man.Levels(2))
+
+	// Column families and tables are recovered when the manifest is loaded, and it can still be added to
+	_, man2, err := LoadLatest(dbName, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []*ColumnFamily{{ID: 1, Name: "users"}, {ID: 2, Name: "orders"}}, man2.ColumnFamilies())
+	assert.Equal(t, []*sstable.Metadata{md}, man2.MetadataForLevel(2, 0))
+
+	id, err = man2.AddColumnFamily("events")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), id)
+}
+
+func TestManifest_Close(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "manifest_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	m, err := CreateManifestFile(dbName, dir)
+	assert.NoError(t, err)
+	man := NewManifest(m)
+
+	meta := &sstable.Metadata{Level: 0, Filename: "foo", StartKey: []byte("a"), EndKey: []byte("b")}
+	assert.NoError(t, man.AddEntry(NewEntry(meta, false)))
+	assert.NoError(t, man.Close())
+
+	// Nothing can be written once closed, but everything written before is persisted
+	assert.Error(t, man.AddEntry(NewEntry(meta, true)))
+
+	_, loaded, err := LoadLatest(dbName, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []*sstable.Metadata{meta}, loaded.MetadataForLevel(0, 0))
+}
+
+func TestManifest_LoadLatestPartialEntry(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "manifest_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	m, err := CreateManifestFile(dbName, dir)
+	assert.NoError(t, err)
+	man := NewManifest(m)
+
+	meta1 := &sstable.Metadata{Level: 0, Filename: "foo", StartKey: []byte("a"), EndKey: []byte("b")}
+	assert.NoError(t, man.AddEntry(NewEntry(meta1, false)))
+	info, err := m.Stat()
+	assert.NoError(t, err)
+	complete := info.Size()
+
+	// Simulate a crash partway through writing the second entry
+	meta2 := &sstable.Metadata{Level: 0, Filename: "bar", StartKey: []byte("c"), EndKey: []byte("d")}
+	assert.NoError(t, man.AddEntry(NewEntry(meta2, false)))
+	info, err = m.Stat()
+	assert.NoError(t, err)
+	assert.NoError(t, m.Truncate(info.Size()-2))
+
+	// The partial entry is cut off so that entries added afterwards follow the last complete one
+	_, man, err = LoadLatest(dbName, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []*sstable.Metadata{meta1}, man.MetadataForLevel(0, 0))
+
+	info, err = os.Stat(m.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, complete, info.Size())
+
+	meta3 := &sstable.Metadata{Level: 0, Filename: "baz", StartKey: []byte("e"), EndKey: []byte("f")}
+	assert.NoError(t, man.AddEntry(NewEntry(meta3, false)))
+
+	_, man, err = LoadLatest(dbName, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []*sstable.Metadata{meta1, meta3}, man.MetadataForLevel(0, 0))
+}
+
+func TestManifest_LoadLatestCorrupt(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "manifest_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	m, err := CreateManifestFile(dbName, dir)
+	assert.NoError(t, err)
+
+	// An entry that was written in full but can't be decoded isn't a partial write
+	_, err = m.Write([]byte{0, 0, 0, 2, 0, 0})
+	assert.NoError(t, err)
+
+	_, _, err = LoadLatest(dbName, dir)
+	assert.True(t, errors.Is(err, storage.ErrCorruption))
+}
+
+func TestManifest_LoadLatestUnversioned(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "manifest_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	// A manifest written before formats were versioned starts straight away with an entry
+	buf := bytes.Buffer{}
+	man := NewManifest(&buf)
+	meta := &sstable.Metadata{Level: 0, Filename: "foo", StartKey: []byte("a"), EndKey: []byte("b")}
+	assert.NoError(t, man.AddEntry(NewEntry(meta, false)))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dbPath, manifestPrefix+"_"+dbName+"_1"), buf.Bytes(), 0644))
+
+	_, _, err = LoadLatest(dbName, dir)
+	assert.True(t, errors.Is(err, storage.ErrIncompatibleFormat))
+}
+
+func TestManifest_LoadLatestEmpty(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "manifest_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	// A crash just after creating a manifest can leave it without a complete header
+	assert.NoError(t, ioutil.WriteFile(path.Join(dbPath, manifestPrefix+"_"+dbName+"_1"), []byte{0x6e}, 0644))
+
+	found, man, err := LoadLatest(dbName, dir)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	meta := &sstable.Metadata{Level: 0, Filename: "foo", StartKey: []byte("a"), EndKey: []byte("b")}
+	assert.NoError(t, man.AddEntry(NewEntry(meta, false)))
+
+	_, man, err = LoadLatest(dbName, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []*sstable.Metadata{meta}, man.MetadataForLevel(0, 0))
+}
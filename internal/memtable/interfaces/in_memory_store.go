@@ -1,23 +1,38 @@
 package interfaces
 
+import (
+	"github.com/nbroyles/nbdb/internal/iterator"
+	"github.com/nbroyles/nbdb/internal/storage"
+)
+
 // InMemoryStore is to be implemented by any data structure that's to be used as the
 // in memory store for the MemTable.
 type InMemoryStore interface {
-	// Get returns a boolean indicating whether the specified key
-	// was found in the list. If true, the value is returned as well
-	Get(key []byte) (bool, []byte)
+	// Get returns the most recent version of key written at or before sequence number
+	// seq, which may be a delete, or nil if there is no such version in the store
+	Get(key []byte, seq uint64) *storage.Record
+
+	// Put inserts a new version of key with sequence number seq
+	Put(key []byte, value []byte, seq uint64)
 
-	// Put inserts or updates the value if the key already exists
-	Put(key []byte, value []byte)
+	// PutWithExpiry inserts a new version of key with sequence number seq that expires at
+	// expiresAt, in nanoseconds since the Unix epoch
+	PutWithExpiry(key []byte, value []byte, expiresAt int64, seq uint64)
 
-	// Deletes the specified key from the skip list. Returns true if
-	// key was removed and false if key was not present
-	Delete(key []byte) bool
+	// Delete inserts a tombstone for key with sequence number seq
+	Delete(key []byte, seq uint64)
+
+	// Merge inserts a merge operand for key with sequence number seq
+	Merge(key []byte, operand []byte, seq uint64)
 
 	// InternalIterator returns an iterator that can be used to iterate over each element
 	// in the store. Primarily useful when flushing structure to an sstable on disk
 	InternalIterator() InternalIterator
 
+	// NewIterator returns a seekable iterator over each element in the store. Useful for
+	// serving range scans
+	NewIterator() iterator.Iterator
+
 	// Size returns the approximate size of the underlying structure
 	Size() uint32
 }
@@ -3,39 +3,101 @@ package memtable
 import (
 	"time"
 
+	"github.com/nbroyles/nbdb/internal/iterator"
 	"github.com/nbroyles/nbdb/internal/memtable/interfaces"
+	"github.com/nbroyles/nbdb/internal/storage"
 
 	"github.com/nbroyles/nbdb/internal/memtable/skiplist"
 )
 
 type MemTable struct {
 	memStore interfaces.InMemoryStore
+	// rangeDeletes are kept apart from the point updates in memStore since they cover many keys
+	rangeDeletes    []*storage.Record
+	rangeDeleteSize uint32
 }
 
 func New() *MemTable {
 	return &MemTable{memStore: skiplist.New(time.Now().UnixNano())}
 }
 
-func (m *MemTable) Get(key []byte) []byte {
-	if found, val := m.memStore.Get(key); found {
-		return val
-	} else {
-		return nil
+// Get looks up the most recent version of key written at or before sequence number seq. A status
+// of KeyDeleted means the key was deleted in this memtable and older data must not be consulted.
+// Merge operands found along the way are appended to operands, newest first, and returned. If the
+// value they apply to isn't in this memtable, KeyNotFound is returned so that the search continues
+func (m *MemTable) Get(key []byte, seq uint64, operands [][]byte) (storage.LookupStatus, []byte, [][]byte) {
+	now := time.Now().UnixNano()
+	for version := seq; ; {
+		record := m.memStore.Get(key, version)
+
+		// Any visible range delete written after the version found hides the key
+		var recordSeq uint64
+		if record != nil {
+			recordSeq = record.Seq
+		}
+		if storage.RangeDeleted(m.rangeDeletes, key, recordSeq, seq) {
+			return storage.KeyDeleted, nil, operands
+		}
+
+		if record == nil {
+			return storage.KeyNotFound, nil, operands
+		}
+
+		switch {
+		case record.Type == storage.RecordDelete || record.Expired(now):
+			return storage.KeyDeleted, nil, operands
+		case record.Type == storage.RecordMerge:
+			operands = append(operands, record.Value)
+			if record.Seq == 0 {
+				return storage.KeyNotFound, nil, operands
+			}
+			version = record.Seq - 1
+		default:
+			return storage.KeyFound, record.Value, operands
+		}
 	}
 }
 
-func (m *MemTable) Put(key []byte, value []byte) {
-	m.memStore.Put(key, value)
+func (m *MemTable) Put(key []byte, value []byte, seq uint64) {
+	m.memStore.Put(key, value, seq)
+}
+
+// PutWithExpiry inserts a version of key that expires at expiresAt, in nanoseconds since the Unix epoch
+func (m *MemTable) PutWithExpiry(key []byte, value []byte, expiresAt int64, seq uint64) {
+	m.memStore.PutWithExpiry(key, value, expiresAt, seq)
+}
+
+func (m *MemTable) Delete(key []byte, seq uint64) {
+	m.memStore.Delete(key, seq)
 }
 
-func (m *MemTable) Delete(key []byte) {
-	m.memStore.Delete(key)
+func (m *MemTable) Merge(key []byte, operand []byte, seq uint64) {
+	m.memStore.Merge(key, operand, seq)
+}
+
+// DeleteRange records a range delete with sequence number seq that hides every key greater than
+// or equal to start and less than end written before it
+func (m *MemTable) DeleteRange(start []byte, end []byte, seq uint64) {
+	rd := storage.NewRangeDelete(start, end)
+	rd.Seq = seq
+
+	m.rangeDeletes = append(m.rangeDeletes, rd)
+	m.rangeDeleteSize += uint32(len(start) + len(end) + 8)
+}
+
+// RangeDeletes returns every range delete in the memtable
+func (m *MemTable) RangeDeletes() []*storage.Record {
+	return m.rangeDeletes
 }
 
 func (m *MemTable) InternalIterator() interfaces.InternalIterator {
 	return m.memStore.InternalIterator()
 }
 
+func (m *MemTable) NewIterator() iterator.Iterator {
+	return m.memStore.NewIterator()
+}
+
 func (m *MemTable) Size() uint32 {
-	return m.memStore.Size()
+	return m.memStore.Size() + m.rangeDeleteSize
 }
@@ -1,6 +1,9 @@
 package skiplist
 
 import (
+	"math"
+
+	"github.com/nbroyles/nbdb/internal/iterator"
 	"github.com/nbroyles/nbdb/internal/memtable/interfaces"
 	"github.com/nbroyles/nbdb/internal/storage"
 	log "github.com/sirupsen/logrus"
@@ -27,7 +30,64 @@ func (i *Iterator) Next() *storage.Record {
 	node := i.pointer.next[0]
 	i.pointer = node
 
-	return storage.NewRecord(node.key, node.value, node.deleted)
+	return newRecord(node)
 }
 
 var _ interfaces.InternalIterator = &Iterator{}
+
+// listIterator is a seekable iterator over the nodes in a SkipList. Deleted nodes are
+// returned as delete records so that they can shadow older values
+type listIterator struct {
+	list *SkipList
+	node *Node
+}
+
+var _ iterator.Iterator = &listIterator{}
+
+func (l *listIterator) Valid() bool {
+	return l.node != nil
+}
+
+func (l *listIterator) SeekToFirst() {
+	l.node = l.list.head.next[0]
+}
+
+func (l *listIterator) SeekToLast() {
+	l.node = l.list.findLast()
+}
+
+func (l *listIterator) Seek(key []byte) {
+	l.node = l.list.findGreaterOrEqual(key, math.MaxUint64)
+}
+
+func (l *listIterator) Next() {
+	if !l.Valid() {
+		log.Panic("iterator is not positioned at a node")
+	}
+
+	l.node = l.node.next[0]
+}
+
+func (l *listIterator) Prev() {
+	if !l.Valid() {
+		log.Panic("iterator is not positioned at a node")
+	}
+
+	l.node = l.node.prev
+}
+
+func (l *listIterator) Record() *storage.Record {
+	return newRecord(l.node)
+}
+
+func (l *listIterator) Error() error {
+	return nil
+}
+
+func (l *listIterator) Close() error {
+	return nil
+}
+
+func newRecord(node *Node) *storage.Record {
+	return &storage.Record{Key: node.key, Value: node.value, Type: node.rType, Seq: node.seq, ExpiresAt: node.expiresAt}
+}
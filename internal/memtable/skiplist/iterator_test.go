@@ -12,25 +12,28 @@ func TestIterator_HasNext(t *testing.T) {
 	assert.False(t, iter.HasNext())
 
 	list2 := New(1)
-	put(list2, "foo", "bar")
+	put(list2, "foo", "bar", 1)
 	iter = NewIterator(list2)
 	assert.True(t, iter.HasNext())
 }
 
 func TestIterator_Next(t *testing.T) {
 	list := New(1)
-	put(list, "foo", "bar")
-	put(list, "baz", "bax")
-	list.Delete([]byte("baz"))
+	put(list, "foo", "bar", 1)
+	put(list, "baz", "bax", 2)
+	list.Delete([]byte("baz"), 3)
 
 	iter := NewIterator(list)
 
 	// Remember, skip list is ordered, so next is opposite of insertion order
 	assert.True(t, iter.HasNext())
-	assertNextRecordEquals(t, iter, "baz", "bax", true)
+	assertNextRecordEquals(t, iter, "baz", "", 3, true)
 
 	assert.True(t, iter.HasNext())
-	assertNextRecordEquals(t, iter, "foo", "bar", false)
+	assertNextRecordEquals(t, iter, "baz", "bax", 2, false)
+
+	assert.True(t, iter.HasNext())
+	assertNextRecordEquals(t, iter, "foo", "bar", 1, false)
 
 	assert.False(t, iter.HasNext())
 }
@@ -41,3 +44,93 @@ func TestIterator_EmptyList(t *testing.T) {
 
 	assert.Panics(t, func() { iter.Next() })
 }
+
+func TestListIterator_SeekToFirst(t *testing.T) {
+	list := New(1)
+	put(list, "foo", "bar", 1)
+	put(list, "baz", "bax", 2)
+	list.Delete([]byte("baz"), 3)
+
+	iter := list.NewIterator()
+	iter.SeekToFirst()
+
+	assert.True(t, iter.Valid())
+	assert.Equal(t, record("baz", "", 3, true), iter.Record())
+
+	iter.Next()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, record("baz", "bax", 2, false), iter.Record())
+
+	iter.Next()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, record("foo", "bar", 1, false), iter.Record())
+
+	iter.Next()
+	assert.False(t, iter.Valid())
+}
+
+func TestListIterator_Seek(t *testing.T) {
+	list := New(1)
+	put(list, "a", "1", 1)
+	put(list, "c", "3", 2)
+	put(list, "e", "5", 3)
+	put(list, "c", "33", 4)
+
+	iter := list.NewIterator()
+
+	// Seeking to a key lands on its most recent version
+	iter.Seek([]byte("c"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, record("c", "33", 4, false), iter.Record())
+
+	iter.Next()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, record("c", "3", 2, false), iter.Record())
+
+	iter.Seek([]byte("d"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("e"), iter.Record().Key)
+
+	iter.Seek([]byte("f"))
+	assert.False(t, iter.Valid())
+}
+
+func TestListIterator_EmptyList(t *testing.T) {
+	list := New(1)
+	iter := list.NewIterator()
+
+	iter.SeekToFirst()
+	assert.False(t, iter.Valid())
+	assert.Panics(t, func() { iter.Next() })
+
+	iter.SeekToLast()
+	assert.False(t, iter.Valid())
+	assert.Panics(t, func() { iter.Prev() })
+}
+
+func TestListIterator_Reverse(t *testing.T) {
+	list := New(1)
+	put(list, "b", "2", 1)
+	put(list, "d", "4", 2)
+	put(list, "a", "1", 3)
+	put(list, "c", "3", 4)
+
+	iter := list.NewIterator()
+	iter.SeekToLast()
+
+	for _, key := range []string{"d", "c", "b", "a"} {
+		assert.True(t, iter.Valid())
+		assert.Equal(t, []byte(key), iter.Record().Key)
+		iter.Prev()
+	}
+	assert.False(t, iter.Valid())
+
+	iter.Seek([]byte("c"))
+	iter.Prev()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("b"), iter.Record().Key)
+
+	iter.Next()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("c"), iter.Record().Key)
+}
@@ -6,19 +6,25 @@ import (
 	"math/rand"
 	"strings"
 
+	"github.com/nbroyles/nbdb/internal/iterator"
 	"github.com/nbroyles/nbdb/internal/memtable/interfaces"
+	"github.com/nbroyles/nbdb/internal/storage"
 	log "github.com/sirupsen/logrus"
 )
 
 // TODO: make configurable?
 const maxLevels = 32
 
-// Node represents a node in the SkipList structure
+// Node represents a node in the SkipList structure. Nodes link forward at every level they
+// appear on, but only link backward on the bottom level
 type Node struct {
-	next    []*Node
-	key     []byte
-	value   []byte
-	deleted bool
+	next      []*Node
+	prev      *Node
+	key       []byte
+	value     []byte
+	seq       uint64
+	rType     storage.RecordType
+	expiresAt int64
 }
 
 // SkipList is an implementation of a data structure that provides
@@ -27,6 +33,9 @@ type Node struct {
 // See the following for more details:
 //   - https://en.wikipedia.org/wiki/Skip_list
 //   - https://igoro.com/archive/skip-lists-are-fascinating/
+//
+// Every write is kept as its own node. Nodes are ordered by key and then by sequence number
+// such that the most recent version of a key comes first
 type SkipList struct {
 	head   *Node
 	levels int
@@ -44,142 +53,134 @@ func New(seed int64) *SkipList {
 	}
 }
 
-// Get returns a boolean indicating whether the specified key
-// was found in the list. If true, the value is returned as well
-func (s *SkipList) Get(key []byte) (bool, []byte) {
-	return s.get(key)
-}
-
-func (s *SkipList) get(key []byte) (bool, []byte) {
-	c := s.head
-	for i := s.levels - 1; i >= 0; i-- {
-	rightTraversal:
-		for ; c.next[i] != nil; c = c.next[i] {
-			switch bytes.Compare(c.next[i].key, key) {
-			case 0:
-				if c.next[i].deleted {
-					return false, nil
-				} else {
-					return true, c.next[i].value
-				}
-			case 1: // next key is greater than the key we're searching for
-				break rightTraversal
-			}
-		}
+// Get returns the most recent version of key written at or before sequence number seq, which may
+// be a delete, or nil if there is no such version in the list
+func (s *SkipList) Get(key []byte, seq uint64) *storage.Record {
+	node := s.findGreaterOrEqual(key, seq)
+	if node == nil || !bytes.Equal(node.key, key) {
+		return nil
 	}
 
-	return false, nil
+	return newRecord(node)
 }
 
-// Put inserts or updates the value if the key already exists
-func (s *SkipList) Put(key []byte, value []byte) {
-	shouldUpdate, oldValue := s.get(key)
-	shouldUpdate = shouldUpdate || s.isDeleted(key)
-
-	if shouldUpdate {
-		s.update(key, value)
-		s.size += uint32(len(value) - len(oldValue))
-	} else {
-		s.insert(key, value)
-		s.size += uint32(len(key) + len(value))
-	}
-
+// Put inserts a new version of key with sequence number seq
+func (s *SkipList) Put(key []byte, value []byte, seq uint64) {
+	s.insert(key, value, seq, storage.RecordUpdate, 0)
 }
 
-// Removes the specified key from the skip list. Returns true if
-// key was removed and false if key was not present
-func (s *SkipList) Delete(key []byte) bool {
-	// TODO: needs to account for deletes of keys that may not currently be in memtable (this allows us to delete
-	// keys that may exist in sstable)
-	c := s.head
-	removed := false
-	for i := s.levels - 1; i >= 0; i-- {
-		for ; c.next[i] != nil; c = c.next[i] {
-			if bytes.Compare(c.next[i].key, key) > 0 {
-				break
-			} else if bytes.Equal(c.next[i].key, key) && !c.next[i].deleted {
-				c.next[i].deleted = true
-				removed = true
-				break
-			}
-		}
-	}
-
-	return removed
+// PutWithExpiry inserts a new version of key with sequence number seq that expires at expiresAt,
+// in nanoseconds since the Unix epoch
+func (s *SkipList) PutWithExpiry(key []byte, value []byte, expiresAt int64, seq uint64) {
+	s.insert(key, value, seq, storage.RecordUpdate, expiresAt)
 }
 
-func (s *SkipList) update(key []byte, value []byte) {
-	c := s.head
-	updated := false
-	for i := s.levels - 1; i >= 0; i-- {
-		for ; c.next[i] != nil; c = c.next[i] {
-			if bytes.Compare(c.next[i].key, key) > 0 {
-				break
-			} else if bytes.Equal(c.next[i].key, key) {
-				c.next[i].value = value
-				c.next[i].deleted = false
-				updated = true
-				break
-			}
-		}
-	}
+// Delete inserts a tombstone for key with sequence number seq. The tombstone
+// shadows any older versions of key, whether they're in this list or elsewhere
+func (s *SkipList) Delete(key []byte, seq uint64) {
+	s.insert(key, nil, seq, storage.RecordDelete, 0)
+}
 
-	if !updated {
-		log.Panicf("could not update key %v (%s) even though we expected it to exist!", key, string(key))
-	}
+// Merge inserts a merge operand for key with sequence number seq
+func (s *SkipList) Merge(key []byte, operand []byte, seq uint64) {
+	s.insert(key, operand, seq, storage.RecordMerge, 0)
 }
 
-func (s *SkipList) insert(key []byte, value []byte) {
+func (s *SkipList) insert(key []byte, value []byte, seq uint64, rType storage.RecordType, expiresAt int64) {
 	levels := s.generateLevels()
 
 	if levels > s.levels {
 		s.levels = levels
 	}
 
-	newNode := &Node{next: make([]*Node, levels), key: key, value: value, deleted: false}
+	newNode := &Node{next: make([]*Node, levels), key: key, value: value, seq: seq, rType: rType,
+		expiresAt: expiresAt}
 
 	c := s.head
 	for i := s.levels - 1; i >= 0; i-- {
 		for ; c.next[i] != nil; c = c.next[i] {
-			// Stop moving rightward at this level if next key is greater
-			// than key we plan to insert
-			if bytes.Compare(c.next[i].key, key) > 0 {
+			// Stop moving rightward at this level if next node is ordered
+			// after the node we plan to insert
+			cmp := compare(c.next[i], key, seq)
+			if cmp > 0 {
 				break
-			} else if bytes.Equal(c.next[i].key, key) {
-				log.Panicf("attempting to insert key %v (%s) that already exists. "+
-					"this should not happen!", key, string(key))
+			} else if cmp == 0 {
+				log.Panicf("attempting to insert key %v (%s) at seq %d that already exists. "+
+					"this should not happen!", key, string(key), seq)
 			}
 		}
 		if levels > i {
 			newNode.next[i] = c.next[i]
 			c.next[i] = newNode
 		}
+
+		if i == 0 {
+			if c != s.head {
+				newNode.prev = c
+			}
+			if newNode.next[0] != nil {
+				newNode.next[0].prev = newNode
+			}
+		}
 	}
+
+	// Account for the sequence number stored alongside each version
+	s.size += uint32(len(key) + len(value) + 8)
 }
 
-func (s *SkipList) isDeleted(key []byte) bool {
+// findGreaterOrEqual returns the first node ordered at or after the version of key with
+// sequence number seq or nil if no such node exists
+func (s *SkipList) findGreaterOrEqual(key []byte, seq uint64) *Node {
 	c := s.head
 	for i := s.levels - 1; i >= 0; i-- {
-		for ; c.next[i] != nil; c = c.next[i] {
-			if bytes.Compare(c.next[i].key, key) > 0 {
-				break
-			} else if bytes.Equal(c.next[i].key, key) {
-				return c.next[i].deleted
-			}
+		for c.next[i] != nil && compare(c.next[i], key, seq) < 0 {
+			c = c.next[i]
 		}
 	}
 
-	return false
+	return c.next[0]
+}
+
+// findLast returns the last node in the list or nil if the list is empty
+func (s *SkipList) findLast() *Node {
+	c := s.head
+	for i := s.levels - 1; i >= 0; i-- {
+		for c.next[i] != nil {
+			c = c.next[i]
+		}
+	}
+
+	if c == s.head {
+		return nil
+	}
+	return c
+}
+
+// compare orders node relative to the version of key with sequence number seq. Versions of
+// the same key are ordered from most to least recent
+func compare(node *Node, key []byte, seq uint64) int {
+	if c := bytes.Compare(node.key, key); c != 0 {
+		return c
+	}
+
+	switch {
+	case node.seq > seq:
+		return -1
+	case node.seq < seq:
+		return 1
+	default:
+		return 0
+	}
 }
 
 // Print prints skip list in a pretty format. Should only be used for debugging
 // Not particularly efficient. Would not recommend on larger lists
 // TODO: represent deleted keys
 func (s *SkipList) Print() {
-	keysLoc := map[string]int{}
+	keysLoc := map[*Node]int{}
 	idx := 1
 	for node := s.head.next[0]; node != nil; node = node.next[0] {
-		keysLoc[string(node.key)] = idx
+		keysLoc[node] = idx
 		idx++
 	}
 	nodeWidth := 10
@@ -194,10 +195,10 @@ func (s *SkipList) Print() {
 	}
 }
 
-func (s *SkipList) printNodeBorder(i int, keysLoc map[string]int, nodeWidth int) {
+func (s *SkipList) printNodeBorder(i int, keysLoc map[*Node]int, nodeWidth int) {
 	nextSlot := 1
 	for node := s.head.next[i]; node != nil; node = node.next[i] {
-		loc := keysLoc[string(node.key)]
+		loc := keysLoc[node]
 
 		for nextSlot != loc {
 			fmt.Printf(fmt.Sprint("%", nodeWidth, "s"), strings.Repeat(" ", nodeWidth))
@@ -211,10 +212,10 @@ func (s *SkipList) printNodeBorder(i int, keysLoc map[string]int, nodeWidth int)
 	}
 }
 
-func (s *SkipList) printNode(i int, keysLoc map[string]int, nodeWidth int) {
+func (s *SkipList) printNode(i int, keysLoc map[*Node]int, nodeWidth int) {
 	nextSlot := 1
 	for node := s.head.next[i]; node != nil; node = node.next[i] {
-		loc := keysLoc[string(node.key)]
+		loc := keysLoc[node]
 
 		keySize := 4
 		key := string(node.key)
@@ -255,6 +256,10 @@ func (s *SkipList) InternalIterator() interfaces.InternalIterator {
 	return NewIterator(s)
 }
 
+func (s *SkipList) NewIterator() iterator.Iterator {
+	return &listIterator{list: s}
+}
+
 func (s *SkipList) Size() uint32 {
 	return s.size
 }
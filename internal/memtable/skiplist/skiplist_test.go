@@ -1,8 +1,10 @@
 package skiplist
 
 import (
+	"math"
 	"testing"
 
+	"github.com/nbroyles/nbdb/internal/storage"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,18 +16,18 @@ import (
 func TestSkipList_RoundTrip(t *testing.T) {
 	list := New(1)
 
-	put(list, "howdy", "time")
+	put(list, "howdy", "time", 1)
 	assertSkipListValue(t, list, "howdy", "time")
 }
 
 func TestSkipList_Put(t *testing.T) {
 	list := New(1)
 
-	put(list, "a", "lot")
-	put(list, "of", "keys")
-	put(list, "into", "this")
-	put(list, "bad", "boy")
-	put(list, "!!!!", "!!!!")
+	put(list, "a", "lot", 1)
+	put(list, "of", "keys", 2)
+	put(list, "into", "this", 3)
+	put(list, "bad", "boy", 4)
+	put(list, "!!!!", "!!!!", 5)
 
 	assertSkipListValue(t, list, "a", "lot")
 	assertSkipListValue(t, list, "of", "keys")
@@ -33,10 +35,10 @@ func TestSkipList_Put(t *testing.T) {
 	assertSkipListValue(t, list, "bad", "boy")
 	assertSkipListValue(t, list, "!!!!", "!!!!")
 
-	assert.True(t, list.Delete([]byte("a")))
-	assert.True(t, list.isDeleted([]byte("a")))
+	list.Delete([]byte("a"), 6)
+	assert.Equal(t, record("a", "", 6, true), list.Get([]byte("a"), math.MaxUint64))
 
-	put(list, "a", "dude")
+	put(list, "a", "dude", 7)
 
 	assertSkipListValue(t, list, "a", "dude")
 }
@@ -44,71 +46,109 @@ func TestSkipList_Put(t *testing.T) {
 func TestSkipList_Delete(t *testing.T) {
 	list := New(1)
 
-	put(list, "foo", "bar")
+	put(list, "foo", "bar", 1)
+	list.Delete([]byte("foo"), 2)
 
-	assert.True(t, list.Delete([]byte("foo")))
-	assert.True(t, list.isDeleted([]byte("foo")))
+	assert.Equal(t, record("foo", "", 2, true), list.Get([]byte("foo"), math.MaxUint64))
 
-	found, val := list.Get([]byte("foo"))
-	assert.False(t, found)
-	assert.Nil(t, val)
+	// Keys that were never written can be deleted too so that they shadow older data elsewhere
+	assert.Nil(t, list.Get([]byte("baz"), math.MaxUint64))
 
-	assert.False(t, list.Delete([]byte("foo")))
-	assert.True(t, list.isDeleted([]byte("foo")))
+	list.Delete([]byte("baz"), 3)
+	assert.Equal(t, record("baz", "", 3, true), list.Get([]byte("baz"), math.MaxUint64))
+
+	iter := list.InternalIterator()
+	assertNextRecordEquals(t, iter, "baz", "", 3, true)
+	assertNextRecordEquals(t, iter, "foo", "", 2, true)
+	assertNextRecordEquals(t, iter, "foo", "bar", 1, false)
 }
 
 func TestSkipList_Update(t *testing.T) {
 	list := New(1)
 
-	put(list, "foo", "bar")
+	put(list, "foo", "bar", 1)
 	assertSkipListValue(t, list, "foo", "bar")
 
-	put(list, "foo", "baz")
+	put(list, "foo", "baz", 2)
 	assertSkipListValue(t, list, "foo", "baz")
 }
 
-func TestSkipList_MultipleInserts(t *testing.T) {
+func TestSkipList_Versions(t *testing.T) {
 	list := New(1)
 
-	list.insert([]byte("foo"), []byte("bar"))
+	put(list, "foo", "bar", 2)
+	list.Delete([]byte("foo"), 4)
+	put(list, "foo", "baz", 6)
+
+	assert.Nil(t, list.Get([]byte("foo"), 1))
+
+	for seq, expected := range map[uint64]*storage.Record{
+		2: record("foo", "bar", 2, false),
+		3: record("foo", "bar", 2, false),
+		4: record("foo", "", 4, true),
+		5: record("foo", "", 4, true),
+		6: record("foo", "baz", 6, false),
+		7: record("foo", "baz", 6, false),
+	} {
+		assert.Equal(t, expected, list.Get([]byte("foo"), seq), "seq %d", seq)
+	}
+}
+
+func TestSkipList_Merge(t *testing.T) {
+	list := New(1)
 
-	assert.Panics(t, func() {
-		list.insert([]byte("foo"), []byte("bar"))
-	})
+	put(list, "foo", "bar", 1)
+	list.Merge([]byte("foo"), []byte("baz"), 2)
+
+	assert.Equal(t, &storage.Record{Key: []byte("foo"), Value: []byte("baz"), Type: storage.RecordMerge, Seq: 2},
+		list.Get([]byte("foo"), math.MaxUint64))
+	assert.Equal(t, record("foo", "bar", 1, false), list.Get([]byte("foo"), 1))
+}
+
+func TestSkipList_PutWithExpiry(t *testing.T) {
+	list := New(1)
+
+	list.PutWithExpiry([]byte("foo"), []byte("bar"), 42, 1)
+
+	assert.Equal(t, &storage.Record{Key: []byte("foo"), Value: []byte("bar"), Type: storage.RecordUpdate, Seq: 1,
+		ExpiresAt: 42}, list.Get([]byte("foo"), math.MaxUint64))
 }
 
-func TestSkipList_UpdateNonExistentKey(t *testing.T) {
+func TestSkipList_MultipleInserts(t *testing.T) {
 	list := New(1)
 
+	list.insert([]byte("foo"), []byte("bar"), 1, storage.RecordUpdate, 0)
+
 	assert.Panics(t, func() {
-		list.update([]byte("foo"), []byte("bar"))
+		list.insert([]byte("foo"), []byte("bar"), 1, storage.RecordUpdate, 0)
 	})
 }
 
 func TestSkipList_InternalIterator(t *testing.T) {
 	list := New(1)
 
-	put(list, "howdy", "time")
-	put(list, "awww", "yeah")
+	put(list, "howdy", "time", 1)
+	put(list, "awww", "yeah", 2)
 
 	iter := list.InternalIterator()
 
-	assertNextRecordEquals(t, iter, "awww", "yeah", false)
-	assertNextRecordEquals(t, iter, "howdy", "time", false)
+	assertNextRecordEquals(t, iter, "awww", "yeah", 2, false)
+	assertNextRecordEquals(t, iter, "howdy", "time", 1, false)
 }
 
 func TestSkipList_Size(t *testing.T) {
 	list := New(1)
 
-	put(list, "howdy", "time")
-	put(list, "awww", "yeah")
+	put(list, "howdy", "time", 1)
+	put(list, "awww", "yeah", 2)
 
-	assert.Equal(t, list.Size(), uint32(17))
+	assert.Equal(t, list.Size(), uint32(33))
 }
 
 func assertSkipListValue(t *testing.T, list *SkipList, key string, value string) {
-	ok, actual := list.Get([]byte(key))
+	actual := list.Get([]byte(key), math.MaxUint64)
 
-	assert.True(t, ok)
-	assert.Equal(t, []byte(value), actual)
+	assert.NotNil(t, actual)
+	assert.Equal(t, storage.RecordUpdate, actual.Type)
+	assert.Equal(t, []byte(value), actual.Value)
 }
@@ -8,10 +8,21 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func put(list *SkipList, key string, value string) {
-	list.Put([]byte(key), []byte(value))
+func put(list *SkipList, key string, value string, seq uint64) {
+	list.Put([]byte(key), []byte(value), seq)
 }
 
-func assertNextRecordEquals(t *testing.T, i interfaces.InternalIterator, key string, value string, delete bool) {
-	assert.Equal(t, storage.NewRecord([]byte(key), []byte(value), delete), i.Next())
+func assertNextRecordEquals(t *testing.T, i interfaces.InternalIterator, key string, value string, seq uint64, delete bool) {
+	assert.Equal(t, record(key, value, seq, delete), i.Next())
+}
+
+func record(key string, value string, seq uint64, delete bool) *storage.Record {
+	var val []byte
+	if value != "" {
+		val = []byte(value)
+	}
+
+	rec := storage.NewRecord([]byte(key), val, delete)
+	rec.Seq = seq
+	return rec
 }
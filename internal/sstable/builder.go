@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/nbroyles/nbdb/internal/memtable/interfaces"
@@ -16,6 +17,7 @@ import (
 type Builder struct {
 	name           string
 	iter           interfaces.InternalIterator
+	rangeDeletes   []*storage.Record
 	codec          *storage.Codec
 	writer         io.Writer
 	indexPerRecord int
@@ -23,28 +25,51 @@ type Builder struct {
 }
 
 const (
-	// TODO: Make this configurable as option? Don't make configurable without removing assumtion in sstable.Search
-	// and sstable.Merger
-	// that this won't change -- will need to encode in the metadata
-	indexCount = 1000
-	sstPrefix  = "sstable"
-	footerLen  = 12
+	// DefaultIndexInterval is the number of records between each entry in an sstable's index unless configured
+	// otherwise. Readers find the index through the footer, so tables written with different intervals can be
+	// read side by side
+	DefaultIndexInterval = 1000
+	sstPrefix            = "sstable"
+	footerLen            = 28
 )
 
+// lastFileID is the suffix of the most recently named sstable
+var lastFileID int64
+
+// CreateFile creates a new, empty sstable file. Files are named so that ones created later sort after ones
+// created earlier, even when they're created at the same time by flushes and compactions running in parallel
 func CreateFile(dbName string, dataDir string) (*os.File, error) {
-	// TODO: needs a nonce to prevent potential collusions of really quickly created sstable files
-	return util.CreateFile(fmt.Sprintf("%s_%s_%d", sstPrefix, dbName, time.Now().UnixNano()/1_000_000_000),
-		dbName, dataDir)
+	return util.CreateFile(fmt.Sprintf("%s_%s_%d", sstPrefix, dbName, nextFileID()), dbName, dataDir)
 }
 
-func NewBuilder(name string, iter interfaces.InternalIterator, level int, writer io.Writer) *Builder {
-	return newBuilder(name, iter, level, writer, indexCount)
+// nextFileID returns the current time in nanoseconds, or one more than the last id handed out if that's later
+func nextFileID() int64 {
+	for {
+		last := atomic.LoadInt64(&lastFileID)
+		id := time.Now().UnixNano()
+		if id <= last {
+			id = last + 1
+		}
+
+		if atomic.CompareAndSwapInt64(&lastFileID, last, id) {
+			return id
+		}
+	}
 }
 
-func newBuilder(name string, iter interfaces.InternalIterator, level int, writer io.Writer, indexPerRecord int) *Builder {
+// NewBuilder returns a builder that writes the records from iter and the range deletes provided
+// to writer as a table at the level specified, with an index entry every indexPerRecord records.
+// An indexPerRecord of zero uses DefaultIndexInterval
+func NewBuilder(name string, iter interfaces.InternalIterator, rangeDeletes []*storage.Record, level int,
+	writer io.Writer, indexPerRecord int) *Builder {
+	if indexPerRecord <= 0 {
+		indexPerRecord = DefaultIndexInterval
+	}
+
 	return &Builder{
 		name:           name,
 		iter:           iter,
+		rangeDeletes:   rangeDeletes,
 		codec:          &storage.Codec{},
 		writer:         writer,
 		indexPerRecord: indexPerRecord,
@@ -57,17 +82,29 @@ func (s *Builder) WriteTable() (*Metadata, error) {
 	recWritten := 0
 	bytesWritten := uint32(0)
 
-	indices := make(map[string]storage.RecordPointer)
-	var order []string
+	var indices []*storage.RecordPointer
 
 	var firstKey []byte
 	var lastKey []byte
+	var minSeq, maxSeq uint64
+	deletes := uint64(0)
 
 	// Write actual key-values to disk
 	for ; s.iter.HasNext(); recWritten++ {
 		rec := s.iter.Next()
 		if firstKey == nil {
 			firstKey = rec.Key
+			minSeq = rec.Seq
+		}
+
+		if rec.Seq < minSeq {
+			minSeq = rec.Seq
+		}
+		if rec.Seq > maxSeq {
+			maxSeq = rec.Seq
+		}
+		if rec.Type == storage.RecordDelete {
+			deletes++
 		}
 
 		bytes, err := s.codec.Encode(rec)
@@ -81,8 +118,8 @@ func (s *Builder) WriteTable() (*Metadata, error) {
 
 		// Create index entry if reached threshold for number of written records
 		if recWritten%s.indexPerRecord == 0 {
-			indices[string(rec.Key)] = storage.RecordPointer{Key: rec.Key, StartByte: bytesWritten, Length: uint32(len(bytes))}
-			order = append(order, string(rec.Key))
+			// Several versions of a key may be written, so an index entry may share a key with its neighbors
+			indices = append(indices, &storage.RecordPointer{Key: rec.Key, StartByte: bytesWritten, Length: uint32(len(bytes))})
 		}
 
 		lastKey = rec.Key
@@ -92,9 +129,8 @@ func (s *Builder) WriteTable() (*Metadata, error) {
 	indexStart := bytesWritten
 	firstLen := 0
 	// Write index blocks in correct order
-	for _, key := range order {
-		ptr := indices[key]
-		bytes, err := s.codec.EncodePointer(&ptr)
+	for _, ptr := range indices {
+		bytes, err := s.codec.EncodePointer(ptr)
 		if err != nil {
 			return nil, fmt.Errorf("could not encode index pointer record: %w", err)
 		}
@@ -107,13 +143,21 @@ func (s *Builder) WriteTable() (*Metadata, error) {
 		if firstLen == 0 {
 			firstLen += len(bytes)
 		}
+		bytesWritten += uint32(len(bytes))
+	}
+
+	rangeDeleteStart := bytesWritten
+	if err := writeRangeDeletes(s.writer, s.codec, s.rangeDeletes); err != nil {
+		return nil, fmt.Errorf("failed attempting to write range deletes to level 0 sstable: %w", err)
 	}
 
 	// Write footer
 	bytes, err := s.codec.EncodeFooter(&storage.Footer{
-		IndexStartByte: indexStart,
-		Length:         uint32(firstLen),
-		IndexEntries:   uint32(len(indices)),
+		IndexStartByte:       indexStart,
+		Length:               uint32(firstLen),
+		IndexEntries:         uint32(len(indices)),
+		RangeDeleteStartByte: rangeDeleteStart,
+		RangeDeleteEntries:   uint32(len(s.rangeDeletes)),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("could not encode footer pointer record: %w", err)
@@ -123,10 +167,17 @@ func (s *Builder) WriteTable() (*Metadata, error) {
 		return nil, fmt.Errorf("failed attempting to write to level 0 sstable: %w", err)
 	}
 
-	return &Metadata{
+	meta := &Metadata{
 		Level:    uint8(s.level),
 		Filename: s.name,
 		StartKey: firstKey,
 		EndKey:   lastKey,
-	}, nil
+		MinSeq:   minSeq,
+		MaxSeq:   maxSeq,
+		Records:  uint64(recWritten),
+		Deletes:  deletes,
+	}
+	meta.includeRangeDeletes(s.rangeDeletes, recWritten > 0)
+
+	return meta, nil
 }
@@ -14,14 +14,15 @@ func TestSSTableBuilder_WriteLevel0Table(t *testing.T) {
 	buf := bytes.Buffer{}
 
 	mem := memtable.New()
-	mem.Put([]byte("foo"), []byte("bar"))
-	mem.Put([]byte("baz"), []byte("bax"))
+	mem.Put([]byte("foo"), []byte("bar"), 1)
+	mem.Put([]byte("baz"), []byte("bax"), 2)
 
-	builder := newBuilder("test", mem.InternalIterator(), 0, &buf, 1)
+	builder := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 1)
 
 	meta, err := builder.WriteTable()
 	assert.NoError(t, err)
-	assert.Equal(t, &Metadata{Level: 0, Filename: "test", StartKey: []byte("baz"), EndKey: []byte("foo")}, meta)
+	assert.Equal(t, &Metadata{Level: 0, Filename: "test", StartKey: []byte("baz"), EndKey: []byte("foo"),
+		MinSeq: 1, MaxSeq: 2, Records: 2}, meta)
 
 	// Expect buf to now have:
 	// - 2 record entries aka 2 records
@@ -45,10 +46,14 @@ func TestSSTableBuilder_WriteLevel0Table(t *testing.T) {
 	idx2 := decodePointer(t, codec, data, idx2Start, idx2Start+idx2Size)
 
 	rec1 := decodeRecord(t, codec, data, idx1.StartByte, idx1.StartByte+idx1.Length)
-	assert.Equal(t, rec1, storage.NewRecord([]byte("baz"), []byte("bax"), false))
+	expected := storage.NewRecord([]byte("baz"), []byte("bax"), false)
+	expected.Seq = 2
+	assert.Equal(t, expected, rec1)
 
 	rec2 := decodeRecord(t, codec, data, idx2.StartByte, idx2.StartByte+idx2.Length)
-	assert.Equal(t, rec2, storage.NewRecord([]byte("foo"), []byte("bar"), false))
+	expected = storage.NewRecord([]byte("foo"), []byte("bar"), false)
+	expected.Seq = 1
+	assert.Equal(t, expected, rec2)
 }
 
 func decodePointer(t *testing.T, codec *storage.Codec, b []byte, start uint32, stop uint32) *storage.RecordPointer {
@@ -0,0 +1,214 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/nbroyles/nbdb/internal/iterator"
+	"github.com/nbroyles/nbdb/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Iterator is a seekable iterator over the records in an sstable. Records are read a block at a
+// time, where a block is the set of records between two consecutive index entries. Since records
+// are only length-prefixed, holding the whole block in memory is what allows moving backward
+type Iterator struct {
+	readSeeker io.ReadSeeker
+	codec      storage.Codec
+	footer     *storage.Footer
+	indices    []*storage.RecordPointer
+	// rangeDeletes are not returned when iterating and must be applied separately
+	rangeDeletes []*storage.Record
+
+	block    []*storage.Record
+	blockIdx int
+	pos      int
+	err      error
+}
+
+var _ iterator.Iterator = &Iterator{}
+
+// NewIterator reads the footer and index of the sstable provided and returns an iterator over
+// its records. The iterator must be positioned with one of the Seek methods before use
+func NewIterator(readSeeker io.ReadSeeker) (*Iterator, error) {
+	it := &Iterator{readSeeker: readSeeker, codec: storage.Codec{}}
+
+	// Seek to footer start
+	if _, err := readSeeker.Seek(-footerLen, io.SeekEnd); err != nil {
+		return nil, storage.Corruptf("could not seek to footer in sstable: %v", err)
+	}
+
+	footer, err := it.codec.DecodeFooter(readSeeker)
+	if errors.Is(err, storage.ErrIncompatibleFormat) {
+		return nil, err
+	} else if err != nil {
+		return nil, storage.Corruptf("failed to decode footer from sstable. %v", err)
+	}
+	it.footer = footer
+
+	// Seek to index start
+	if _, err := readSeeker.Seek(int64(footer.IndexStartByte), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("could not seek to index portion of sstable: %w", err)
+	}
+
+	for i := 0; i < int(footer.IndexEntries); i++ {
+		ptr, err := it.codec.DecodePointer(readSeeker)
+		if err != nil {
+			return nil, storage.Corruptf("failed to decode index from sstable. %v", err)
+		}
+		it.indices = append(it.indices, ptr)
+	}
+
+	if footer.RangeDeleteEntries > 0 {
+		if _, err := readSeeker.Seek(int64(footer.RangeDeleteStartByte), io.SeekStart); err != nil {
+			return nil, fmt.Errorf("could not seek to range delete portion of sstable: %w", err)
+		}
+
+		for i := 0; i < int(footer.RangeDeleteEntries); i++ {
+			rd, err := it.codec.DecodeFromReader(readSeeker)
+			if err != nil {
+				return nil, storage.Corruptf("failed to decode range delete from sstable. %v", err)
+			}
+			it.rangeDeletes = append(it.rangeDeletes, rd)
+		}
+	}
+
+	return it, nil
+}
+
+// IndexKeys returns the key at the start of each block of the sstable, in order
+func (it *Iterator) IndexKeys() [][]byte {
+	keys := make([][]byte, len(it.indices))
+	for i, ptr := range it.indices {
+		keys[i] = ptr.Key
+	}
+
+	return keys
+}
+
+// RangeDeletes returns every range delete in the sstable
+func (it *Iterator) RangeDeletes() []*storage.Record {
+	return it.rangeDeletes
+}
+
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.block != nil && it.pos < len(it.block)
+}
+
+func (it *Iterator) SeekToFirst() {
+	it.loadBlock(0)
+}
+
+func (it *Iterator) SeekToLast() {
+	it.loadBlock(len(it.indices) - 1)
+	if it.block != nil {
+		it.pos = len(it.block) - 1
+	}
+}
+
+func (it *Iterator) Seek(key []byte) {
+	// Find the last block that starts with a key less than the key we're seeking. Any block after
+	// that can only contain keys greater than or equal to key
+	blockIdx := sort.Search(len(it.indices), func(i int) bool {
+		return bytes.Compare(it.indices[i].Key, key) >= 0
+	}) - 1
+	if blockIdx < 0 {
+		blockIdx = 0
+	}
+
+	for it.loadBlock(blockIdx); it.Valid(); it.loadBlock(it.blockIdx + 1) {
+		it.pos = sort.Search(len(it.block), func(i int) bool {
+			return bytes.Compare(it.block[i].Key, key) >= 0
+		})
+
+		if it.pos < len(it.block) {
+			return
+		}
+	}
+}
+
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		log.Panic("iterator is not positioned at a record")
+	}
+
+	it.pos++
+	if it.pos >= len(it.block) {
+		it.loadBlock(it.blockIdx + 1)
+	}
+}
+
+func (it *Iterator) Prev() {
+	if !it.Valid() {
+		log.Panic("iterator is not positioned at a record")
+	}
+
+	it.pos--
+	if it.pos < 0 {
+		it.loadBlock(it.blockIdx - 1)
+		if it.block != nil {
+			it.pos = len(it.block) - 1
+		}
+	}
+}
+
+func (it *Iterator) Record() *storage.Record {
+	return it.block[it.pos]
+}
+
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// Close closes the underlying reader if it is closeable
+func (it *Iterator) Close() error {
+	if closer, ok := it.readSeeker.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// loadBlock reads every record in the block at blockIdx into memory and positions the iterator at
+// the start of the block. If blockIdx is out of range, the iterator is invalidated
+func (it *Iterator) loadBlock(blockIdx int) {
+	it.block = nil
+	it.blockIdx = blockIdx
+	it.pos = 0
+
+	if it.err != nil || blockIdx < 0 || blockIdx >= len(it.indices) {
+		return
+	}
+
+	start := it.indices[blockIdx].StartByte
+	end := it.footer.IndexStartByte
+	if blockIdx+1 < len(it.indices) {
+		end = it.indices[blockIdx+1].StartByte
+	}
+
+	if _, err := it.readSeeker.Seek(int64(start), io.SeekStart); err != nil {
+		it.err = fmt.Errorf("could not seek to key-value portion of sstable: %w", err)
+		return
+	}
+
+	data := make([]byte, end-start)
+	if _, err := io.ReadFull(it.readSeeker, data); err != nil {
+		it.err = storage.Corruptf("failed reading block from sstable: %v", err)
+		return
+	}
+
+	reader := bytes.NewReader(data)
+	block := make([]*storage.Record, 0)
+	for reader.Len() > 0 {
+		record, err := it.codec.DecodeFromReader(reader)
+		if err != nil {
+			it.err = storage.Corruptf("failed decoding record in sstable: %v", err)
+			return
+		}
+		block = append(block, record)
+	}
+
+	it.block = block
+}
@@ -0,0 +1,175 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/nbroyles/nbdb/internal/memtable"
+	"github.com/nbroyles/nbdb/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterator_SeekToFirst(t *testing.T) {
+	mem := memtable.New()
+	mem.Put([]byte("foo"), []byte("bar"), 1)
+	mem.Put([]byte("baz"), []byte("bax"), 2)
+	mem.Put([]byte("howdy"), []byte("time"), 3)
+	mem.Delete([]byte("howdy"), 4)
+
+	iter := newTestIterator(t, mem, 2)
+	iter.SeekToFirst()
+
+	assertIteratorRecord(t, iter, "baz", "bax", false)
+	iter.Next()
+	assertIteratorRecord(t, iter, "foo", "bar", false)
+	iter.Next()
+	assertIteratorRecord(t, iter, "howdy", "", true)
+	iter.Next()
+	assertIteratorRecord(t, iter, "howdy", "time", false)
+	iter.Next()
+	assert.False(t, iter.Valid())
+	assert.NoError(t, iter.Error())
+}
+
+func TestIterator_Seek(t *testing.T) {
+	mem := memtable.New()
+	for i := 0; i < 50; i++ {
+		mem.Put([]byte(fmt.Sprintf("key%03d", i*2)), []byte(fmt.Sprintf("val%03d", i*2)), uint64(i+1))
+	}
+
+	// Index every 3 records to exercise seeking across blocks
+	iter := newTestIterator(t, mem, 3)
+
+	iter.Seek([]byte("key000"))
+	assertIteratorRecord(t, iter, "key000", "val000", false)
+
+	iter.Seek([]byte("key041"))
+	assertIteratorRecord(t, iter, "key042", "val042", false)
+
+	iter.Seek([]byte("key042"))
+	assertIteratorRecord(t, iter, "key042", "val042", false)
+
+	// Iterate across block boundaries
+	for i := 42; i < 100; i += 2 {
+		assertIteratorRecord(t, iter, fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i), false)
+		iter.Next()
+	}
+	assert.False(t, iter.Valid())
+
+	iter.Seek([]byte("a"))
+	assertIteratorRecord(t, iter, "key000", "val000", false)
+
+	iter.Seek([]byte("zzz"))
+	assert.False(t, iter.Valid())
+}
+
+func TestIterator_Reverse(t *testing.T) {
+	mem := memtable.New()
+	for i := 0; i < 10; i++ {
+		mem.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)), uint64(i+1))
+	}
+
+	iter := newTestIterator(t, mem, 3)
+
+	iter.SeekToLast()
+	for i := 9; i >= 0; i-- {
+		assertIteratorRecord(t, iter, fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i), false)
+		iter.Prev()
+	}
+	assert.False(t, iter.Valid())
+
+	// Move back across a block boundary and then forward again
+	iter.Seek([]byte("key6"))
+	iter.Prev()
+	assertIteratorRecord(t, iter, "key5", "val5", false)
+	iter.Prev()
+	assertIteratorRecord(t, iter, "key4", "val4", false)
+	iter.Next()
+	iter.Next()
+	assertIteratorRecord(t, iter, "key6", "val6", false)
+}
+
+func TestIterator_EmptyTable(t *testing.T) {
+	iter := newTestIterator(t, memtable.New(), 3)
+
+	iter.SeekToFirst()
+	assert.False(t, iter.Valid())
+
+	iter.SeekToLast()
+	assert.False(t, iter.Valid())
+
+	iter.Seek([]byte("foo"))
+	assert.False(t, iter.Valid())
+	assert.NoError(t, iter.Error())
+}
+
+func TestIterator_IncompatibleFormat(t *testing.T) {
+	mem := memtable.New()
+	mem.Put([]byte("foo"), []byte("bar"), 1)
+
+	buf := bytes.Buffer{}
+	_, err := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 1).WriteTable()
+	assert.NoError(t, err)
+	data := buf.Bytes()
+
+	// A table written in a newer format version can't be read
+	binary.BigEndian.PutUint32(data[len(data)-4:], storage.FormatVersion+1)
+	_, err = NewIterator(bytes.NewReader(data))
+	assert.True(t, errors.Is(err, storage.ErrIncompatibleFormat))
+
+	// Nor can one written before formats were versioned, which has no format version at the end of its footer
+	_, err = NewIterator(bytes.NewReader(data[:len(data)-storage.HeaderLen]))
+	assert.True(t, errors.Is(err, storage.ErrIncompatibleFormat))
+}
+
+func TestIterator_Corruption(t *testing.T) {
+	mem := memtable.New()
+	mem.Put([]byte("foo"), []byte("bar"), 1)
+	mem.Put([]byte("baz"), []byte("bax"), 2)
+
+	buf := bytes.Buffer{}
+	_, err := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 1).WriteTable()
+	assert.NoError(t, err)
+	data := buf.Bytes()
+
+	// Too short to even hold a footer
+	_, err = NewIterator(bytes.NewReader(data[:footerLen-1]))
+	assert.True(t, errors.Is(err, storage.ErrCorruption))
+
+	// A flipped bit in a record is caught by its checksum
+	data[10] ^= 0xFF
+	iter, err := NewIterator(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	iter.SeekToFirst()
+	assert.False(t, iter.Valid())
+	assert.True(t, errors.Is(iter.Error(), storage.ErrCorruption))
+}
+
+func newTestIterator(t *testing.T, mem *memtable.MemTable, indexPerRecord int) *Iterator {
+	buf := bytes.Buffer{}
+	_, err := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, indexPerRecord).WriteTable()
+	assert.NoError(t, err)
+
+	iter, err := NewIterator(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+
+	return iter
+}
+
+func assertIteratorRecord(t *testing.T, iter *Iterator, key string, value string, deleted bool) {
+	assert.True(t, iter.Valid())
+	if !iter.Valid() {
+		return
+	}
+
+	assert.Equal(t, []byte(key), iter.Record().Key)
+	if deleted {
+		assert.Nil(t, iter.Record().Value)
+	} else {
+		assert.Equal(t, []byte(value), iter.Record().Value)
+	}
+}
@@ -7,7 +7,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"time"
 
+	"github.com/nbroyles/nbdb/internal/iterator"
 	"github.com/nbroyles/nbdb/internal/storage"
 	log "github.com/sirupsen/logrus"
 )
@@ -16,228 +19,436 @@ type Merger struct {
 	level          int
 	nextLevel      int
 	srcMetadata    []*Metadata
+	snapshots      []uint64
+	mergeOperator  storage.MergeOperator
+	opts           TableOpts
 	dataDir        string
 	dbName         string
 	codec          storage.Codec
 	done           bool
 	mergedMetadata []*Metadata
+
+	// prevKey and prevStripe track the last record kept so that versions hidden from every
+	// snapshot can be dropped, even when the versions of a key span more than one output file
+	prevKey    []byte
+	prevStripe int
+
+	// rangeDeletes holds the range deletes from every source table. Each output file gets the part of
+	// every range delete that falls between lowerBound and the first key of the next output file
+	rangeDeletes []*storage.Record
+	lowerBound   []byte
+
+	// now is the time the merge started. Updates that expired before it are removed
+	now int64
+
+	// bottommost is set if no level below nextLevel holds keys the merged tables do
+	bottommost bool
+
+	// start and end, if set, limit the merge to the keys from start (inclusive) to end (exclusive)
+	start []byte
+	end   []byte
 }
 
 const (
-	maxFileSize = 2_000_000
+	// DefaultMaxFileSize is the size in bytes after which the merger starts writing a new sstable unless
+	// configured otherwise
+	DefaultMaxFileSize = 2_000_000
 )
 
-// Merger expects to receive srcMetadata in order of most recently created to least recently created in order
-// to ensure duplicate updates are properly handled
-func NewMerger(level int, nextLevel int, srcMetadata []*Metadata, dataDir string, dbName string) *Merger {
+// TableOpts configures the sstables written by a Merger. Zero values use the defaults
+type TableOpts struct {
+	// IndexInterval is the number of records between each entry in an sstable's index
+	IndexInterval int
+	// MaxFileSize is the size in bytes after which the merger starts writing a new sstable
+	MaxFileSize int
+}
+
+func (o *TableOpts) applyDefaults() {
+	if o.IndexInterval <= 0 {
+		o.IndexInterval = DefaultIndexInterval
+	}
+
+	if o.MaxFileSize <= 0 {
+		o.MaxFileSize = DefaultMaxFileSize
+	}
+}
+
+// Merger expects to receive srcMetadata, all from the same column family, in order of most recently created to
+// least recently created. Records are ordered by sequence number, but this ordering acts as a tiebreaker for
+// tables written without them.
+// snapshots are the sequence numbers of every live snapshot in ascending order. The newest version of a key
+// visible to each snapshot is preserved; every other version hidden by a newer one is dropped. mergeOperator, if
+// not nil, is used to collapse merge operands into the value they apply to
+func NewMerger(level int, nextLevel int, srcMetadata []*Metadata, snapshots []uint64,
+	mergeOperator storage.MergeOperator, opts TableOpts, dataDir string, dbName string) *Merger {
+	opts.applyDefaults()
+
 	return &Merger{
 		level:          level,
 		nextLevel:      nextLevel,
 		srcMetadata:    srcMetadata,
+		snapshots:      snapshots,
+		mergeOperator:  mergeOperator,
+		opts:           opts,
 		dataDir:        dataDir,
 		dbName:         dbName,
 		codec:          storage.Codec{},
 		done:           false,
 		mergedMetadata: nil,
+		prevStripe:     -1,
 	}
 }
 
+// SetBottommost tells the merger whether any level below the one it's merging into holds keys that the tables
+// being merged do. If none do, deletes that every snapshot can see have nothing left to hide and are dropped
+func (m *Merger) SetBottommost(bottommost bool) {
+	m.bottommost = bottommost
+}
+
+// SetBounds limits the merge to the keys from start (inclusive) to end (exclusive) so that a large merge can be
+// split into shards that run in parallel. A nil bound leaves that side unbounded. Range deletes are cut at the
+// bounds, so the tables written by the shards of a merge never overlap
+func (m *Merger) SetBounds(start []byte, end []byte) {
+	m.start = start
+	m.end = end
+}
+
 func (m *Merger) Merge() ([]*Metadata, error) {
 	if m.done {
 		log.Infof("already ran merger. skipping. level=%d, nextLevel=%d", m.level, m.nextLevel)
 		return m.mergedMetadata, nil
 	}
 
+	m.now = time.Now().UnixNano()
+
 	// open all files for reading
-	var files []io.ReadSeeker
+	var children []iterator.Iterator
 	for _, me := range m.srcMetadata {
 		handle, err := os.Open(path.Join(m.dataDir, m.dbName, me.Filename))
 		if err != nil {
+			closeAll(children)
 			return nil, fmt.Errorf("could not open file %s for compaction: %w", me.Filename, err)
 		}
 
-		files = append(files, handle)
-	}
-
-	// pointers to current key in each file
-	current := make([]*storage.Record, len(files))
-	stopByte := make([]uint32, len(files))
-
-	for i, handle := range files {
-		_, err := handle.Seek(-footerLen, io.SeekEnd)
+		it, err := NewIterator(handle)
 		if err != nil {
-			return nil, fmt.Errorf("could not seek to footer in sstable: %w", err)
+			handle.Close()
+			closeAll(children)
+			return nil, fmt.Errorf("could not read sstable %s for compaction: %w", me.Filename, err)
 		}
 
-		footer, err := m.codec.DecodeFooter(handle)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode footer from sstable. %w", err)
-		}
+		children = append(children, it)
+		m.rangeDeletes = append(m.rangeDeletes, it.RangeDeletes()...)
+	}
 
-		stopByte[i] = footer.IndexStartByte
+	sort.Slice(m.rangeDeletes, func(i, j int) bool {
+		return storage.Compare(m.rangeDeletes[i], m.rangeDeletes[j]) < 0
+	})
 
-		_, err = handle.Seek(0, io.SeekStart)
-		if err != nil {
-			return nil, fmt.Errorf("could not seek to beginning in sstable: %w", err)
-		}
+	iter := iterator.NewMergingIterator(children)
+	defer iter.Close()
 
-		current[i], err = m.readNext(handle, stopByte[i])
-		if err != nil {
-			return nil, fmt.Errorf("failed attempting to read next record in sstable: %w", err)
-		}
+	if m.start != nil {
+		iter.Seek(m.start)
+	} else {
+		iter.SeekToFirst()
 	}
+	m.lowerBound = m.start
 
-	// Merge into files at the new level until data exhausted
+	// Merge into files at the new level until data exhausted. This happens at least once so that
+	// range deletes are carried over even if there are no records left
 	for {
-		meta, finished, err := m.mergeToFile(files, current, stopByte)
+		meta, err := m.mergeToFile(iter)
 		if err != nil {
 			return nil, fmt.Errorf("failed attempting to merge files: %v %w", m, err)
 		}
 
-		log.Debugf("results of mergeToFile: meta=%v meta.startKey=%s meta.endKey=%s finished=%v",
-			meta, string(meta.StartKey), string(meta.EndKey), finished)
+		if meta != nil {
+			log.Debugf("results of mergeToFile: meta=%v meta.startKey=%s meta.endKey=%s",
+				meta, string(meta.StartKey), string(meta.EndKey))
 
-		m.mergedMetadata = append(m.mergedMetadata, meta)
+			m.mergedMetadata = append(m.mergedMetadata, meta)
+		}
 
-		if finished {
+		if !m.valid(iter) {
 			break
 		}
 	}
 
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed reading sstables for compaction: %w", err)
+	}
+
 	m.done = true
 
 	return m.mergedMetadata, nil
 }
 
 // mergeToFile takes the source data and merges as much data as it can until it's either exhausted the source
-// material or hit a limit on output size. Return values are the metadata for the file created, a boolean indicating if
-// there's more merge work to be done, and an error value. Method should be called until boolean indicating more work is false
-func (m *Merger) mergeToFile(files []io.ReadSeeker, current []*storage.Record, stopByte []uint32) (*Metadata, bool, error) {
+// material or hit a limit on output size. Output files are only ever split between keys so that every version of
+// a key lives in the same file. Range deletes are cut at the split points so that files in the same level never
+// overlap. Return values are the metadata for the file created, or nil if there was nothing left to write, and an
+// error value. Method should be called until the iterator is exhausted
+func (m *Merger) mergeToFile(iter iterator.Iterator) (*Metadata, error) {
 	out, err := CreateFile(m.dbName, m.dataDir)
 	if err != nil {
-		return nil, false, fmt.Errorf("failed attempt to create new sstable file: %w", err)
+		return nil, fmt.Errorf("failed attempt to create new sstable file: %w", err)
 	}
 	defer out.Close()
 
 	bytesWritten := 0
 	recWritten := 0
 
-	indices := make(map[string]*storage.RecordPointer)
-	var order []string
+	var indices []*storage.RecordPointer
 
 	var startKey []byte
 	var endKey []byte
-	var prevKey []byte
-	for {
-		// select the next key to right from current head of each sstable
-		var currRecord *storage.Record
-		var currIdx int
-		for i, rec := range current {
-			// skip this key because we've accounted for a newer version of it
-			for ; rec != nil && bytes.Equal(rec.Key, prevKey); rec = current[i] {
-				log.Debugf("skipping key=%s since newer update found", string(rec.Key))
-				current[i], err = m.readNext(files[i], stopByte[i])
-				if err != nil {
-					return nil, false, fmt.Errorf("failed attempting to read next record in sstable: %w", err)
-				}
-			}
+	var minSeq, maxSeq uint64
+	deletes := uint64(0)
+	for m.valid(iter) {
+		currRecord := iter.Record()
 
-			if rec == nil {
+		// This file has reached its max size. Stop once every version of the last key written is in it
+		if bytesWritten > m.opts.MaxFileSize && !bytes.Equal(currRecord.Key, endKey) {
+			break
+		}
+
+		if !m.shouldKeep(currRecord) {
+			log.Debugf("skipping key=%s seq=%d since newer update found", string(currRecord.Key), currRecord.Seq)
+			iter.Next()
+			continue
+		}
+
+		records, err := m.collapseMerges(iter)
+		if err != nil {
+			return nil, fmt.Errorf("failed merging operands for key %s: %w", string(currRecord.Key), err)
+		}
+
+		for _, record := range records {
+			if m.obsoleteDelete(record) {
 				continue
-			} else if currRecord == nil {
-				currRecord = rec
-				currIdx = i
-			} else if bytes.Compare(rec.Key, currRecord.Key) < 0 {
-				currRecord = rec
-				currIdx = i
 			}
-		}
 
-		if shouldStop(current) {
-			if recWritten > 0 {
-				if err = m.writeFooter(out, bytesWritten, indices, order); err != nil {
-					return nil, false, fmt.Errorf("failed attempting to write footer information for sstable: %w", err)
-				}
+			log.Debugf("next record to be written: key=%s value=%s seq=%d", string(record.Key),
+				string(record.Value), record.Seq)
+
+			if startKey == nil {
+				startKey = record.Key
+				minSeq = record.Seq
+			}
+
+			// Write out current next value to be written
+			data, err := m.codec.Encode(record)
+			if err != nil {
+				return nil, fmt.Errorf("could not encode record: %w", err)
+			}
+
+			if err := write(out, data); err != nil {
+				return nil, fmt.Errorf("failure writing next entry into sstable: %w", err)
+			}
+
+			// Create index entry if reached threshold for number of written records
+			if recWritten%m.opts.IndexInterval == 0 {
+				indices = append(indices, &storage.RecordPointer{
+					Key:       record.Key,
+					StartByte: uint32(bytesWritten),
+					Length:    uint32(len(data)),
+				})
 			}
-			break
-		}
 
-		log.Debugf("next record to be written from current[%d]: key=%s value=%s", currIdx, string(currRecord.Key),
-			string(currRecord.Value))
+			bytesWritten += len(data)
+			recWritten++
 
-		// We should always have a key if we're not done, so panic
-		if currRecord == nil {
-			log.Panicf("next record to write is nil when it shouldn't be: current=%v", current)
+			endKey = record.Key
+			if record.Seq < minSeq {
+				minSeq = record.Seq
+			}
+			if record.Seq > maxSeq {
+				maxSeq = record.Seq
+			}
+			if record.Type == storage.RecordDelete {
+				deletes++
+			}
 		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed attempting to read next record in sstable: %w", err)
+	}
+
+	// The next file starts at the next key, if there is one. Otherwise this file runs to the end of the merge
+	upperBound := m.end
+	if m.valid(iter) {
+		upperBound = iter.Record().Key
+	}
+	rangeDeletes := m.truncateRangeDeletes(m.lowerBound, upperBound)
+	m.lowerBound = upperBound
 
-		if startKey == nil {
-			startKey = currRecord.Key
+	if recWritten == 0 && len(rangeDeletes) == 0 {
+		out.Close()
+		if err := os.Remove(out.Name()); err != nil {
+			return nil, fmt.Errorf("failed removing empty sstable %s: %w", out.Name(), err)
 		}
+		return nil, nil
+	}
 
-		// Write out current next value to be written
-		data, err := m.codec.Encode(currRecord)
-		if err != nil {
-			return nil, false, fmt.Errorf("could not encode record: %w", err)
+	if err = m.writeFooter(out, bytesWritten, indices, rangeDeletes); err != nil {
+		return nil, fmt.Errorf("failed attempting to write footer information for sstable: %w", err)
+	}
+
+	// Compaction removes its inputs once this replaces them, so it has to be on disk first
+	if err = out.Sync(); err != nil {
+		return nil, fmt.Errorf("failed syncing sstable %s: %w", out.Name(), err)
+	}
+
+	newMeta := Metadata{
+		ColumnFamily: m.srcMetadata[0].ColumnFamily,
+		Level:        uint8(m.nextLevel),
+		Filename:     filepath.Base(out.Name()),
+		StartKey:     startKey,
+		EndKey:       endKey,
+		MinSeq:       minSeq,
+		MaxSeq:       maxSeq,
+		Records:      uint64(recWritten),
+		Deletes:      deletes,
+	}
+	newMeta.includeRangeDeletes(rangeDeletes, recWritten > 0)
+
+	return &newMeta, nil
+}
+
+// valid returns true if iter is positioned at a record within the bounds of the merge
+func (m *Merger) valid(iter iterator.Iterator) bool {
+	return iter.Valid() && (m.end == nil || bytes.Compare(iter.Record().Key, m.end) < 0)
+}
+
+// shouldKeep returns true if record is the newest version of its key visible to some snapshot. Records must
+// be provided in order. Sequence numbers are divided into stripes by the live snapshots; only the first version
+// of a key seen in each stripe can be read by anyone, and only if no range delete in the same stripe hides it
+func (m *Merger) shouldKeep(record *storage.Record) bool {
+	stripe := m.stripe(record.Seq)
+
+	if bytes.Equal(record.Key, m.prevKey) && stripe == m.prevStripe {
+		return false
+	}
+
+	m.prevKey = record.Key
+	m.prevStripe = stripe
+
+	return !m.rangeDeleted(record, stripe)
+}
+
+// obsoleteDelete returns true if record is a delete that can be dropped since every snapshot can see it and
+// there's nothing left below for it to hide
+func (m *Merger) obsoleteDelete(record *storage.Record) bool {
+	deleted := record.Type == storage.RecordDelete || record.Type == storage.RecordRangeDelete
+	return m.bottommost && deleted && m.stripe(record.Seq) == 0
+}
+
+// collapseMerges consumes the record iter is positioned at and returns the records to write in its place,
+// leaving iter positioned at the next record. Most records are returned as is, except that expired updates
+// are replaced by deletes so that they keep hiding older versions of their key in lower levels. A merge
+// operand, though, is consumed along with the older versions of its key in the same stripe until the value
+// it applies to is found, at which point they're combined into a single update. If there's no merge operator,
+// the value isn't found before the key or stripe changes or the value has yet to expire, the operands are all
+// returned so they can be combined later
+func (m *Merger) collapseMerges(iter iterator.Iterator) ([]*storage.Record, error) {
+	first := iter.Record()
+	iter.Next()
+	if first.Expired(m.now) {
+		return []*storage.Record{{Key: first.Key, Type: storage.RecordDelete, Seq: first.Seq}}, nil
+	} else if first.Type != storage.RecordMerge {
+		return []*storage.Record{first}, nil
+	}
+
+	stripe := m.stripe(first.Seq)
+	records := []*storage.Record{first}
+	operands := [][]byte{first.Value}
+	for ; iter.Valid(); iter.Next() {
+		record := iter.Record()
+		if !bytes.Equal(record.Key, first.Key) || m.stripe(record.Seq) != stripe {
+			break
 		}
 
-		if err := write(out, data); err != nil {
-			return nil, false, fmt.Errorf("failure writing next entry into sstable: %w", err)
+		rangeDeleted := m.rangeDeleted(record, stripe)
+		if record.Type == storage.RecordMerge && !rangeDeleted {
+			records = append(records, record)
+			operands = append(operands, record.Value)
+			continue
 		}
 
-		// Create index entry if reached threshold for number of written records
-		if recWritten%indexCount == 0 {
-			indices[string(currRecord.Key)] = &storage.RecordPointer{
-				Key:       currRecord.Key,
-				StartByte: uint32(bytesWritten),
-				Length:    uint32(len(data)),
+		// Found the value the operands apply to. Every version after it in this stripe is hidden
+		iter.Next()
+		deleted := rangeDeleted || record.Type == storage.RecordDelete || record.Expired(m.now)
+		if m.mergeOperator == nil || (!deleted && record.ExpiresAt != 0) {
+			if !rangeDeleted {
+				records = append(records, record)
 			}
-			order = append(order, string(currRecord.Key))
+			return records, nil
 		}
 
-		bytesWritten += len(data)
-		recWritten++
-
-		prevKey = currRecord.Key
-		endKey = currRecord.Key
-
-		// Advance to the next record
-		current[currIdx], err = m.readNext(files[currIdx], stopByte[currIdx])
-
-		if current[currIdx] == nil {
-			log.Debugf("updating current pointers. current[%d]=nil", currIdx)
-		} else {
-			log.Debugf("updating current pointers. current[%d]=%s", currIdx, string(current[currIdx].Key))
+		var existing []byte
+		if !deleted {
+			existing = record.Value
 		}
 
+		value, err := storage.FullMerge(m.mergeOperator, first.Key, existing, operands)
 		if err != nil {
-			return nil, false, fmt.Errorf("failed attempting to read next record in sstable: %w", err)
+			return nil, err
 		}
+		return []*storage.Record{{Key: first.Key, Value: value, Type: storage.RecordUpdate, Seq: first.Seq}}, nil
+	}
 
-		// This file has reached its max size. Let's write out the index and footer information and create a new one
-		if bytesWritten > maxFileSize {
-			if err = m.writeFooter(out, bytesWritten, indices, order); err != nil {
-				return nil, false, fmt.Errorf("failed attempting to write footer information for sstable: %w", err)
-			}
-			break
+	return records, nil
+}
+
+// rangeDeleted returns true if record is hidden by a range delete in stripe
+func (m *Merger) rangeDeleted(record *storage.Record, stripe int) bool {
+	for _, rd := range m.rangeDeletes {
+		if rd.Deletes(record.Key, record.Seq) && m.stripe(rd.Seq) == stripe {
+			return true
 		}
 	}
 
-	newMeta := Metadata{
-		Level:    uint8(m.nextLevel),
-		Filename: filepath.Base(out.Name()),
-		StartKey: startKey,
-		EndKey:   endKey,
+	return false
+}
+
+// stripe returns the index of the oldest snapshot that can see seq or the number of snapshots if none can
+func (m *Merger) stripe(seq uint64) int {
+	return sort.Search(len(m.snapshots), func(i int) bool {
+		return m.snapshots[i] >= seq
+	})
+}
+
+// truncateRangeDeletes returns the parts of the range deletes being merged that fall between lower (inclusive)
+// and upper (exclusive). A nil bound leaves that side of the range unbounded
+func (m *Merger) truncateRangeDeletes(lower []byte, upper []byte) []*storage.Record {
+	var truncated []*storage.Record
+	for _, rd := range m.rangeDeletes {
+		start, end := rd.Key, rd.Value
+		if lower != nil && bytes.Compare(start, lower) < 0 {
+			start = lower
+		}
+		if upper != nil && bytes.Compare(end, upper) > 0 {
+			end = upper
+		}
+
+		if bytes.Compare(start, end) < 0 && !m.obsoleteDelete(rd) {
+			t := storage.NewRangeDelete(start, end)
+			t.Seq = rd.Seq
+			truncated = append(truncated, t)
+		}
 	}
 
-	return &newMeta, shouldStop(current), nil
+	return truncated
 }
 
-func (m *Merger) writeFooter(out io.Writer, bytesWritten int, indices map[string]*storage.RecordPointer, order []string) error {
+func (m *Merger) writeFooter(out io.Writer, bytesWritten int, indices []*storage.RecordPointer,
+	rangeDeletes []*storage.Record) error {
 	indexStart := bytesWritten
 	firstLen := 0
 	// Write index blocks in correct order
-	for _, key := range order {
-		ptr := indices[key]
+	for _, ptr := range indices {
 		data, err := m.codec.EncodePointer(ptr)
 		if err != nil {
 			return fmt.Errorf("could not encode index pointer record: %w", err)
@@ -253,13 +464,21 @@ func (m *Merger) writeFooter(out io.Writer, bytesWritten int, indices map[string
 		if firstLen == 0 {
 			firstLen += len(data)
 		}
+		bytesWritten += len(data)
+	}
+
+	rangeDeleteStart := bytesWritten
+	if err := writeRangeDeletes(out, &m.codec, rangeDeletes); err != nil {
+		return fmt.Errorf("failed attempting to write range deletes to sstable: %w", err)
 	}
 
 	// Write footer
 	data, err := m.codec.EncodeFooter(&storage.Footer{
-		IndexStartByte: uint32(indexStart),
-		Length:         uint32(firstLen),
-		IndexEntries:   uint32(len(indices)),
+		IndexStartByte:       uint32(indexStart),
+		Length:               uint32(firstLen),
+		IndexEntries:         uint32(len(indices)),
+		RangeDeleteStartByte: uint32(rangeDeleteStart),
+		RangeDeleteEntries:   uint32(len(rangeDeletes)),
 	})
 	if err != nil {
 		return fmt.Errorf("could not encode footer pointer record: %w", err)
@@ -272,28 +491,49 @@ func (m *Merger) writeFooter(out io.Writer, bytesWritten int, indices map[string
 	return nil
 }
 
-// readNext reads next entry from the handle provided. Returns the record for the entry or nil if no next record
-func (m *Merger) readNext(handle io.ReadSeeker, stopByte uint32) (*storage.Record, error) {
-	curPos, err := handle.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return nil, fmt.Errorf("failure getting current position in file: %w", err)
-	} else if curPos == int64(stopByte) {
+// SplitKeys returns up to shards - 1 keys that divide the records in srcMetadata into shards of roughly equal
+// size, in ascending order. They're chosen from the keys in the tables' indexes, which start a new block every
+// so many records, so fewer are returned if the tables don't have enough distinct index keys
+func SplitKeys(srcMetadata []*Metadata, shards int, dataDir string, dbName string) ([][]byte, error) {
+	var keys [][]byte
+	for _, me := range srcMetadata {
+		handle, err := os.Open(path.Join(dataDir, dbName, me.Filename))
+		if err != nil {
+			return nil, fmt.Errorf("could not open file %s to split compaction: %w", me.Filename, err)
+		}
+
+		it, err := NewIterator(handle)
+		handle.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read sstable %s to split compaction: %w", me.Filename, err)
+		}
+		keys = append(keys, it.IndexKeys()...)
+	}
+
+	if len(keys) == 0 {
 		return nil, nil
 	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
 
-	record, err := m.codec.DecodeFromReader(handle)
-	if err != nil {
-		return nil, fmt.Errorf("could not decode record in sstable for merge process: %w", err)
+	// The smallest key can't split anything off, so it's never chosen
+	var splits [][]byte
+	for i := 1; i < shards; i++ {
+		key := keys[i*len(keys)/shards]
+		if bytes.Equal(key, keys[0]) || (len(splits) > 0 && bytes.Equal(key, splits[len(splits)-1])) {
+			continue
+		}
+		splits = append(splits, key)
 	}
 
-	return record, nil
+	return splits, nil
 }
 
-func shouldStop(current []*storage.Record) bool {
-	for _, val := range current {
-		if val != nil {
-			return false
+func closeAll(iters []iterator.Iterator) {
+	for _, it := range iters {
+		if err := it.Close(); err != nil {
+			log.Warnf("failed closing sstable after compaction: %v", err)
 		}
 	}
-	return true
 }
@@ -1,13 +1,17 @@
 package sstable
 
 import (
+	"fmt"
+	"os"
 	"path"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/nbroyles/nbdb/internal/test"
 
 	"github.com/nbroyles/nbdb/internal/memtable"
+	"github.com/nbroyles/nbdb/internal/storage"
 	"github.com/nbroyles/nbdb/internal/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -19,34 +23,29 @@ func TestMerger_Merge(t *testing.T) {
 
 	// create a bunch of level 0 files
 	mem1 := memtable.New()
-	mem1.Put([]byte("foo"), []byte("bar"))
-	mem1.Put([]byte("baz"), []byte("bax"))
+	mem1.Put([]byte("foo"), []byte("bar"), 1)
+	mem1.Put([]byte("baz"), []byte("bax"), 2)
 	md01 := writeMemTable(t, "sst01", dbName, dataDir, mem1)
 
 	mem2 := memtable.New()
-	mem2.Put([]byte("aaa"), []byte("blarg"))
-	mem2.Put([]byte("foo"), []byte("butt"))
+	mem2.Put([]byte("aaa"), []byte("blarg"), 3)
+	mem2.Put([]byte("foo"), []byte("butt"), 4)
 	md02 := writeMemTable(t, "sst02", dbName, dataDir, mem2)
 
-	/*
-		TODO: test this once bug in memtable flushing logic fixed
-		mem3 := memtable.New()
-		mem3.Delete([]byte("aaa"))
-		mem3.Put([]byte("howdy"), []byte("time"))
-		md03 := writeMemTable(t, "sst03", dbName, dataDir, mem3)
-	*/
-
 	mem3 := memtable.New()
-	mem3.Put([]byte("yerrr"), []byte("ayyy"))
-	mem3.Put([]byte("howdy"), []byte("time"))
+	mem3.Put([]byte("yerrr"), []byte("ayyy"), 5)
+	mem3.Put([]byte("howdy"), []byte("time"), 6)
 	md03 := writeMemTable(t, "sst03", dbName, dataDir, mem3)
 
+	// Deletes of keys only found in older tables must carry over so they keep hiding them
 	mem4 := memtable.New()
-	mem4.Put([]byte("ohhh"), []byte("brother"))
-	mem4.Put([]byte("whoomp"), []byte("there it is"))
+	mem4.Put([]byte("ohhh"), []byte("brother"), 7)
+	mem4.Put([]byte("whoomp"), []byte("there it is"), 8)
+	mem4.Delete([]byte("aaa"), 9)
 	md04 := writeMemTable(t, "sst04", dbName, dataDir, mem4)
 
-	mrg := NewMerger(0, 1, []*Metadata{md04, md03, md02, md01}, dataDir, dbName)
+	// Provide tables out of order to show that sequence numbers decide which version wins
+	mrg := NewMerger(0, 1, []*Metadata{md01, md02, md03, md04}, nil, nil, TableOpts{}, dataDir, dbName)
 
 	res, err := mrg.Merge()
 	assert.NoError(t, err)
@@ -59,10 +58,14 @@ func TestMerger_Merge(t *testing.T) {
 		Filename: mergeMeta.Filename,
 		StartKey: []byte("aaa"),
 		EndKey:   []byte("yerrr"),
+		MinSeq:   2,
+		MaxSeq:   9,
+		Records:  7,
+		Deletes:  1,
 	}, mergeMeta)
 
 	test.AssertTable(t, map[string]string{
-		"aaa":    "blarg",
+		"aaa":    "",
 		"baz":    "bax",
 		"foo":    "butt",
 		"howdy":  "time",
@@ -72,11 +75,362 @@ func TestMerger_Merge(t *testing.T) {
 	}, mergeMeta.Filename, path.Join(dataDir, dbName))
 }
 
+func TestMerger_MergeSnapshots(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mem1 := memtable.New()
+	mem1.Put([]byte("foo"), []byte("v1"), 1)
+	mem1.Put([]byte("foo"), []byte("v2"), 2)
+	mem1.Put([]byte("bar"), []byte("v3"), 3)
+	md01 := writeMemTable(t, "sst01", dbName, dataDir, mem1)
+
+	mem2 := memtable.New()
+	mem2.Put([]byte("foo"), []byte("v4"), 4)
+	mem2.Delete([]byte("bar"), 5)
+	mem2.Put([]byte("foo"), []byte("v6"), 6)
+	md02 := writeMemTable(t, "sst02", dbName, dataDir, mem2)
+
+	// Snapshots taken at seq 2 and 4 must still see v2 and v4 respectively
+	res, err := NewMerger(0, 1, []*Metadata{md02, md01}, []uint64{2, 4}, nil, TableOpts{}, dataDir, dbName).Merge()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res))
+
+	handle, err := os.Open(path.Join(dataDir, dbName, res[0].Filename))
+	assert.NoError(t, err)
+
+	iter, err := NewIterator(handle)
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	var actual []string
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		actual = append(actual, fmt.Sprintf("%s@%d", iter.Record().Key, iter.Record().Seq))
+	}
+	assert.Equal(t, []string{"bar@5", "bar@3", "foo@6", "foo@4", "foo@2"}, actual)
+}
+
+func TestMerger_MergeRangeDeletes(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mem1 := memtable.New()
+	mem1.Put([]byte("a"), []byte("v1"), 1)
+	mem1.Put([]byte("b"), []byte("v2"), 2)
+	mem1.Put([]byte("c"), []byte("v3"), 3)
+	mem1.Put([]byte("d"), []byte("v4"), 4)
+	md01 := writeMemTable(t, "sst01", dbName, dataDir, mem1)
+
+	mem2 := memtable.New()
+	mem2.DeleteRange([]byte("b"), []byte("d"), 5)
+	mem2.Put([]byte("c"), []byte("v6"), 6)
+	md02 := writeMemTable(t, "sst02", dbName, dataDir, mem2)
+
+	// A snapshot at seq 2 can still see b but nothing needs to keep c@3 around
+	res, err := NewMerger(0, 1, []*Metadata{md02, md01}, []uint64{2}, nil, TableOpts{}, dataDir, dbName).Merge()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res))
+
+	handle, err := os.Open(path.Join(dataDir, dbName, res[0].Filename))
+	assert.NoError(t, err)
+
+	iter, err := NewIterator(handle)
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	var actual []string
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		actual = append(actual, fmt.Sprintf("%s@%d", iter.Record().Key, iter.Record().Seq))
+	}
+	assert.Equal(t, []string{"a@1", "b@2", "c@6", "d@4"}, actual)
+	assert.Equal(t, mem2.RangeDeletes(), iter.RangeDeletes())
+}
+
+func TestMerger_MergeOnlyRangeDeletes(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mem1 := memtable.New()
+	mem1.Put([]byte("b"), []byte("v1"), 1)
+	md01 := writeMemTable(t, "sst01", dbName, dataDir, mem1)
+
+	mem2 := memtable.New()
+	mem2.DeleteRange([]byte("a"), []byte("z"), 2)
+	md02 := writeMemTable(t, "sst02", dbName, dataDir, mem2)
+
+	// Every record is dropped, but the range delete must survive to hide data in older levels
+	res, err := NewMerger(0, 1, []*Metadata{md02, md01}, nil, nil, TableOpts{}, dataDir, dbName).Merge()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res))
+
+	assert.Equal(t, &Metadata{
+		Level:        1,
+		Filename:     res[0].Filename,
+		StartKey:     []byte("a"),
+		EndKey:       []byte("z"),
+		MinSeq:       2,
+		MaxSeq:       2,
+		Records:      1,
+		Deletes:      1,
+		RangeDeletes: 1,
+	}, res[0])
+}
+
+func TestMerger_MergeBottommost(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mem1 := memtable.New()
+	mem1.Put([]byte("a"), []byte("v1"), 1)
+	mem1.Put([]byte("b"), []byte("v2"), 2)
+	mem1.Put([]byte("e"), []byte("v3"), 3)
+	md01 := writeMemTable(t, "sst01", dbName, dataDir, mem1)
+
+	mem2 := memtable.New()
+	mem2.Delete([]byte("a"), 4)
+	mem2.DeleteRange([]byte("b"), []byte("d"), 5)
+	mem2.Put([]byte("c"), []byte("v6"), 6)
+	md02 := writeMemTable(t, "sst02", dbName, dataDir, mem2)
+
+	merge := func(snapshots []uint64) ([]string, []*storage.Record) {
+		merger := NewMerger(0, 1, []*Metadata{md02, md01}, snapshots, nil, TableOpts{}, dataDir, dbName)
+		merger.SetBottommost(true)
+		res, err := merger.Merge()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(res))
+
+		handle, err := os.Open(path.Join(dataDir, dbName, res[0].Filename))
+		assert.NoError(t, err)
+
+		iter, err := NewIterator(handle)
+		assert.NoError(t, err)
+		defer iter.Close()
+
+		var actual []string
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			actual = append(actual, fmt.Sprintf("%s@%d", iter.Record().Key, iter.Record().Seq))
+		}
+		return actual, iter.RangeDeletes()
+	}
+
+	// Deletes every snapshot can see have nothing left to hide, but the range delete is newer than the
+	// snapshot at seq 4, which can still see b
+	actual, rangeDeletes := merge([]uint64{4})
+	assert.Equal(t, []string{"b@2", "c@6", "e@3"}, actual)
+	assert.Equal(t, mem2.RangeDeletes(), rangeDeletes)
+
+	actual, rangeDeletes = merge(nil)
+	assert.Equal(t, []string{"c@6", "e@3"}, actual)
+	assert.Empty(t, rangeDeletes)
+}
+
+func TestMerger_TruncateRangeDeletes(t *testing.T) {
+	rd := storage.NewRangeDelete([]byte("b"), []byte("f"))
+	rd.Seq = 3
+	m := &Merger{rangeDeletes: []*storage.Record{rd}}
+
+	expected := func(start string, end string) []*storage.Record {
+		t := storage.NewRangeDelete([]byte(start), []byte(end))
+		t.Seq = 3
+		return []*storage.Record{t}
+	}
+
+	assert.Equal(t, expected("b", "f"), m.truncateRangeDeletes(nil, nil))
+	assert.Equal(t, expected("b", "d"), m.truncateRangeDeletes(nil, []byte("d")))
+	assert.Equal(t, expected("d", "f"), m.truncateRangeDeletes([]byte("d"), nil))
+	assert.Equal(t, expected("c", "d"), m.truncateRangeDeletes([]byte("c"), []byte("d")))
+	assert.Empty(t, m.truncateRangeDeletes([]byte("f"), nil))
+	assert.Empty(t, m.truncateRangeDeletes(nil, []byte("b")))
+}
+
+func TestMerger_MergeOperands(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mem1 := memtable.New()
+	mem1.Put([]byte("foo"), []byte("a"), 1)
+	mem1.Merge([]byte("foo"), []byte("b"), 2)
+	mem1.Merge([]byte("bar"), []byte("x"), 3)
+	mem1.Delete([]byte("baz"), 4)
+	md01 := writeMemTable(t, "sst01", dbName, dataDir, mem1)
+
+	mem2 := memtable.New()
+	mem2.Merge([]byte("baz"), []byte("z"), 5)
+	mem2.Merge([]byte("foo"), []byte("c"), 6)
+	mem2.Merge([]byte("foo"), []byte("d"), 7)
+	mem2.Merge([]byte("bar"), []byte("y"), 8)
+	md02 := writeMemTable(t, "sst02", dbName, dataDir, mem2)
+
+	// The snapshot at seq 6 splits the operands of foo and bar in two
+	res, err := NewMerger(0, 1, []*Metadata{md02, md01}, []uint64{6}, test.AppendOperator{}, TableOpts{}, dataDir,
+		dbName).Merge()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res))
+
+	handle, err := os.Open(path.Join(dataDir, dbName, res[0].Filename))
+	assert.NoError(t, err)
+
+	iter, err := NewIterator(handle)
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	var actual []string
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		record := iter.Record()
+		actual = append(actual, fmt.Sprintf("%s@%d=%s/%d", record.Key, record.Seq, record.Value, record.Type))
+	}
+
+	// Operands whose value isn't found are kept so they can be combined later
+	assert.Equal(t, []string{
+		fmt.Sprintf("bar@8=y/%d", storage.RecordMerge),
+		fmt.Sprintf("bar@3=x/%d", storage.RecordMerge),
+		fmt.Sprintf("baz@5=z/%d", storage.RecordUpdate),
+		fmt.Sprintf("foo@7=d/%d", storage.RecordMerge),
+		fmt.Sprintf("foo@6=a,b,c/%d", storage.RecordUpdate),
+	}, actual)
+}
+
+func TestMerger_MergeExpired(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	expiresAt := time.Now().Add(time.Hour).UnixNano()
+
+	mem1 := memtable.New()
+	mem1.PutWithExpiry([]byte("foo"), []byte("bar"), time.Now().Add(-time.Minute).UnixNano(), 1)
+	mem1.PutWithExpiry([]byte("baz"), []byte("bax"), expiresAt, 2)
+	md01 := writeMemTable(t, "sst01", dbName, dataDir, mem1)
+
+	res, err := NewMerger(0, 1, []*Metadata{md01}, nil, nil, TableOpts{}, dataDir, dbName).Merge()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res))
+
+	handle, err := os.Open(path.Join(dataDir, dbName, res[0].Filename))
+	assert.NoError(t, err)
+
+	iter, err := NewIterator(handle)
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	// The expired value is dropped, leaving a delete behind to hide any older versions in lower levels
+	iter.SeekToFirst()
+	assert.Equal(t, &storage.Record{Key: []byte("baz"), Value: []byte("bax"), Type: storage.RecordUpdate, Seq: 2,
+		ExpiresAt: expiresAt}, iter.Record())
+	iter.Next()
+	assert.Equal(t, &storage.Record{Key: []byte("foo"), Type: storage.RecordDelete, Seq: 1}, iter.Record())
+	iter.Next()
+	assert.False(t, iter.Valid())
+}
+
+func TestMerger_MaxFileSize(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mem1 := memtable.New()
+	mem1.Put([]byte("a"), []byte("1"), 1)
+	mem1.Put([]byte("b"), []byte("2"), 2)
+	mem1.Put([]byte("c"), []byte("3"), 3)
+	md01 := writeMemTable(t, "sst01", dbName, dataDir, mem1)
+
+	// Every record is bigger than the limit, so each ends up in its own file
+	res, err := NewMerger(0, 1, []*Metadata{md01}, nil, nil, TableOpts{MaxFileSize: 1}, dataDir, dbName).Merge()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(res))
+
+	for i, key := range []string{"a", "b", "c"} {
+		assert.Equal(t, []byte(key), res[i].StartKey)
+		assert.Equal(t, []byte(key), res[i].EndKey)
+	}
+}
+
+func TestMerger_SetBounds(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	mem1 := memtable.New()
+	for i, key := range []string{"a", "b", "c", "d", "e"} {
+		mem1.Put([]byte(key), []byte("v"), uint64(i+1))
+	}
+	md01 := writeMemTable(t, "sst01", dbName, dataDir, mem1)
+
+	mem2 := memtable.New()
+	mem2.Put([]byte("c"), []byte("new"), 6)
+	mem2.DeleteRange([]byte("a"), []byte("cc"), 7)
+	md02 := writeMemTable(t, "sst02", dbName, dataDir, mem2)
+
+	merge := func(start string, end string) ([]string, []*storage.Record) {
+		merger := NewMerger(0, 1, []*Metadata{md02, md01}, []uint64{6}, nil, TableOpts{}, dataDir, dbName)
+		merger.SetBounds([]byte(start), []byte(end))
+		res, err := merger.Merge()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(res))
+
+		handle, err := os.Open(path.Join(dataDir, dbName, res[0].Filename))
+		assert.NoError(t, err)
+
+		iter, err := NewIterator(handle)
+		assert.NoError(t, err)
+		defer iter.Close()
+
+		var actual []string
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			actual = append(actual, fmt.Sprintf("%s@%d", iter.Record().Key, iter.Record().Seq))
+		}
+		return actual, iter.RangeDeletes()
+	}
+
+	// Only the keys within the bounds are merged, and the range delete is cut at them. The snapshot at seq 6
+	// can still see the keys it hides
+	actual, rangeDeletes := merge("b", "d")
+	assert.Equal(t, []string{"b@2", "c@6"}, actual)
+	rd := storage.NewRangeDelete([]byte("b"), []byte("cc"))
+	rd.Seq = 7
+	assert.Equal(t, []*storage.Record{rd}, rangeDeletes)
+
+	actual, rangeDeletes = merge("d", "f")
+	assert.Equal(t, []string{"d@4", "e@5"}, actual)
+	assert.Empty(t, rangeDeletes)
+}
+
+func TestSplitKeys(t *testing.T) {
+	dataDir, dbName := test.ConfigureDataDir(t, "foo")
+	defer test.Cleanup(t, path.Join(dataDir, dbName))
+
+	var metas []*Metadata
+	for i, keys := range [][]string{{"a", "c", "e", "g"}, {"b", "d", "f", "h"}} {
+		mem := memtable.New()
+		for _, key := range keys {
+			mem.Put([]byte(key), []byte("v"), 1)
+		}
+
+		file, err := util.CreateFile(fmt.Sprintf("sst%02d", i), dbName, dataDir)
+		assert.NoError(t, err)
+
+		// Every record starts a block, so each key is in the index
+		md, err := NewBuilder(filepath.Base(file.Name()), mem.InternalIterator(), nil, 0, file, 1).WriteTable()
+		assert.NoError(t, err)
+		metas = append(metas, md)
+	}
+
+	splits, err := SplitKeys(metas, 4, dataDir, dbName)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("c"), []byte("e"), []byte("g")}, splits)
+
+	splits, err = SplitKeys(metas, 1, dataDir, dbName)
+	assert.NoError(t, err)
+	assert.Empty(t, splits)
+
+	// There aren't enough distinct keys to split into more shards than there are records
+	splits, err = SplitKeys(metas, 20, dataDir, dbName)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, len(splits))
+}
+
 func writeMemTable(t *testing.T, filename string, dbName string, dataDir string, mem *memtable.MemTable) *Metadata {
 	sst01, err := util.CreateFile(filename, dbName, dataDir)
 	assert.NoError(t, err)
 
-	builder := NewBuilder(filepath.Base(sst01.Name()), mem.InternalIterator(), 0, sst01)
+	builder := NewBuilder(filepath.Base(sst01.Name()), mem.InternalIterator(), mem.RangeDeletes(), 0, sst01, 0)
 	md01, err := builder.WriteTable()
 	assert.NoError(t, err)
 
@@ -1,12 +1,35 @@
 package sstable
 
-import "bytes"
+import (
+	"bytes"
+
+	"github.com/nbroyles/nbdb/internal/storage"
+)
 
 type Metadata struct {
-	Level    uint8
-	Filename string
-	StartKey []byte
-	EndKey   []byte
+	// ColumnFamily is the id of the column family the table belongs to
+	ColumnFamily uint32
+	Level        uint8
+	Filename     string
+	StartKey     []byte
+	EndKey       []byte
+	// MinSeq and MaxSeq are the smallest and largest sequence numbers of the records in the table
+	MinSeq uint64
+	MaxSeq uint64
+	// Records is the number of records in the table, including range deletes, Deletes is how many of them
+	// are deletes and RangeDeletes is how many of those are range deletes
+	Records      uint64
+	Deletes      uint64
+	RangeDeletes uint64
+}
+
+// DeleteRatio returns the fraction of the records in the table that are deletes
+func (m *Metadata) DeleteRatio() float64 {
+	if m.Records == 0 {
+		return 0
+	}
+
+	return float64(m.Deletes) / float64(m.Records)
 }
 
 // ContainsKey returns true if the metadata key range contains the specified key
@@ -14,3 +37,34 @@ func (m *Metadata) ContainsKey(key []byte) bool {
 	// startKey <= key <= endKey
 	return bytes.Compare(m.StartKey, key) <= 0 && bytes.Compare(key, m.EndKey) <= 0
 }
+
+// includeRangeDeletes widens the key and sequence number ranges of the metadata so that they cover
+// the range deletes provided. hasRecords indicates whether the ranges already cover any records
+func (m *Metadata) includeRangeDeletes(rangeDeletes []*storage.Record, hasRecords bool) {
+	for _, rd := range rangeDeletes {
+		m.Records++
+		m.Deletes++
+		m.RangeDeletes++
+
+		if !hasRecords {
+			m.StartKey, m.EndKey = rd.Key, rd.Value
+			m.MinSeq, m.MaxSeq = rd.Seq, rd.Seq
+			hasRecords = true
+			continue
+		}
+
+		if bytes.Compare(rd.Key, m.StartKey) < 0 {
+			m.StartKey = rd.Key
+		}
+		// The end of a range delete is exclusive, so this slightly overstates the range covered
+		if bytes.Compare(rd.Value, m.EndKey) > 0 {
+			m.EndKey = rd.Value
+		}
+		if rd.Seq < m.MinSeq {
+			m.MinSeq = rd.Seq
+		}
+		if rd.Seq > m.MaxSeq {
+			m.MaxSeq = rd.Seq
+		}
+	}
+}
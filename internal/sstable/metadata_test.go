@@ -19,3 +19,8 @@ func TestMetadata_ContainsKey(t *testing.T) {
 	assert.True(t, md.ContainsKey([]byte("omega")))
 	assert.False(t, md.ContainsKey([]byte("zomg")))
 }
+
+func TestMetadata_DeleteRatio(t *testing.T) {
+	assert.Equal(t, float64(0), (&Metadata{}).DeleteRatio())
+	assert.Equal(t, 0.25, (&Metadata{Records: 8, Deletes: 2}).DeleteRatio())
+}
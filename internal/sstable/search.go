@@ -2,81 +2,104 @@ package sstable
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"time"
 
 	"github.com/nbroyles/nbdb/internal/storage"
 )
 
-// Search searches for a key in the provided io. If key not found, then
-// returns nil
-func Search(key []byte, readSeeker io.ReadSeeker) ([]byte, error) {
-	// Seek to footer start
-	_, err := readSeeker.Seek(-footerLen, io.SeekEnd)
-	if err != nil {
-		return nil, fmt.Errorf("could not seek to footer in sstable: %w", err)
-	}
+// Lookup holds the state of a search for the most recent version of a single key. Operands collects
+// merge operands found along the way, newest first
+type Lookup struct {
+	Key      []byte
+	Status   storage.LookupStatus
+	Value    []byte
+	Operands [][]byte
+}
 
-	sCodec := storage.Codec{}
-	footer, err := sCodec.DecodeFooter(readSeeker)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode footer from sstable. %w", err)
-	}
+// Search searches for the most recent version of key written at or before sequence number seq
+// in the provided io. The status returned indicates whether the key was found, deleted or not
+// present in the table. The value is only returned if the key was found. Merge operands found along
+// the way are appended to operands, newest first, and returned. If the value they apply to isn't in
+// the table, KeyNotFound is returned so that the search continues. The search is abandoned with ctx's error
+// if ctx is done before it finishes
+func Search(ctx context.Context, key []byte, seq uint64, operands [][]byte, readSeeker io.ReadSeeker) (
+	storage.LookupStatus, []byte, [][]byte, error) {
+	lookup := &Lookup{Key: key, Operands: operands}
+	err := SearchAll(ctx, []*Lookup{lookup}, seq, readSeeker)
 
-	// Seek to index start
-	_, err = readSeeker.Seek(int64(footer.IndexStartByte), io.SeekStart)
-	if err != nil {
-		return nil, fmt.Errorf("could not seek to index portion of sstable: %w", err)
+	return lookup.Status, lookup.Value, lookup.Operands, err
+}
+
+// SearchAll searches for each of the lookups' keys like Search, updating the lookups with the results.
+// The table's index is only read once, no matter how many keys are searched for
+func SearchAll(ctx context.Context, lookups []*Lookup, seq uint64, readSeeker io.ReadSeeker) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	startPtr, err := sCodec.DecodePointer(readSeeker)
+	it, err := NewIterator(readSeeker)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode index from sstable. %w", err)
+		return fmt.Errorf("failed to read sstable: %w", err)
 	}
 
-	// Iterate until we've found an entry point in list of indices where our key is > index start key
-	for i := 1; i < int(footer.IndexEntries) && bytes.Compare(startPtr.Key, key) > 0; i++ {
-		startPtr, err = sCodec.DecodePointer(readSeeker)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode index from sstable. %w", err)
+	now := time.Now().UnixNano()
+	for _, lookup := range lookups {
+		if lookup.Status, lookup.Value, lookup.Operands, err = search(ctx, it, lookup.Key, seq, lookup.Operands,
+			now); err != nil {
+			return err
 		}
 	}
 
-	if bytes.Compare(startPtr.Key, key) > 0 {
-		log.Panicf("failed to find an appropriate index in sstable for key %s. this should not happen!",
-			string(key))
-	}
+	return nil
+}
 
-	// Seek to entry point specified by index block
-	_, err = readSeeker.Seek(int64(startPtr.StartByte), io.SeekStart)
-	if err != nil {
-		return nil, fmt.Errorf("could not seek to key-value portion of sstable: %w", err)
+func search(ctx context.Context, it *Iterator, key []byte, seq uint64, operands [][]byte, now int64) (
+	storage.LookupStatus, []byte, [][]byte, error) {
+	// Versions are ordered newest first, so skip past any that are too recent to be seen
+	for it.Seek(key); it.Valid() && bytes.Equal(it.Record().Key, key) && it.Record().Seq > seq; {
+		if err := ctx.Err(); err != nil {
+			return storage.KeyNotFound, nil, operands, err
+		}
+		it.Next()
 	}
 
-	for i := 0; i < indexCount; i++ {
-		curPos, err := readSeeker.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return nil, fmt.Errorf("failure getting current position in file: %w", err)
-		} else if curPos == int64(footer.IndexStartByte) {
-			// We searched the last set of records and ended up at the index section of the file, so we didn't find the
-			// key
-			return nil, nil
+	for ; ; it.Next() {
+		if err := ctx.Err(); err != nil {
+			return storage.KeyNotFound, nil, operands, err
 		}
 
-		record, err := sCodec.DecodeFromReader(readSeeker)
-		if err != nil {
-			return nil, fmt.Errorf("failed decoding record in sstable: %w", err)
+		if err := it.Error(); err != nil {
+			return storage.KeyNotFound, nil, operands, fmt.Errorf("failed searching sstable: %w", err)
 		}
 
-		if bytes.Equal(record.Key, key) {
-			if record.Type == storage.RecordDelete {
-				return nil, nil
-			} else {
-				return record.Value, nil
-			}
+		var record *storage.Record
+		if it.Valid() && bytes.Equal(it.Record().Key, key) {
+			record = it.Record()
+		}
+
+		// Any visible range delete written after the version found hides the key
+		var version uint64
+		if record != nil {
+			version = record.Seq
+		}
+		if storage.RangeDeleted(it.RangeDeletes(), key, version, seq) {
+			return storage.KeyDeleted, nil, operands, nil
+		}
+
+		if record == nil {
+			return storage.KeyNotFound, nil, operands, nil
 		}
-	}
 
-	return nil, nil
+		switch {
+		case record.Type == storage.RecordDelete || record.Expired(now):
+			return storage.KeyDeleted, nil, operands, nil
+		case record.Type == storage.RecordMerge:
+			operands = append(operands, record.Value)
+		default:
+			return storage.KeyFound, record.Value, operands, nil
+		}
+	}
 }
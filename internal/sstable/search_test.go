@@ -2,41 +2,225 @@ package sstable
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/nbroyles/nbdb/internal/memtable"
+	"github.com/nbroyles/nbdb/internal/storage"
 	"github.com/stretchr/testify/assert"
 )
 
-// TODO: Test w/ multiple index entries once indexPerRecord is configurable and stored in Metadata
 func TestSearch(t *testing.T) {
 	// Build memtable and flush to disk
 	mem := memtable.New()
-	mem.Put([]byte("foo"), []byte("bar"))
-	mem.Put([]byte("howdy"), []byte("time"))
-	mem.Put([]byte("sick"), []byte("dude"))
+	mem.Put([]byte("foo"), []byte("bar"), 1)
+	mem.Put([]byte("howdy"), []byte("time"), 2)
+	mem.Put([]byte("sick"), []byte("dude"), 3)
 
 	buf := bytes.Buffer{}
-	builder := newBuilder("test", mem.InternalIterator(), 0, &buf, 1)
+	builder := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 1)
 
 	meta, err := builder.WriteTable()
 	assert.NoError(t, err)
-	assert.Equal(t, &Metadata{Level: 0, Filename: "test", StartKey: []byte("foo"), EndKey: []byte("sick")}, meta)
+	assert.Equal(t, &Metadata{Level: 0, Filename: "test", StartKey: []byte("foo"), EndKey: []byte("sick"),
+		MinSeq: 1, MaxSeq: 3, Records: 3}, meta)
 
 	// Search for keys
-	val, err := Search([]byte("howdy"), bytes.NewReader(buf.Bytes()))
+	status, val, _, err := Search(context.Background(), []byte("howdy"), math.MaxUint64, nil, bytes.NewReader(buf.Bytes()))
 	assert.NoError(t, err)
+	assert.Equal(t, storage.KeyFound, status)
 	assert.Equal(t, []byte("time"), val)
 
-	val, err = Search([]byte("foo"), bytes.NewReader(buf.Bytes()))
+	status, val, _, err = Search(context.Background(), []byte("foo"), math.MaxUint64, nil, bytes.NewReader(buf.Bytes()))
 	assert.NoError(t, err)
+	assert.Equal(t, storage.KeyFound, status)
 	assert.Equal(t, []byte("bar"), val)
 
-	val, err = Search([]byte("sick"), bytes.NewReader(buf.Bytes()))
+	status, val, _, err = Search(context.Background(), []byte("sick"), math.MaxUint64, nil, bytes.NewReader(buf.Bytes()))
 	assert.NoError(t, err)
+	assert.Equal(t, storage.KeyFound, status)
 	assert.Equal(t, []byte("dude"), val)
 
-	val, err = Search([]byte("goo"), bytes.NewReader(buf.Bytes()))
+	status, val, _, err = Search(context.Background(), []byte("goo"), math.MaxUint64, nil, bytes.NewReader(buf.Bytes()))
 	assert.NoError(t, err)
+	assert.Equal(t, storage.KeyNotFound, status)
 	assert.Nil(t, val)
 }
+
+func TestSearch_MultipleIndexEntries(t *testing.T) {
+	mem := memtable.New()
+	for i := 0; i < 20; i++ {
+		mem.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("val%02d", i)), uint64(i+1))
+	}
+
+	buf := bytes.Buffer{}
+	_, err := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 3).WriteTable()
+	assert.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		status, val, _, err := Search(context.Background(), []byte(fmt.Sprintf("key%02d", i)), math.MaxUint64, nil,
+			bytes.NewReader(buf.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, storage.KeyFound, status)
+		assert.Equal(t, []byte(fmt.Sprintf("val%02d", i)), val)
+	}
+
+	status, val, _, err := Search(context.Background(), []byte("key055"), math.MaxUint64, nil, bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.KeyNotFound, status)
+	assert.Nil(t, val)
+}
+
+func TestSearch_Versions(t *testing.T) {
+	mem := memtable.New()
+	mem.Put([]byte("foo"), []byte("bar"), 2)
+	mem.Delete([]byte("foo"), 4)
+	mem.Put([]byte("foo"), []byte("baz"), 6)
+
+	buf := bytes.Buffer{}
+	_, err := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 1).WriteTable()
+	assert.NoError(t, err)
+
+	for seq, expected := range map[uint64]storage.LookupStatus{1: storage.KeyNotFound, 2: storage.KeyFound,
+		3: storage.KeyFound, 5: storage.KeyDeleted, 6: storage.KeyFound} {
+		status, _, _, err := Search(context.Background(), []byte("foo"), seq, nil, bytes.NewReader(buf.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, status, "seq %d", seq)
+	}
+
+	_, val, _, err := Search(context.Background(), []byte("foo"), 3, nil, bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), val)
+}
+
+func TestSearch_RangeDelete(t *testing.T) {
+	mem := memtable.New()
+	mem.Put([]byte("b"), []byte("old"), 1)
+	mem.Put([]byte("c"), []byte("old"), 2)
+	mem.DeleteRange([]byte("a"), []byte("c"), 3)
+	mem.Put([]byte("b"), []byte("new"), 4)
+
+	buf := bytes.Buffer{}
+	meta, err := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 1).WriteTable()
+	assert.NoError(t, err)
+
+	// Key range of the table must cover the range delete
+	assert.Equal(t, []byte("a"), meta.StartKey)
+	assert.Equal(t, []byte("c"), meta.EndKey)
+	assert.Equal(t, uint64(4), meta.MaxSeq)
+
+	for _, tc := range []struct {
+		key    string
+		seq    uint64
+		status storage.LookupStatus
+	}{
+		{"a", math.MaxUint64, storage.KeyDeleted},
+		{"a", 2, storage.KeyNotFound},
+		{"b", 2, storage.KeyFound},
+		{"b", 3, storage.KeyDeleted},
+		{"b", 4, storage.KeyFound},
+		{"c", math.MaxUint64, storage.KeyFound},
+	} {
+		status, _, _, err := Search(context.Background(), []byte(tc.key), tc.seq, nil, bytes.NewReader(buf.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, tc.status, status, "key %s seq %d", tc.key, tc.seq)
+	}
+}
+
+func TestSearch_Merge(t *testing.T) {
+	mem := memtable.New()
+	mem.Merge([]byte("foo"), []byte("a"), 1)
+	mem.Put([]byte("foo"), []byte("bar"), 2)
+	mem.Merge([]byte("foo"), []byte("b"), 3)
+	mem.Merge([]byte("foo"), []byte("c"), 4)
+
+	buf := bytes.Buffer{}
+	_, err := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 1).WriteTable()
+	assert.NoError(t, err)
+
+	// Operands are collected until the value they apply to is found
+	status, val, operands, err := Search(context.Background(), []byte("foo"), math.MaxUint64, [][]byte{[]byte("d")},
+		bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.KeyFound, status)
+	assert.Equal(t, []byte("bar"), val)
+	assert.Equal(t, [][]byte{[]byte("d"), []byte("c"), []byte("b")}, operands)
+
+	// If the value isn't in the table, the search must continue in older data
+	status, val, operands, err = Search(context.Background(), []byte("foo"), 1, nil, bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.KeyNotFound, status)
+	assert.Nil(t, val)
+	assert.Equal(t, [][]byte{[]byte("a")}, operands)
+}
+
+func TestSearch_Expired(t *testing.T) {
+	mem := memtable.New()
+	mem.Put([]byte("foo"), []byte("old"), 1)
+	mem.PutWithExpiry([]byte("foo"), []byte("bar"), time.Now().Add(-time.Minute).UnixNano(), 2)
+	mem.PutWithExpiry([]byte("baz"), []byte("bax"), time.Now().Add(time.Hour).UnixNano(), 3)
+
+	buf := bytes.Buffer{}
+	_, err := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 1).WriteTable()
+	assert.NoError(t, err)
+
+	// An expired value hides older versions of its key
+	status, val, _, err := Search(context.Background(), []byte("foo"), math.MaxUint64, nil, bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.KeyDeleted, status)
+	assert.Nil(t, val)
+
+	status, val, _, err = Search(context.Background(), []byte("baz"), math.MaxUint64, nil, bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.KeyFound, status)
+	assert.Equal(t, []byte("bax"), val)
+}
+
+func TestSearch_Cancelled(t *testing.T) {
+	mem := memtable.New()
+	mem.Put([]byte("foo"), []byte("bar"), 1)
+
+	buf := bytes.Buffer{}
+	_, err := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 1).WriteTable()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	status, _, _, err := Search(ctx, []byte("foo"), math.MaxUint64, nil, bytes.NewReader(buf.Bytes()))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, storage.KeyNotFound, status)
+}
+
+func TestSearchAll(t *testing.T) {
+	mem := memtable.New()
+	for i := 0; i < 20; i++ {
+		mem.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("val%02d", i)), uint64(i+1))
+	}
+	mem.Delete([]byte("key05"), 21)
+	mem.Merge([]byte("key07"), []byte("op"), 22)
+
+	buf := bytes.Buffer{}
+	_, err := NewBuilder("test", mem.InternalIterator(), mem.RangeDeletes(), 0, &buf, 3).WriteTable()
+	assert.NoError(t, err)
+
+	// Keys can be searched for in any order
+	lookups := []*Lookup{
+		{Key: []byte("key12")},
+		{Key: []byte("key03")},
+		{Key: []byte("key055")},
+		{Key: []byte("key05")},
+		{Key: []byte("key07"), Operands: [][]byte{[]byte("newer")}},
+	}
+	assert.NoError(t, SearchAll(context.Background(), lookups, math.MaxUint64, bytes.NewReader(buf.Bytes())))
+
+	assert.Equal(t, &Lookup{Key: []byte("key12"), Status: storage.KeyFound, Value: []byte("val12")}, lookups[0])
+	assert.Equal(t, &Lookup{Key: []byte("key03"), Status: storage.KeyFound, Value: []byte("val03")}, lookups[1])
+	assert.Equal(t, &Lookup{Key: []byte("key055"), Status: storage.KeyNotFound}, lookups[2])
+	assert.Equal(t, &Lookup{Key: []byte("key05"), Status: storage.KeyDeleted}, lookups[3])
+	assert.Equal(t, &Lookup{Key: []byte("key07"), Status: storage.KeyFound, Value: []byte("val07"),
+		Operands: [][]byte{[]byte("newer"), []byte("op")}}, lookups[4])
+}
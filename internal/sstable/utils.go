@@ -3,6 +3,8 @@ package sstable
 import (
 	"fmt"
 	"io"
+
+	"github.com/nbroyles/nbdb/internal/storage"
 )
 
 func write(out io.Writer, bytes []byte) error {
@@ -14,3 +16,19 @@ func write(out io.Writer, bytes []byte) error {
 
 	return nil
 }
+
+// writeRangeDeletes writes the range delete section of an sstable, which directly follows the index
+func writeRangeDeletes(out io.Writer, codec *storage.Codec, rangeDeletes []*storage.Record) error {
+	for _, rd := range rangeDeletes {
+		data, err := codec.Encode(rd)
+		if err != nil {
+			return fmt.Errorf("could not encode range delete: %w", err)
+		}
+
+		if err = write(out, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -12,15 +12,66 @@ import (
 // from disk
 type Codec struct{}
 
+// FormatVersion is the version of the on-disk formats written. It's bumped whenever the layout of WALs,
+// sstables or manifests changes in a way that older versions can't read
+const FormatVersion uint32 = 1
+
+// Magic numbers identify the kind of file a header or footer belongs to
+const (
+	WALMagic      uint32 = 0x6e62776c // "nbwl"
+	ManifestMagic uint32 = 0x6e626d66 // "nbmf"
+	TableMagic    uint32 = 0x6e627374 // "nbst"
+)
+
+// HeaderLen is the length of the header at the start of WALs and manifests
+const HeaderLen = 8
+
+// Encoding header format:
+// - magic number (uint32 == 4 bytes)
+// - format version (uint32 == 4 bytes)
+
+// EncodeHeader returns the header identifying a file as holding the kind of data magic stands for, written in
+// the current format version
+func (c *Codec) EncodeHeader(magic uint32) []byte {
+	data := make([]byte, HeaderLen)
+	binary.BigEndian.PutUint32(data, magic)
+	binary.BigEndian.PutUint32(data[4:], FormatVersion)
+
+	return data
+}
+
+// DecodeHeader reads a header from reader and returns an error wrapping ErrIncompatibleFormat if it doesn't
+// belong to the kind of file magic stands for or was written in a format version that can't be read
+func (c *Codec) DecodeHeader(reader io.Reader, magic uint32) error {
+	data := make([]byte, HeaderLen)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+
+	if binary.BigEndian.Uint32(data) != magic {
+		return fmt.Errorf("%w: missing format version. file was likely written by an older version",
+			ErrIncompatibleFormat)
+	} else if version := binary.BigEndian.Uint32(data[4:]); version > FormatVersion {
+		return fmt.Errorf("%w: format version %d is newer than supported version %d", ErrIncompatibleFormat,
+			version, FormatVersion)
+	}
+
+	return nil
+}
+
 // Encoding record format:
 // - total record length
-// - record type (put, delete)
 // - key length (uint32 == 4 bytes)
 // - key
-// { if update }
+// - record type (put, delete, range delete)
+// - sequence number (uint64 == 8 bytes)
+// { if update, merge or range delete. the value of a range delete is the end of its range }
 //   - val length (uint32 == 4 bytes)
 //	 - val
 // { /if }
+// { if update }
+//   - expires at (int64 == 8 bytes)
+// { /if }
 // - checksum
 
 // Encodes provided key, value and record type and returns a byte array
@@ -29,12 +80,15 @@ func (c *Codec) Encode(record *Record) ([]byte, error) {
 	key := record.Key
 	value := record.Value
 
-	// record type byte + key length bytes + variable key bytes + checksum bytes
-	// + (conditionally) value length bytes + (conditionally) variable value bytes
-	totalLength := 1 + 4 + crc32.Size + len(key)
-	if record.Type == RecordUpdate {
+	// record type byte + key length bytes + variable key bytes + sequence number bytes + checksum bytes
+	// + (conditionally) value length bytes + (conditionally) variable value bytes + (conditionally) expiry bytes
+	totalLength := 1 + 4 + 8 + crc32.Size + len(key)
+	if record.Type != RecordDelete {
 		totalLength += 4 + len(value)
 	}
+	if record.Type == RecordUpdate {
+		totalLength += 8
+	}
 
 	buf := bytes.Buffer{}
 	if err := binary.Write(&buf, binary.BigEndian, uint32(totalLength)); err != nil {
@@ -55,7 +109,11 @@ func (c *Codec) Encode(record *Record) ([]byte, error) {
 		return nil, fmt.Errorf("failed to encode record type: %w", err)
 	}
 
-	if record.Type == RecordUpdate {
+	if err := binary.Write(&buf, binary.BigEndian, record.Seq); err != nil {
+		return nil, fmt.Errorf("failed to encode sequence number: %w", err)
+	}
+
+	if record.Type != RecordDelete {
 		if err := binary.Write(&buf, binary.BigEndian, int32(len(value))); err != nil {
 			return nil, fmt.Errorf("failed to encode value length: %w", err)
 		}
@@ -67,6 +125,12 @@ func (c *Codec) Encode(record *Record) ([]byte, error) {
 		}
 	}
 
+	if record.Type == RecordUpdate {
+		if err := binary.Write(&buf, binary.BigEndian, record.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to encode expiry: %w", err)
+		}
+	}
+
 	checksumData := buf.Bytes()[4:] // Ignore initial 4 bytes containing totalLen
 	if err := binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(checksumData)); err != nil {
 		return nil, fmt.Errorf("failed to encode checksum: %w", err)
@@ -80,6 +144,9 @@ func (c *Codec) Encode(record *Record) ([]byte, error) {
 // TODO: convert to using a io.reader like other Decode methods?
 func (c *Codec) Decode(record []byte) (*Record, error) {
 	totalLen := len(record)
+	if totalLen < crc32.Size {
+		return nil, Corruptf("record too short to decode. len=%d", totalLen)
+	}
 
 	data := record
 
@@ -88,7 +155,7 @@ func (c *Codec) Decode(record []byte) (*Record, error) {
 
 	actualChecksum := crc32.ChecksumIEEE(actualRecord)
 	if actualChecksum != expectedChecksum {
-		return nil, fmt.Errorf("expected checksum of WAL record does not match! expected=%d, "+
+		return nil, Corruptf("expected checksum of WAL record does not match! expected=%d, "+
 			"actual=%d", expectedChecksum, actualChecksum)
 	}
 
@@ -96,37 +163,57 @@ func (c *Codec) Decode(record []byte) (*Record, error) {
 
 	var keyLen uint32
 	if err := binary.Read(dataReader, binary.BigEndian, &keyLen); err != nil {
-		return nil, fmt.Errorf("failed to read key length: %w", err)
+		return nil, Corruptf("failed to read key length: %v", err)
 	}
 
+	if int(keyLen) > dataReader.Len() {
+		return nil, Corruptf("key length %d exceeds remaining record length %d", keyLen, dataReader.Len())
+	}
 	key := make([]byte, keyLen)
 	if _, err := io.ReadFull(dataReader, key); err != nil {
-		return nil, fmt.Errorf("failed to read key: %w", err)
+		return nil, Corruptf("failed to read key: %v", err)
 	}
 
 	var rawType uint8
 	if err := binary.Read(dataReader, binary.BigEndian, &rawType); err != nil {
-		return nil, fmt.Errorf("failed to read record type: %w", err)
+		return nil, Corruptf("failed to read record type: %v", err)
 	}
 	rType := RecordType(rawType)
 
+	var seq uint64
+	if err := binary.Read(dataReader, binary.BigEndian, &seq); err != nil {
+		return nil, Corruptf("failed to read sequence number: %v", err)
+	}
+
 	var value []byte
-	if rType == RecordUpdate {
+	if rType != RecordDelete {
 		var valueLen uint32
 		if err := binary.Read(dataReader, binary.BigEndian, &valueLen); err != nil {
-			return nil, fmt.Errorf("failed to read value length: %w", err)
+			return nil, Corruptf("failed to read value length: %v", err)
 		}
 
+		if int(valueLen) > dataReader.Len() {
+			return nil, Corruptf("value length %d exceeds remaining record length %d", valueLen, dataReader.Len())
+		}
 		value = make([]byte, valueLen)
 		if _, err := io.ReadFull(dataReader, value); err != nil {
-			return nil, fmt.Errorf("failed to read value: %w", err)
+			return nil, Corruptf("failed to read value: %v", err)
+		}
+	}
+
+	var expiresAt int64
+	if rType == RecordUpdate {
+		if err := binary.Read(dataReader, binary.BigEndian, &expiresAt); err != nil {
+			return nil, Corruptf("failed to read expiry: %v", err)
 		}
 	}
 
 	return &Record{
-		Key:   key,
-		Value: value,
-		Type:  rType,
+		Key:       key,
+		Value:     value,
+		Type:      rType,
+		Seq:       seq,
+		ExpiresAt: expiresAt,
 	}, nil
 }
 
@@ -138,7 +225,7 @@ func (c *Codec) DecodeFromReader(reader io.Reader) (*Record, error) {
 
 	data := make([]byte, length)
 	if n, err := reader.Read(data); uint32(n) != length {
-		return nil, fmt.Errorf("failed to read expected amount of record data from sstable."+
+		return nil, Corruptf("failed to read expected amount of record data from sstable."+
 			" read=%d, expected=%d", n, length)
 	} else if err != nil {
 		return nil, fmt.Errorf("failed to read record: %w", err)
@@ -147,6 +234,96 @@ func (c *Codec) DecodeFromReader(reader io.Reader) (*Record, error) {
 	return c.Decode(data)
 }
 
+// Encoding batch format:
+// - total batch length
+// - record count (uint32 == 4 bytes)
+// - records, each preceded by the id of its column family (uint32 == 4 bytes) and encoded as described above
+// - checksum
+
+// EncodeBatch encodes the provided records into a single entry with one checksum covering all of
+// them. This allows the records to be written to the WAL and later recovered atomically
+func (c *Codec) EncodeBatch(records []*Record) ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	// Placeholder for total length which isn't known until every record is encoded
+	if err := binary.Write(&buf, binary.BigEndian, uint32(0)); err != nil {
+		return nil, fmt.Errorf("failed to encode total batch length: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(records))); err != nil {
+		return nil, fmt.Errorf("failed to encode batch record count: %w", err)
+	}
+
+	for _, record := range records {
+		if err := binary.Write(&buf, binary.BigEndian, record.ColumnFamily); err != nil {
+			return nil, fmt.Errorf("failed to encode batch record column family: %w", err)
+		}
+
+		data, err := c.Encode(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode batch record: %w", err)
+		}
+
+		if n, err := buf.Write(data); n != len(data) {
+			return nil, fmt.Errorf("failed to write full record to buffer. wrote=%d, len=%d", n, len(data))
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to encode batch record: %w", err)
+		}
+	}
+
+	checksumData := buf.Bytes()[4:] // Ignore initial 4 bytes containing totalLen
+	if err := binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(checksumData)); err != nil {
+		return nil, fmt.Errorf("failed to encode checksum: %w", err)
+	}
+
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(data)-4))
+
+	return data, nil
+}
+
+// DecodeBatch takes a batch entry (minus its total length) and decodes it into the records
+// it contains. Fails if the batch checksum does not match
+func (c *Codec) DecodeBatch(batch []byte) ([]*Record, error) {
+	totalLen := len(batch)
+	if totalLen < 8 {
+		return nil, Corruptf("batch too short to decode. len=%d", totalLen)
+	}
+
+	actualBatch := batch[0:(totalLen - 4)] // minus checksum len
+	expectedChecksum := binary.BigEndian.Uint32(batch[(totalLen - 4):])
+
+	actualChecksum := crc32.ChecksumIEEE(actualBatch)
+	if actualChecksum != expectedChecksum {
+		return nil, Corruptf("expected checksum of batch does not match! expected=%d, "+
+			"actual=%d", expectedChecksum, actualChecksum)
+	}
+
+	reader := bytes.NewReader(actualBatch)
+
+	var count uint32
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return nil, Corruptf("failed to read batch record count: %v", err)
+	}
+
+	records := make([]*Record, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var family uint32
+		if err := binary.Read(reader, binary.BigEndian, &family); err != nil {
+			return nil, Corruptf("failed to read batch record column family: %v", err)
+		}
+
+		record, err := c.DecodeFromReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode batch record: %w", err)
+		}
+		record.ColumnFamily = family
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
 func (c *Codec) EncodePointer(pointer *RecordPointer) ([]byte, error) {
 	buf := bytes.Buffer{}
 
@@ -213,6 +390,19 @@ func (c *Codec) EncodeFooter(footer *Footer) ([]byte, error) {
 		return nil, fmt.Errorf("failed to encode index entries for footer: %w", err)
 	}
 
+	if err := binary.Write(&buf, binary.BigEndian, footer.RangeDeleteStartByte); err != nil {
+		return nil, fmt.Errorf("failed to encode range delete start byte for footer: %w", err)
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, footer.RangeDeleteEntries); err != nil {
+		return nil, fmt.Errorf("failed to encode range delete entries for footer: %w", err)
+	}
+
+	// The format version comes last so that it's always at the same offset from the end of the table
+	if _, err := buf.Write(c.EncodeHeader(TableMagic)); err != nil {
+		return nil, fmt.Errorf("failed to encode format version for footer: %w", err)
+	}
+
 	return buf.Bytes(), nil
 }
 
@@ -232,9 +422,25 @@ func (c *Codec) DecodeFooter(reader io.Reader) (*Footer, error) {
 		return nil, fmt.Errorf("failed to decode index entries for footer: %w", err)
 	}
 
+	var rangeDeleteStart uint32
+	if err := binary.Read(reader, binary.BigEndian, &rangeDeleteStart); err != nil {
+		return nil, fmt.Errorf("failed to decode range delete start byte for footer: %w", err)
+	}
+
+	var rangeDeleteEntries uint32
+	if err := binary.Read(reader, binary.BigEndian, &rangeDeleteEntries); err != nil {
+		return nil, fmt.Errorf("failed to decode range delete entries for footer: %w", err)
+	}
+
+	if err := c.DecodeHeader(reader, TableMagic); err != nil {
+		return nil, err
+	}
+
 	return &Footer{
-		IndexStartByte: startByte,
-		Length:         length,
-		IndexEntries:   entries,
+		IndexStartByte:       startByte,
+		Length:               length,
+		IndexEntries:         entries,
+		RangeDeleteStartByte: rangeDeleteStart,
+		RangeDeleteEntries:   rangeDeleteEntries,
 	}, nil
 }
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,6 +15,7 @@ func TestCodec_RoundTripUpdate(t *testing.T) {
 		Key:   []byte("foo"),
 		Value: []byte("bar"),
 		Type:  RecordUpdate,
+		Seq:   42,
 	})
 	assert.NoError(t, err)
 
@@ -26,9 +29,28 @@ func TestCodec_RoundTripUpdate(t *testing.T) {
 		Key:   []byte("foo"),
 		Value: []byte("bar"),
 		Type:  RecordUpdate,
+		Seq:   42,
 	}, *record)
 }
 
+func TestCodec_RoundTripExpiry(t *testing.T) {
+	codec := Codec{}
+	rec := &Record{
+		Key:       []byte("foo"),
+		Value:     []byte("bar"),
+		Type:      RecordUpdate,
+		Seq:       42,
+		ExpiresAt: 1600000000000000000,
+	}
+
+	data, err := codec.Encode(rec)
+	assert.NoError(t, err)
+
+	record, err := codec.Decode(data[4:])
+	assert.NoError(t, err)
+	assert.Equal(t, rec, record)
+}
+
 func TestCodec_RoundTripDelete(t *testing.T) {
 	codec := Codec{}
 	data, err := codec.Encode(&Record{
@@ -49,6 +71,40 @@ func TestCodec_RoundTripDelete(t *testing.T) {
 	}, *record)
 }
 
+func TestCodec_RoundTripRangeDelete(t *testing.T) {
+	codec := Codec{}
+	rec := NewRangeDelete([]byte("bar"), []byte("foo"))
+	rec.Seq = 7
+
+	data, err := codec.Encode(rec)
+	assert.NoError(t, err)
+
+	totalLen := binary.BigEndian.Uint32(data[0:4])
+	assert.Equal(t, totalLen, uint32(len(data)-4))
+
+	record, err := codec.Decode(data[4:])
+	assert.NoError(t, err)
+	assert.Equal(t, rec, record)
+}
+
+func TestCodec_RoundTripFooter(t *testing.T) {
+	codec := Codec{}
+	footer := &Footer{
+		IndexStartByte:       100,
+		Length:               12,
+		IndexEntries:         3,
+		RangeDeleteStartByte: 150,
+		RangeDeleteEntries:   2,
+	}
+
+	data, err := codec.EncodeFooter(footer)
+	assert.NoError(t, err)
+
+	actual, err := codec.DecodeFooter(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, footer, actual)
+}
+
 func TestCodec_ChecksumFail(t *testing.T) {
 	codec := Codec{}
 	data, err := codec.Encode(&Record{
@@ -71,5 +127,48 @@ func TestCodec_ChecksumFail(t *testing.T) {
 	assert.Equal(t, totalLen, uint32(len(data)-4))
 
 	_, err = codec.Decode(data[4:])
-	assert.EqualError(t, err, "expected checksum of WAL record does not match! expected=12, actual=538011314")
+	assert.EqualError(t, err, "corruption detected: expected checksum of WAL record does not match! expected=12, "+
+		"actual=2033142217")
+	assert.True(t, errors.Is(err, ErrCorruption))
+}
+
+func TestCodec_RoundTripBatch(t *testing.T) {
+	codec := Codec{}
+	records := []*Record{
+		NewRecord([]byte("foo"), []byte("bar"), false),
+		NewRecord([]byte("baz"), nil, true),
+		{Key: []byte("qux"), Value: []byte("quux"), Type: RecordUpdate, Seq: 3, ColumnFamily: 2},
+	}
+
+	data, err := codec.EncodeBatch(records)
+	assert.NoError(t, err)
+
+	totalLen := binary.BigEndian.Uint32(data[0:4])
+	assert.Equal(t, totalLen, uint32(len(data)-4))
+
+	actual, err := codec.DecodeBatch(data[4:])
+	assert.NoError(t, err)
+	assert.Equal(t, records, actual)
+}
+
+func TestCodec_BatchChecksumFail(t *testing.T) {
+	codec := Codec{}
+	data, err := codec.EncodeBatch([]*Record{NewRecord([]byte("foo"), []byte("bar"), false)})
+	assert.NoError(t, err)
+
+	// Corrupt the value of the record
+	data[len(data)-10] ^= 0xFF
+
+	_, err = codec.DecodeBatch(data[4:])
+	assert.True(t, errors.Is(err, ErrCorruption))
+}
+
+func TestCodec_DecodeTruncated(t *testing.T) {
+	codec := Codec{}
+
+	_, err := codec.Decode([]byte{1, 2})
+	assert.True(t, errors.Is(err, ErrCorruption))
+
+	_, err = codec.DecodeBatch([]byte{1, 2})
+	assert.True(t, errors.Is(err, ErrCorruption))
 }
@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorruption indicates that data read from disk is malformed or fails its checksum
+var ErrCorruption = errors.New("corruption detected")
+
+// ErrIncompatibleFormat indicates that a file on disk was written in a format this version can't read, either by
+// a newer version or by one from before the formats were versioned
+var ErrIncompatibleFormat = errors.New("incompatible file format")
+
+// Corruptf returns an error wrapping ErrCorruption, described by the format and args provided
+func Corruptf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorruption, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,25 @@
+package storage
+
+import "fmt"
+
+// MergeOperator combines the operands written to a key with DB#Merge into a single value
+type MergeOperator interface {
+	// Merge applies operands, ordered from oldest to newest, to the existing value of key. existing
+	// is nil if the key has no value
+	Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// FullMerge applies operands to existing using op. Operands are expected newest first, which is the
+// order they're found in when searching from newer to older data
+func FullMerge(op MergeOperator, key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	if op == nil {
+		return nil, fmt.Errorf("found merge operands for key %s but no merge operator is configured", key)
+	}
+
+	ordered := make([][]byte, len(operands))
+	for i, operand := range operands {
+		ordered[len(operands)-1-i] = operand
+	}
+
+	return op.Merge(key, existing, ordered)
+}
@@ -1,17 +1,40 @@
 package storage
 
+import "bytes"
+
 type RecordType int8
 
 const (
-	RecordUpdate RecordType = iota // indicates that this record was an update
-	RecordDelete                   // indicates that this record was a delete
+	RecordUpdate      RecordType = iota // indicates that this record was an update
+	RecordDelete                        // indicates that this record was a delete
+	RecordRangeDelete                   // indicates that this record deletes every key from Key up to but not including Value
+	RecordMerge                         // indicates that this record is an operand to be merged into the key's value
 )
 
-// Record is an in-memory representation of an update on the datastore
+// LookupStatus is the result of looking up a key in a single layer of the datastore (e.g. a
+// memtable or an sstable). A key that has been deleted is distinct from one that was never seen
+// so that a delete can stop a lookup from falling through to older layers
+type LookupStatus int8
+
+const (
+	KeyNotFound LookupStatus = iota // indicates that the layer has no record of the key
+	KeyFound                        // indicates that the layer has a live value for the key
+	KeyDeleted                      // indicates that the most recent record of the key in the layer is a delete
+)
+
+// Record is an in-memory representation of an update on the datastore. Seq is the sequence
+// number assigned to the update when it was written. It determines the order of updates to the
+// same key, with higher sequence numbers being more recent. ExpiresAt is the time, in nanoseconds
+// since the Unix epoch, after which an update is no longer visible. Zero means it never expires.
+// ColumnFamily is the id of the column family the update applies to. It's only persisted in the
+// WAL, since every other structure holds data for a single column family
 type Record struct {
-	Key   []byte
-	Value []byte
-	Type  RecordType
+	Key          []byte
+	Value        []byte
+	Type         RecordType
+	Seq          uint64
+	ExpiresAt    int64
+	ColumnFamily uint32
 }
 
 // RecordPointer is a pointer to a Record on disk
@@ -22,11 +45,15 @@ type RecordPointer struct {
 }
 
 // Footer is the last entry in an sstable. It points to the first index in the list
-// of indices within the file. Length is the length of the index entry in bytes
+// of indices within the file. Length is the length of the index entry in bytes. It
+// also points to the range deletes in the file, which follow the indices. It ends with the
+// table's format version
 type Footer struct {
-	IndexStartByte uint32
-	Length         uint32
-	IndexEntries   uint32
+	IndexStartByte       uint32
+	Length               uint32
+	IndexEntries         uint32
+	RangeDeleteStartByte uint32
+	RangeDeleteEntries   uint32
 }
 
 func NewRecord(key []byte, value []byte, delete bool) *Record {
@@ -43,3 +70,62 @@ func NewRecord(key []byte, value []byte, delete bool) *Record {
 		Type:  rType,
 	}
 }
+
+// NewRangeDelete returns a record that deletes every key greater than or equal to start and less than end
+func NewRangeDelete(start []byte, end []byte) *Record {
+	return &Record{
+		Key:   start,
+		Value: end,
+		Type:  RecordRangeDelete,
+	}
+}
+
+// NewMerge returns a record that merges operand into the value of key
+func NewMerge(key []byte, operand []byte) *Record {
+	return &Record{
+		Key:   key,
+		Value: operand,
+		Type:  RecordMerge,
+	}
+}
+
+// Expired returns true if the record is an update that has expired as of now, in nanoseconds since
+// the Unix epoch. An expired update hides older versions of its key the same way a delete does
+func (r *Record) Expired(now int64) bool {
+	return r.Type == RecordUpdate && r.ExpiresAt != 0 && r.ExpiresAt <= now
+}
+
+// Deletes returns true if the record is a range delete that hides the version of key with
+// sequence number seq. Range deletes only hide versions written before them
+func (r *Record) Deletes(key []byte, seq uint64) bool {
+	return r.Type == RecordRangeDelete && r.Seq > seq &&
+		bytes.Compare(r.Key, key) <= 0 && bytes.Compare(key, r.Value) < 0
+}
+
+// RangeDeleted returns true if any of the range deletes that are visible as of sequence number
+// seq hides the version of key with sequence number version. A version of 0 indicates that there
+// is no version of key, in which case any visible range delete covering key hides it
+func RangeDeleted(rangeDeletes []*Record, key []byte, version uint64, seq uint64) bool {
+	for _, rd := range rangeDeletes {
+		if rd.Seq <= seq && rd.Deletes(key, version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Compare orders records by key ascending and then by sequence number descending, meaning that
+// the most recent version of a key comes before older versions of it
+func Compare(a *Record, b *Record) int {
+	if c := bytes.Compare(a.Key, b.Key); c != 0 {
+		return c
+	}
+
+	if a.Seq > b.Seq {
+		return -1
+	} else if a.Seq < b.Seq {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	a1 := &Record{Key: []byte("a"), Seq: 1}
+	a2 := &Record{Key: []byte("a"), Seq: 2}
+	b1 := &Record{Key: []byte("b"), Seq: 1}
+
+	assert.Equal(t, -1, Compare(a1, b1))
+	assert.Equal(t, 1, Compare(b1, a2))
+
+	// More recent versions of a key come first
+	assert.Equal(t, -1, Compare(a2, a1))
+	assert.Equal(t, 1, Compare(a1, a2))
+	assert.Equal(t, 0, Compare(a1, a1))
+}
+
+func TestRecord_Deletes(t *testing.T) {
+	rd := NewRangeDelete([]byte("b"), []byte("d"))
+	rd.Seq = 5
+
+	assert.True(t, rd.Deletes([]byte("b"), 4))
+	assert.True(t, rd.Deletes([]byte("c"), 1))
+
+	// End of the range is exclusive
+	assert.False(t, rd.Deletes([]byte("d"), 4))
+	assert.False(t, rd.Deletes([]byte("a"), 4))
+
+	// Writes made after the range delete are not hidden by it
+	assert.False(t, rd.Deletes([]byte("c"), 6))
+
+	// Only range deletes hide other keys
+	assert.False(t, NewRecord([]byte("c"), nil, true).Deletes([]byte("c"), 0))
+}
+
+func TestRecord_Expired(t *testing.T) {
+	rec := &Record{Key: []byte("foo"), Value: []byte("bar"), Type: RecordUpdate, ExpiresAt: 10}
+
+	assert.False(t, rec.Expired(9))
+	assert.True(t, rec.Expired(10))
+	assert.True(t, rec.Expired(11))
+
+	// Records without an expiry live forever
+	rec.ExpiresAt = 0
+	assert.False(t, rec.Expired(11))
+}
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"bytes"
 	"os"
 	"path"
 	"sort"
@@ -46,7 +47,12 @@ func AssertTable(t *testing.T, entries map[string]string, filename, tablePath st
 		assert.NoError(t, err)
 
 		assert.Equal(t, []byte(keys[i]), rec.Key)
-		assert.Equal(t, []byte(entries[keys[i]]), rec.Value)
+		// Like StaticIterator, an empty value represents a delete
+		if entries[keys[i]] == "" {
+			assert.Equal(t, storage.RecordDelete, rec.Type)
+		} else {
+			assert.Equal(t, []byte(entries[keys[i]]), rec.Value)
+		}
 	}
 }
 
@@ -91,3 +97,14 @@ func (s *StaticIterator) Next() *storage.Record {
 }
 
 var _ interfaces.InternalIterator = &StaticIterator{}
+
+// AppendOperator is a merge operator that joins operands onto the existing value with commas
+type AppendOperator struct{}
+
+func (AppendOperator) Merge(_ []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	parts := operands
+	if existing != nil {
+		parts = append([][]byte{existing}, operands...)
+	}
+	return bytes.Join(parts, []byte(",")), nil
+}
@@ -18,10 +18,29 @@ func CreateFile(filename string, dbName string, dataDir string) (*os.File, error
 		}
 	}
 
-	file, err := os.Create(tablePath)
-	if err != nil {
+	// Created exclusively so that a file created since checking for it isn't truncated
+	file, err := os.OpenFile(tablePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("attempting to create %s but already exists", tablePath)
+	} else if err != nil {
 		return nil, fmt.Errorf("could not create %s file: %w", tablePath, err)
 	}
 
 	return file, nil
 }
+
+// SyncDir syncs the database's directory to disk so that the files created in it, and those removed from it,
+// survive a crash
+func SyncDir(dbName string, dataDir string) error {
+	dir, err := os.Open(path.Join(dataDir, dbName))
+	if err != nil {
+		return fmt.Errorf("could not open %s directory: %w", dbName, err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("failed syncing %s directory: %w", dbName, err)
+	}
+
+	return nil
+}
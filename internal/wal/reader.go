@@ -0,0 +1,147 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+const archivePrefix = "archived"
+
+// Reader reads the batches in a WAL file in the order they were written
+type Reader struct {
+	codec  storage.Codec
+	file   *os.File
+	reader io.Reader
+}
+
+// NewReader returns a Reader over every batch written to the WAL so far. Batches written afterwards
+// are not read
+func (w *WAL) NewReader() (*Reader, error) {
+	file, err := os.Open(w.logFile.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed opening WAL for reading: %w", err)
+	}
+
+	reader := io.NewSectionReader(file, storage.HeaderLen, int64(w.size))
+	return &Reader{codec: w.codec, file: file, reader: reader}, nil
+}
+
+// OpenArchived returns a Reader over the archived WAL file at path
+func OpenArchived(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening archived WAL for reading: %w", err)
+	}
+
+	reader := &Reader{codec: storage.Codec{}, file: file, reader: file}
+	if err := reader.codec.DecodeHeader(file, storage.WALMagic); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading header of archived WAL %s: %w", path, err)
+	}
+
+	return reader, nil
+}
+
+// Next returns the records in the next batch. ok is false once there are no more complete batches
+func (r *Reader) Next() (records []*storage.Record, ok bool, err error) {
+	return readBatch(r.codec, r.reader, r.file.Name())
+}
+
+// Close closes the file being read
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// Archive closes the WAL and moves its file aside instead of removing it, so that its batches can
+// still be read with OpenArchived
+func (w *WAL) Archive() error {
+	if err := w.logFile.Close(); err != nil {
+		return fmt.Errorf("failed attempting to close WAL log file: %w", err)
+	}
+
+	dir, name := filepath.Split(w.logFile.Name())
+	if err := os.Rename(w.logFile.Name(), path.Join(dir, fmt.Sprintf("%s_%s", archivePrefix, name))); err != nil {
+		return fmt.Errorf("failed attempting to archive WAL file: %w", err)
+	}
+
+	return nil
+}
+
+// Archived returns the paths of the database's archived WAL files, from oldest to newest
+func Archived(dbName string, dataDir string) ([]string, error) {
+	search := path.Join(dataDir, dbName, fmt.Sprintf("%s_%s_%s_*", archivePrefix, walPrefix, dbName))
+	matches, err := filepath.Glob(search)
+	if err != nil {
+		return nil, fmt.Errorf("error finding archived WAL files: %w", err)
+	}
+
+	// File names end with the time the WAL was created, so sorting them orders them by age
+	sort.Strings(matches)
+
+	return matches, nil
+}
+
+// RemoveArchived removes the database's archived WAL files that were last written to before cutoff
+func RemoveArchived(dbName string, dataDir string, cutoff time.Time) error {
+	archived, err := Archived(dbName, dataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range archived {
+		info, err := os.Stat(name)
+		if err != nil {
+			return fmt.Errorf("error retrieving file info for archived WAL: %w", err)
+		}
+
+		if !info.ModTime().Before(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(name); err != nil {
+			return fmt.Errorf("failed attempting to remove archived WAL file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// readBatch reads the next batch from reader. ok is false if there are no more batches or the
+// next one was only partially written to the end of the log (e.g. due to a crash mid-write)
+func readBatch(codec storage.Codec, reader io.Reader, name string) (records []*storage.Record, ok bool, err error) {
+	data := make([]byte, uint32size)
+	if _, err := io.ReadFull(reader, data); err == io.EOF {
+		return nil, false, nil
+	} else if err == io.ErrUnexpectedEOF {
+		log.Warnf("found partially written batch length at end of WAL %s. skipping", name)
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to read batch length: %w", err)
+	}
+
+	bLen := binary.BigEndian.Uint32(data)
+
+	batchBytes := make([]byte, bLen)
+	if n, err := io.ReadFull(reader, batchBytes); err == io.EOF || err == io.ErrUnexpectedEOF {
+		log.Warnf("found partially written batch at end of WAL %s. read=%d, expected=%d. skipping",
+			name, n, bLen)
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to read batch: %w", err)
+	}
+
+	if records, err = codec.DecodeBatch(batchBytes); err != nil {
+		return nil, false, fmt.Errorf("failed to decoding batch: %w", err)
+	}
+
+	return records, true, nil
+}
@@ -0,0 +1,95 @@
+package wal
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/storage"
+	"github.com/nbroyles/nbdb/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "wal_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	wf, err := CreateFile(dbName, dir)
+	assert.NoError(t, err)
+	w := New(wf)
+
+	batch := []*storage.Record{newRecord("foo", "bar", 1, false), newRecord("baz", "", 2, true)}
+	assert.NoError(t, w.WriteBatch(batch))
+
+	reader, err := w.NewReader()
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	// Batches written after the reader was created aren't read
+	assert.NoError(t, w.Write(newRecord("bax", "bam", 3, false)))
+
+	records, ok, err := reader.Next()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, batch, records)
+
+	_, ok, err = reader.Next()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestWAL_Archive(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "wal_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	for i := 1; i <= 2; i++ {
+		wf, err := CreateFile(dbName, dir)
+		assert.NoError(t, err)
+		w := New(wf)
+		assert.NoError(t, w.Write(newRecord("foo", "bar", uint64(i), false)))
+		assert.NoError(t, w.Archive())
+		assert.False(t, test.FileExists(t, w.Name()))
+	}
+
+	// Archived files aren't mistaken for the active WAL
+	wals, err := FindExisting(dbName, dir)
+	assert.NoError(t, err)
+	assert.Empty(t, wals)
+
+	archived, err := Archived(dbName, dir)
+	assert.NoError(t, err)
+	assert.Len(t, archived, 2)
+
+	for i, name := range archived {
+		reader, err := OpenArchived(name)
+		assert.NoError(t, err)
+
+		records, ok, err := reader.Next()
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, []*storage.Record{newRecord("foo", "bar", uint64(i+1), false)}, records)
+		assert.NoError(t, reader.Close())
+	}
+
+	// Only files last written to before the cutoff are removed
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(archived[0], old, old))
+	assert.NoError(t, RemoveArchived(dbName, dir, time.Now().Add(-time.Minute)))
+
+	remaining, err := Archived(dbName, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, archived[1:], remaining)
+}
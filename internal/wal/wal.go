@@ -1,12 +1,11 @@
 package wal
 
 import (
-	"encoding/binary"
 	"fmt"
-	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/nbroyles/nbdb/internal/memtable"
@@ -21,7 +20,10 @@ import (
 type WAL struct {
 	codec   storage.Codec
 	logFile *os.File
-	size    uint32
+	// size is the number of bytes of batches written, not counting the header
+	size uint32
+	// syncLatency is how long the most recent write took to sync to disk
+	syncLatency time.Duration
 }
 
 const (
@@ -34,42 +36,101 @@ func New(file *os.File) *WAL {
 	return &WAL{codec: storage.Codec{}, logFile: file, size: 0}
 }
 
+// CreateFile creates a new WAL file, starting with a header recording the format version it's written in
 func CreateFile(dbName string, dataDir string) (*os.File, error) {
-	return util.CreateFile(fmt.Sprintf("%s_%s_%d", walPrefix, dbName, time.Now().UnixNano()/1_000_000_000),
+	file, err := util.CreateFile(fmt.Sprintf("%s_%s_%d", walPrefix, dbName, time.Now().UnixNano()),
 		dbName, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeHeader(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// writeHeader writes the header identifying file as a WAL written in the current format version
+func writeHeader(file *os.File) error {
+	codec := storage.Codec{}
+	if _, err := file.Write(codec.EncodeHeader(storage.WALMagic)); err != nil {
+		return fmt.Errorf("failed writing WAL header: %w", err)
+	}
+
+	return nil
 }
 
-// FindExisting returns true and the WAL filename if an existing WAL is fine. Otherwise, returns false
-func FindExisting(dbName string, dataDir string) (bool, *WAL, error) {
+// FindExisting returns every WAL left behind by the database, from oldest to newest. There's more than one
+// when memtables written to older WALs were still waiting to be flushed. Archived WALs aren't included
+func FindExisting(dbName string, dataDir string) ([]*WAL, error) {
 	search := path.Join(dataDir, dbName, fmt.Sprintf("%s_%s_*", walPrefix, dbName))
 	matches, err := filepath.Glob(search)
 	if err != nil {
-		return false, nil, fmt.Errorf("error loading WAL file: %w", err)
-	} else if len(matches) == 0 {
-		return false, nil, nil
-	} else if len(matches) > 1 {
-		return false, nil, fmt.Errorf("multiple WAL files detected: %v", matches)
+		return nil, fmt.Errorf("error loading WAL file: %w", err)
 	}
 
-	file, err := os.OpenFile(matches[0], os.O_RDWR|os.O_APPEND, 0666)
-	if err != nil {
-		return false, nil, fmt.Errorf("error opening existing WAL file: %w", err)
-	}
+	// File names end with the time the WAL was created, so sorting them orders them by age
+	sort.Strings(matches)
 
-	info, err := file.Stat()
-	if err != nil {
-		return false, nil, fmt.Errorf("error retrieving file info for WAL: %w", err)
+	wals := make([]*WAL, 0, len(matches))
+	for _, match := range matches {
+		file, err := os.OpenFile(match, os.O_RDWR|os.O_APPEND, 0666)
+		if err != nil {
+			closeAll(wals)
+			return nil, fmt.Errorf("error opening existing WAL file: %w", err)
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			closeAll(wals)
+			return nil, fmt.Errorf("error retrieving file info for WAL: %w", err)
+		}
+
+		wal := New(file)
+		if info.Size() < storage.HeaderLen {
+			// Created just before a crash. Nothing can have been written after a partial header, so start afresh
+			if err := file.Truncate(0); err != nil {
+				file.Close()
+				closeAll(wals)
+				return nil, fmt.Errorf("error truncating partially written WAL header: %w", err)
+			} else if err := writeHeader(file); err != nil {
+				file.Close()
+				closeAll(wals)
+				return nil, err
+			}
+		} else if err := wal.codec.DecodeHeader(file, storage.WALMagic); err != nil {
+			file.Close()
+			closeAll(wals)
+			return nil, fmt.Errorf("error reading header of WAL %s: %w", match, err)
+		} else {
+			wal.size = uint32(info.Size() - storage.HeaderLen)
+		}
+		wals = append(wals, wal)
 	}
 
-	wal := New(file)
-	wal.size = uint32(info.Size())
+	return wals, nil
+}
 
-	return true, wal, nil
+// closeAll closes the files backing wals without removing them
+func closeAll(wals []*WAL) {
+	for _, wal := range wals {
+		wal.logFile.Close()
+	}
 }
 
 // Write writes the record to the writeahead log
 func (w *WAL) Write(record *storage.Record) error {
-	data, err := w.codec.Encode(record)
+	return w.WriteBatch([]*storage.Record{record})
+}
+
+// WriteBatch writes the records to the writeahead log as a single entry. Upon restore,
+// either all of the records in the batch are recovered or none of them are
+func (w *WAL) WriteBatch(records []*storage.Record) error {
+	data, err := w.codec.EncodeBatch(records)
 	if err != nil {
 		return fmt.Errorf("failed encoding data to write to log: %w", err)
 	}
@@ -84,6 +145,17 @@ func (w *WAL) Write(record *storage.Record) error {
 	// update current size of WAL
 	w.size += uint32(len(data))
 
+	start := time.Now()
+	if err := w.logFile.Sync(); err != nil {
+		return fmt.Errorf("failed syncing data to disk: %w", err)
+	}
+	w.syncLatency = time.Since(start)
+
+	return nil
+}
+
+// Sync syncs the writeahead log to disk
+func (w *WAL) Sync() error {
 	if err := w.logFile.Sync(); err != nil {
 		return fmt.Errorf("failed syncing data to disk: %w", err)
 	}
@@ -95,41 +167,55 @@ func (w *WAL) Size() uint32 {
 	return w.size
 }
 
-func (w *WAL) Restore(mem *memtable.MemTable) error {
-	for {
-		data := make([]byte, uint32size)
-		if n, err := w.logFile.Read(data); err == io.EOF {
-			break
-		} else if n != len(data) {
-			return fmt.Errorf("failed to read expected amount of data from WAL."+
-				" read=%d, expected=%d", n, len(data))
-		} else if err != nil {
-			return fmt.Errorf("failed to read record: %w", err)
-		}
-
-		rLen := binary.BigEndian.Uint32(data)
-
-		recBytes := make([]byte, rLen)
-		if n, err := w.logFile.Read(recBytes); uint32(n) != rLen {
-			return fmt.Errorf("failed to read expected amount of record data from WAL."+
-				" read=%d, expected=%d", n, rLen)
-		} else if err != nil {
-			return fmt.Errorf("failed to read record: %w", err)
-		}
+// SyncLatency returns how long the most recent write took to sync to disk
+func (w *WAL) SyncLatency() time.Duration {
+	return w.syncLatency
+}
 
-		record, err := w.codec.Decode(recBytes)
+// Restore replays every batch in the writeahead log into the memtables provided, keyed by column
+// family id, and returns the largest sequence number found. A batch that was only partially written
+// to the end of the log (e.g. due to a crash mid-write) is skipped entirely. Sequence numbers are
+// handed out in the order batches are written, so a record that doesn't follow the one before it
+// means the log is corrupt
+func (w *WAL) Restore(memtables map[uint32]*memtable.MemTable) (uint64, error) {
+	var maxSeq uint64
+	for {
+		records, ok, err := readBatch(w.codec, w.logFile, w.logFile.Name())
 		if err != nil {
-			return fmt.Errorf("failed to decoding record: %w", err)
+			return 0, err
+		} else if !ok {
+			break
 		}
 
-		if record.Type == storage.RecordUpdate {
-			mem.Put(record.Key, record.Value)
-		} else {
-			mem.Delete(record.Key)
+		for _, record := range records {
+			mem, ok := memtables[record.ColumnFamily]
+			if !ok {
+				return 0, storage.Corruptf("found record for unknown column family %d in WAL", record.ColumnFamily)
+			} else if record.Seq <= maxSeq {
+				return 0, storage.Corruptf("found record with sequence number %d after %d in WAL", record.Seq, maxSeq)
+			}
+
+			switch record.Type {
+			case storage.RecordUpdate:
+				mem.PutWithExpiry(record.Key, record.Value, record.ExpiresAt, record.Seq)
+			case storage.RecordDelete:
+				mem.Delete(record.Key, record.Seq)
+			case storage.RecordMerge:
+				mem.Merge(record.Key, record.Value, record.Seq)
+			case storage.RecordRangeDelete:
+				mem.DeleteRange(record.Key, record.Value, record.Seq)
+			}
+
+			maxSeq = record.Seq
 		}
 	}
 
-	return nil
+	return maxSeq, nil
+}
+
+// Name returns the path of the file backing the WAL
+func (w *WAL) Name() string {
+	return w.logFile.Name()
 }
 
 func (w *WAL) Close() error {
@@ -3,6 +3,7 @@ package wal
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
@@ -46,10 +47,10 @@ func TestWAL_Write(t *testing.T) {
 	w := New(wf)
 
 	records := []*storage.Record{
-		storage.NewRecord([]byte("foo"), []byte("bar"), false),
-		storage.NewRecord([]byte("foo"), nil, true),
-		storage.NewRecord([]byte("foo"), []byte("baz"), false),
-		storage.NewRecord([]byte("oooooh"), []byte("wweeee"), false),
+		newRecord("foo", "bar", 1, false),
+		newRecord("foo", "", 2, true),
+		newRecord("foo", "baz", 3, false),
+		newRecord("oooooh", "wweeee", 4, false),
 	}
 	for _, record := range records {
 		assert.NoError(t, w.Write(record))
@@ -57,19 +58,20 @@ func TestWAL_Write(t *testing.T) {
 
 	data, err := ioutil.ReadFile(w.logFile.Name())
 	assert.NoError(t, err)
+	assert.NoError(t, w.codec.DecodeHeader(bytes.NewReader(data), storage.WALMagic))
 
-	for i, j := 0, 0; i < len(data); j++ {
+	for i, j := storage.HeaderLen, 0; i < len(data); j++ {
 		reader := bytes.NewReader(data[i:])
 
 		var totalLen uint32
 		err = binary.Read(reader, binary.BigEndian, &totalLen)
 		assert.NoError(t, err)
 
-		recordBytes := data[i+4 : (i + int(totalLen) + 4)]
-		actualRecord, err := w.codec.Decode(recordBytes)
+		batchBytes := data[i+4 : (i + int(totalLen) + 4)]
+		actualRecords, err := w.codec.DecodeBatch(batchBytes)
 		assert.NoError(t, err)
 
-		assert.Equal(t, records[j], actualRecord)
+		assert.Equal(t, []*storage.Record{records[j]}, actualRecords)
 
 		i += int(totalLen + 4)
 	}
@@ -112,36 +114,297 @@ func TestWAL_Restore(t *testing.T) {
 	w := New(wf)
 
 	records := []*storage.Record{
-		storage.NewRecord([]byte("foo"), []byte("bar"), false),
-		storage.NewRecord([]byte("foo"), nil, true),
-		storage.NewRecord([]byte("foo"), []byte("baz"), false),
-		storage.NewRecord([]byte("oooooh"), []byte("wweeee"), false),
+		newRecord("foo", "bar", 1, false),
+		newRecord("foo", "", 2, true),
+		newRecord("foo", "baz", 3, false),
+		newRecord("oooooh", "wweeee", 4, false),
 	}
 	for _, record := range records {
 		assert.NoError(t, w.Write(record))
 	}
 
-	found, loadedWal, err := FindExisting(dbName, dir)
+	wals, err := FindExisting(dbName, dir)
 	assert.NoError(t, err)
-	assert.True(t, found)
+	assert.Len(t, wals, 1)
+	loadedWal := wals[0]
 
 	mt := memtable.New()
 	iter := mt.InternalIterator()
 	assert.False(t, iter.HasNext())
 
-	err = loadedWal.Restore(mt)
+	seq, err := loadedWal.Restore(map[uint32]*memtable.MemTable{0: mt})
 	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), seq)
 
+	// Every version is restored, most recent first
 	iter = mt.InternalIterator()
-	rec := iter.Next()
-	assert.Equal(t, records[2], rec)
+	for _, idx := range []int{2, 1, 0, 3} {
+		assert.Equal(t, records[idx], iter.Next())
+	}
+
+	assert.False(t, iter.HasNext())
+}
+
+func TestWAL_WriteBatch(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "wal_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	wf, err := CreateFile(dbName, dir)
+	assert.NoError(t, err)
+	w := New(wf)
+
+	records := []*storage.Record{
+		newRecord("foo", "bar", 1, false),
+		newRecord("baz", "bax", 2, false),
+	}
+	assert.NoError(t, w.WriteBatch(records))
+
+	data, err := ioutil.ReadFile(w.logFile.Name())
+	assert.NoError(t, err)
+	data = data[storage.HeaderLen:]
+
+	// Only a single entry should have been written
+	totalLen := binary.BigEndian.Uint32(data[0:4])
+	assert.Equal(t, uint32(len(data)-4), totalLen)
+
+	actual, err := w.codec.DecodeBatch(data[4:])
+	assert.NoError(t, err)
+	assert.Equal(t, records, actual)
+}
 
-	rec = iter.Next()
-	assert.Equal(t, records[3], rec)
+func TestWAL_RestoreRangeDelete(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "wal_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	wf, err := CreateFile(dbName, dir)
+	assert.NoError(t, err)
+	w := New(wf)
+
+	rd := storage.NewRangeDelete([]byte("a"), []byte("c"))
+	rd.Seq = 2
+	assert.NoError(t, w.WriteBatch([]*storage.Record{newRecord("b", "bar", 1, false), rd}))
+
+	wals, err := FindExisting(dbName, dir)
+	assert.NoError(t, err)
+	assert.Len(t, wals, 1)
+	loadedWal := wals[0]
+
+	mt := memtable.New()
+	seq, err := loadedWal.Restore(map[uint32]*memtable.MemTable{0: mt})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), seq)
+
+	assert.Equal(t, []*storage.Record{rd}, mt.RangeDeletes())
+
+	status, _, _ := mt.Get([]byte("b"), seq, nil)
+	assert.Equal(t, storage.KeyDeleted, status)
+}
+
+func TestWAL_RestoreColumnFamilies(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "wal_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	wf, err := CreateFile(dbName, dir)
+	assert.NoError(t, err)
+	w := New(wf)
+
+	other := newRecord("foo", "baz", 2, false)
+	other.ColumnFamily = 1
+	assert.NoError(t, w.WriteBatch([]*storage.Record{newRecord("foo", "bar", 1, false), other}))
+
+	wals, err := FindExisting(dbName, dir)
+	assert.NoError(t, err)
+	assert.Len(t, wals, 1)
+	loadedWal := wals[0]
+
+	defaultMt := memtable.New()
+	otherMt := memtable.New()
+	seq, err := loadedWal.Restore(map[uint32]*memtable.MemTable{0: defaultMt, 1: otherMt})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), seq)
+
+	_, value, _ := defaultMt.Get([]byte("foo"), seq, nil)
+	assert.Equal(t, []byte("bar"), value)
+	_, value, _ = otherMt.Get([]byte("foo"), seq, nil)
+	assert.Equal(t, []byte("baz"), value)
+
+	// Records for column families that weren't provided can't be restored
+	wals, err = FindExisting(dbName, dir)
+	assert.NoError(t, err)
+	loadedWal = wals[0]
+	_, err = loadedWal.Restore(map[uint32]*memtable.MemTable{0: memtable.New()})
+	assert.Error(t, err)
+}
+
+func TestWAL_RestorePartialBatch(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "wal_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	wf, err := CreateFile(dbName, dir)
+	assert.NoError(t, err)
+	w := New(wf)
 
+	assert.NoError(t, w.Write(newRecord("foo", "bar", 1, false)))
+
+	// Simulate a crash partway through writing a batch
+	data, err := w.codec.EncodeBatch([]*storage.Record{
+		newRecord("baz", "bax", 2, false),
+		newRecord("howdy", "time", 3, false),
+	})
+	assert.NoError(t, err)
+	_, err = wf.Write(data[:len(data)-6])
+	assert.NoError(t, err)
+
+	wals, err := FindExisting(dbName, dir)
+	assert.NoError(t, err)
+	assert.Len(t, wals, 1)
+	loadedWal := wals[0]
+
+	mt := memtable.New()
+	seq, err := loadedWal.Restore(map[uint32]*memtable.MemTable{0: mt})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+
+	iter := mt.InternalIterator()
+	assert.Equal(t, newRecord("foo", "bar", 1, false), iter.Next())
 	assert.False(t, iter.HasNext())
 }
 
+func TestWAL_FindExistingMultiple(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "wal_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	var names []string
+	for i := 1; i <= 3; i++ {
+		wf, err := CreateFile(dbName, dir)
+		assert.NoError(t, err)
+		w := New(wf)
+		assert.NoError(t, w.Write(newRecord("foo", "bar", uint64(i), false)))
+		names = append(names, w.Name())
+	}
+
+	// Every WAL is found, oldest first
+	wals, err := FindExisting(dbName, dir)
+	assert.NoError(t, err)
+	assert.Len(t, wals, 3)
+
+	for i, w := range wals {
+		assert.Equal(t, names[i], w.Name())
+
+		seq, err := w.Restore(map[uint32]*memtable.MemTable{0: memtable.New()})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i+1), seq)
+	}
+}
+
+func TestWAL_FindExistingUnversioned(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "wal_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	// A WAL written before formats were versioned starts straight away with a batch
+	codec := storage.Codec{}
+	data, err := codec.EncodeBatch([]*storage.Record{newRecord("foo", "bar", 1, false)})
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dbPath, walPrefix+"_"+dbName+"_1"), data, 0644))
+
+	_, err = FindExisting(dbName, dir)
+	assert.True(t, errors.Is(err, storage.ErrIncompatibleFormat))
+}
+
+func TestWAL_FindExistingEmpty(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "wal_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	// A crash just after creating a WAL can leave it without a complete header
+	name := path.Join(dbPath, walPrefix+"_"+dbName+"_1")
+	assert.NoError(t, ioutil.WriteFile(name, []byte{0x6e, 0x62}, 0644))
+
+	wals, err := FindExisting(dbName, dir)
+	assert.NoError(t, err)
+	assert.Len(t, wals, 1)
+	assert.Equal(t, uint32(0), wals[0].Size())
+
+	assert.NoError(t, wals[0].Write(newRecord("foo", "bar", 1, false)))
+	closeAll(wals)
+
+	wals, err = FindExisting(dbName, dir)
+	assert.NoError(t, err)
+	mt := memtable.New()
+	seq, err := wals[0].Restore(map[uint32]*memtable.MemTable{0: mt})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+	closeAll(wals)
+}
+
+func TestWAL_RestoreOutOfOrder(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "wal_test"
+	dbPath := path.Join(dir, dbName)
+
+	test.MakeDB(t, dbPath)
+	defer test.CleanupDB(dbPath)
+
+	wf, err := CreateFile(dbName, dir)
+	assert.NoError(t, err)
+	w := New(wf)
+
+	// Two versions of a key with the same sequence number can't be told apart
+	assert.NoError(t, w.Write(newRecord("foo", "bar", 1, false)))
+	assert.NoError(t, w.Write(newRecord("foo", "baz", 1, false)))
+
+	wals, err := FindExisting(dbName, dir)
+	assert.NoError(t, err)
+	assert.Len(t, wals, 1)
+
+	_, err = wals[0].Restore(map[uint32]*memtable.MemTable{0: memtable.New()})
+	assert.True(t, errors.Is(err, storage.ErrCorruption))
+	closeAll(wals)
+}
+
 func TestWAL_Close(t *testing.T) {
 	dir, err := os.Getwd()
 	assert.NoError(t, err)
@@ -163,10 +426,21 @@ func TestWAL_Close(t *testing.T) {
 }
 
 func writeRecord(t *testing.T, w *WAL, rec *storage.Record) uint32 {
-	data, err := w.codec.Encode(rec)
+	data, err := w.codec.EncodeBatch([]*storage.Record{rec})
 	assert.NoError(t, err)
 
 	assert.NoError(t, w.Write(rec))
 
 	return uint32(len(data))
 }
+
+func newRecord(key string, value string, seq uint64, deleted bool) *storage.Record {
+	var val []byte
+	if !deleted {
+		val = []byte(value)
+	}
+
+	rec := storage.NewRecord([]byte(key), val, deleted)
+	rec.Seq = seq
+	return rec
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/storage"
+)
+
+// WriteBatch collects a set of updates that are applied to the database atomically via
+// DB#Write. Keys and values are copied when added, so callers are free to reuse them.
+// Updates apply to the default column family unless UseColumnFamily says otherwise.
+// Not threadsafe
+type WriteBatch struct {
+	records []*storage.Record
+	// family is the id of the column family that updates added to the batch apply to
+	family uint32
+}
+
+// NewWriteBatch returns an empty WriteBatch
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// size returns the number of bytes of keys and values in the batch
+func (b *WriteBatch) size() int {
+	size := 0
+	for _, record := range b.records {
+		size += len(record.Key) + len(record.Value)
+	}
+	return size
+}
+
+// Put adds an insert or update of key to the batch
+func (b *WriteBatch) Put(key []byte, value []byte) {
+	b.add(storage.NewRecord(copyBytes(key), copyBytes(value), false))
+}
+
+// PutWithTTL adds an insert or update of key that expires once ttl has passed to the batch. The
+// expiry is measured from when the update is added to the batch
+func (b *WriteBatch) PutWithTTL(key []byte, value []byte, ttl time.Duration) {
+	record := storage.NewRecord(copyBytes(key), copyBytes(value), false)
+	record.ExpiresAt = time.Now().Add(ttl).UnixNano()
+	b.add(record)
+}
+
+// Delete adds a delete of key to the batch
+func (b *WriteBatch) Delete(key []byte) {
+	b.add(storage.NewRecord(copyBytes(key), nil, true))
+}
+
+// Merge adds a merge of operand into the value of key to the batch
+func (b *WriteBatch) Merge(key []byte, operand []byte) {
+	b.add(storage.NewMerge(copyBytes(key), copyBytes(operand)))
+}
+
+// DeleteRange adds a delete of every key from start up to but not including end to the batch
+func (b *WriteBatch) DeleteRange(start []byte, end []byte) {
+	b.add(storage.NewRangeDelete(copyBytes(start), copyBytes(end)))
+}
+
+// UseColumnFamily makes every update added to the batch afterwards apply to the column family provided.
+// Updates already in the batch are unaffected
+func (b *WriteBatch) UseColumnFamily(family *ColumnFamily) {
+	b.family = family.id
+}
+
+func (b *WriteBatch) add(record *storage.Record) {
+	record.ColumnFamily = b.family
+	b.records = append(b.records, record)
+}
+
+// Len returns the number of updates in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+// Clear removes all updates from the batch so that it can be reused. Updates added afterwards
+// apply to the default column family
+func (b *WriteBatch) Clear() {
+	b.records = nil
+	b.family = defaultFamilyID
+}
+
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append([]byte{}, data...)
+}
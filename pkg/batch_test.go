@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteBatch(t *testing.T) {
+	batch := NewWriteBatch()
+	assert.Equal(t, 0, batch.Len())
+
+	key := []byte("foo")
+	value := []byte("bar")
+	batch.Put(key, value)
+	batch.Delete([]byte("baz"))
+	batch.DeleteRange([]byte("a"), []byte("c"))
+	batch.Merge([]byte("qux"), []byte("1"))
+	assert.Equal(t, 4, batch.Len())
+
+	// Batch should hold onto its own copies of keys and values
+	key[0] = 'g'
+	value[0] = 'c'
+
+	assert.Equal(t, []*storage.Record{
+		storage.NewRecord([]byte("foo"), []byte("bar"), false),
+		storage.NewRecord([]byte("baz"), nil, true),
+		storage.NewRangeDelete([]byte("a"), []byte("c")),
+		storage.NewMerge([]byte("qux"), []byte("1")),
+	}, batch.records)
+
+	batch.Clear()
+	assert.Equal(t, 0, batch.Len())
+}
+
+func TestWriteBatch_PutWithTTL(t *testing.T) {
+	batch := NewWriteBatch()
+
+	before := time.Now()
+	batch.PutWithTTL([]byte("foo"), []byte("bar"), time.Minute)
+
+	assert.Equal(t, 1, batch.Len())
+	assert.Equal(t, storage.RecordUpdate, batch.records[0].Type)
+	assert.GreaterOrEqual(t, batch.records[0].ExpiresAt, before.Add(time.Minute).UnixNano())
+	assert.LessOrEqual(t, batch.records[0].ExpiresAt, time.Now().Add(time.Minute).UnixNano())
+}
+
+func TestWriteBatch_UseColumnFamily(t *testing.T) {
+	batch := NewWriteBatch()
+	batch.Put([]byte("foo"), []byte("bar"))
+	batch.UseColumnFamily(&ColumnFamily{id: 2})
+	batch.Delete([]byte("baz"))
+
+	assert.Equal(t, uint32(0), batch.records[0].ColumnFamily)
+	assert.Equal(t, uint32(2), batch.records[1].ColumnFamily)
+
+	// Clearing the batch goes back to the default column family
+	batch.Clear()
+	batch.Put([]byte("foo"), []byte("bar"))
+	assert.Equal(t, uint32(0), batch.records[0].ColumnFamily)
+}
@@ -0,0 +1,422 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/compaction"
+	"github.com/nbroyles/nbdb/internal/memtable"
+	"github.com/nbroyles/nbdb/internal/sstable"
+	"github.com/nbroyles/nbdb/internal/storage"
+)
+
+const (
+	// DefaultColumnFamily is the name of the column family that DB#Get, DB#Put, etc. read and write
+	DefaultColumnFamily = "default"
+	defaultFamilyID     = uint32(0)
+)
+
+// ColumnFamily is a named keyspace within the database. Each column family has its own memtables
+// and sstables, but every column family shares the database's WAL and manifest. This means that
+// a WriteBatch with updates to several column families is still applied atomically.
+// Calls to Get, Put, Delete are thread-safe
+type ColumnFamily struct {
+	db   *DB
+	id   uint32
+	name string
+
+	// memTable is guarded by the database's mutex
+	memTable  *memtable.MemTable
+	compactor compaction.Compactor
+}
+
+func newColumnFamily(db *DB, id uint32, name string) *ColumnFamily {
+	family := &ColumnFamily{
+		db:       db,
+		id:       id,
+		name:     name,
+		memTable: memtable.New(),
+	}
+
+	opts := db.opts.compactionOpts()
+	opts.Listener = &compactionListener{family: family, inputs: make(map[string][]TableInfo)}
+	opts.RemoveTables = func(metas []*sstable.Metadata) error {
+		return db.removeTables(name, metas)
+	}
+	family.compactor = compaction.New(db.manifest, id, db.dataDir, db.name, opts)
+
+	return family
+}
+
+// CreateColumnFamily creates a new, empty column family with the name provided.
+// CreateColumnFamily fails if a column family of that name already exists
+func (d *DB) CreateColumnFamily(name string) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, fmt.Errorf("column family name must not be empty")
+	} else if len(name) > MaxColumnFamilyNameSize {
+		return nil, fmt.Errorf("column family name must be at most %d bytes. got %d", MaxColumnFamilyNameSize,
+			len(name))
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	if d.column(name) != nil {
+		return nil, fmt.Errorf("column family %s already exists", name)
+	}
+
+	id, err := d.manifest.AddColumnFamily(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed attempting to create column family: %w", err)
+	}
+
+	family := newColumnFamily(d, id, name)
+	d.families[id] = family
+
+	return family, nil
+}
+
+// Column returns the column family with the name provided, or nil if it does not exist
+func (d *DB) Column(name string) *ColumnFamily {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.column(name)
+}
+
+func (d *DB) column(name string) *ColumnFamily {
+	for _, family := range d.families {
+		if family.name == name {
+			return family
+		}
+	}
+
+	return nil
+}
+
+// Name returns the name of the column family
+func (c *ColumnFamily) Name() string {
+	return c.name
+}
+
+// Get returns the value associated with the key. If key is not found then
+// ErrNotFound is returned
+func (c *ColumnFamily) Get(key []byte) ([]byte, error) {
+	return c.GetWithOptsContext(context.Background(), key, ReadOpts{})
+}
+
+// GetContext is like Get, but gives up with ctx's error if ctx is done before the read completes
+func (c *ColumnFamily) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	return c.GetWithOptsContext(ctx, key, ReadOpts{})
+}
+
+// GetWithOpts returns the value associated with the key, reading as of the snapshot
+// in opts if one is provided. If key is not found then ErrNotFound is returned
+func (c *ColumnFamily) GetWithOpts(key []byte, opts ReadOpts) ([]byte, error) {
+	return c.GetWithOptsContext(context.Background(), key, opts)
+}
+
+// GetWithOptsContext is like GetWithOpts, but gives up with ctx's error if ctx is done before the read
+// completes
+func (c *ColumnFamily) GetWithOptsContext(ctx context.Context, key []byte, opts ReadOpts) ([]byte, error) {
+	defer c.db.stats.record(OpGet, time.Now())
+
+	values, errs := c.multiGet(ctx, [][]byte{key}, opts)
+	return values[0], errs[0]
+}
+
+// MultiGet returns the values associated with each of the keys. errs[i] is ErrNotFound if keys[i] is
+// not found. Each sstable is only opened once no matter how many of the keys it may hold, so MultiGet
+// is cheaper than calling Get for each key
+func (c *ColumnFamily) MultiGet(keys [][]byte) (values [][]byte, errs []error) {
+	return c.MultiGetWithOpts(keys, ReadOpts{})
+}
+
+// MultiGetWithOpts is like MultiGet, but reads as of the snapshot in opts if one is provided
+func (c *ColumnFamily) MultiGetWithOpts(keys [][]byte, opts ReadOpts) (values [][]byte, errs []error) {
+	defer c.db.stats.record(OpMultiGet, time.Now())
+
+	return c.multiGet(context.Background(), keys, opts)
+}
+
+func (c *ColumnFamily) multiGet(ctx context.Context, keys [][]byte, opts ReadOpts) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	fail := func(err error) ([][]byte, []error) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return values, errs
+	}
+
+	d := c.db
+	if err := d.rlockContext(ctx); err != nil {
+		return fail(err)
+	}
+	defer d.mutex.RUnlock()
+
+	if d.closed {
+		return fail(ErrClosed)
+	}
+
+	seq := d.seq
+	if opts.Snapshot != nil {
+		seq = opts.Snapshot.seq
+	}
+
+	// Search from newest to oldest data, stopping at the first layer that knows about each key. A delete
+	// found in a newer layer hides any value for the key in older ones. Merge operands are collected
+	// until the value they apply to is found
+	lookups := make([]*sstable.Lookup, len(keys))
+	for i, key := range keys {
+		lookup := &sstable.Lookup{Key: key}
+		lookup.Status, lookup.Value, lookup.Operands = c.memTable.Get(key, seq, nil)
+		for _, memTable := range c.immutableMemTables() {
+			if lookup.Status != storage.KeyNotFound {
+				break
+			}
+			lookup.Status, lookup.Value, lookup.Operands = memTable.Get(key, seq, lookup.Operands)
+		}
+		lookups[i] = lookup
+	}
+
+	// TODO: add a bloom filter to reduce need to potentially check every level
+	// TODO: can we unlock during this search? issue to solve is sstables getting compacted while searching
+	for i := 0; i < d.manifest.Levels(c.id); i++ {
+		metas := d.manifest.MetadataForLevel(c.id, i)
+		for j := range metas {
+			// sstables are ordered from oldest to newest. Only level 0 ones overlap under leveled compaction,
+			// but under tiered compaction every level's can
+			meta := metas[len(metas)-1-j]
+
+			// Group the keys that may be in the table so that it's only searched once
+			var pending []int
+			for k, lookup := range lookups {
+				if errs[k] == nil && lookup.Status == storage.KeyNotFound && meta.ContainsKey(lookup.Key) {
+					pending = append(pending, k)
+				}
+			}
+			if len(pending) == 0 {
+				continue
+			}
+
+			tableLookups := make([]*sstable.Lookup, len(pending))
+			for k, idx := range pending {
+				tableLookups[k] = lookups[idx]
+			}
+
+			if err := d.searchSSTable(ctx, tableLookups, seq, meta); err != nil {
+				for _, idx := range pending {
+					errs[idx] = fmt.Errorf("failed attempting to scan sstable for key %s: %w",
+						string(keys[idx]), err)
+				}
+			}
+		}
+	}
+
+	for i, lookup := range lookups {
+		if errs[i] != nil {
+			continue
+		}
+
+		if len(lookup.Operands) > 0 {
+			merged, err := storage.FullMerge(d.opts.MergeOperator, lookup.Key, lookup.Value, lookup.Operands)
+			if err != nil {
+				errs[i] = fmt.Errorf("failed merging operands for key %s: %w", string(lookup.Key), err)
+			} else {
+				values[i] = merged
+			}
+		} else if lookup.Status != storage.KeyFound {
+			errs[i] = ErrNotFound
+		} else {
+			values[i] = lookup.Value
+		}
+	}
+
+	return values, errs
+}
+
+// Put inserts or updates the value if the key already exists
+func (c *ColumnFamily) Put(key []byte, value []byte) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put, but gives up with ctx's error if ctx is done before the write is applied
+func (c *ColumnFamily) PutContext(ctx context.Context, key []byte, value []byte) error {
+	defer c.db.stats.record(OpPut, time.Now())
+
+	batch := c.newWriteBatch()
+	batch.Put(key, value)
+
+	if err := c.db.write(ctx, batch); err != nil {
+		return fmt.Errorf("failed attempting put: %w", err)
+	}
+
+	return nil
+}
+
+// PutWithTTL inserts or updates the value of key such that it expires once ttl has passed. Expired keys
+// are hidden from reads and removed during compaction
+func (c *ColumnFamily) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return c.PutWithTTLContext(context.Background(), key, value, ttl)
+}
+
+// PutWithTTLContext is like PutWithTTL, but gives up with ctx's error if ctx is done before the write is
+// applied
+func (c *ColumnFamily) PutWithTTLContext(ctx context.Context, key []byte, value []byte, ttl time.Duration) error {
+	defer c.db.stats.record(OpPut, time.Now())
+
+	batch := c.newWriteBatch()
+	batch.PutWithTTL(key, value, ttl)
+
+	if err := c.db.write(ctx, batch); err != nil {
+		return fmt.Errorf("failed attempting put with ttl: %w", err)
+	}
+
+	return nil
+}
+
+// Deletes the specified key from the column family
+func (c *ColumnFamily) Delete(key []byte) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, but gives up with ctx's error if ctx is done before the delete is applied
+func (c *ColumnFamily) DeleteContext(ctx context.Context, key []byte) error {
+	defer c.db.stats.record(OpDelete, time.Now())
+
+	batch := c.newWriteBatch()
+	batch.Delete(key)
+
+	if err := c.db.write(ctx, batch); err != nil {
+		return fmt.Errorf("failed attempting delete: %w", err)
+	}
+
+	return nil
+}
+
+// Merge adds operand to the value of key using the database's MergeOperator, without having to read the
+// current value first. Operands are combined when the key is read or compacted
+func (c *ColumnFamily) Merge(key []byte, operand []byte) error {
+	return c.MergeContext(context.Background(), key, operand)
+}
+
+// MergeContext is like Merge, but gives up with ctx's error if ctx is done before the merge is applied
+func (c *ColumnFamily) MergeContext(ctx context.Context, key []byte, operand []byte) error {
+	defer c.db.stats.record(OpMerge, time.Now())
+
+	batch := c.newWriteBatch()
+	batch.Merge(key, operand)
+
+	if err := c.db.write(ctx, batch); err != nil {
+		return fmt.Errorf("failed attempting merge: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteRange deletes every key from start up to but not including end
+func (c *ColumnFamily) DeleteRange(start []byte, end []byte) error {
+	return c.DeleteRangeContext(context.Background(), start, end)
+}
+
+// DeleteRangeContext is like DeleteRange, but gives up with ctx's error if ctx is done before the delete is
+// applied
+func (c *ColumnFamily) DeleteRangeContext(ctx context.Context, start []byte, end []byte) error {
+	defer c.db.stats.record(OpDeleteRange, time.Now())
+
+	batch := c.newWriteBatch()
+	batch.DeleteRange(start, end)
+
+	if err := c.db.write(ctx, batch); err != nil {
+		return fmt.Errorf("failed attempting delete range: %w", err)
+	}
+
+	return nil
+}
+
+func (c *ColumnFamily) newWriteBatch() *WriteBatch {
+	batch := NewWriteBatch()
+	batch.UseColumnFamily(c)
+	return batch
+}
+
+// apply applies the update in record to the active memtable. Must be called while holding the
+// database's lock
+func (c *ColumnFamily) apply(record *storage.Record) {
+	switch record.Type {
+	case storage.RecordUpdate:
+		c.memTable.PutWithExpiry(record.Key, record.Value, record.ExpiresAt, record.Seq)
+	case storage.RecordDelete:
+		c.memTable.Delete(record.Key, record.Seq)
+	case storage.RecordMerge:
+		c.memTable.Merge(record.Key, record.Value, record.Seq)
+	case storage.RecordRangeDelete:
+		c.memTable.DeleteRange(record.Key, record.Value, record.Seq)
+	}
+}
+
+// CompactRange compacts every key in the column family between start and end, inclusive, down into the
+// bottom level, dropping deleted and overwritten versions that no snapshot can see to free up space. A nil
+// start or end leaves that side of the range unbounded. The memtables are flushed first so that the keys
+// in them are compacted too. CompactRange returns once the compaction is done
+func (c *ColumnFamily) CompactRange(start []byte, end []byte) error {
+	if start != nil && end != nil && bytes.Compare(start, end) > 0 {
+		return fmt.Errorf("invalid range. start %s must not come after end %s", start, end)
+	}
+
+	if err := c.db.Flush(true); err != nil {
+		return err
+	}
+
+	d := c.db
+	d.mutex.RLock()
+	if d.closed {
+		d.mutex.RUnlock()
+		return ErrClosed
+	}
+	d.manualCompactions.Add(1)
+	d.mutex.RUnlock()
+	defer d.manualCompactions.Done()
+
+	if err := c.compactor.CompactRange(start, end, d.liveSnapshots()); err != nil {
+		return fmt.Errorf("failed compacting range of column family %s: %w", c.name, err)
+	}
+
+	return d.refreshWriteStall()
+}
+
+// immutableMemTables returns the column family's memtables that are waiting to be flushed, newest first.
+// Must be called while holding the database's lock
+func (c *ColumnFamily) immutableMemTables() []*memtable.MemTable {
+	var memTables []*memtable.MemTable
+	for i := len(c.db.immutable) - 1; i >= 0; i-- {
+		if memTable, ok := c.db.immutable[i].memTables[c.id]; ok {
+			memTables = append(memTables, memTable)
+		}
+	}
+
+	return memTables
+}
+
+func (c *ColumnFamily) flushMemTable(memTable *memtable.MemTable, tableName string, writer io.Writer) (
+	*sstable.Metadata, error) {
+	iter := memTable.InternalIterator()
+
+	builder := sstable.NewBuilder(tableName, iter, memTable.RangeDeletes(), 0, writer,
+		c.db.opts.IndexInterval)
+	metadata, err := builder.WriteTable()
+	if err != nil {
+		return nil, fmt.Errorf("could not write memtable to level 0 sstable: %w", err)
+	}
+	metadata.ColumnFamily = c.id
+
+	return metadata, nil
+}
@@ -0,0 +1,195 @@
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_CreateColumnFamily(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.Nil(t, db.Column("users"))
+	assert.Equal(t, DefaultColumnFamily, db.Column(DefaultColumnFamily).Name())
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+	assert.Equal(t, "users", users.Name())
+	assert.Equal(t, users, db.Column("users"))
+
+	_, err = db.CreateColumnFamily("users")
+	assert.EqualError(t, err, "column family users already exists")
+	_, err = db.CreateColumnFamily(DefaultColumnFamily)
+	assert.EqualError(t, err, "column family default already exists")
+
+	// Names have to fit in the manifest
+	_, err = db.CreateColumnFamily(strings.Repeat("a", MaxColumnFamilyNameSize+1))
+	assert.EqualError(t, err, "column family name must be at most 255 bytes. got 256")
+	long, err := db.CreateColumnFamily(strings.Repeat("a", MaxColumnFamilyNameSize))
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	db, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	assert.NotNil(t, db.Column(long.Name()))
+	assert.NoError(t, db.Close())
+}
+
+func TestColumnFamily_Isolation(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("default")))
+	assert.NoError(t, users.Put([]byte("foo"), []byte("users")))
+	assert.NoError(t, users.Put([]byte("bar"), []byte("users")))
+
+	assertIsolated := func() {
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("default"), val)
+
+		val, err = db.Get([]byte("bar"))
+		assert.Equal(t, ErrNotFound, err)
+		assert.Nil(t, val)
+
+		val, err = users.Get([]byte("foo"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("users"), val)
+
+		iter, err := users.NewIterator(ReadOpts{})
+		assert.NoError(t, err)
+		defer iter.Close()
+
+		iter.SeekToFirst()
+		assertIteration(t, iter, map[string]string{"bar": "users", "foo": "users"}, "bar", "foo")
+	}
+	assertIsolated()
+
+	// Each column family is flushed to its own sstables
+	flush(t, db)
+	assert.Len(t, db.manifest.MetadataForLevel(defaultFamilyID, 0), 1)
+	assert.Len(t, db.manifest.MetadataForLevel(users.id, 0), 1)
+	assertIsolated()
+
+	// Deletes only apply to their own column family
+	assert.NoError(t, users.Delete([]byte("foo")))
+	val, err := users.Get([]byte("foo"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, val)
+
+	val, err = db.Get([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("default"), val)
+}
+
+func TestColumnFamily_AtomicWrite(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+	emails, err := db.CreateColumnFamily("emails")
+	assert.NoError(t, err)
+
+	batch := NewWriteBatch()
+	batch.UseColumnFamily(users)
+	batch.Put([]byte("1"), []byte("nick"))
+	batch.UseColumnFamily(emails)
+	batch.Put([]byte("nick@example.com"), []byte("1"))
+	batch.UseColumnFamily(db.Column(DefaultColumnFamily))
+	batch.Put([]byte("count"), []byte("1"))
+	assert.NoError(t, db.Write(batch))
+
+	assertWritten := func(db *DB) {
+		for family, kv := range map[string][]string{
+			"users":             {"1", "nick"},
+			"emails":            {"nick@example.com", "1"},
+			DefaultColumnFamily: {"count", "1"},
+		} {
+			val, err := db.Column(family).Get([]byte(kv[0]))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(kv[1]), val, family)
+		}
+	}
+	assertWritten(db)
+
+	// Every column family is recovered from the shared WAL
+	db2, err := Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	assertWritten(db2)
+
+	// And from their sstables once flushed
+	flush(t, db2)
+	db3, err := Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	assertWritten(db3)
+
+	// Column families are only valid for the database that created them
+	other, err := New("bar", DBOpts{DataDir: dir})
+	defer cleanup("bar", dir)
+	assert.NoError(t, err)
+
+	batch = NewWriteBatch()
+	batch.UseColumnFamily(emails)
+	batch.Put([]byte("foo"), []byte("bar"))
+	assert.Error(t, other.Write(batch))
+}
+
+func TestColumnFamily_FlushTogether(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, MemTableSizeLimit: 100})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+
+	// Filling up one column family's memtable flushes every column family since they share a WAL
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, users.Put([]byte("foo"), bytes.Repeat([]byte("a"), 100)))
+
+	assert.Eventually(t, func() bool {
+		db.mutex.RLock()
+		defer db.mutex.RUnlock()
+		return len(db.immutable) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Len(t, db.manifest.MetadataForLevel(defaultFamilyID, 0), 1)
+	assert.Len(t, db.manifest.MetadataForLevel(users.id, 0), 1)
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), val)
+
+	matches, err := filepath.Glob(path.Join(dir, dbName, "wal_*"))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+}
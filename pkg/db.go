@@ -2,15 +2,16 @@ package pkg
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
-	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 
-	"github.com/nbroyles/nbdb/internal/compaction"
 	"github.com/nbroyles/nbdb/internal/manifest"
 	"github.com/nbroyles/nbdb/internal/memtable"
 	"github.com/nbroyles/nbdb/internal/sstable"
@@ -19,65 +20,107 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// TODO: copy keys and values passed as arguments
-// TODO: check key and value size and fail if > threshold
-
 // DB represents the API for database access
 // One process can have a database open at a time
-// Calls to Get, Put, Delete are thread-safe
+// Calls to Get, Put, Delete are thread-safe and operate on the default column family
 type DB struct {
 	name    string
 	dataDir string
 
-	mutex     sync.RWMutex
-	memTable  *memtable.MemTable
-	walog     *wal.WAL
-	manifest  *manifest.Manifest
-	compactor *compaction.Compactor
+	mutex    sync.RWMutex
+	walog    *wal.WAL
+	manifest *manifest.Manifest
+
+	// families holds every column family in the database, keyed by id
+	families      map[uint32]*ColumnFamily
+	defaultFamily *ColumnFamily
+
+	// immutable holds the memtables waiting to be flushed, oldest first
+	immutable []*immutableMemTables
+	// flushRequested is set when a flush is requested while another is underway so that it's scheduled as
+	// soon as that one finishes
+	flushRequested bool
+	// flushed is broadcast whenever a memtable is flushed, or fails to be. flushFailures counts the failures
+	// and flushErr is the error the most recent one failed with
+	flushed       *sync.Cond
+	flushFailures int64
+	flushErr      error
+	scheduler     *scheduler
+	// manualCompactions counts the calls to CompactRange underway, which Close waits for
+	manualCompactions sync.WaitGroup
+	opts              DBOpts
+
+	// closed is set once Close is called, after which every operation fails with ErrClosed
+	closed bool
+
+	// seq is the sequence number of the most recent write
+	seq uint64
+
+	snapshotMutex sync.Mutex
+	snapshots     []*Snapshot
+
+	// subscriptions holds every open subscription to the database's changes. Guarded by mutex
+	subscriptions map[*Subscription]bool
+
+	// l0Files and pendingCompactionBytes are the most level 0 sstables and pending compaction bytes of any
+	// column family as of the last flush or compaction. Guarded by mutex
+	l0Files                int
+	pendingCompactionBytes int64
+	writes                 *writeController
+
+	stats *dbStats
+}
 
-	compactingMemTable *memtable.MemTable
-	compactingWAL      *wal.WAL
-	compact            chan bool
-	stopWatching       chan bool
-	mtSizeLimit        uint32
+// immutableMemTables are memtables that filled up and were swapped out for new ones, waiting to be
+// flushed to level 0 sstables along with the WAL holding their writes
+type immutableMemTables struct {
+	walog *wal.WAL
+	// memTables holds the memtable of each column family that had been written to, keyed by id. They're
+	// removed as they're flushed
+	memTables map[uint32]*memtable.MemTable
+	// flushing holds the ids of the column families whose memtables are being flushed
+	flushing map[uint32]bool
 }
 
-// TODO: allow configuration via options provided to constructor
-const (
-	// Makes sense on Mac OS X, may not elsewhere
-	datadir  = "/usr/local/var/nbdb"
-	lockFile = "__DB_LOCK__"
-	// Limit memtable to 4 MBs before flushing
-	mtSizeLimit = uint32(4194304)
-)
+func newImmutableMemTables(walog *wal.WAL) *immutableMemTables {
+	return &immutableMemTables{walog: walog, memTables: make(map[uint32]*memtable.MemTable),
+		flushing: make(map[uint32]bool)}
+}
 
-type DBOpts struct {
-	dataDir     string
-	mtSizeLimit uint32
+// flushJob is a column family's memtable claimed for flushing
+type flushJob struct {
+	frozen   *immutableMemTables
+	family   *ColumnFamily
+	memTable *memtable.MemTable
 }
 
-func (o *DBOpts) applyDefaults() {
-	if o.dataDir == "" {
-		o.dataDir = datadir
-	}
+const (
+	lockFile = "__DB_LOCK__"
 
-	if o.mtSizeLimit == 0 {
-		o.mtSizeLimit = mtSizeLimit
-	}
-}
+	// MaxKeySize is the size in bytes of the largest key that can be written. It also limits the
+	// bounds of range deletes
+	MaxKeySize = 64 * 1024
+	// MaxValueSize is the size in bytes of the largest value that can be written
+	MaxValueSize = 64 * 1024 * 1024
+	// MaxColumnFamilyNameSize is the size in bytes of the longest column family name
+	MaxColumnFamilyNameSize = 255
+)
 
 // New creates a new database based on the name provided.
 // New fails if the database already exists
 func New(name string, opts DBOpts) (*DB, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
+	}
 	opts.applyDefaults()
 
-	if err := os.MkdirAll(opts.dataDir, 0755); err != nil {
-		return nil, fmt.Errorf("could not create data dir %s: %w", opts.dataDir, err)
+	if err := os.MkdirAll(opts.DataDir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create data dir %s: %w", opts.DataDir, err)
 	}
 
-	dbPath := path.Join(opts.dataDir, name)
+	dbPath := path.Join(opts.DataDir, name)
 
-	if exists, err := exists(name, opts.dataDir); !exists {
+	if exists, err := exists(name, opts.DataDir); !exists {
 		if err := os.Mkdir(dbPath, 0755); err != nil {
 			return nil, fmt.Errorf("failed creating data directory for database %s: %w", name, err)
 		}
@@ -90,7 +133,9 @@ func New(name string, opts DBOpts) (*DB, error) {
 	return Open(name, opts)
 }
 
-func lock(name string, dataDir string) error {
+// lock locks the database for this process. It returns true if the lock was taken by this call, or false if
+// this process already held it
+func lock(name string, dataDir string) (bool, error) {
 	pid := os.Getpid()
 	lockPath := path.Join(dataDir, name, lockFile)
 
@@ -98,44 +143,56 @@ func lock(name string, dataDir string) error {
 	// Database is not currently locked, attempt to acquire
 	if os.IsNotExist(err) {
 		if lockFile, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666); os.IsExist(err) {
-			return fmt.Errorf("cannot lock database. already locked by another process")
+			return false, fmt.Errorf("%w by another process", ErrLocked)
 		} else if err != nil {
-			return fmt.Errorf("failure attempting to lock database: %w", err)
+			return false, fmt.Errorf("failure attempting to lock database: %w", err)
 		} else {
+			defer lockFile.Close()
 			pidBytes := []byte(strconv.Itoa(pid))
 			if n, err := lockFile.Write(pidBytes); n < len(pidBytes) {
-				return fmt.Errorf("failure writing owner pid to lock file. wrote %d bytes, expected %d",
+				os.Remove(lockPath)
+				return false, fmt.Errorf("failure writing owner pid to lock file. wrote %d bytes, expected %d",
 					n, len(pidBytes))
 			} else if err != nil {
-				return fmt.Errorf("failure writing owner pid to lock file: %w", err)
+				os.Remove(lockPath)
+				return false, fmt.Errorf("failure writing owner pid to lock file: %w", err)
 			}
-			return nil
+			return true, nil
 		}
 	} else if err != nil {
-		return fmt.Errorf("failure attempting to lock database: %w", err)
+		return false, fmt.Errorf("failure attempting to lock database: %w", err)
 	} else {
+		defer lock.Close()
 		// Database currently locked, see if it's me
 		scanner := bufio.NewScanner(lock)
 		scanner.Scan()
 		lockPid, err := strconv.Atoi(scanner.Text())
 		if err != nil {
-			return fmt.Errorf("failed attempting to read lockfile: %w", err)
+			return false, fmt.Errorf("failed attempting to read lockfile: %w", err)
 		}
 
 		if lockPid == pid {
-			return nil
+			return false, nil
 		} else {
-			return fmt.Errorf("cannot lock database. already locked by another process (%d)", lockPid)
+			return false, fmt.Errorf("%w by another process (%d)", ErrLocked, lockPid)
 		}
 	}
 }
 
+// unlock releases the database's lock
+func unlock(name string, dataDir string) error {
+	return os.Remove(path.Join(dataDir, name, lockFile))
+}
+
 // Open opens a database of the name provided. Open fails
 // if the database does not exist
 func Open(name string, opts DBOpts) (*DB, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
+	}
 	opts.applyDefaults()
 
-	if exists, err := exists(name, opts.dataDir); !exists {
+	if exists, err := exists(name, opts.DataDir); !exists {
 		if err == nil {
 			return nil, fmt.Errorf("failed opening database %s. does not exist", name)
 		} else {
@@ -143,54 +200,115 @@ func Open(name string, opts DBOpts) (*DB, error) {
 		}
 	}
 
-	if err := lock(name, opts.dataDir); err != nil {
+	locked, err := lock(name, opts.DataDir)
+	if err != nil {
 		return nil, fmt.Errorf("could not lock database: %w", err)
 	}
+	// A lock taken here is released if opening fails, so that the database can be opened again
+	opened := false
+	defer func() {
+		if locked && !opened {
+			if err := unlock(name, opts.DataDir); err != nil {
+				log.Errorf("failed releasing lock on database %s: %v", name, err)
+			}
+		}
+	}()
 
-	mem := memtable.New()
+	if err := checkOptionsFile(path.Join(opts.DataDir, name), opts); err != nil {
+		return nil, fmt.Errorf("failed checking options: %w", err)
+	}
 
-	// Attempt to load WAL if exists. Otherwise create a new one
-	found, walog, err := wal.FindExisting(name, opts.dataDir)
+	// The manifest is loaded first since it knows which column families the WAL may hold writes for
+	found, man, err := manifest.LoadLatest(name, opts.DataDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed attempting to look for existing WAL file: %w", err)
+		return nil, fmt.Errorf("failed attempting to load manifest file: %w", err)
+	} else if !found {
+		maf, err := manifest.CreateManifestFile(name, opts.DataDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not create manifest file: %w", err)
+		}
+		man = manifest.NewManifest(maf)
+	}
+
+	db := &DB{
+		manifest:      man,
+		name:          name,
+		dataDir:       opts.DataDir,
+		families:      make(map[uint32]*ColumnFamily),
+		subscriptions: make(map[*Subscription]bool),
+		stats:         newDBStats(),
+		writes:        newWriteController(opts.DelayedWriteRate),
+		opts:          opts,
 	}
+	db.flushed = sync.NewCond(&db.mutex)
+	db.scheduler = newScheduler(db)
 
-	if !found {
-		waf, err := wal.CreateFile(name, opts.dataDir)
+	db.defaultFamily = newColumnFamily(db, defaultFamilyID, DefaultColumnFamily)
+	db.families[defaultFamilyID] = db.defaultFamily
+	for _, family := range man.ColumnFamilies() {
+		db.families[family.ID] = newColumnFamily(db, family.ID, family.Name)
+	}
+
+	// Replay every WAL left behind, oldest first. The newest stays the active WAL while the memtables restored
+	// from older ones are queued to be flushed, as they were before the database was closed
+	wals, err := wal.FindExisting(name, opts.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed attempting to look for existing WAL files: %w", err)
+	}
+
+	if len(wals) == 0 {
+		waf, err := wal.CreateFile(name, opts.DataDir)
 		if err != nil {
 			return nil, fmt.Errorf("could not create WAL file: %w", err)
 		}
-		walog = wal.New(waf)
-	} else {
-		if err = walog.Restore(mem); err != nil {
-			return nil, fmt.Errorf("failed attempting to restore WAL: %w", err)
-		}
+		wals = append(wals, wal.New(waf))
 	}
 
-	found, man, err := manifest.LoadLatest(name, opts.dataDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed attempting to load manifest file: %w", err)
-	} else if !found {
-		maf, err := manifest.CreateManifestFile(name, opts.dataDir)
+	for i, walog := range wals {
+		if i > 0 {
+			db.freezeMemTables(walog)
+		} else {
+			db.walog = walog
+		}
+
+		memtables := make(map[uint32]*memtable.MemTable)
+		for id, family := range db.families {
+			memtables[id] = family.memTable
+		}
+
+		seq, err := walog.Restore(memtables)
 		if err != nil {
-			return nil, fmt.Errorf("could not create manifest file: %w", err)
+			return nil, fmt.Errorf("failed attempting to restore WAL %s: %w", walog.Name(), err)
+		} else if seq > db.seq {
+			db.seq = seq
 		}
-		man = manifest.NewManifest(maf)
 	}
 
-	db := &DB{
-		memTable:     mem,
-		walog:        walog,
-		manifest:     man,
-		compactor:    compaction.New(man, opts.dataDir, name),
-		name:         name,
-		dataDir:      opts.dataDir,
-		compact:      make(chan bool, 1),
-		stopWatching: make(chan bool),
-		mtSizeLimit:  opts.mtSizeLimit,
+	// Writes in the WAL may already have been flushed, so resume after whichever is most recent
+	for id := range db.families {
+		for level := 0; level < man.Levels(id); level++ {
+			for _, meta := range man.MetadataForLevel(id, level) {
+				if meta.MaxSeq > db.seq {
+					db.seq = meta.MaxSeq
+				}
+			}
+		}
 	}
 
-	go db.compactionWatcher()
+	// WALs whose writes had all been flushed already are removed straight away
+	db.mutex.Lock()
+	err = db.finishFlushes()
+	db.updateWriteStall()
+	db.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	db.scheduler.start(opts.MaxBackgroundFlushes, opts.MaxBackgroundCompactions)
+	if len(db.immutable) > 0 {
+		db.scheduler.scheduleFlush()
+	}
+	opened = true
 
 	return db, nil
 }
@@ -210,7 +328,7 @@ func exists(name string, datadir string) (bool, error) {
 func OpenOrNew(name string, opts DBOpts) (*DB, error) {
 	opts.applyDefaults()
 
-	dbExists, err := exists(name, opts.dataDir)
+	dbExists, err := exists(name, opts.DataDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed checking if database %s already exists: %v", name, err)
 	}
@@ -222,174 +340,674 @@ func OpenOrNew(name string, opts DBOpts) (*DB, error) {
 	}
 }
 
-// Close ensures that any resources used by the DB are tidied up
+// Close waits for any flushes and compactions underway to finish, flushes every memtable to level 0
+// sstables and releases the files held by the database, including its lock. Every operation on the
+// database after Close, including Close itself, fails with ErrClosed
 func (d *DB) Close() error {
-	// TODO:
-	// flush to memtable here
-	// ensure no future get/puts succeed
-	close(d.stopWatching)
-	return d.unlock()
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return ErrClosed
+	}
+	d.closed = true
+	// Subscribers are sent every change committed before closing and nothing more
+	for sub := range d.subscriptions {
+		sub.end()
+	}
+	d.subscriptions = nil
+	// Writers held back by a stall fail once they find the database closed
+	d.writes.set(WriteStall{})
+	d.mutex.Unlock()
+
+	d.scheduler.stop()
+	d.manualCompactions.Wait()
+
+	err := d.flushAll()
+	if closeErr := d.manifest.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+
+	// The lock is released even if flushing failed since the WAL still holds anything that wasn't flushed
+	if unlockErr := d.unlock(); err == nil && unlockErr != nil {
+		err = fmt.Errorf("failed releasing database lock: %w", unlockErr)
+	}
+
+	return err
+}
+
+// flushAll flushes every memtable to level 0 sstables and removes the WAL. Must only be called once the
+// database is closed, since writes can't be accepted afterwards
+func (d *DB) flushAll() error {
+	d.mutex.Lock()
+	d.flushRequested = false
+	d.freezeMemTables(nil)
+	d.mutex.Unlock()
+
+	return d.flushImmutable()
 }
 
 func (d *DB) unlock() error {
-	lockPath := path.Join(d.dataDir, d.name, lockFile)
-	return os.Remove(lockPath)
+	return unlock(d.name, d.dataDir)
 }
 
-// Get returns the value associated with the key. If key is not found then
-// the value returned is nil
-func (d *DB) Get(key []byte) ([]byte, error) {
-	d.mutex.RLock()
-	defer d.mutex.RUnlock()
+// lockContext acquires the write lock, giving up with ctx's error if ctx is done first
+func (d *DB) lockContext(ctx context.Context) error {
+	return acquireContext(ctx, d.mutex.Lock, d.mutex.Unlock)
+}
 
-	val := d.memTable.Get(key)
-	if val == nil && d.compactingMemTable != nil {
-		val = d.compactingMemTable.Get(key)
+// rlockContext acquires the read lock, giving up with ctx's error if ctx is done first
+func (d *DB) rlockContext(ctx context.Context) error {
+	return acquireContext(ctx, d.mutex.RLock, d.mutex.RUnlock)
+}
+
+func acquireContext(ctx context.Context, lock func(), unlock func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// TODO: add a bloom filter to reduce need to potentially check every level
-	// TODO: can we unlock during this search? issue to solve is sstables getting compacted while searching
-	if val == nil {
-		// 255 == uint8 max == max number of levels based on value used for encoding level information on disk
-	levelTraversal:
-		for i := 0; i < 255; i++ {
-			for _, meta := range d.manifest.MetadataForLevel(i) {
-				if meta == nil {
-					break levelTraversal
-				}
-				if meta.ContainsKey(key) {
-					val, err := d.searchSSTable(key, meta)
-					if err != nil {
-						return nil, fmt.Errorf("failed attempting to scan sstable for key %s: %w", string(key), err)
-					}
-
-					if val != nil {
-						return val, nil
-					}
-				}
-			}
-		}
+	// Contexts that can't be cancelled don't need to wait on anything but the lock
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		// Nobody is left waiting on the lock, so release it as soon as it's acquired
+		go func() {
+			<-acquired
+			unlock()
+		}()
+		return ctx.Err()
 	}
+}
+
+// Get returns the value associated with the key in the default column family. If key is not found then
+// ErrNotFound is returned
+func (d *DB) Get(key []byte) ([]byte, error) {
+	return d.defaultFamily.Get(key)
+}
+
+// GetContext is like Get, but gives up with ctx's error if ctx is done before the read completes
+func (d *DB) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	return d.defaultFamily.GetContext(ctx, key)
+}
 
-	return val, nil
+// GetWithOpts returns the value associated with the key in the default column family, reading as of the
+// snapshot in opts if one is provided. If key is not found then ErrNotFound is returned
+func (d *DB) GetWithOpts(key []byte, opts ReadOpts) ([]byte, error) {
+	return d.defaultFamily.GetWithOpts(key, opts)
 }
 
-func (d *DB) searchSSTable(key []byte, meta *sstable.Metadata) ([]byte, error) {
+// GetWithOptsContext is like GetWithOpts, but gives up with ctx's error if ctx is done before the read
+// completes
+func (d *DB) GetWithOptsContext(ctx context.Context, key []byte, opts ReadOpts) ([]byte, error) {
+	return d.defaultFamily.GetWithOptsContext(ctx, key, opts)
+}
+
+// MultiGet returns the values associated with each of the keys in the default column family. errs[i] is
+// ErrNotFound if keys[i] is not found
+func (d *DB) MultiGet(keys [][]byte) (values [][]byte, errs []error) {
+	return d.defaultFamily.MultiGet(keys)
+}
+
+// MultiGetWithOpts is like MultiGet, but reads as of the snapshot in opts if one is provided
+func (d *DB) MultiGetWithOpts(keys [][]byte, opts ReadOpts) (values [][]byte, errs []error) {
+	return d.defaultFamily.MultiGetWithOpts(keys, opts)
+}
+
+// searchSSTable searches the sstable for every one of the lookups' keys, opening it only once
+func (d *DB) searchSSTable(ctx context.Context, lookups []*sstable.Lookup, seq uint64, meta *sstable.Metadata) error {
 	// TODO: cache this instead of opening and closing every time
 	sstHandle, err := os.Open(path.Join(d.dataDir, d.name, meta.Filename))
 	if err != nil {
-		return nil, fmt.Errorf("failed attempting to open sstable for reading: %w", err)
+		return fmt.Errorf("failed attempting to open sstable for reading: %w", err)
 	}
 	defer sstHandle.Close()
 
-	return sstable.Search(key, sstHandle)
+	return sstable.SearchAll(ctx, lookups, seq, sstHandle)
 }
 
 // Put inserts or updates the value if the key already exists
 func (d *DB) Put(key []byte, value []byte) error {
-	d.mutex.Lock()
+	return d.defaultFamily.Put(key, value)
+}
+
+// PutContext is like Put, but gives up with ctx's error if ctx is done before the write is applied
+func (d *DB) PutContext(ctx context.Context, key []byte, value []byte) error {
+	return d.defaultFamily.PutContext(ctx, key, value)
+}
+
+// PutWithTTL inserts or updates the value of key such that it expires once ttl has passed. Expired keys
+// are hidden from reads and removed during compaction
+func (d *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return d.defaultFamily.PutWithTTL(key, value, ttl)
+}
+
+// PutWithTTLContext is like PutWithTTL, but gives up with ctx's error if ctx is done before the write is
+// applied
+func (d *DB) PutWithTTLContext(ctx context.Context, key []byte, value []byte, ttl time.Duration) error {
+	return d.defaultFamily.PutWithTTLContext(ctx, key, value, ttl)
+}
+
+// Deletes the specified key from the data store
+func (d *DB) Delete(key []byte) error {
+	return d.defaultFamily.Delete(key)
+}
+
+// DeleteContext is like Delete, but gives up with ctx's error if ctx is done before the delete is applied
+func (d *DB) DeleteContext(ctx context.Context, key []byte) error {
+	return d.defaultFamily.DeleteContext(ctx, key)
+}
+
+// Merge adds operand to the value of key using the database's MergeOperator, without having to read the
+// current value first. Operands are combined when the key is read or compacted
+func (d *DB) Merge(key []byte, operand []byte) error {
+	return d.defaultFamily.Merge(key, operand)
+}
+
+// MergeContext is like Merge, but gives up with ctx's error if ctx is done before the merge is applied
+func (d *DB) MergeContext(ctx context.Context, key []byte, operand []byte) error {
+	return d.defaultFamily.MergeContext(ctx, key, operand)
+}
+
+// DeleteRange deletes every key from start up to but not including end
+func (d *DB) DeleteRange(start []byte, end []byte) error {
+	return d.defaultFamily.DeleteRange(start, end)
+}
+
+// DeleteRangeContext is like DeleteRange, but gives up with ctx's error if ctx is done before the delete is
+// applied
+func (d *DB) DeleteRangeContext(ctx context.Context, start []byte, end []byte) error {
+	return d.defaultFamily.DeleteRangeContext(ctx, start, end)
+}
+
+// Write applies every update in the batch atomically, including updates to different column families.
+// The batch is written to the WAL as a single entry, so after a crash either all of its updates are
+// recovered or none are
+func (d *DB) Write(batch *WriteBatch) error {
+	return d.WriteContext(context.Background(), batch)
+}
+
+// WriteContext is like Write, but gives up with ctx's error if ctx is done before the batch is applied.
+// A batch is either applied in full or not at all
+func (d *DB) WriteContext(ctx context.Context, batch *WriteBatch) error {
+	defer d.stats.record(OpWrite, time.Now())
+
+	return d.write(ctx, batch)
+}
+
+func (d *DB) write(ctx context.Context, batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	for _, record := range batch.records {
+		if err := checkSize(record); err != nil {
+			return err
+		}
+
+		if record.Type == storage.RecordRangeDelete && bytes.Compare(record.Key, record.Value) >= 0 {
+			return fmt.Errorf("invalid range delete. start %s must come before end %s", record.Key, record.Value)
+		} else if record.Type == storage.RecordMerge && d.opts.MergeOperator == nil {
+			return fmt.Errorf("cannot merge key %s. no merge operator configured", record.Key)
+		}
+	}
+
+	if err := d.throttle(ctx, batch.size()); err != nil {
+		return err
+	}
+
+	if err := d.lockContext(ctx); err != nil {
+		return err
+	}
 	defer d.mutex.Unlock()
 
-	if err := d.walog.Write(storage.NewRecord(key, value, false)); err != nil {
-		return fmt.Errorf("failed attempting write put to WAL: %w", err)
+	if d.closed {
+		return ErrClosed
+	}
+
+	for _, record := range batch.records {
+		if _, ok := d.families[record.ColumnFamily]; !ok {
+			return fmt.Errorf("column family %d does not exist in database %s", record.ColumnFamily, d.name)
+		}
 	}
 
-	d.memTable.Put(key, value)
+	// Every update in the batch gets its own sequence number, in the order they were added
+	for i, record := range batch.records {
+		record.Seq = d.seq + uint64(i) + 1
+	}
 
-	// compactingMemTable not being nil indicating that a compaction is already underway
-	if d.memTable.Size() > d.mtSizeLimit && d.compactingMemTable == nil {
-		d.compactingMemTable = d.memTable
-		d.compactingWAL = d.walog
+	if err := d.walog.WriteBatch(batch.records); err != nil {
+		return fmt.Errorf("failed attempting write batch to WAL: %w", err)
+	}
+	d.stats.walSyncs.observe(d.walog.SyncLatency())
+	d.seq += uint64(batch.Len())
 
-		d.memTable = memtable.New()
+	for _, record := range batch.records {
+		d.families[record.ColumnFamily].apply(record)
+	}
+	d.publish(batch.records)
 
-		waf, err := wal.CreateFile(d.name, d.dataDir)
-		if err != nil {
-			// Abort compaction attempt
-			d.memTable = d.compactingMemTable
-			d.walog = d.compactingWAL
+	return d.maybeScheduleFlush()
+}
 
-			d.compactingMemTable = nil
-			d.compactingWAL = nil
+func checkSize(record *storage.Record) error {
+	if len(record.Key) > MaxKeySize {
+		return fmt.Errorf("%w. key is %d bytes, limit is %d", ErrKeyTooLarge, len(record.Key), MaxKeySize)
+	}
 
-			return fmt.Errorf("could not create WAL file: %w", err)
+	switch record.Type {
+	case storage.RecordRangeDelete:
+		if len(record.Value) > MaxKeySize {
+			return fmt.Errorf("%w. range delete end is %d bytes, limit is %d", ErrKeyTooLarge, len(record.Value),
+				MaxKeySize)
+		}
+	case storage.RecordUpdate, storage.RecordMerge:
+		if len(record.Value) > MaxValueSize {
+			return fmt.Errorf("%w. value is %d bytes, limit is %d", ErrValueTooLarge, len(record.Value),
+				MaxValueSize)
 		}
-		d.walog = wal.New(waf)
+	}
+
+	return nil
+}
+
+// maybeScheduleFlush swaps out the active memtables and WAL for new ones and signals that the old
+// memtables should be flushed if any of them has grown past its size limit or a flush was requested.
+// Since every column family shares the WAL, all non-empty memtables are flushed together so that the
+// old WAL can be removed once they're done. Nothing is swapped out while the maximum number of memtables
+// are already waiting to be flushed. Must be called while holding the lock
+func (d *DB) maybeScheduleFlush() error {
+	if d.closed {
+		return nil
+	}
+	defer d.updateWriteStall()
+
+	if len(d.immutable) >= d.opts.MaxImmutableMemTables || (!d.memTableFull() && !d.flushRequested) {
+		return nil
+	}
+
+	d.flushRequested = false
+	empty := true
+	for _, family := range d.families {
+		empty = empty && family.memTable.Size() == 0
+	}
+	if empty {
+		return nil
+	}
+
+	waf, err := wal.CreateFile(d.name, d.dataDir)
+	if err != nil {
+		// Abort compaction attempt
+		return fmt.Errorf("could not create WAL file: %w", err)
+	}
+
+	previous := d.walog
+	d.freezeMemTables(wal.New(waf))
 
-		d.compact <- true
+	rotation := WALRotationInfo{Previous: previous.Name(), Current: d.walog.Name()}
+	for _, listener := range d.opts.EventListeners {
+		listener.OnWALRotated(rotation)
 	}
 
+	d.scheduler.scheduleFlush()
+
 	return nil
 }
 
-// Deletes the specified key from the data store
-func (d *DB) Delete(key []byte) error {
+// memTableFull returns true if any column family's memtable has grown past its size limit. Must be called
+// while holding the lock
+func (d *DB) memTableFull() bool {
+	for _, family := range d.families {
+		if family.memTable.Size() > d.opts.MemTableSizeLimit {
+			return true
+		}
+	}
+
+	return false
+}
+
+// freezeMemTables queues the active memtables to be flushed, along with the WAL, and replaces them with
+// empty ones. walog replaces the WAL. Must be called while holding the lock
+func (d *DB) freezeMemTables(walog *wal.WAL) {
+	frozen := newImmutableMemTables(d.walog)
+	for id, family := range d.families {
+		if family.memTable.Size() > 0 {
+			frozen.memTables[id] = family.memTable
+			family.memTable = memtable.New()
+		}
+	}
+
+	d.immutable = append(d.immutable, frozen)
+	d.walog = walog
+}
+
+// Flush writes the active memtables of every column family to level 0 sstables. If the maximum number of
+// memtables are already waiting to be flushed, they're flushed as soon as there's room. If wait is true,
+// Flush returns once they've been flushed, or with the error a flush fails with in the meantime. Otherwise
+// it returns once the flush is scheduled, leaving it to run in the background
+func (d *DB) Flush(wait bool) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	if err := d.walog.Write(storage.NewRecord(key, nil, true)); err != nil {
-		return fmt.Errorf("failed attempting write delete to WAL: %w", err)
+	if d.closed {
+		return ErrClosed
 	}
-	d.memTable.Delete(key)
 
-	return nil
+	d.flushRequested = true
+	if err := d.maybeScheduleFlush(); err != nil || !wait {
+		return err
+	}
+	// Memtables that failed to flush are retried
+	d.scheduler.scheduleFlush()
+
+	// The memtables requested are the newest waiting to be flushed once they've been swapped out
+	failures := d.flushFailures
+	var requested *immutableMemTables
+	for {
+		if d.flushFailures > failures {
+			return d.flushErr
+		}
+
+		if requested == nil && !d.flushRequested {
+			if len(d.immutable) == 0 {
+				return nil
+			}
+			requested = d.immutable[len(d.immutable)-1]
+		}
+
+		if requested != nil && !d.queued(requested) {
+			return nil
+		}
+
+		d.flushed.Wait()
+	}
+}
+
+// queued returns true if frozen is still waiting to be flushed. Must be called while holding the lock
+func (d *DB) queued(frozen *immutableMemTables) bool {
+	for _, waiting := range d.immutable {
+		if waiting == frozen {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SyncWAL syncs the WAL to disk. Writes are synced as they're committed, so this is only needed as a
+// barrier, e.g. before copying the database's files
+func (d *DB) SyncWAL() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+
+	return d.walog.Sync()
 }
 
-func (d *DB) compactionWatcher() {
+// CompactRange compacts every key in the default column family between start and end, inclusive, down
+// into the bottom level. See ColumnFamily#CompactRange
+func (d *DB) CompactRange(start []byte, end []byte) error {
+	return d.defaultFamily.CompactRange(start, end)
+}
+
+// doCompaction flushes every memtable waiting to be flushed and then compacts each column family until
+// none of its levels need compacting, all in the calling goroutine. Flushes and compactions already
+// underway in the background are waited for
+func (d *DB) doCompaction() error {
+	if err := d.flushImmutable(); err != nil {
+		return err
+	}
+
 	for {
-		select {
-		case <-d.compact:
-			if err := d.doCompaction(); err != nil {
-				log.Errorf("error performing compaction: %v", err)
+		compacted := false
+		for _, family := range d.columnFamilies() {
+			familyCompacted, err := d.compactNext(family)
+			if err != nil {
+				return err
 			}
-		case <-d.stopWatching:
-			return
+			compacted = compacted || familyCompacted
+		}
+
+		if compacted {
+			continue
+		}
+
+		// Compactions finishing in the background may leave more to compact
+		waited := false
+		for _, family := range d.columnFamilies() {
+			waited = family.compactor.Wait() || waited
+		}
+
+		if !waited {
+			return d.refreshWriteStall()
 		}
 	}
 }
 
-func (d *DB) flushMemTable(tableName string, writer io.Writer) error {
-	iter := d.compactingMemTable.InternalIterator()
+// compactNext runs one compaction of the column family's sstables if any level needs compacting and the
+// merge doesn't overlap the compactions underway. It returns false if there was nothing it could compact
+func (d *DB) compactNext(family *ColumnFamily) (bool, error) {
+	compaction, err := family.compactor.Pick()
+	if err != nil {
+		return false, fmt.Errorf("failed picking compaction for column family %s: %w", family.name, err)
+	} else if compaction == nil {
+		return false, nil
+	}
+
+	// Another worker may find a compaction that can run alongside this one
+	d.scheduler.scheduleCompaction()
 
-	builder := sstable.NewBuilder(tableName, iter, 0, writer)
-	metadata, err := builder.WriteTable()
+	err = family.compactor.Run(compaction, d.liveSnapshots())
 	if err != nil {
-		return fmt.Errorf("could not write memtable to level 0 sstable: %w", err)
+		// Retrying straight away would likely pick the same inputs and fail again, so the caller decides when
+		return false, fmt.Errorf("failed attempting to compact column family %s: %w", family.name, err)
 	}
+	// Compactions that overlapped this one may be able to run now
+	d.scheduler.scheduleCompaction()
 
-	return d.manifest.AddEntry(manifest.NewEntry(metadata, false))
+	return true, d.refreshWriteStall()
 }
 
-func (d *DB) doCompaction() error {
-	if d.compactingMemTable != nil {
-		file, err := sstable.CreateFile(d.name, d.dataDir)
-		if err != nil {
-			return fmt.Errorf("failed attempt to create new sstable file: %w", err)
+// flushImmutable flushes the memtables waiting to be flushed, if there are any, to level 0 sstables,
+// waiting for those being flushed in the background
+func (d *DB) flushImmutable() error {
+	for {
+		d.mutex.Lock()
+		// Close queues the WAL to be removed even if none of the memtables written to it need flushing
+		if err := d.finishFlushes(); err != nil {
+			d.mutex.Unlock()
+			return err
+		} else if len(d.immutable) == 0 {
+			d.mutex.Unlock()
+			return nil
 		}
-		defer file.Close()
 
-		err = d.flushMemTable(filepath.Base(file.Name()), file)
+		job := d.claimFlush()
+		if job == nil {
+			d.flushed.Wait()
+			d.mutex.Unlock()
+			continue
+		}
+		d.mutex.Unlock()
 
-		if err == nil {
-			if err = file.Sync(); err != nil {
-				return fmt.Errorf("error flushing sstable to disk: %w", err)
-			}
+		if err := d.runFlush(job); err != nil {
+			return err
+		}
+	}
+}
 
-			d.mutex.Lock()
-			defer d.mutex.Unlock()
+// flushNext flushes the next memtable waiting to be flushed, returning false if there was none that could
+// be flushed
+func (d *DB) flushNext() (bool, error) {
+	d.mutex.Lock()
+	job := d.claimFlush()
+	d.mutex.Unlock()
+	if job == nil {
+		return false, nil
+	}
+
+	// Another worker can flush another column family's memtable alongside this one
+	d.scheduler.scheduleFlush()
+
+	return true, d.runFlush(job)
+}
 
-			if err = d.compactingWAL.Close(); err != nil {
-				return fmt.Errorf("failed attempt to close WAL: %w", err)
+// claimFlush claims the oldest memtable waiting to be flushed whose column family has no older memtables
+// waiting or being flushed, so that each column family's level 0 sstables are added in the order they were
+// written. It returns nil if there's none. Must be called while holding the lock
+func (d *DB) claimFlush() *flushJob {
+	blocked := make(map[uint32]bool)
+	for _, frozen := range d.immutable {
+		for id, memTable := range frozen.memTables {
+			if !blocked[id] && !frozen.flushing[id] {
+				frozen.flushing[id] = true
+				return &flushJob{frozen: frozen, family: d.families[id], memTable: memTable}
 			}
+		}
 
-			d.compactingMemTable = nil
-			d.compactingWAL = nil
+		for id := range frozen.memTables {
+			blocked[id] = true
 		}
 	}
 
-	if err := d.compactor.Compact(); err != nil {
-		return fmt.Errorf("failed attempting to compact: %w", err)
+	return nil
+}
+
+// runFlush flushes a claimed memtable to a level 0 sstable, removing the memtables and WALs that are no
+// longer needed once it's done
+func (d *DB) runFlush(job *flushJob) error {
+	err := d.flushColumnFamily(job.family, job.memTable)
+
+	d.mutex.Lock()
+	delete(job.frozen.flushing, job.family.id)
+	if err != nil {
+		err = fmt.Errorf("failed flushing column family %s: %w", job.family.name, err)
+		d.flushFailures++
+		d.flushErr = err
+		d.flushed.Broadcast()
+		d.mutex.Unlock()
+		return err
+	}
+
+	// Once in level 0 the memtable isn't needed, nor flushed again if another column family fails to
+	delete(job.frozen.memTables, job.family.id)
+	err = d.finishFlushes()
+	d.flushed.Broadcast()
+	d.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Level 0 may need compacting now
+	d.scheduler.scheduleCompaction()
+
+	return d.refreshWriteStall()
+}
+
+func (d *DB) columnFamilies() []*ColumnFamily {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	families := make([]*ColumnFamily, 0, len(d.families))
+	for _, family := range d.families {
+		families = append(families, family)
+	}
+
+	return families
+}
+
+func (d *DB) flushColumnFamily(family *ColumnFamily, memTable *memtable.MemTable) error {
+	file, err := sstable.CreateFile(d.name, d.dataDir)
+	if err != nil {
+		return fmt.Errorf("failed attempt to create new sstable file: %w", err)
+	}
+	defer file.Close()
+
+	start := time.Now()
+	info := FlushInfo{ColumnFamily: family.name, Table: TableInfo{ColumnFamily: family.name,
+		Filename: filepath.Base(file.Name())}}
+	for _, listener := range d.opts.EventListeners {
+		listener.OnFlushBegin(info)
+	}
+
+	info.Table, info.Err = d.writeFlush(family, memTable, file)
+	info.Duration = time.Since(start)
+	for _, listener := range d.opts.EventListeners {
+		if info.Err == nil {
+			listener.OnTableCreated(info.Table)
+		}
+		listener.OnFlushCompleted(info)
+	}
+
+	return info.Err
+}
+
+// writeFlush writes one of the column family's immutable memtables to file and adds it to the manifest
+func (d *DB) writeFlush(family *ColumnFamily, memTable *memtable.MemTable, file *os.File) (TableInfo, error) {
+	filename := filepath.Base(file.Name())
+	metadata, err := family.flushMemTable(memTable, filename, file)
+	if err != nil {
+		return TableInfo{ColumnFamily: family.name, Filename: filename}, err
+	}
+
+	if err = file.Sync(); err != nil {
+		return TableInfo{}, fmt.Errorf("error flushing sstable to disk: %w", err)
+	}
+
+	// The table's size is read before it's added to the manifest, after which compaction can remove it
+	table := d.tableInfo(family.name, metadata)
+	if err = d.manifest.AddEntry(manifest.NewEntry(metadata, false)); err != nil {
+		return table, err
+	}
+	d.stats.recordFlush(table.Size)
+
+	return table, nil
+}
+
+// finishFlushes removes the oldest memtables waiting to be flushed for as long as they've all been flushed
+// Must be called while holding the lock
+func (d *DB) finishFlushes() error {
+	for len(d.immutable) > 0 && len(d.immutable[0].memTables) == 0 {
+		if err := d.finishFlush(d.immutable[0]); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// finishFlush removes the WAL once every memtable that was written to it has been flushed, or archives
+// it if WALs are being retained for subscribers. Must be called while holding the lock
+func (d *DB) finishFlush(flushed *immutableMemTables) error {
+	if flushed.walog != nil {
+		if d.opts.WALRetention > 0 {
+			if err := flushed.walog.Archive(); err != nil {
+				return fmt.Errorf("failed attempt to archive WAL: %w", err)
+			}
+		} else if err := flushed.walog.Close(); err != nil {
+			return fmt.Errorf("failed attempt to close WAL: %w", err)
+		}
+	}
+
+	if err := wal.RemoveArchived(d.name, d.dataDir, time.Now().Add(-d.opts.WALRetention)); err != nil {
+		return fmt.Errorf("failed removing expired WALs: %w", err)
+	}
+
+	d.immutable = d.immutable[1:]
+
+	// Memtables may have filled up or a flush may have been requested while waiting for room in the queue
+	return d.maybeScheduleFlush()
+}
@@ -1,14 +1,22 @@
 package pkg
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nbroyles/nbdb/internal/memtable"
+	"github.com/nbroyles/nbdb/internal/storage"
+	"github.com/nbroyles/nbdb/internal/test"
+	"github.com/nbroyles/nbdb/internal/wal"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,7 +25,7 @@ func TestDB_RoundTrip(t *testing.T) {
 	assert.NoError(t, err)
 
 	dbName := "foo"
-	db, err := New(dbName, DBOpts{dataDir: dir})
+	db, err := New(dbName, DBOpts{DataDir: dir})
 	defer cleanup(dbName, dir)
 	assert.NoError(t, err)
 
@@ -29,22 +37,68 @@ func TestDB_RoundTrip(t *testing.T) {
 	assert.Equal(t, []byte("bar"), val)
 }
 
-func TestDB_GetFromCompactingMemtable(t *testing.T) {
+func TestDB_Write(t *testing.T) {
 	dir, err := os.Getwd()
 	assert.NoError(t, err)
 
 	dbName := "foo"
-	db, err := New(dbName, DBOpts{dataDir: dir})
+	db, err := New(dbName, DBOpts{DataDir: dir})
 	defer cleanup(dbName, dir)
 	assert.NoError(t, err)
 
+	assert.NoError(t, db.Put([]byte("baz"), []byte("bax")))
+
+	batch := NewWriteBatch()
+	batch.Put([]byte("foo"), []byte("bar"))
+	batch.Put([]byte("howdy"), []byte("time"))
+	batch.Delete([]byte("baz"))
+	assert.NoError(t, db.Write(batch))
+
 	val, err := db.Get([]byte("foo"))
 	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), val)
+
+	val, err = db.Get([]byte("howdy"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("time"), val)
+
+	val, err = db.Get([]byte("baz"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, val)
+
+	// Batch should be recovered from the WAL on restart
+	db2, err := Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+
+	val, err = db2.Get([]byte("howdy"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("time"), val)
+
+	val, err = db2.Get([]byte("baz"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, val)
+}
+
+func TestDB_GetFromCompactingMemtable(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	val, err := db.Get([]byte("foo"))
+	assert.Equal(t, ErrNotFound, err)
 	assert.Nil(t, val)
 
 	mt := memtable.New()
-	mt.Put([]byte("foo"), []byte("bar"))
-	db.compactingMemTable = mt
+	mt.Put([]byte("foo"), []byte("bar"), 0)
+	frozen := newImmutableMemTables(nil)
+	frozen.memTables[defaultFamilyID] = mt
+	db.mutex.Lock()
+	db.immutable = append(db.immutable, frozen)
+	db.mutex.Unlock()
 
 	val, err = db.Get([]byte("foo"))
 	assert.NoError(t, err)
@@ -56,7 +110,7 @@ func TestDB_GetFromSSTable(t *testing.T) {
 	assert.NoError(t, err)
 
 	dbName := "foo"
-	db, err := New(dbName, DBOpts{dataDir: dir})
+	db, err := New(dbName, DBOpts{DataDir: dir})
 	defer cleanup(dbName, dir)
 
 	assert.NoError(t, err)
@@ -64,16 +118,14 @@ func TestDB_GetFromSSTable(t *testing.T) {
 	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
 	assert.NoError(t, db.Put([]byte("bar"), []byte("baz")))
 
-	db.compactingWAL = db.walog
-	db.compactingMemTable = db.memTable
-
-	db.memTable = memtable.New()
+	db.mutex.Lock()
+	db.freezeMemTables(db.walog)
+	db.mutex.Unlock()
 
 	err = db.doCompaction()
 	assert.NoError(t, err)
 
-	assert.Nil(t, db.compactingMemTable)
-	assert.Nil(t, db.compactingWAL)
+	assert.Empty(t, db.immutable)
 
 	// Key found
 	val, err := db.Get([]byte("foo"))
@@ -82,16 +134,277 @@ func TestDB_GetFromSSTable(t *testing.T) {
 
 	// Key not found
 	val, err = db.Get([]byte("doo"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, val)
+}
+
+func TestDB_DeleteShadowsOlderLevels(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, db.Put([]byte("baz"), []byte("bax")))
+	flush(t, db)
+
+	// Deleting a key that only exists in an sstable must hide it
+	assert.NoError(t, db.Delete([]byte("foo")))
+	assertDeleted := func() {
+		val, err := db.Get([]byte("foo"))
+		assert.Equal(t, ErrNotFound, err)
+		assert.Nil(t, val)
+
+		val, err = db.Get([]byte("baz"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("bax"), val)
+	}
+	assertDeleted()
+
+	// The delete is in an immutable memtable
+	freeze(t, db)
+	assertDeleted()
+
+	// The delete is in a newer level 0 sstable
+	assert.NoError(t, db.doCompaction())
+	assert.Len(t, db.manifest.MetadataForLevel(0, 0), 2)
+	assertDeleted()
+
+	// The delete and the value are both compacted into level 1
+	flush(t, db)
+	flush(t, db)
+	assert.Empty(t, db.manifest.MetadataForLevel(0, 0))
+	assertDeleted()
+
+	// The value is in level 1 and the delete is in level 0
+	assert.NoError(t, db.Put([]byte("foo"), []byte("again")))
+	for i := 0; i < 4; i++ {
+		flush(t, db)
+	}
+	assert.NoError(t, db.Delete([]byte("foo")))
+	flush(t, db)
+	assertDeleted()
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	dir, err := os.Getwd()
 	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, db.Put([]byte(key), []byte(key)))
+	}
+	flush(t, db)
+
+	assert.EqualError(t, db.DeleteRange([]byte("c"), []byte("b")),
+		"failed attempting delete range: invalid range delete. start c must come before end b")
+
+	assert.NoError(t, db.DeleteRange([]byte("b"), []byte("d")))
+	assertDeleted := func(db *DB) {
+		for key, expected := range map[string][]byte{"a": []byte("a"), "b": nil, "c": nil, "d": []byte("d")} {
+			val, err := db.Get([]byte(key))
+			if expected == nil {
+				assert.Equal(t, ErrNotFound, err, "key %s", key)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, expected, val, "key %s", key)
+		}
+
+		iter, err := db.NewIterator(ReadOpts{})
+		assert.NoError(t, err)
+		defer iter.Close()
+
+		iter.SeekToFirst()
+		assertIteration(t, iter, map[string]string{"a": "a", "d": "d"}, "a", "d")
+
+		iter.SeekToLast()
+		assert.Equal(t, []byte("d"), iter.Key())
+		iter.Prev()
+		assert.Equal(t, []byte("a"), iter.Key())
+		iter.Prev()
+		assert.False(t, iter.Valid())
+	}
+
+	// The range delete is in the memtable
+	assertDeleted(db)
+
+	// The range delete is in a level 0 sstable
+	flush(t, db)
+	assertDeleted(db)
+
+	// Both the range delete and the values it hides are compacted into level 1
+	flush(t, db)
+	flush(t, db)
+	assert.Empty(t, db.manifest.MetadataForLevel(0, 0))
+	assertDeleted(db)
+
+	// Writes made after the range delete are visible
+	assert.NoError(t, db.Put([]byte("c"), []byte("again")))
+	val, err := db.Get([]byte("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("again"), val)
+
+	// Range deletes are recovered from the WAL
+	assert.NoError(t, db.DeleteRange([]byte("a"), []byte("b")))
+	db2, err := Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+
+	val, err = db2.Get([]byte("a"))
+	assert.Equal(t, ErrNotFound, err)
 	assert.Nil(t, val)
 }
 
+func TestDB_Merge(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, MergeOperator: test.AppendOperator{}})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assertValues := func(db *DB, expected map[string]string, order ...string) {
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(value), val, "key %s", key)
+		}
+
+		iter, err := db.NewIterator(ReadOpts{})
+		assert.NoError(t, err)
+		defer iter.Close()
+
+		iter.SeekToFirst()
+		assertIteration(t, iter, expected, order...)
+
+		iter.SeekToLast()
+		for j := len(order) - 1; j >= 0; j-- {
+			assert.True(t, iter.Valid())
+			assert.Equal(t, []byte(order[j]), iter.Key())
+			assert.Equal(t, []byte(expected[order[j]]), iter.Value())
+			iter.Prev()
+		}
+		assert.False(t, iter.Valid())
+		assert.NoError(t, iter.Error())
+	}
+
+	assert.NoError(t, db.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, db.Merge([]byte("a"), []byte("2")))
+	assert.NoError(t, db.Merge([]byte("b"), []byte("1")))
+	assertValues(db, map[string]string{"a": "1,2", "b": "1"}, "a", "b")
+
+	// Operands in newer layers are applied to values in older ones
+	flush(t, db)
+	assert.NoError(t, db.Merge([]byte("a"), []byte("3")))
+	assert.NoError(t, db.Merge([]byte("b"), []byte("2")))
+	assertValues(db, map[string]string{"a": "1,2,3", "b": "1,2"}, "a", "b")
+
+	// A delete starts the value over
+	assert.NoError(t, db.Delete([]byte("b")))
+	assert.NoError(t, db.Merge([]byte("b"), []byte("3")))
+	assertValues(db, map[string]string{"a": "1,2,3", "b": "3"}, "a", "b")
+
+	// Operands are collapsed during compaction
+	flush(t, db)
+	flush(t, db)
+	flush(t, db)
+	assert.Empty(t, db.manifest.MetadataForLevel(0, 0))
+	assertValues(db, map[string]string{"a": "1,2,3", "b": "3"}, "a", "b")
+
+	// Operands are recovered from the WAL
+	assert.NoError(t, db.Merge([]byte("a"), []byte("4")))
+	db2, err := Open(dbName, DBOpts{DataDir: dir, MergeOperator: test.AppendOperator{}})
+	assert.NoError(t, err)
+	assertValues(db2, map[string]string{"a": "1,2,3,4", "b": "3"}, "a", "b")
+}
+
+func TestDB_MergeWithoutOperator(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.EqualError(t, db.Merge([]byte("a"), []byte("1")),
+		"failed attempting merge: cannot merge key a. no merge operator configured")
+}
+
+func TestDB_PutWithTTL(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("a"), []byte("old")))
+	flush(t, db)
+
+	assert.NoError(t, db.PutWithTTL([]byte("a"), []byte("new"), 100*time.Millisecond))
+	assert.NoError(t, db.PutWithTTL([]byte("b"), []byte("b"), time.Hour))
+
+	val, err := db.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), val)
+
+	time.Sleep(150 * time.Millisecond)
+
+	// The expired key must not fall through to the older value
+	assertExpired := func(db *DB) {
+		val, err := db.Get([]byte("a"))
+		assert.Equal(t, ErrNotFound, err)
+		assert.Nil(t, val)
+
+		val, err = db.Get([]byte("b"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("b"), val)
+
+		iter, err := db.NewIterator(ReadOpts{})
+		assert.NoError(t, err)
+		defer iter.Close()
+
+		iter.SeekToFirst()
+		assertIteration(t, iter, map[string]string{"b": "b"}, "b")
+
+		iter.SeekToLast()
+		assert.Equal(t, []byte("b"), iter.Key())
+		iter.Prev()
+		assert.False(t, iter.Valid())
+	}
+	assertExpired(db)
+
+	// Expiry is recovered from the WAL
+	db2, err := Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	assertExpired(db2)
+
+	// And survives being flushed and compacted
+	flush(t, db)
+	assertExpired(db)
+
+	flush(t, db)
+	flush(t, db)
+	assert.Empty(t, db.manifest.MetadataForLevel(0, 0))
+	assertExpired(db)
+}
+
 func TestNew(t *testing.T) {
 	dir, err := os.Getwd()
 	assert.NoError(t, err)
 
 	dbName := "foo"
-	_, err = New(dbName, DBOpts{dataDir: dir})
+	_, err = New(dbName, DBOpts{DataDir: dir})
 	defer cleanup(dbName, dir)
 
 	assert.NoError(t, err)
@@ -104,12 +417,12 @@ func TestNew_AlreadyExists(t *testing.T) {
 	assert.NoError(t, err)
 
 	dbName := "foo"
-	_, err = New(dbName, DBOpts{dataDir: dir})
+	_, err = New(dbName, DBOpts{DataDir: dir})
 	defer cleanup(dbName, dir)
 
 	assert.NoError(t, err)
 
-	_, err = New(dbName, DBOpts{dataDir: dir})
+	_, err = New(dbName, DBOpts{DataDir: dir})
 	assert.EqualError(t, err, "database foo already exists. use DB#Open instead")
 }
 
@@ -118,7 +431,7 @@ func TestExists(t *testing.T) {
 	assert.NoError(t, err)
 
 	dbName := "foo"
-	_, err = New(dbName, DBOpts{dataDir: dir})
+	_, err = New(dbName, DBOpts{DataDir: dir})
 	defer cleanup(dbName, dir)
 
 	assert.NoError(t, err)
@@ -134,15 +447,13 @@ func TestOpen(t *testing.T) {
 	assert.NoError(t, err)
 
 	dbName := "foo"
-	_, err = New(dbName, DBOpts{dataDir: dir})
+	db, err := New(dbName, DBOpts{DataDir: dir})
 	defer cleanup(dbName, dir)
 
 	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
 
-	// TODO: replace this logic with DB#Close when implemented
-	closeDb(t, dbName, dir)
-
-	db, err := Open(dbName, DBOpts{dataDir: dir})
+	db, err = Open(dbName, DBOpts{DataDir: dir})
 	assert.NoError(t, err)
 
 	assert.Equal(t, dbName, db.name)
@@ -152,7 +463,7 @@ func TestOpen_NotExist(t *testing.T) {
 	dir, err := os.Getwd()
 	assert.NoError(t, err)
 
-	_, err = Open("foo", DBOpts{dataDir: dir})
+	_, err = Open("foo", DBOpts{DataDir: dir})
 	assert.EqualError(t, err, "failed opening database foo. does not exist")
 }
 
@@ -163,16 +474,14 @@ func TestOpenOrNew(t *testing.T) {
 	dbName := "foo"
 	assert.False(t, dbExists(t, dbName, dir))
 
-	_, err = OpenOrNew(dbName, DBOpts{dataDir: dir})
+	db, err := OpenOrNew(dbName, DBOpts{DataDir: dir})
 	defer cleanup(dbName, dir)
 
 	assert.NoError(t, err)
 	assert.True(t, dbExists(t, dbName, dir))
+	assert.NoError(t, db.Close())
 
-	// TODO: replace this logic with DB#Close when implemented
-	closeDb(t, dbName, dir)
-
-	db, err := OpenOrNew(dbName, DBOpts{dataDir: dir})
+	db, err = OpenOrNew(dbName, DBOpts{DataDir: dir})
 	assert.NoError(t, err)
 
 	assert.Equal(t, dbName, db.name)
@@ -189,7 +498,7 @@ func TestLocking(t *testing.T) {
 	_, err = os.Stat(lockPath)
 	assert.True(t, os.IsNotExist(err))
 
-	db, err := New(dbName, DBOpts{dataDir: dir})
+	db, err := New(dbName, DBOpts{DataDir: dir})
 	defer cleanup(dbName, dir)
 	assert.NoError(t, err)
 
@@ -199,9 +508,25 @@ func TestLocking(t *testing.T) {
 	assert.NotNil(t, info)
 
 	// Close and ensure lock gone
-	db.Close()
+	assert.NoError(t, db.Close())
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// Failing to open releases the lock too
+	optionsPath := path.Join(dir, dbName, optionsFile)
+	options, err := ioutil.ReadFile(optionsPath)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(optionsPath, []byte("malformed"), 0644))
+
+	_, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.EqualError(t, err, "failed checking options: malformed line in options file: malformed")
 	_, err = os.Stat(lockPath)
 	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, ioutil.WriteFile(optionsPath, options, 0644))
+	db, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	db.Close()
 }
 
 func TestFailIfLocked(t *testing.T) {
@@ -224,9 +549,463 @@ func TestFailIfLocked(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Try to open db; expect an error
-	_, err = OpenOrNew(dbName, DBOpts{dataDir: dir})
+	_, err = OpenOrNew(dbName, DBOpts{DataDir: dir})
 	assert.EqualError(t, err, fmt.Sprintf("could not lock database: cannot lock database. already "+
 		"locked by another process (%d)", os.Getpid()+1))
+	assert.True(t, errors.Is(err, ErrLocked))
+}
+
+func TestDB_GetEmptyValue(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte{}))
+
+	// A key with an empty value is distinct from one that doesn't exist, in memory and on disk
+	assertEmpty := func() {
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(t, err)
+		assert.Empty(t, val)
+
+		_, err = db.Get([]byte("bar"))
+		assert.Equal(t, ErrNotFound, err)
+	}
+	assertEmpty()
+
+	flush(t, db)
+	assertEmpty()
+}
+
+func TestDB_SizeLimits(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	bigKey := make([]byte, MaxKeySize+1)
+	bigValue := make([]byte, MaxValueSize+1)
+
+	assert.True(t, errors.Is(db.Put(bigKey, []byte("bar")), ErrKeyTooLarge))
+	assert.True(t, errors.Is(db.Delete(bigKey), ErrKeyTooLarge))
+	assert.True(t, errors.Is(db.DeleteRange([]byte("a"), bigKey), ErrKeyTooLarge))
+	assert.True(t, errors.Is(db.Put([]byte("foo"), bigValue), ErrValueTooLarge))
+
+	// Nothing in a batch is written if any of it is too large
+	batch := NewWriteBatch()
+	batch.Put([]byte("foo"), []byte("bar"))
+	batch.Put([]byte("baz"), bigValue)
+	assert.True(t, errors.Is(db.Write(batch), ErrValueTooLarge))
+
+	_, err = db.Get([]byte("foo"))
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, db.Put(bigKey[:MaxKeySize], bigValue[:MaxValueSize]))
+	assert.NoError(t, db.Close())
+}
+
+func TestDB_OpenCorruptWAL(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, db.Put([]byte("baz"), []byte("bax")))
+
+	// Flip a byte in the first batch, which isn't at the end of the WAL and so can't be a partial write
+	matches, err := filepath.Glob(path.Join(dir, dbName, "wal_*"))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+
+	data, err := ioutil.ReadFile(matches[0])
+	assert.NoError(t, err)
+	data[storage.HeaderLen+10] ^= 0xFF
+	assert.NoError(t, ioutil.WriteFile(matches[0], data, 0644))
+
+	_, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.True(t, errors.Is(err, ErrCorruption))
+}
+
+func TestDB_OpenIncompatibleFormat(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, db.Close())
+
+	// Strip the header from the manifest, as if it had been written before formats were versioned
+	matches, err := filepath.Glob(path.Join(dir, dbName, "manifest_*"))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+
+	data, err := ioutil.ReadFile(matches[0])
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(matches[0], data[storage.HeaderLen:], 0644))
+
+	_, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.True(t, errors.Is(err, ErrIncompatibleFormat))
+
+	// Failing to open leaves the database unlocked
+	assert.NoError(t, ioutil.WriteFile(matches[0], data, 0644))
+	db, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+}
+
+func TestDB_CloseFullImmutableQueue(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, MaxImmutableMemTables: 2})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	// Queue two memtables for flushing, each written to its own WAL
+	for _, key := range []string{"a", "b"} {
+		assert.NoError(t, db.Put([]byte(key), []byte("old")))
+
+		waf, err := wal.CreateFile(db.name, db.dataDir)
+		assert.NoError(t, err)
+		db.mutex.Lock()
+		db.freezeMemTables(wal.New(waf))
+		db.mutex.Unlock()
+	}
+	assert.NoError(t, db.Put([]byte("a"), []byte("new")))
+	assert.NoError(t, db.Put([]byte("c"), []byte("new")))
+	assert.NoError(t, db.Close())
+
+	db, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	for key, expected := range map[string]string{"a": "new", "b": "old", "c": "new"} {
+		value, err := db.Get([]byte(key))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(expected), value)
+	}
+	assert.NoError(t, db.Close())
+}
+
+func TestDB_OpenFullImmutableQueue(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, MaxImmutableMemTables: 2})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+
+	// Fill the queue of immutable memtables without letting any of them be flushed
+	db.scheduler.stop()
+	for _, key := range []string{"a", "b"} {
+		assert.NoError(t, db.Put([]byte(key), []byte("old")))
+		assert.NoError(t, users.Put([]byte(key), []byte("user")))
+
+		waf, err := wal.CreateFile(db.name, db.dataDir)
+		assert.NoError(t, err)
+		db.mutex.Lock()
+		db.freezeMemTables(wal.New(waf))
+		db.mutex.Unlock()
+	}
+	assert.NoError(t, db.Put([]byte("a"), []byte("new")))
+	assert.NoError(t, db.Put([]byte("c"), []byte("new")))
+
+	// Crash, leaving a WAL behind for each memtable
+	matches, err := filepath.Glob(path.Join(dir, dbName, "wal_*"))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 3)
+
+	db, err = Open(dbName, DBOpts{DataDir: dir, MaxImmutableMemTables: 2})
+	assert.NoError(t, err)
+	users = db.Column("users")
+
+	for key, expected := range map[string]string{"a": "new", "b": "old", "c": "new"} {
+		value, err := db.Get([]byte(key))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(expected), value)
+	}
+	for _, key := range []string{"a", "b"} {
+		value, err := users.Get([]byte(key))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("user"), value)
+	}
+
+	// Only the newest WAL is left once the older memtables are flushed
+	assert.NoError(t, db.Flush(true))
+	matches, err = filepath.Glob(path.Join(dir, dbName, "wal_*"))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+
+	assert.NoError(t, db.Put([]byte("d"), []byte("new")))
+	assert.NoError(t, db.Close())
+
+	db, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	value, err := db.Get([]byte("d"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), value)
+	assert.NoError(t, db.Close())
+}
+
+func TestDB_Close(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, users.Put([]byte("baz"), []byte("bax")))
+	assert.NoError(t, db.Close())
+
+	// Every memtable is flushed, leaving nothing to replay from the WAL
+	matches, err := filepath.Glob(path.Join(dir, dbName, "wal_*"))
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+
+	matches, err = filepath.Glob(path.Join(dir, dbName, "sstable_*"))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 2)
+
+	// Nothing can be done with a closed database
+	_, err = db.Get([]byte("foo"))
+	assert.True(t, errors.Is(err, ErrClosed))
+	assert.True(t, errors.Is(db.Put([]byte("foo"), []byte("bar")), ErrClosed))
+	assert.True(t, errors.Is(db.Delete([]byte("foo")), ErrClosed))
+	assert.True(t, errors.Is(users.Put([]byte("foo"), []byte("bar")), ErrClosed))
+	_, err = db.NewIterator(ReadOpts{})
+	assert.True(t, errors.Is(err, ErrClosed))
+	_, err = db.CreateColumnFamily("emails")
+	assert.True(t, errors.Is(err, ErrClosed))
+	assert.True(t, errors.Is(db.Flush(true), ErrClosed))
+	assert.True(t, errors.Is(db.SyncWAL(), ErrClosed))
+	assert.True(t, errors.Is(db.CompactRange(nil, nil), ErrClosed))
+	assert.True(t, errors.Is(db.Close(), ErrClosed))
+
+	db, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), val)
+
+	val, err = db.Column("users").Get([]byte("baz"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bax"), val)
+}
+
+func TestDB_CloseRacingWrites(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, MemTableSizeLimit: 1000})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	// Each writer records the keys it managed to write before the database was closed
+	written := make([][]string, 4)
+	var wg sync.WaitGroup
+	for i := range written {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				key := fmt.Sprintf("%d-%d", i, j)
+				if err := db.Put([]byte(key), []byte(key)); err != nil {
+					assert.True(t, errors.Is(err, ErrClosed))
+					return
+				}
+				written[i] = append(written[i], key)
+			}
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, db.Close())
+	wg.Wait()
+
+	db, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+
+	for _, keys := range written {
+		for _, key := range keys {
+			val, err := db.Get([]byte(key))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(key), val)
+		}
+	}
+}
+
+func TestDB_MultiGet(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("apple"), []byte("red")))
+	assert.NoError(t, db.Put([]byte("banana"), []byte("yellow")))
+	assert.NoError(t, db.Put([]byte("cherry"), []byte("red")))
+	flush(t, db)
+
+	assert.NoError(t, db.Put([]byte("banana"), []byte("green")))
+	assert.NoError(t, db.Delete([]byte("cherry")))
+	assert.NoError(t, db.Put([]byte("date"), []byte("brown")))
+	flush(t, db)
+
+	snap := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snap)
+
+	assert.NoError(t, db.Put([]byte("apple"), []byte("green")))
+
+	keys := [][]byte{[]byte("date"), []byte("apple"), []byte("banana"), []byte("cherry"), []byte("fig"),
+		[]byte("apple")}
+	values, errs := db.MultiGet(keys)
+	assert.Equal(t, [][]byte{[]byte("brown"), []byte("green"), []byte("green"), nil, nil, []byte("green")}, values)
+	assert.Equal(t, []error{nil, nil, nil, ErrNotFound, ErrNotFound, nil}, errs)
+
+	values, errs = db.MultiGetWithOpts(keys, ReadOpts{Snapshot: snap})
+	assert.Equal(t, [][]byte{[]byte("brown"), []byte("red"), []byte("green"), nil, nil, []byte("red")}, values)
+	assert.Equal(t, []error{nil, nil, nil, ErrNotFound, ErrNotFound, nil}, errs)
+
+	assert.NoError(t, db.Close())
+	_, errs = db.MultiGet(keys[:2])
+	assert.Equal(t, []error{ErrClosed, ErrClosed}, errs)
+}
+
+func TestDB_WriteContext(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, MergeOperator: test.AppendOperator{}})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	for _, family := range []*ColumnFamily{db.defaultFamily, users} {
+		assert.NoError(t, family.PutWithTTLContext(ctx, []byte("a"), []byte("1"), time.Hour))
+		assert.NoError(t, family.MergeContext(ctx, []byte("a"), []byte("2")))
+		assert.NoError(t, family.PutContext(ctx, []byte("b"), []byte("1")))
+		assert.NoError(t, family.DeleteRangeContext(ctx, []byte("b"), []byte("c")))
+	}
+	assert.NoError(t, db.MergeContext(ctx, []byte("a"), []byte("3")))
+
+	// Nothing is written once the context is cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	assert.True(t, errors.Is(db.PutWithTTLContext(cancelled, []byte("c"), []byte("1"), time.Hour),
+		context.Canceled))
+	assert.True(t, errors.Is(db.MergeContext(cancelled, []byte("a"), []byte("4")), context.Canceled))
+	assert.True(t, errors.Is(db.DeleteRangeContext(cancelled, []byte("a"), []byte("b")), context.Canceled))
+	assert.True(t, errors.Is(users.PutWithTTLContext(cancelled, []byte("c"), []byte("1"), time.Hour),
+		context.Canceled))
+	assert.True(t, errors.Is(users.MergeContext(cancelled, []byte("a"), []byte("4")), context.Canceled))
+	assert.True(t, errors.Is(users.DeleteRangeContext(cancelled, []byte("a"), []byte("b")), context.Canceled))
+
+	for family, expected := range map[*ColumnFamily]string{db.defaultFamily: "1,2,3", users: "1,2"} {
+		val, err := family.Get([]byte("a"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(expected), val)
+
+		_, err = family.Get([]byte("b"))
+		assert.Equal(t, ErrNotFound, err)
+
+		_, err = family.Get([]byte("c"))
+		assert.Equal(t, ErrNotFound, err)
+	}
+}
+
+func TestDB_Context(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	assert.NoError(t, db.PutContext(ctx, []byte("foo"), []byte("bar")))
+	flush(t, db)
+
+	val, err := db.GetContext(ctx, []byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), val)
+
+	// Nothing is read or written once the context is cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err = db.GetContext(cancelled, []byte("foo"))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.True(t, errors.Is(db.PutContext(cancelled, []byte("baz"), []byte("bax")), context.Canceled))
+	assert.True(t, errors.Is(db.DeleteContext(cancelled, []byte("foo")), context.Canceled))
+
+	_, err = db.Get([]byte("baz"))
+	assert.Equal(t, ErrNotFound, err)
+
+	val, err = db.Get([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), val)
+}
+
+func TestDB_ContextLockTimeout(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	// Requests stop waiting on a lock that's held for longer than their deadline
+	db.mutex.Lock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.True(t, errors.Is(db.PutContext(ctx, []byte("foo"), []byte("bar")), context.DeadlineExceeded))
+	_, err = db.GetContext(ctx, []byte("foo"))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	db.mutex.Unlock()
+
+	// The lock isn't left held by requests that gave up on it
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	val, err := db.Get([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), val)
 }
 
 func TestMemtableFlush(t *testing.T) {
@@ -234,7 +1013,7 @@ func TestMemtableFlush(t *testing.T) {
 	assert.NoError(t, err)
 
 	dbName := "foo"
-	db, err := New(dbName, DBOpts{dataDir: dir})
+	db, err := New(dbName, DBOpts{DataDir: dir})
 	defer cleanup(dbName, dir)
 
 	assert.NoError(t, err)
@@ -242,14 +1021,14 @@ func TestMemtableFlush(t *testing.T) {
 	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
 	assert.NoError(t, db.Put([]byte("bar"), []byte("baz")))
 
-	db.compactingWAL = db.walog
-	db.compactingMemTable = db.memTable
+	db.mutex.Lock()
+	db.freezeMemTables(db.walog)
+	db.mutex.Unlock()
 
 	err = db.doCompaction()
 	assert.NoError(t, err)
 
-	assert.Nil(t, db.compactingMemTable)
-	assert.Nil(t, db.compactingWAL)
+	assert.Empty(t, db.immutable)
 
 	matches, err := filepath.Glob(path.Join(dir, dbName, "wal_*"))
 	assert.NoError(t, err)
@@ -266,17 +1045,6 @@ func cleanup(name string, datadir string) {
 	os.RemoveAll(path.Join(datadir, name))
 }
 
-func closeDb(t *testing.T, dbName string, datadir string) {
-	// Simulate a successful close by ensuring wal is removed before re-opening
-	matches, err := filepath.Glob(path.Join(datadir, dbName, "wal_*"))
-	assert.NoError(t, err)
-
-	for _, match := range matches {
-		err = os.Remove(match)
-		assert.NoError(t, err)
-	}
-}
-
 func dbExists(t *testing.T, dbName string, datadir string) bool {
 	dbPath := path.Join(datadir, dbName)
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
@@ -289,3 +1057,195 @@ func dbExists(t *testing.T, dbName string, datadir string) bool {
 
 	return false
 }
+
+func TestDB_Flush(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, users.Put([]byte("baz"), []byte("bax")))
+	assert.NoError(t, db.SyncWAL())
+	assert.NoError(t, db.Flush(true))
+
+	assert.Len(t, db.manifest.MetadataForLevel(db.defaultFamily.id, 0), 1)
+	assert.Len(t, db.manifest.MetadataForLevel(users.id, 0), 1)
+	assert.Equal(t, uint32(0), db.defaultFamily.memTable.Size())
+	assert.Empty(t, db.immutable)
+
+	// The flushed WAL is removed
+	matches, err := filepath.Glob(path.Join(dir, dbName, "wal_*"))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+
+	value, err := users.Get([]byte("baz"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bax"), value)
+
+	// Nothing is written if the memtables are empty
+	assert.NoError(t, db.Flush(true))
+	assert.Len(t, db.manifest.MetadataForLevel(db.defaultFamily.id, 0), 1)
+
+	// A flush that doesn't wait is done once the next one that does is
+	assert.NoError(t, db.Put([]byte("foo"), []byte("baz")))
+	assert.NoError(t, db.Flush(false))
+	assert.NoError(t, db.Flush(true))
+	assert.Len(t, db.manifest.MetadataForLevel(db.defaultFamily.id, 0), 2)
+}
+
+func TestDB_CompactRange(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")))
+	}
+	assert.NoError(t, db.Flush(true))
+
+	snapshot := db.GetSnapshot()
+	assert.NoError(t, db.DeleteRange([]byte("key000"), []byte("key090")))
+	assert.NoError(t, db.Delete([]byte("key095")))
+	assert.NoError(t, db.CompactRange(nil, nil))
+
+	// Everything is pushed into level 1, the bottom level, but the snapshot keeps the deleted keys around
+	assert.Empty(t, db.manifest.MetadataForLevel(db.defaultFamily.id, 0))
+	assert.Len(t, db.manifest.MetadataForLevel(db.defaultFamily.id, 1), 1)
+	before, err := db.defaultFamily.compactor.LevelSize(1)
+	assert.NoError(t, err)
+
+	value, err := db.GetWithOpts([]byte("key010"), ReadOpts{Snapshot: snapshot})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+
+	// Once released, the space taken by deleted keys is given back
+	db.ReleaseSnapshot(snapshot)
+	assert.NoError(t, db.CompactRange([]byte("key000"), []byte("key099")))
+	after, err := db.defaultFamily.compactor.LevelSize(1)
+	assert.NoError(t, err)
+	assert.True(t, after < before/5, "expected %d to be much smaller than %d", after, before)
+
+	for i := 0; i < 100; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if i < 90 || i == 95 {
+			assert.True(t, errors.Is(err, ErrNotFound))
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("value"), value)
+		}
+	}
+
+	assert.Error(t, db.CompactRange([]byte("b"), []byte("a")))
+}
+
+func TestDB_TieredCompaction(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, CompactionStrategy: CompactionTiered, L0CompactionTrigger: 2})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	for round := 0; round < 8; round++ {
+		for i := round; i < 20; i++ {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", round))))
+		}
+		assert.NoError(t, db.Flush(true))
+		assert.NoError(t, db.doCompaction())
+	}
+
+	// Runs are merged down a level whenever two of them pile up
+	levels := db.manifest.Levels(db.defaultFamily.id)
+	assert.True(t, levels > 2)
+	for level := 0; level < levels; level++ {
+		assert.True(t, len(db.manifest.MetadataForLevel(db.defaultFamily.id, level)) < 2)
+	}
+
+	assert.NoError(t, db.Put([]byte("key19"), []byte("newest")))
+	assert.NoError(t, db.Flush(true))
+	for i := 0; i < 20; i++ {
+		expected := fmt.Sprintf("value%d", i)
+		if i >= 7 {
+			expected = "value7"
+		}
+		if i == 19 {
+			expected = "newest"
+		}
+
+		value, err := db.Get([]byte(fmt.Sprintf("key%02d", i)))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(expected), value)
+	}
+
+	// Compacting everything leaves a single run in the deepest level
+	assert.NoError(t, db.CompactRange(nil, nil))
+	levels = db.manifest.Levels(db.defaultFamily.id)
+	for level := 0; level < levels-1; level++ {
+		assert.Empty(t, db.manifest.MetadataForLevel(db.defaultFamily.id, level))
+	}
+	assert.Len(t, db.manifest.MetadataForLevel(db.defaultFamily.id, levels-1), 1)
+
+	value, err := db.Get([]byte("key19"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("newest"), value)
+	assert.NoError(t, db.Close())
+}
+
+func TestDB_FIFOCompaction(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, CompactionStrategy: CompactionFIFO})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("a"), []byte("value")))
+	assert.NoError(t, db.Flush(true))
+	tableSize, err := db.defaultFamily.compactor.LevelSize(0)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	// Room for two sstables the same size as the first
+	db, err = Open(dbName, DBOpts{DataDir: dir, CompactionStrategy: CompactionFIFO, L0CompactionTrigger: 2,
+		L0StopWritesTrigger: 2, FIFOMaxTotalSize: 2 * tableSize})
+	assert.NoError(t, err)
+
+	for _, key := range []string{"b", "c", "d"} {
+		assert.NoError(t, db.Put([]byte(key), []byte("value")))
+		assert.NoError(t, db.Flush(true))
+	}
+	assert.NoError(t, db.doCompaction())
+
+	// The oldest sstables are dropped rather than merged, and writes aren't held back by how many there are
+	assert.Len(t, db.manifest.MetadataForLevel(db.defaultFamily.id, 0), 2)
+	assert.Equal(t, 1, db.manifest.Levels(db.defaultFamily.id))
+	assert.Equal(t, WriteStall{}, db.WriteStall())
+
+	for _, key := range []string{"a", "b"} {
+		_, err := db.Get([]byte(key))
+		assert.True(t, errors.Is(err, ErrNotFound))
+	}
+	for _, key := range []string{"c", "d"} {
+		value, err := db.Get([]byte(key))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), value)
+	}
+
+	stats, err := db.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), stats.CompactionBytesWritten)
+	assert.NoError(t, db.Close())
+}
@@ -0,0 +1,27 @@
+package pkg
+
+import (
+	"errors"
+
+	"github.com/nbroyles/nbdb/internal/storage"
+)
+
+var (
+	// ErrNotFound is returned when reading a key that has no value
+	ErrNotFound = errors.New("key not found")
+	// ErrClosed is returned when attempting to use a database that has been closed
+	ErrClosed = errors.New("database is closed")
+	// ErrLocked is returned when attempting to open a database that another process has open
+	ErrLocked = errors.New("cannot lock database. already locked")
+	// ErrCorruption is returned when data read from disk is malformed or fails its checksum
+	ErrCorruption = storage.ErrCorruption
+	// ErrIncompatibleFormat is returned when opening a database with files written in a format this version can't
+	// read, either by a newer version or by one from before the formats were versioned
+	ErrIncompatibleFormat = storage.ErrIncompatibleFormat
+	// ErrKeyTooLarge is returned when writing a key larger than MaxKeySize
+	ErrKeyTooLarge = errors.New("key too large")
+	// ErrValueTooLarge is returned when writing a value larger than MaxValueSize
+	ErrValueTooLarge = errors.New("value too large")
+	// ErrChangesUnavailable is returned when subscribing from a change that's no longer retained
+	ErrChangesUnavailable = errors.New("changes no longer retained")
+)
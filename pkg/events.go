@@ -0,0 +1,232 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/compaction"
+	"github.com/nbroyles/nbdb/internal/sstable"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventListener is notified of the work a database does in the background. Listeners are registered with
+// DBOpts#EventListeners and are called synchronously, in the order they were registered, from whichever
+// goroutine is doing the work. Some events are sent while the database's lock is held, so listeners must
+// return quickly and must not call back into the database. Embed NoOpEventListener to only handle some events
+type EventListener interface {
+	// OnFlushBegin is called before a column family's memtable is written to a level 0 sstable
+	OnFlushBegin(info FlushInfo)
+	// OnFlushCompleted is called once the sstable has been written and added to the manifest, or with the
+	// error that stopped the flush
+	OnFlushCompleted(info FlushInfo)
+	// OnCompactionBegin is called before sstables are merged into the next level
+	OnCompactionBegin(info CompactionInfo)
+	// OnCompactionCompleted is called once the merged sstables have replaced their inputs and the inputs
+	// have been deleted, or with the error that stopped the compaction
+	OnCompactionCompleted(info CompactionInfo)
+	// OnTableCreated is called for each sstable written by a flush or compaction
+	OnTableCreated(info TableInfo)
+	// OnTableDeleted is called for each sstable removed once compaction has replaced it
+	OnTableDeleted(info TableInfo)
+	// OnWALRotated is called when writes switch to a new WAL so that the memtables written to the old one
+	// can be flushed
+	OnWALRotated(info WALRotationInfo)
+	// OnBackgroundError is called when a flush or compaction running in the background fails
+	OnBackgroundError(err error)
+	// OnWriteStallChanged is called when writes start or stop being held back, or are held back differently
+	OnWriteStallChanged(info WriteStallInfo)
+}
+
+// NoOpEventListener ignores every event. Embed it in listeners that only handle some events
+type NoOpEventListener struct{}
+
+func (NoOpEventListener) OnFlushBegin(FlushInfo)               {}
+func (NoOpEventListener) OnFlushCompleted(FlushInfo)           {}
+func (NoOpEventListener) OnCompactionBegin(CompactionInfo)     {}
+func (NoOpEventListener) OnCompactionCompleted(CompactionInfo) {}
+func (NoOpEventListener) OnTableCreated(TableInfo)             {}
+func (NoOpEventListener) OnTableDeleted(TableInfo)             {}
+func (NoOpEventListener) OnWALRotated(WALRotationInfo)         {}
+func (NoOpEventListener) OnBackgroundError(error)              {}
+func (NoOpEventListener) OnWriteStallChanged(WriteStallInfo)   {}
+
+// TableInfo describes an sstable
+type TableInfo struct {
+	ColumnFamily string
+	Filename     string
+	Level        int
+	// StartKey and EndKey are the smallest and largest keys in the table, including range delete bounds
+	StartKey []byte
+	EndKey   []byte
+	// MinSeq and MaxSeq are the smallest and largest sequence numbers of the records in the table
+	MinSeq uint64
+	MaxSeq uint64
+	// Size is the size of the table in bytes. Zero for tables that haven't been written yet
+	Size int64
+}
+
+// FlushInfo describes the flush of a column family's memtable to a level 0 sstable
+type FlushInfo struct {
+	ColumnFamily string
+	// Table is the sstable being written. Only its filename and level are known until the flush completes
+	Table TableInfo
+	// Duration is how long the flush took. Only set once it has completed
+	Duration time.Duration
+	// Err is the error the flush failed with, if any
+	Err error
+}
+
+// CompactionInfo describes the merge of sstables from one level into the next
+type CompactionInfo struct {
+	ColumnFamily string
+	Level        int
+	OutputLevel  int
+	Inputs       []TableInfo
+	// Outputs are the sstables the inputs were merged into. Only set once the compaction has completed
+	Outputs      []TableInfo
+	BytesRead    int64
+	BytesWritten int64
+	// Duration is how long the compaction took. Only set once it has completed
+	Duration time.Duration
+	// Err is the error the compaction failed with, if any
+	Err error
+}
+
+// WALRotationInfo describes the switch from one WAL to another
+type WALRotationInfo struct {
+	// Previous is the path of the WAL holding the writes that are about to be flushed
+	Previous string
+	// Current is the path of the WAL new writes go to
+	Current string
+}
+
+// backgroundError records and reports an error from work done in the background. op names the work, e.g. flush
+func (d *DB) backgroundError(op string, err error) {
+	d.stats.recordBackgroundError()
+	log.Errorf("error performing %s: %v", op, err)
+	for _, listener := range d.opts.EventListeners {
+		listener.OnBackgroundError(err)
+	}
+}
+
+func (d *DB) tableInfo(family string, meta *sstable.Metadata) TableInfo {
+	info := TableInfo{
+		ColumnFamily: family,
+		Filename:     meta.Filename,
+		Level:        int(meta.Level),
+		StartKey:     meta.StartKey,
+		EndKey:       meta.EndKey,
+		MinSeq:       meta.MinSeq,
+		MaxSeq:       meta.MaxSeq,
+	}
+
+	if stat, err := os.Stat(path.Join(d.dataDir, d.name, meta.Filename)); err == nil {
+		info.Size = stat.Size()
+	}
+
+	return info
+}
+
+func (d *DB) tableInfos(family string, metas []*sstable.Metadata) []TableInfo {
+	infos := make([]TableInfo, len(metas))
+	for i, meta := range metas {
+		infos[i] = d.tableInfo(family, meta)
+	}
+
+	return infos
+}
+
+// removeTables deletes sstables that compaction has replaced. The lock is held so that no reader still
+// has them listed without having opened them
+func (d *DB) removeTables(family string, metas []*sstable.Metadata) error {
+	infos := d.tableInfos(family, metas)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, info := range infos {
+		if err := os.Remove(path.Join(d.dataDir, d.name, info.Filename)); err != nil {
+			return fmt.Errorf("failed removing compacted sstable %s: %w", info.Filename, err)
+		}
+
+		for _, listener := range d.opts.EventListeners {
+			listener.OnTableDeleted(info)
+		}
+	}
+
+	return nil
+}
+
+// compactionListener turns a column family's compactions into events
+type compactionListener struct {
+	family *ColumnFamily
+
+	mutex sync.Mutex
+	// inputs holds the inputs of each compaction underway, keyed by the filename of the first. They're described
+	// as the compaction begins since they've been removed by the time it completes
+	inputs map[string][]TableInfo
+}
+
+func (l *compactionListener) CompactionBegin(info compaction.Info) {
+	d := l.family.db
+	if len(d.opts.EventListeners) == 0 {
+		return
+	}
+
+	event := l.event(info, d.tableInfos(l.family.name, info.Inputs), nil)
+	if len(info.Inputs) > 0 {
+		l.mutex.Lock()
+		l.inputs[info.Inputs[0].Filename] = event.Inputs
+		l.mutex.Unlock()
+	}
+
+	for _, listener := range d.opts.EventListeners {
+		listener.OnCompactionBegin(event)
+	}
+}
+
+func (l *compactionListener) CompactionCompleted(info compaction.Info, err error) {
+	d := l.family.db
+	if err == nil {
+		d.stats.compactions.observe(info.Duration)
+	}
+
+	if len(d.opts.EventListeners) == 0 {
+		return
+	}
+
+	var inputs []TableInfo
+	if len(info.Inputs) > 0 {
+		l.mutex.Lock()
+		inputs = l.inputs[info.Inputs[0].Filename]
+		delete(l.inputs, info.Inputs[0].Filename)
+		l.mutex.Unlock()
+	}
+
+	event := l.event(info, inputs, err)
+	event.Duration = info.Duration
+
+	for _, listener := range d.opts.EventListeners {
+		for _, table := range event.Outputs {
+			listener.OnTableCreated(table)
+		}
+		listener.OnCompactionCompleted(event)
+	}
+}
+
+func (l *compactionListener) event(info compaction.Info, inputs []TableInfo, err error) CompactionInfo {
+	d := l.family.db
+	return CompactionInfo{
+		ColumnFamily: l.family.name,
+		Level:        info.Level,
+		OutputLevel:  info.OutputLevel,
+		Inputs:       inputs,
+		Outputs:      d.tableInfos(l.family.name, info.Outputs),
+		BytesRead:    info.BytesRead,
+		BytesWritten: info.BytesWritten,
+		Err:          err,
+	}
+}
@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingListener struct {
+	NoOpEventListener
+
+	mutex       sync.Mutex
+	events      []string
+	flushes     []FlushInfo
+	compactions []CompactionInfo
+	created     []TableInfo
+	deleted     []TableInfo
+	rotations   []WALRotationInfo
+	errs        []error
+}
+
+func (r *recordingListener) record(event string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recordingListener) OnFlushBegin(FlushInfo) {
+	r.record("flush begin")
+}
+
+func (r *recordingListener) OnFlushCompleted(info FlushInfo) {
+	r.record("flush completed")
+	r.flushes = append(r.flushes, info)
+}
+
+func (r *recordingListener) OnCompactionBegin(CompactionInfo) {
+	r.record("compaction begin")
+}
+
+func (r *recordingListener) OnCompactionCompleted(info CompactionInfo) {
+	r.record("compaction completed")
+	r.compactions = append(r.compactions, info)
+}
+
+func (r *recordingListener) OnTableCreated(info TableInfo) {
+	r.record("table created")
+	r.created = append(r.created, info)
+}
+
+func (r *recordingListener) OnTableDeleted(info TableInfo) {
+	r.record("table deleted")
+	r.deleted = append(r.deleted, info)
+}
+
+func (r *recordingListener) OnWALRotated(info WALRotationInfo) {
+	r.record("wal rotated")
+	r.rotations = append(r.rotations, info)
+}
+
+func (r *recordingListener) OnBackgroundError(err error) {
+	r.record("background error")
+	r.errs = append(r.errs, err)
+}
+
+func TestDB_EventListener(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	listener := &recordingListener{}
+	db, err := New(dbName, DBOpts{DataDir: dir, EventListeners: []EventListener{listener}})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	// Four flushes is enough to trigger compacting level 0 into level 1
+	for _, key := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, db.Put([]byte(key), []byte("value")))
+		flush(t, db)
+	}
+
+	flushEvents := []string{"flush begin", "table created", "flush completed"}
+	var expected []string
+	for i := 0; i < 4; i++ {
+		expected = append(expected, flushEvents...)
+	}
+	expected = append(expected, "compaction begin", "table deleted", "table deleted", "table deleted",
+		"table deleted", "table created", "compaction completed")
+	assert.Equal(t, expected, listener.events)
+
+	assert.Len(t, listener.flushes, 4)
+	flushed := listener.flushes[0]
+	assert.NoError(t, flushed.Err)
+	assert.Equal(t, DefaultColumnFamily, flushed.ColumnFamily)
+	assert.Equal(t, []byte("a"), flushed.Table.StartKey)
+	assert.Equal(t, 0, flushed.Table.Level)
+	assert.True(t, flushed.Table.Size > 0)
+	assert.Equal(t, flushed.Table, listener.created[0])
+
+	assert.Len(t, listener.compactions, 1)
+	compacted := listener.compactions[0]
+	assert.NoError(t, compacted.Err)
+	assert.Equal(t, 0, compacted.Level)
+	assert.Equal(t, 1, compacted.OutputLevel)
+	assert.Len(t, compacted.Inputs, 4)
+	assert.True(t, compacted.Inputs[0].Size > 0)
+	assert.Len(t, compacted.Outputs, 1)
+	assert.Equal(t, []byte("a"), compacted.Outputs[0].StartKey)
+	assert.Equal(t, []byte("d"), compacted.Outputs[0].EndKey)
+	assert.Equal(t, compacted.Outputs[0].Size, compacted.BytesWritten)
+	assert.Equal(t, compacted.Inputs, listener.deleted)
+
+	// Compacted sstables are removed once they've been replaced
+	matches, err := filepath.Glob(path.Join(dir, dbName, "sstable_*"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join(dir, dbName, compacted.Outputs[0].Filename)}, matches)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		value, err := db.Get([]byte(key))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), value)
+	}
+
+	assert.Empty(t, listener.errs)
+	db.backgroundError("compaction", errors.New("boom"))
+	assert.EqualError(t, listener.errs[0], "boom")
+
+	// Filling the memtable switches to a new WAL before flushing in the background
+	previous := db.walog.Name()
+	db.opts.MemTableSizeLimit = 1
+	assert.NoError(t, db.Put([]byte("e"), []byte("value")))
+	assert.NoError(t, db.Close())
+
+	assert.Len(t, listener.rotations, 1)
+	assert.Equal(t, previous, listener.rotations[0].Previous)
+	assert.NotEqual(t, previous, listener.rotations[0].Current)
+	assert.Len(t, listener.flushes, 5)
+}
@@ -0,0 +1,428 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/iterator"
+	"github.com/nbroyles/nbdb/internal/sstable"
+	"github.com/nbroyles/nbdb/internal/storage"
+)
+
+// ReadOpts configures how data is read from the database
+type ReadOpts struct {
+	// LowerBound, if set, is the inclusive lower bound of keys returned by an iterator
+	LowerBound []byte
+	// UpperBound, if set, is the exclusive upper bound of keys returned by an iterator
+	UpperBound []byte
+	// Snapshot, if set, reads the database as it was when the snapshot was taken. Otherwise, reads
+	// see every write completed before the read (or, for iterators, before the iterator was created)
+	Snapshot *Snapshot
+}
+
+type direction int8
+
+const (
+	forward direction = iota
+	reverse
+)
+
+// Iterator iterates over the live keys in the database in either ascending or descending key order.
+// Data in the active memtable, the memtable being compacted and every live sstable is merged
+// together such that only the most recent version of each key is returned and deleted keys are
+// hidden. An Iterator must be positioned with one of its Seek methods before use and closed once
+// done with. Iterators are not threadsafe
+type Iterator struct {
+	db   *DB
+	iter iterator.Iterator
+	opts ReadOpts
+	// ctx, once done, stops the iterator from waiting on the database's lock or scanning any further
+	ctx context.Context
+	// seq is the sequence number of the most recent write visible to the iterator
+	seq uint64
+	// rangeDeletes holds the range deletes from every source being iterated over
+	rangeDeletes []*storage.Record
+	// now is the time the iterator was created. Keys that expire after it remain visible
+	now int64
+
+	// When moving forward, iter is positioned at the most recent version of the current key.
+	// When moving in reverse, iter is positioned just before the oldest version of the current key
+	direction direction
+
+	key   []byte
+	value []byte
+	valid bool
+	err   error
+}
+
+// NewIterator returns an iterator over the default column family. Keys and values returned by the
+// iterator must not be modified
+func (d *DB) NewIterator(opts ReadOpts) (*Iterator, error) {
+	return d.defaultFamily.NewIterator(opts)
+}
+
+// NewIteratorContext is like NewIterator, but the iterator stops with ctx's error, reported by
+// Iterator#Error, once ctx is done
+func (d *DB) NewIteratorContext(ctx context.Context, opts ReadOpts) (*Iterator, error) {
+	return d.defaultFamily.NewIteratorContext(ctx, opts)
+}
+
+// NewIterator returns an iterator over the column family. Keys and values returned by the
+// iterator must not be modified
+func (c *ColumnFamily) NewIterator(opts ReadOpts) (*Iterator, error) {
+	return c.NewIteratorContext(context.Background(), opts)
+}
+
+// NewIteratorContext is like NewIterator, but the iterator stops with ctx's error, reported by
+// Iterator#Error, once ctx is done
+func (c *ColumnFamily) NewIteratorContext(ctx context.Context, opts ReadOpts) (*Iterator, error) {
+	d := c.db
+	if err := d.rlockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer d.mutex.RUnlock()
+
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	// Order matters here. Newer data must come before older data so that it takes precedence
+	iters := []iterator.Iterator{c.memTable.NewIterator()}
+	rangeDeletes := append([]*storage.Record{}, c.memTable.RangeDeletes()...)
+	for _, memTable := range c.immutableMemTables() {
+		iters = append(iters, memTable.NewIterator())
+		rangeDeletes = append(rangeDeletes, memTable.RangeDeletes()...)
+	}
+
+	for level := 0; level < d.manifest.Levels(c.id); level++ {
+		metas := d.manifest.MetadataForLevel(c.id, level)
+		for i := range metas {
+			// sstables are ordered from oldest to newest. Only level 0 ones overlap under leveled compaction,
+			// but under tiered compaction every level's can
+			meta := metas[len(metas)-1-i]
+
+			iter, err := d.sstableIterator(meta)
+			if err != nil {
+				iterator.NewMergingIterator(iters).Close()
+				return nil, fmt.Errorf("failed creating iterator: %w", err)
+			}
+			iters = append(iters, iter)
+			rangeDeletes = append(rangeDeletes, iter.RangeDeletes()...)
+		}
+	}
+
+	seq := d.seq
+	if opts.Snapshot != nil {
+		seq = opts.Snapshot.seq
+	}
+
+	return &Iterator{
+		db:           d,
+		iter:         iterator.NewMergingIterator(iters),
+		opts:         opts,
+		ctx:          ctx,
+		seq:          seq,
+		rangeDeletes: rangeDeletes,
+		now:          time.Now().UnixNano(),
+	}, nil
+}
+
+func (d *DB) sstableIterator(meta *sstable.Metadata) (*sstable.Iterator, error) {
+	sstHandle, err := os.Open(path.Join(d.dataDir, d.name, meta.Filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed attempting to open sstable for reading: %w", err)
+	}
+
+	iter, err := sstable.NewIterator(sstHandle)
+	if err != nil {
+		sstHandle.Close()
+		return nil, fmt.Errorf("failed attempting to read sstable %s: %w", meta.Filename, err)
+	}
+
+	return iter, nil
+}
+
+// Valid returns true if the iterator is positioned at a key
+func (i *Iterator) Valid() bool {
+	return i.valid && i.Error() == nil
+}
+
+// Key returns the key the iterator is positioned at. Iterator must be valid
+func (i *Iterator) Key() []byte {
+	return i.key
+}
+
+// Value returns the value of the key the iterator is positioned at. Iterator must be valid
+func (i *Iterator) Value() []byte {
+	return i.value
+}
+
+// SeekToFirst positions the iterator at the first key, respecting the lower bound if set
+func (i *Iterator) SeekToFirst() {
+	if i.opts.LowerBound != nil {
+		i.Seek(i.opts.LowerBound)
+		return
+	}
+
+	if !i.lock() {
+		return
+	}
+	defer i.db.mutex.RUnlock()
+
+	i.iter.SeekToFirst()
+	i.findNextEntry(nil, false)
+}
+
+// SeekToLast positions the iterator at the last key, respecting the upper bound if set
+func (i *Iterator) SeekToLast() {
+	if !i.lock() {
+		return
+	}
+	defer i.db.mutex.RUnlock()
+
+	i.seekBefore(i.opts.UpperBound)
+	i.findPrevEntry()
+}
+
+// Seek positions the iterator at the first key greater than or equal to key
+func (i *Iterator) Seek(key []byte) {
+	if i.opts.LowerBound != nil && bytes.Compare(key, i.opts.LowerBound) < 0 {
+		key = i.opts.LowerBound
+	}
+
+	if !i.lock() {
+		return
+	}
+	defer i.db.mutex.RUnlock()
+
+	i.iter.Seek(key)
+	i.findNextEntry(nil, false)
+}
+
+// SeekForPrev positions the iterator at the last key less than or equal to key
+func (i *Iterator) SeekForPrev(key []byte) {
+	if i.opts.UpperBound != nil && bytes.Compare(key, i.opts.UpperBound) >= 0 {
+		i.SeekToLast()
+		return
+	}
+
+	if !i.lock() {
+		return
+	}
+	defer i.db.mutex.RUnlock()
+
+	// Position after every version of key so that reverse iteration visits them
+	i.iter.Seek(key)
+	for i.iter.Valid() && bytes.Equal(i.iter.Record().Key, key) {
+		i.iter.Next()
+	}
+
+	if i.iter.Valid() {
+		i.iter.Prev()
+	} else {
+		i.iter.SeekToLast()
+	}
+	i.findPrevEntry()
+}
+
+// Next advances the iterator to the next key. Iterator must be valid
+func (i *Iterator) Next() {
+	if !i.lock() {
+		return
+	}
+	defer i.db.mutex.RUnlock()
+
+	if i.direction == reverse {
+		// Reposition at the most recent version of the current key so it can be skipped
+		i.iter.Seek(i.key)
+	}
+
+	i.findNextEntry(i.key, true)
+}
+
+// Prev moves the iterator back to the previous key. Iterator must be valid
+func (i *Iterator) Prev() {
+	if !i.lock() {
+		return
+	}
+	defer i.db.mutex.RUnlock()
+
+	if i.direction == forward {
+		// Move before every version of the current key
+		for i.iter.Valid() && bytes.Compare(i.iter.Record().Key, i.key) >= 0 {
+			i.iter.Prev()
+		}
+	}
+
+	i.findPrevEntry()
+}
+
+// Error returns any error encountered during iteration
+func (i *Iterator) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.iter.Error()
+}
+
+// Close releases the resources held by the iterator
+func (i *Iterator) Close() error {
+	i.valid = false
+	return i.iter.Close()
+}
+
+// lock acquires the database's read lock, leaving the iterator invalid if its context is done first
+func (i *Iterator) lock() bool {
+	if i.err = i.db.rlockContext(i.ctx); i.err != nil {
+		i.valid = false
+		return false
+	}
+	return true
+}
+
+// findNextEntry advances the underlying iterator until it's positioned at the most recent visible
+// version of a key that has not been deleted. If skip is true, any versions of skipKey are passed over
+func (i *Iterator) findNextEntry(skipKey []byte, skip bool) {
+	i.direction = forward
+	i.valid = false
+	for ; i.iter.Valid(); i.iter.Next() {
+		if i.err = i.ctx.Err(); i.err != nil {
+			return
+		}
+
+		record := i.iter.Record()
+		if i.opts.UpperBound != nil && bytes.Compare(record.Key, i.opts.UpperBound) >= 0 {
+			return
+		}
+
+		if record.Seq > i.seq || (skip && bytes.Equal(record.Key, skipKey)) {
+			continue
+		}
+
+		// The first version of a key seen is the most recent, so a delete hides everything after it
+		if i.deleted(record) {
+			skipKey = record.Key
+			skip = true
+			continue
+		}
+
+		value := record.Value
+		if record.Type == storage.RecordMerge {
+			if value, i.err = i.mergeOperands(record); i.err != nil {
+				return
+			}
+		}
+
+		i.key = record.Key
+		i.value = value
+		i.valid = true
+		return
+	}
+}
+
+// mergeOperands combines the merge operand first, which the underlying iterator is positioned at, with the
+// older versions of its key until the value they apply to is found. The underlying iterator is left
+// positioned at the most recent version of the key
+func (i *Iterator) mergeOperands(first *storage.Record) ([]byte, error) {
+	operands := [][]byte{first.Value}
+	var existing []byte
+	for i.iter.Next(); i.iter.Valid() && bytes.Equal(i.iter.Record().Key, first.Key); i.iter.Next() {
+		record := i.iter.Record()
+		if i.deleted(record) {
+			break
+		} else if record.Type != storage.RecordMerge {
+			existing = record.Value
+			break
+		}
+		operands = append(operands, record.Value)
+	}
+	if err := i.iter.Error(); err != nil {
+		return nil, err
+	}
+
+	i.iter.Seek(first.Key)
+
+	return storage.FullMerge(i.db.opts.MergeOperator, first.Key, existing, operands)
+}
+
+// findPrevEntry moves the underlying iterator backward until it has passed every version of a key
+// whose most recent version has not been deleted. Since versions of a key are visited from oldest
+// to newest, the last one seen before moving on to a smaller key is the one returned
+func (i *Iterator) findPrevEntry() {
+	i.direction = reverse
+	i.valid = false
+
+	var key []byte
+	var value []byte
+	// operands holds any merge operands applied on top of value, newest first
+	var operands [][]byte
+	deleted := true
+	for ; i.iter.Valid(); i.iter.Prev() {
+		if i.err = i.ctx.Err(); i.err != nil {
+			return
+		}
+
+		record := i.iter.Record()
+		if i.opts.LowerBound != nil && bytes.Compare(record.Key, i.opts.LowerBound) < 0 {
+			break
+		}
+
+		if !deleted && bytes.Compare(record.Key, key) < 0 {
+			// Reached a key smaller than a live one we've found, so we're done
+			break
+		}
+
+		if record.Seq > i.seq {
+			continue
+		}
+
+		key = record.Key
+		switch {
+		case i.deleted(record):
+			value, operands, deleted = nil, nil, true
+		case record.Type == storage.RecordMerge:
+			operands = append([][]byte{record.Value}, operands...)
+			deleted = false
+		default:
+			value, operands, deleted = record.Value, nil, false
+		}
+	}
+
+	if !deleted && len(operands) > 0 {
+		if value, i.err = storage.FullMerge(i.db.opts.MergeOperator, key, value, operands); i.err != nil {
+			return
+		}
+	}
+
+	if !deleted {
+		i.key = key
+		i.value = value
+		i.valid = true
+	}
+}
+
+// deleted returns true if record is a delete, has expired or is hidden by a range delete visible to the iterator
+func (i *Iterator) deleted(record *storage.Record) bool {
+	return record.Type == storage.RecordDelete || record.Expired(i.now) ||
+		storage.RangeDeleted(i.rangeDeletes, record.Key, record.Seq, i.seq)
+}
+
+// seekBefore positions the underlying iterator at the last record with a key less than key or
+// at the last record if key is nil
+func (i *Iterator) seekBefore(key []byte) {
+	if key == nil {
+		i.iter.SeekToLast()
+		return
+	}
+
+	i.iter.Seek(key)
+	if i.iter.Valid() {
+		i.iter.Prev()
+	} else {
+		i.iter.SeekToLast()
+	}
+}
@@ -0,0 +1,340 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/nbroyles/nbdb/internal/memtable"
+	"github.com/nbroyles/nbdb/internal/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterator_MergesMemTablesAndSSTables(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	// Oldest data gets flushed to an sstable
+	assert.NoError(t, db.Put([]byte("a"), []byte("old")))
+	assert.NoError(t, db.Put([]byte("b"), []byte("old")))
+	assert.NoError(t, db.Put([]byte("c"), []byte("old")))
+	flush(t, db)
+
+	// Newer data lives in an immutable memtable
+	assert.NoError(t, db.Put([]byte("b"), []byte("newer")))
+	assert.NoError(t, db.Put([]byte("d"), []byte("newer")))
+	freeze(t, db)
+
+	// Newest data lives in the active memtable
+	assert.NoError(t, db.Put([]byte("c"), []byte("newest")))
+	assert.NoError(t, db.Put([]byte("e"), []byte("newest")))
+	assert.NoError(t, db.Put([]byte("f"), []byte("newest")))
+	assert.NoError(t, db.Delete([]byte("f")))
+
+	iter, err := db.NewIterator(ReadOpts{})
+	assert.NoError(t, err)
+
+	iter.SeekToFirst()
+	assertIteration(t, iter, map[string]string{
+		"a": "old",
+		"b": "newer",
+		"c": "newest",
+		"d": "newer",
+		"e": "newest",
+	}, "a", "b", "c", "d", "e")
+	assert.NoError(t, iter.Close())
+	assert.NoError(t, db.Close())
+}
+
+func TestIterator_Seek(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	for _, key := range []string{"apple", "banana", "cherry", "date"} {
+		assert.NoError(t, db.Put([]byte(key), []byte(key)))
+	}
+	assert.NoError(t, db.Delete([]byte("cherry")))
+
+	iter, err := db.NewIterator(ReadOpts{})
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	iter.Seek([]byte("b"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("banana"), iter.Key())
+
+	// Deleted keys are skipped
+	iter.Seek([]byte("c"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("date"), iter.Key())
+
+	iter.Seek([]byte("e"))
+	assert.False(t, iter.Valid())
+
+	iter.SeekToLast()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("date"), iter.Key())
+	assert.NoError(t, iter.Error())
+}
+
+func TestIterator_Bounds(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(t, db.Put([]byte(key), []byte(key)))
+	}
+	flush(t, db)
+
+	iter, err := db.NewIterator(ReadOpts{LowerBound: []byte("b"), UpperBound: []byte("d")})
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	iter.SeekToFirst()
+	assertIteration(t, iter, map[string]string{"b": "b", "c": "c"}, "b", "c")
+
+	iter.Seek([]byte("a"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("b"), iter.Key())
+
+	iter.Seek([]byte("d"))
+	assert.False(t, iter.Valid())
+
+	iter.SeekToLast()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("c"), iter.Key())
+}
+
+func TestIterator_Reverse(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("a"), []byte("old")))
+	assert.NoError(t, db.Put([]byte("b"), []byte("old")))
+	assert.NoError(t, db.Put([]byte("d"), []byte("old")))
+	flush(t, db)
+
+	assert.NoError(t, db.Put([]byte("b"), []byte("new")))
+	assert.NoError(t, db.Put([]byte("c"), []byte("new")))
+	assert.NoError(t, db.Put([]byte("e"), []byte("new")))
+	assert.NoError(t, db.Delete([]byte("e")))
+
+	iter, err := db.NewIterator(ReadOpts{})
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	iter.SeekToLast()
+	for _, kv := range [][]string{{"d", "old"}, {"c", "new"}, {"b", "new"}, {"a", "old"}} {
+		assert.True(t, iter.Valid())
+		assert.Equal(t, []byte(kv[0]), iter.Key())
+		assert.Equal(t, []byte(kv[1]), iter.Value())
+		iter.Prev()
+	}
+	assert.False(t, iter.Valid())
+	assert.NoError(t, iter.Error())
+}
+
+func TestIterator_ChangeDirection(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, db.Put([]byte(key), []byte("old")))
+	}
+	flush(t, db)
+	for _, key := range []string{"b", "c"} {
+		assert.NoError(t, db.Put([]byte(key), []byte("new")))
+	}
+
+	iter, err := db.NewIterator(ReadOpts{})
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	iter.Seek([]byte("b"))
+	assert.Equal(t, []byte("b"), iter.Key())
+	assert.Equal(t, []byte("new"), iter.Value())
+
+	iter.Next()
+	assert.Equal(t, []byte("c"), iter.Key())
+
+	iter.Prev()
+	assert.Equal(t, []byte("b"), iter.Key())
+	assert.Equal(t, []byte("new"), iter.Value())
+
+	iter.Prev()
+	assert.Equal(t, []byte("a"), iter.Key())
+
+	iter.Next()
+	assert.Equal(t, []byte("b"), iter.Key())
+
+	iter.Next()
+	assert.Equal(t, []byte("c"), iter.Key())
+	assert.Equal(t, []byte("new"), iter.Value())
+
+	iter.Next()
+	assert.Equal(t, []byte("d"), iter.Key())
+
+	iter.Next()
+	assert.False(t, iter.Valid())
+}
+
+func TestIterator_SeekForPrev(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	for _, key := range []string{"apple", "banana", "cherry", "date"} {
+		assert.NoError(t, db.Put([]byte(key), []byte(key)))
+	}
+	flush(t, db)
+	assert.NoError(t, db.Put([]byte("cherry"), []byte("new")))
+	assert.NoError(t, db.Delete([]byte("cherry")))
+
+	iter, err := db.NewIterator(ReadOpts{LowerBound: []byte("b")})
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	iter.SeekForPrev([]byte("banana"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("banana"), iter.Key())
+
+	// cherry was deleted after being flushed
+	iter.SeekForPrev([]byte("d"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("banana"), iter.Key())
+
+	iter.Next()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("date"), iter.Key())
+
+	iter.SeekForPrev([]byte("zzz"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("date"), iter.Key())
+
+	// apple is below the lower bound
+	iter.SeekForPrev([]byte("b"))
+	assert.False(t, iter.Valid())
+}
+
+func TestIterator_Empty(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	iter, err := db.NewIterator(ReadOpts{})
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	iter.SeekToFirst()
+	assert.False(t, iter.Valid())
+
+	iter.SeekToLast()
+	assert.False(t, iter.Valid())
+}
+
+func TestIterator_Context(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("apple"), []byte("red")))
+	assert.NoError(t, db.Put([]byte("banana"), []byte("yellow")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	iter, err := db.NewIteratorContext(ctx, ReadOpts{})
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	iter.SeekToFirst()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("apple"), iter.Key())
+
+	// Iteration stops once the context is cancelled
+	cancel()
+	iter.Next()
+	assert.False(t, iter.Valid())
+	assert.Equal(t, context.Canceled, iter.Error())
+
+	_, err = db.NewIteratorContext(ctx, ReadOpts{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func assertIteration(t *testing.T, iter *Iterator, expected map[string]string, order ...string) {
+	for _, key := range order {
+		assert.True(t, iter.Valid())
+		if !iter.Valid() {
+			return
+		}
+		assert.Equal(t, []byte(key), iter.Key())
+		assert.Equal(t, []byte(expected[key]), iter.Value())
+		iter.Next()
+	}
+	assert.False(t, iter.Valid())
+	assert.NoError(t, iter.Error())
+}
+
+// freeze swaps out the active memtables to wait for a flush, along with the WAL they were written to
+func freeze(t *testing.T, db *DB) {
+	waf, err := wal.CreateFile(db.name, db.dataDir)
+	assert.NoError(t, err)
+
+	db.mutex.Lock()
+	db.freezeMemTables(wal.New(waf))
+	db.mutex.Unlock()
+}
+
+func flush(t *testing.T, db *DB) {
+	waf, err := wal.CreateFile(db.name, db.dataDir)
+	assert.NoError(t, err)
+
+	db.mutex.Lock()
+	frozen := newImmutableMemTables(db.walog)
+	for id, family := range db.families {
+		if family == db.defaultFamily || family.memTable.Size() > 0 {
+			frozen.memTables[id] = family.memTable
+			family.memTable = memtable.New()
+		}
+	}
+	db.immutable = append(db.immutable, frozen)
+	db.walog = wal.New(waf)
+	db.mutex.Unlock()
+
+	assert.NoError(t, db.doCompaction())
+}
@@ -0,0 +1,10 @@
+package pkg
+
+import "github.com/nbroyles/nbdb/internal/storage"
+
+// MergeOperator combines the operands written to a key with DB#Merge into a single value. It allows
+// read-modify-write updates, such as incrementing a counter or appending to a list, without reading
+// the current value first. Merge is called with the operands ordered from oldest to newest and the
+// value they apply to, which is nil if the key has no value. Merge may be called when reading a key
+// or while compacting, so it must be deterministic and must not modify its arguments
+type MergeOperator = storage.MergeOperator
@@ -0,0 +1,358 @@
+// Package metrics exports the stats of nbdb databases as metrics in the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nbroyles/nbdb/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+// ContentType is the content type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Exporter gathers the stats of every database registered with it. Metrics are labelled with the name each
+// database was registered under. Exporter is an http.Handler that serves the metrics for Prometheus to scrape
+type Exporter struct {
+	mutex sync.RWMutex
+	dbs   map[string]*pkg.DB
+}
+
+// NewExporter returns an Exporter with no databases registered
+func NewExporter() *Exporter {
+	return &Exporter{dbs: make(map[string]*pkg.DB)}
+}
+
+// Register adds db to the databases whose metrics are exported, labelled with name. Registering another
+// database under the same name replaces it
+func (e *Exporter) Register(name string, db *pkg.DB) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.dbs[name] = db
+}
+
+// Unregister stops exporting metrics for the database registered under name
+func (e *Exporter) Unregister(name string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	delete(e.dbs, name)
+}
+
+// ServeHTTP writes the metrics of every registered database in the Prometheus text exposition format
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	if err := e.Write(w); err != nil {
+		log.Errorf("failed writing metrics: %v", err)
+	}
+}
+
+// Publish makes the stats of every registered database available through expvar under name, keyed by the
+// name each database was registered under
+func (e *Exporter) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		stats, _ := e.stats()
+		return stats
+	}))
+}
+
+// Write writes the metrics of every registered database to w in the Prometheus text exposition format.
+// Databases that have been closed are skipped
+func (e *Exporter) Write(w io.Writer) error {
+	stats, names := e.stats()
+
+	buf := bufio.NewWriter(w)
+	for _, family := range families {
+		fmt.Fprintf(buf, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", family.name, family.kind)
+		for _, name := range names {
+			family.write(buf, family.name, labels{{"db", name}}, stats[name])
+		}
+	}
+
+	return buf.Flush()
+}
+
+// stats returns the stats of every open registered database keyed by name, along with the names in order
+func (e *Exporter) stats() (map[string]*pkg.Stats, []string) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	stats := make(map[string]*pkg.Stats, len(e.dbs))
+	names := make([]string, 0, len(e.dbs))
+	for name, db := range e.dbs {
+		dbStats, err := db.Stats()
+		if err != nil {
+			continue
+		}
+
+		stats[name] = dbStats
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return stats, names
+}
+
+// metricFamily is a set of metrics that share a name and are written from a database's stats
+type metricFamily struct {
+	name  string
+	help  string
+	kind  string
+	write func(w io.Writer, name string, labels labels, stats *pkg.Stats)
+}
+
+var families = []metricFamily{
+	{
+		name: "nbdb_operations_total",
+		help: "Number of operations performed.",
+		kind: "counter",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			for _, op := range operations(stats) {
+				writeSample(w, name, l.with("op", op), float64(stats.Operations[op].Count))
+			}
+		},
+	},
+	{
+		name: "nbdb_operation_duration_seconds",
+		help: "Latency of operations.",
+		kind: "histogram",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			for _, op := range operations(stats) {
+				writeHistogram(w, name, l.with("op", op), stats.Operations[op])
+			}
+		},
+	},
+	{
+		name: "nbdb_memtable_size_bytes",
+		help: "Size of the active memtable.",
+		kind: "gauge",
+		write: forEachColumnFamily(func(w io.Writer, name string, l labels, family pkg.ColumnFamilyStats) {
+			writeSample(w, name, l, float64(family.MemTableSize))
+		}),
+	},
+	{
+		name: "nbdb_immutable_memtable_size_bytes",
+		help: "Total size of the memtables waiting to be flushed.",
+		kind: "gauge",
+		write: forEachColumnFamily(func(w io.Writer, name string, l labels, family pkg.ColumnFamilyStats) {
+			writeSample(w, name, l, float64(family.ImmutableMemTableSize))
+		}),
+	},
+	{
+		name: "nbdb_immutable_memtables",
+		help: "Number of memtables waiting to be flushed.",
+		kind: "gauge",
+		write: forEachColumnFamily(func(w io.Writer, name string, l labels, family pkg.ColumnFamilyStats) {
+			writeSample(w, name, l, float64(family.ImmutableMemTables))
+		}),
+	},
+	{
+		name: "nbdb_level_files",
+		help: "Number of sstables in each level.",
+		kind: "gauge",
+		write: forEachColumnFamily(func(w io.Writer, name string, l labels, family pkg.ColumnFamilyStats) {
+			for level, lvl := range family.Levels {
+				writeSample(w, name, l.with("level", strconv.Itoa(level)), float64(lvl.Files))
+			}
+		}),
+	},
+	{
+		name: "nbdb_level_size_bytes",
+		help: "Total size of the sstables in each level.",
+		kind: "gauge",
+		write: forEachColumnFamily(func(w io.Writer, name string, l labels, family pkg.ColumnFamilyStats) {
+			for level, lvl := range family.Levels {
+				writeSample(w, name, l.with("level", strconv.Itoa(level)), float64(lvl.Bytes))
+			}
+		}),
+	},
+	{
+		name: "nbdb_pending_compaction_bytes",
+		help: "Estimated number of bytes that need compacting.",
+		kind: "gauge",
+		write: forEachColumnFamily(func(w io.Writer, name string, l labels, family pkg.ColumnFamilyStats) {
+			writeSample(w, name, l, float64(family.PendingCompactionBytes))
+		}),
+	},
+	{
+		name: "nbdb_wal_size_bytes",
+		help: "Size of the WALs holding writes that haven't been flushed.",
+		kind: "gauge",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, float64(stats.WALSize))
+		},
+	},
+	{
+		name: "nbdb_wal_sync_duration_seconds",
+		help: "Latency of syncing the WAL to disk.",
+		kind: "histogram",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeHistogram(w, name, l, stats.WALSyncLatency)
+		},
+	},
+	{
+		name: "nbdb_flushes_total",
+		help: "Number of memtables flushed to level 0.",
+		kind: "counter",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, float64(stats.Flushes))
+		},
+	},
+	{
+		name: "nbdb_flush_written_bytes_total",
+		help: "Total size of the sstables written by flushes.",
+		kind: "counter",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, float64(stats.FlushBytesWritten))
+		},
+	},
+	{
+		name: "nbdb_compactions_total",
+		help: "Number of merges performed by compaction.",
+		kind: "counter",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, float64(stats.Compactions))
+		},
+	},
+	{
+		name: "nbdb_compaction_read_bytes_total",
+		help: "Total size of the sstables merged by compaction.",
+		kind: "counter",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, float64(stats.CompactionBytesRead))
+		},
+	},
+	{
+		name: "nbdb_compaction_written_bytes_total",
+		help: "Total size of the sstables written by compaction.",
+		kind: "counter",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, float64(stats.CompactionBytesWritten))
+		},
+	},
+	{
+		name: "nbdb_compaction_duration_seconds",
+		help: "Duration of compactions that merged sstables.",
+		kind: "histogram",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeHistogram(w, name, l, stats.CompactionLatency)
+		},
+	},
+	{
+		name: "nbdb_write_amplification",
+		help: "Bytes written to sstables for each byte flushed from memtables.",
+		kind: "gauge",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, stats.WriteAmplification)
+		},
+	},
+	{
+		name: "nbdb_background_errors_total",
+		help: "Number of errors encountered flushing and compacting in the background.",
+		kind: "counter",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, float64(stats.BackgroundErrors))
+		},
+	},
+	{
+		name: "nbdb_write_stall",
+		help: "Whether writes are being held back: 0 if not, 1 if delayed and 2 if stopped.",
+		kind: "gauge",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, float64(stats.WriteStall.Condition))
+		},
+	},
+	{
+		name: "nbdb_delayed_writes_total",
+		help: "Number of writes slowed down to let flushes and compactions catch up.",
+		kind: "counter",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, float64(stats.DelayedWrites))
+		},
+	},
+	{
+		name: "nbdb_stopped_writes_total",
+		help: "Number of writes that waited for flushes or compactions to catch up.",
+		kind: "counter",
+		write: func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+			writeSample(w, name, l, float64(stats.StoppedWrites))
+		},
+	},
+}
+
+func forEachColumnFamily(write func(w io.Writer, name string, l labels, family pkg.ColumnFamilyStats)) func(
+	io.Writer, string, labels, *pkg.Stats) {
+	return func(w io.Writer, name string, l labels, stats *pkg.Stats) {
+		for _, family := range stats.ColumnFamilies {
+			write(w, name, l.with("column_family", family.Name), family)
+		}
+	}
+}
+
+func operations(stats *pkg.Stats) []string {
+	ops := make([]string, 0, len(stats.Operations))
+	for op := range stats.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// writeHistogram writes hist as cumulative buckets, a sum and a count, with latencies in seconds
+func writeHistogram(w io.Writer, name string, l labels, hist pkg.Histogram) {
+	cumulative := uint64(0)
+	for i, count := range hist.Buckets {
+		cumulative += count
+
+		bound := "+Inf"
+		if i < len(pkg.LatencyBuckets) {
+			bound = formatFloat(pkg.LatencyBuckets[i].Seconds())
+		}
+		writeSample(w, name+"_bucket", l.with("le", bound), float64(cumulative))
+	}
+
+	writeSample(w, name+"_sum", l, hist.Sum.Seconds())
+	writeSample(w, name+"_count", l, float64(hist.Count))
+}
+
+func writeSample(w io.Writer, name string, l labels, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, l, formatFloat(value))
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type labels [][2]string
+
+// with returns a copy of the labels with name=value added
+func (l labels) with(name string, value string) labels {
+	return append(append(labels{}, l...), [2]string{name, value})
+}
+
+func (l labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(l))
+	for i, label := range l {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label[0], escape(label[1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escape escapes label values as the exposition format expects
+func escape(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"").Replace(value)
+}
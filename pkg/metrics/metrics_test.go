@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/nbroyles/nbdb/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExporter(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := pkg.New(dbName, pkg.DBOpts{DataDir: dir})
+	defer os.RemoveAll(path.Join(dir, dbName))
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, db.Put([]byte("baz"), []byte("bax")))
+	_, err = db.Get([]byte("foo"))
+	assert.NoError(t, err)
+
+	exporter := NewExporter()
+	exporter.Register("test", db)
+
+	rec := httptest.NewRecorder()
+	exporter.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"# TYPE nbdb_operations_total counter\n",
+		`nbdb_operations_total{db="test",op="put"} 2` + "\n",
+		`nbdb_operations_total{db="test",op="get"} 1` + "\n",
+		"# TYPE nbdb_operation_duration_seconds histogram\n",
+		`nbdb_operation_duration_seconds_bucket{db="test",op="put",le="+Inf"} 2` + "\n",
+		`nbdb_operation_duration_seconds_count{db="test",op="put"} 2` + "\n",
+		`nbdb_operation_duration_seconds_bucket{db="test",op="delete",le="1e-06"} 0` + "\n",
+		`nbdb_memtable_size_bytes{db="test",column_family="default"} `,
+		`nbdb_wal_sync_duration_seconds_bucket{db="test",le="+Inf"} 2` + "\n",
+		`nbdb_wal_sync_duration_seconds_count{db="test"} 2` + "\n",
+		`nbdb_compactions_total{db="test"} 0` + "\n",
+		`nbdb_background_errors_total{db="test"} 0` + "\n",
+		`nbdb_write_stall{db="test"} 0` + "\n",
+		`nbdb_stopped_writes_total{db="test"} 0` + "\n",
+	} {
+		assert.Contains(t, body, expected)
+	}
+
+	exporter.Publish("nbdb_test")
+	assert.Contains(t, expvar.Get("nbdb_test").String(), `"test":{"ColumnFamilies":[{"Name":"default"`)
+
+	// Closed and unregistered databases are left out
+	exporter.Register("other", db)
+	exporter.Unregister("test")
+	buf := bytes.Buffer{}
+	assert.NoError(t, exporter.Write(&buf))
+	assert.NotContains(t, buf.String(), `db="test"`)
+	assert.Contains(t, buf.String(), `db="other"`)
+
+	assert.NoError(t, db.Close())
+	buf.Reset()
+	assert.NoError(t, exporter.Write(&buf))
+	assert.NotContains(t, buf.String(), `db="other"`)
+	assert.Contains(t, buf.String(), "# TYPE nbdb_operations_total counter\n")
+}
+
+func TestLabels(t *testing.T) {
+	l := labels{{"db", "foo"}}.with("column_family", "a\"b\\c\nd")
+	assert.Equal(t, `{db="foo",column_family="a\"b\\c\nd"}`, l.String())
+	assert.Equal(t, "", labels{}.String())
+}
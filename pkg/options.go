@@ -0,0 +1,439 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/compaction"
+	"github.com/nbroyles/nbdb/internal/sstable"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Makes sense on Mac OS X, may not elsewhere
+	defaultDataDir = "/usr/local/var/nbdb"
+	// Limit memtable to 4 MBs before flushing
+	defaultMemTableSizeLimit = uint32(4194304)
+
+	defaultMaxImmutableMemTables           = 2
+	defaultL0SlowdownWritesTrigger         = 20
+	defaultL0StopWritesTrigger             = 36
+	defaultSoftPendingCompactionBytesLimit = int64(64) << 30
+	defaultHardPendingCompactionBytesLimit = int64(256) << 30
+	defaultDelayedWriteRate                = int64(16) << 20
+	defaultMaxBackgroundFlushes            = 1
+	defaultMaxBackgroundCompactions        = 1
+	defaultMaxSubcompactions               = 1
+
+	optionsFile = "OPTIONS"
+
+	optIndexInterval            = "index_interval"
+	optMaxFileSize              = "max_file_size"
+	optMemTableSizeLimit        = "memtable_size_limit"
+	optL0CompactionTrigger      = "l0_compaction_trigger"
+	optLevelSizeBase            = "level_size_base"
+	optLevelSizeMultiplier      = "level_size_multiplier"
+	optDynamicLevelBytes        = "dynamic_level_bytes"
+	optTombstoneCompactionRatio = "tombstone_compaction_ratio"
+	optCompactionStrategy       = "compaction_strategy"
+	optFIFOMaxTotalSize         = "fifo_max_total_size"
+	optWALRetention             = "wal_retention"
+	optMaxImmutableMemTables    = "max_immutable_memtables"
+	optL0SlowdownWritesTrigger  = "l0_slowdown_writes_trigger"
+	optL0StopWritesTrigger      = "l0_stop_writes_trigger"
+	optMaxSubcompactions        = "max_subcompactions"
+)
+
+// CompactionStrategy decides which sstables are compacted, and when
+type CompactionStrategy int8
+
+const (
+	CompactionLeveled CompactionStrategy = iota // merges each level into the next as it outgrows its size threshold
+	CompactionTiered                            // merges runs of similar size, rewriting data less often than leveled
+	CompactionFIFO                              // never merges, dropping the oldest sstables once they outgrow a cap
+)
+
+func (c CompactionStrategy) String() string {
+	switch c {
+	case CompactionTiered:
+		return "tiered"
+	case CompactionFIFO:
+		return "fifo"
+	default:
+		return "leveled"
+	}
+}
+
+// incompatibleOptions are the options that can't change once a database has been created. The index interval
+// can, since sstables written with different intervals can be read side by side
+var incompatibleOptions = map[string]bool{optCompactionStrategy: true}
+
+// DBOpts configures a database. Zero values use the defaults. The options a database is opened with are
+// recorded in an OPTIONS file in its directory
+type DBOpts struct {
+	// DataDir is the directory databases are stored in. Defaults to /usr/local/var/nbdb
+	DataDir string
+	// MemTableSizeLimit is the size in bytes a memtable can grow to before it's flushed to an sstable.
+	// Defaults to 4 MB
+	MemTableSizeLimit uint32
+	// IndexInterval is the number of records between each entry in an sstable's index. Changing it only
+	// affects sstables written afterwards. Defaults to 1000
+	IndexInterval int
+	// MaxFileSize is the size in bytes after which compaction starts writing a new sstable. Defaults to 2 MB
+	MaxFileSize int
+	// L0CompactionTrigger is the number of level 0 sstables that triggers compacting them into level 1.
+	// Defaults to 4
+	L0CompactionTrigger int
+	// LevelSizeBase determines how large each level can grow before it's compacted into the next one.
+	// Level L can hold LevelSizeBase * LevelSizeMultiplier^L bytes. Only used by CompactionLeveled. Defaults
+	// to 1 MB
+	LevelSizeBase int64
+	// LevelSizeMultiplier is how many times larger each level can grow than the one above it. Only used by
+	// CompactionLeveled. Defaults to 10
+	LevelSizeMultiplier int
+	// DynamicLevelBytes sizes every level but the last off how much data the last level actually holds, rather
+	// than how much it can hold, so that each is a fraction of the one below it. That bounds the space taken
+	// by overwritten versions however large the database is. The last level grows as needed rather than being
+	// compacted into a new one. Only used by CompactionLeveled
+	DynamicLevelBytes bool
+	// TombstoneCompactionRatio is the share of an sstable's records that must be deletes for it to be
+	// compacted into the next level ahead of its turn, so that the space held by deleted keys is given
+	// back sooner. Otherwise each level's sstables are compacted in turn, moving through the key space from
+	// where the last compaction of the level stopped. A ratio above 1 disables it. Only used by
+	// CompactionLeveled. Defaults to 0.5
+	TombstoneCompactionRatio float64
+	// CompactionStrategy decides which sstables are compacted, and when. CompactionLeveled keeps reads and
+	// space overhead low, CompactionTiered suits write-heavy ingest and CompactionFIFO suits data that's
+	// only kept for a while. It can't be changed once the database has been created. Defaults to
+	// CompactionLeveled
+	CompactionStrategy CompactionStrategy
+	// FIFOMaxTotalSize is the total size in bytes of a column family's sstables after which the oldest are
+	// dropped under CompactionFIFO. Defaults to 1 GB
+	FIFOMaxTotalSize int64
+	// WALRetention is how long a WAL is kept once the memtables written to it have been flushed, so that
+	// subscribers can resume from changes older than the ones still in memtables. Defaults to 0, which
+	// removes each WAL as soon as it's flushed
+	WALRetention time.Duration
+
+	// MaxImmutableMemTables is the number of full memtables that can wait to be flushed. Writes are delayed
+	// while that many are waiting and stop once the active memtable fills up as well. Defaults to 2
+	MaxImmutableMemTables int
+	// L0SlowdownWritesTrigger is the number of level 0 sstables in any column family at which writes are
+	// delayed. Defaults to 20
+	L0SlowdownWritesTrigger int
+	// L0StopWritesTrigger is the number of level 0 sstables in any column family at which writes stop until
+	// compaction catches up. Defaults to 36
+	L0StopWritesTrigger int
+	// SoftPendingCompactionBytesLimit is the number of bytes needing compaction in any column family at
+	// which writes are delayed. Defaults to 64 GB
+	SoftPendingCompactionBytesLimit int64
+	// HardPendingCompactionBytesLimit is the number of bytes needing compaction in any column family at
+	// which writes stop until compaction catches up. Defaults to 256 GB
+	HardPendingCompactionBytesLimit int64
+	// DelayedWriteRate is the number of bytes per second that writes are slowed to while delayed. Defaults
+	// to 16 MB
+	DelayedWriteRate int64
+
+	// MaxBackgroundFlushes is the number of memtables that can be flushed at once. Memtables of different
+	// column families are flushed in parallel. Defaults to 1
+	MaxBackgroundFlushes int
+	// MaxBackgroundCompactions is the number of compactions that can run at once. Compactions only run in
+	// parallel when they merge different sstables into different key ranges of a level. Compaction workers
+	// also flush any memtable that's waiting before starting another compaction. Defaults to 1
+	MaxBackgroundCompactions int
+	// MaxSubcompactions is the number of key ranges a single compaction can be split into so that they're
+	// merged in parallel. Each range covers at least MaxFileSize bytes of the sstables being compacted.
+	// Defaults to 1
+	MaxSubcompactions int
+
+	// MergeOperator combines the operands written with DB#Merge. Must be set to use DB#Merge and must be
+	// the same operator each time the database is opened
+	MergeOperator MergeOperator
+	// EventListeners are notified of flushes, compactions and other work done in the background
+	EventListeners []EventListener
+}
+
+// Validate returns an error if any of the options are invalid
+func (o *DBOpts) Validate() error {
+	if o.IndexInterval < 0 {
+		return fmt.Errorf("index interval must not be negative. got %d", o.IndexInterval)
+	}
+
+	if o.MaxFileSize < 0 {
+		return fmt.Errorf("max file size must not be negative. got %d", o.MaxFileSize)
+	}
+
+	if o.L0CompactionTrigger < 0 {
+		return fmt.Errorf("level 0 compaction trigger must not be negative. got %d", o.L0CompactionTrigger)
+	}
+
+	if o.LevelSizeBase < 0 {
+		return fmt.Errorf("level size base must not be negative. got %d", o.LevelSizeBase)
+	}
+
+	if o.LevelSizeMultiplier < 0 || o.LevelSizeMultiplier == 1 {
+		return fmt.Errorf("level size multiplier must be greater than 1. got %d", o.LevelSizeMultiplier)
+	}
+
+	if o.TombstoneCompactionRatio < 0 {
+		return fmt.Errorf("tombstone compaction ratio must not be negative. got %g", o.TombstoneCompactionRatio)
+	}
+
+	if o.CompactionStrategy < CompactionLeveled || o.CompactionStrategy > CompactionFIFO {
+		return fmt.Errorf("unknown compaction strategy %d", o.CompactionStrategy)
+	}
+
+	if o.FIFOMaxTotalSize < 0 {
+		return fmt.Errorf("FIFO max total size must not be negative. got %d", o.FIFOMaxTotalSize)
+	}
+
+	if o.WALRetention < 0 {
+		return fmt.Errorf("WAL retention must not be negative. got %s", o.WALRetention)
+	}
+
+	if o.MaxImmutableMemTables < 0 {
+		return fmt.Errorf("max immutable memtables must not be negative. got %d", o.MaxImmutableMemTables)
+	}
+
+	if o.L0SlowdownWritesTrigger < 0 || o.L0StopWritesTrigger < 0 {
+		return fmt.Errorf("level 0 write triggers must not be negative. got slowdown %d, stop %d",
+			o.L0SlowdownWritesTrigger, o.L0StopWritesTrigger)
+	} else if o.L0SlowdownWritesTrigger > 0 && o.L0StopWritesTrigger > 0 &&
+		o.L0SlowdownWritesTrigger > o.L0StopWritesTrigger {
+		return fmt.Errorf("level 0 slowdown writes trigger must not exceed the stop writes trigger. got "+
+			"slowdown %d, stop %d", o.L0SlowdownWritesTrigger, o.L0StopWritesTrigger)
+	}
+
+	if o.SoftPendingCompactionBytesLimit < 0 || o.HardPendingCompactionBytesLimit < 0 {
+		return fmt.Errorf("pending compaction bytes limits must not be negative. got soft %d, hard %d",
+			o.SoftPendingCompactionBytesLimit, o.HardPendingCompactionBytesLimit)
+	} else if o.SoftPendingCompactionBytesLimit > 0 && o.HardPendingCompactionBytesLimit > 0 &&
+		o.SoftPendingCompactionBytesLimit > o.HardPendingCompactionBytesLimit {
+		return fmt.Errorf("soft pending compaction bytes limit must not exceed the hard limit. got soft %d, "+
+			"hard %d", o.SoftPendingCompactionBytesLimit, o.HardPendingCompactionBytesLimit)
+	}
+
+	if o.DelayedWriteRate < 0 {
+		return fmt.Errorf("delayed write rate must not be negative. got %d", o.DelayedWriteRate)
+	}
+
+	if o.MaxBackgroundFlushes < 0 || o.MaxBackgroundCompactions < 0 {
+		return fmt.Errorf("max background jobs must not be negative. got flushes %d, compactions %d",
+			o.MaxBackgroundFlushes, o.MaxBackgroundCompactions)
+	}
+
+	if o.MaxSubcompactions < 0 {
+		return fmt.Errorf("max subcompactions must not be negative. got %d", o.MaxSubcompactions)
+	}
+
+	return nil
+}
+
+func (o *DBOpts) applyDefaults() {
+	if o.DataDir == "" {
+		o.DataDir = defaultDataDir
+	}
+
+	if o.MemTableSizeLimit == 0 {
+		o.MemTableSizeLimit = defaultMemTableSizeLimit
+	}
+
+	if o.IndexInterval == 0 {
+		o.IndexInterval = sstable.DefaultIndexInterval
+	}
+
+	if o.MaxFileSize == 0 {
+		o.MaxFileSize = sstable.DefaultMaxFileSize
+	}
+
+	if o.L0CompactionTrigger == 0 {
+		o.L0CompactionTrigger = compaction.DefaultL0CompactionTrigger
+	}
+
+	if o.LevelSizeBase == 0 {
+		o.LevelSizeBase = compaction.DefaultLevelSizeBase
+	}
+
+	if o.LevelSizeMultiplier == 0 {
+		o.LevelSizeMultiplier = compaction.DefaultLevelSizeMultiplier
+	}
+
+	if o.TombstoneCompactionRatio == 0 {
+		o.TombstoneCompactionRatio = compaction.DefaultTombstoneRatio
+	}
+
+	if o.FIFOMaxTotalSize == 0 {
+		o.FIFOMaxTotalSize = compaction.DefaultMaxTotalSize
+	}
+
+	if o.MaxImmutableMemTables == 0 {
+		o.MaxImmutableMemTables = defaultMaxImmutableMemTables
+	}
+
+	// A default never puts the slowdown and stop thresholds out of order with one that's been configured
+	if o.L0SlowdownWritesTrigger == 0 {
+		o.L0SlowdownWritesTrigger = defaultL0SlowdownWritesTrigger
+		if o.L0StopWritesTrigger > 0 && o.L0StopWritesTrigger < o.L0SlowdownWritesTrigger {
+			o.L0SlowdownWritesTrigger = o.L0StopWritesTrigger
+		}
+	}
+
+	if o.L0StopWritesTrigger == 0 {
+		o.L0StopWritesTrigger = defaultL0StopWritesTrigger
+		if o.L0StopWritesTrigger < o.L0SlowdownWritesTrigger {
+			o.L0StopWritesTrigger = o.L0SlowdownWritesTrigger
+		}
+	}
+
+	if o.SoftPendingCompactionBytesLimit == 0 {
+		o.SoftPendingCompactionBytesLimit = defaultSoftPendingCompactionBytesLimit
+		if o.HardPendingCompactionBytesLimit > 0 && o.HardPendingCompactionBytesLimit < o.SoftPendingCompactionBytesLimit {
+			o.SoftPendingCompactionBytesLimit = o.HardPendingCompactionBytesLimit
+		}
+	}
+
+	if o.HardPendingCompactionBytesLimit == 0 {
+		o.HardPendingCompactionBytesLimit = defaultHardPendingCompactionBytesLimit
+		if o.HardPendingCompactionBytesLimit < o.SoftPendingCompactionBytesLimit {
+			o.HardPendingCompactionBytesLimit = o.SoftPendingCompactionBytesLimit
+		}
+	}
+
+	if o.DelayedWriteRate == 0 {
+		o.DelayedWriteRate = defaultDelayedWriteRate
+	}
+
+	if o.MaxBackgroundFlushes == 0 {
+		o.MaxBackgroundFlushes = defaultMaxBackgroundFlushes
+	}
+
+	if o.MaxBackgroundCompactions == 0 {
+		o.MaxBackgroundCompactions = defaultMaxBackgroundCompactions
+	}
+
+	if o.MaxSubcompactions == 0 {
+		o.MaxSubcompactions = defaultMaxSubcompactions
+	}
+}
+
+func (o *DBOpts) compactionOpts() compaction.Options {
+	return compaction.Options{
+		Strategy:            compaction.Strategy(o.CompactionStrategy),
+		L0CompactionTrigger: o.L0CompactionTrigger,
+		LevelSizeBase:       o.LevelSizeBase,
+		LevelSizeMultiplier: o.LevelSizeMultiplier,
+		DynamicLevelBytes:   o.DynamicLevelBytes,
+		TombstoneRatio:      o.TombstoneCompactionRatio,
+		MaxTotalSize:        o.FIFOMaxTotalSize,
+		MaxSubcompactions:   o.MaxSubcompactions,
+		Table: sstable.TableOpts{
+			IndexInterval: o.IndexInterval,
+			MaxFileSize:   o.MaxFileSize,
+		},
+		MergeOperator: o.MergeOperator,
+	}
+}
+
+// persisted returns the options recorded in the OPTIONS file, in the order they're written
+func (o *DBOpts) persisted() [][2]string {
+	return [][2]string{
+		{optIndexInterval, strconv.Itoa(o.IndexInterval)},
+		{optMaxFileSize, strconv.Itoa(o.MaxFileSize)},
+		{optMemTableSizeLimit, strconv.FormatUint(uint64(o.MemTableSizeLimit), 10)},
+		{optL0CompactionTrigger, strconv.Itoa(o.L0CompactionTrigger)},
+		{optLevelSizeBase, strconv.FormatInt(o.LevelSizeBase, 10)},
+		{optLevelSizeMultiplier, strconv.Itoa(o.LevelSizeMultiplier)},
+		{optDynamicLevelBytes, strconv.FormatBool(o.DynamicLevelBytes)},
+		{optTombstoneCompactionRatio, strconv.FormatFloat(o.TombstoneCompactionRatio, 'g', -1, 64)},
+		{optCompactionStrategy, o.CompactionStrategy.String()},
+		{optFIFOMaxTotalSize, strconv.FormatInt(o.FIFOMaxTotalSize, 10)},
+		{optWALRetention, o.WALRetention.String()},
+		{optMaxImmutableMemTables, strconv.Itoa(o.MaxImmutableMemTables)},
+		{optL0SlowdownWritesTrigger, strconv.Itoa(o.L0SlowdownWritesTrigger)},
+		{optL0StopWritesTrigger, strconv.Itoa(o.L0StopWritesTrigger)},
+		{optMaxSubcompactions, strconv.Itoa(o.MaxSubcompactions)},
+	}
+}
+
+// checkOptionsFile compares opts to the options recorded in the OPTIONS file in dbPath, if there is one, and
+// then records opts in it. Options that can't change once the database has been created cause an error if
+// they differ. Changes to any other option are logged
+func checkOptionsFile(dbPath string, opts DBOpts) error {
+	existing, err := readOptionsFile(dbPath)
+	if err != nil {
+		return err
+	}
+
+	for _, opt := range opts.persisted() {
+		name, value := opt[0], opt[1]
+		prev, ok := existing[name]
+		if !ok || prev == value {
+			continue
+		}
+
+		if incompatibleOptions[name] {
+			return fmt.Errorf("incompatible option %s. database was created with %s, got %s", name, prev, value)
+		}
+		log.Warnf("option %s changed from %s to %s", name, prev, value)
+	}
+
+	return writeOptionsFile(dbPath, opts)
+}
+
+func readOptionsFile(dbPath string) (map[string]string, error) {
+	file, err := os.Open(path.Join(dbPath, optionsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed opening options file: %w", err)
+	}
+	defer file.Close()
+
+	opts := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed line in options file: %s", line)
+		}
+		opts[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading options file: %w", err)
+	}
+
+	return opts, nil
+}
+
+// writeOptionsFile writes opts to a temporary file before renaming it over the OPTIONS file so that
+// a crash can't leave a partially written one behind
+func writeOptionsFile(dbPath string, opts DBOpts) error {
+	var sb strings.Builder
+	sb.WriteString("# options the database was last opened with\n")
+	for _, opt := range opts.persisted() {
+		sb.WriteString(fmt.Sprintf("%s=%s\n", opt[0], opt[1]))
+	}
+
+	tmpPath := path.Join(dbPath, optionsFile+".tmp")
+	if err := ioutil.WriteFile(tmpPath, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("failed writing options file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path.Join(dbPath, optionsFile)); err != nil {
+		return fmt.Errorf("failed replacing options file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBOpts_Validate(t *testing.T) {
+	assert.NoError(t, (&DBOpts{}).Validate())
+	assert.NoError(t, (&DBOpts{IndexInterval: 10, MaxFileSize: 100, L0CompactionTrigger: 2}).Validate())
+
+	assert.EqualError(t, (&DBOpts{IndexInterval: -1}).Validate(), "index interval must not be negative. got -1")
+	assert.EqualError(t, (&DBOpts{MaxFileSize: -1}).Validate(), "max file size must not be negative. got -1")
+	assert.EqualError(t, (&DBOpts{L0CompactionTrigger: -1}).Validate(),
+		"level 0 compaction trigger must not be negative. got -1")
+	assert.EqualError(t, (&DBOpts{LevelSizeBase: -1}).Validate(), "level size base must not be negative. got -1")
+	assert.EqualError(t, (&DBOpts{LevelSizeMultiplier: 1}).Validate(),
+		"level size multiplier must be greater than 1. got 1")
+	assert.EqualError(t, (&DBOpts{TombstoneCompactionRatio: -0.5}).Validate(),
+		"tombstone compaction ratio must not be negative. got -0.5")
+	assert.EqualError(t, (&DBOpts{CompactionStrategy: 3}).Validate(), "unknown compaction strategy 3")
+	assert.EqualError(t, (&DBOpts{FIFOMaxTotalSize: -1}).Validate(), "FIFO max total size must not be negative. got -1")
+	assert.EqualError(t, (&DBOpts{WALRetention: -time.Second}).Validate(), "WAL retention must not be negative. got -1s")
+	assert.EqualError(t, (&DBOpts{L0SlowdownWritesTrigger: 10, L0StopWritesTrigger: 5}).Validate(),
+		"level 0 slowdown writes trigger must not exceed the stop writes trigger. got slowdown 10, stop 5")
+	assert.EqualError(t, (&DBOpts{SoftPendingCompactionBytesLimit: 10, HardPendingCompactionBytesLimit: 5}).Validate(),
+		"soft pending compaction bytes limit must not exceed the hard limit. got soft 10, hard 5")
+	assert.EqualError(t, (&DBOpts{MaxBackgroundCompactions: -1}).Validate(),
+		"max background jobs must not be negative. got flushes 0, compactions -1")
+	assert.EqualError(t, (&DBOpts{MaxSubcompactions: -1}).Validate(), "max subcompactions must not be negative. got -1")
+
+	// Defaults are kept in order with the thresholds that are set
+	opts := DBOpts{L0SlowdownWritesTrigger: 50, HardPendingCompactionBytesLimit: 10}
+	opts.applyDefaults()
+	assert.Equal(t, 50, opts.L0StopWritesTrigger)
+	assert.Equal(t, int64(10), opts.SoftPendingCompactionBytesLimit)
+
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	_, err = New(dbName, DBOpts{DataDir: dir, IndexInterval: -1})
+	defer cleanup(dbName, dir)
+	assert.EqualError(t, err, "invalid options: index interval must not be negative. got -1")
+}
+
+func TestDBOpts_OptionsFile(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	_, err = New(dbName, DBOpts{DataDir: dir, IndexInterval: 10, L0CompactionTrigger: 2})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(path.Join(dir, dbName, optionsFile))
+	assert.NoError(t, err)
+	assert.Equal(t, "# options the database was last opened with\n"+
+		"index_interval=10\n"+
+		"max_file_size=2000000\n"+
+		"memtable_size_limit=4194304\n"+
+		"l0_compaction_trigger=2\n"+
+		"level_size_base=1000000\n"+
+		"level_size_multiplier=10\n"+
+		"dynamic_level_bytes=false\n"+
+		"tombstone_compaction_ratio=0.5\n"+
+		"compaction_strategy=leveled\n"+
+		"fifo_max_total_size=1073741824\n"+
+		"wal_retention=0s\n"+
+		"max_immutable_memtables=2\n"+
+		"l0_slowdown_writes_trigger=20\n"+
+		"l0_stop_writes_trigger=36\n"+
+		"max_subcompactions=1\n", string(data))
+
+	// Options that can change are recorded each time the database is opened
+	_, err = Open(dbName, DBOpts{DataDir: dir, IndexInterval: 10, L0CompactionTrigger: 8,
+		WALRetention: time.Hour, MaxSubcompactions: 4})
+	assert.NoError(t, err)
+
+	opts, err := readOptionsFile(path.Join(dir, dbName))
+	assert.NoError(t, err)
+	assert.Equal(t, "8", opts[optL0CompactionTrigger])
+	assert.Equal(t, "1h0m0s", opts[optWALRetention])
+	assert.Equal(t, "4", opts[optMaxSubcompactions])
+
+	// But the compaction strategy can't be
+	_, err = Open(dbName, DBOpts{DataDir: dir, CompactionStrategy: CompactionTiered})
+	assert.EqualError(t, err, "failed checking options: incompatible option compaction_strategy. database was "+
+		"created with leveled, got tiered")
+}
+
+func TestDBOpts_ChangeIndexInterval(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, IndexInterval: 2})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	// Closing flushes each batch of writes to an sstable written with the interval the database was opened with
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("old%02d", i)), []byte("value")))
+	}
+	assert.NoError(t, db.Close())
+
+	db, err = Open(dbName, DBOpts{DataDir: dir, IndexInterval: 5})
+	assert.NoError(t, err)
+
+	opts, err := readOptionsFile(path.Join(dir, dbName))
+	assert.NoError(t, err)
+	assert.Equal(t, "5", opts[optIndexInterval])
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("new%02d", i)), []byte("value")))
+	}
+	assert.NoError(t, db.Close())
+
+	// sstables written with either interval are read side by side
+	db, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	for _, prefix := range []string{"old", "new"} {
+		for i := 0; i < 10; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("%s%02d", prefix, i)))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("value"), value)
+		}
+	}
+	assert.NoError(t, db.Close())
+}
@@ -0,0 +1,180 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// initialRetryDelay is how long a worker waits before retrying work that failed. The wait doubles with
+	// each failure in a row, up to maxRetryDelay, so work that keeps failing isn't retried in a tight loop
+	initialRetryDelay = 100 * time.Millisecond
+	maxRetryDelay     = 10 * time.Second
+)
+
+// scheduler runs flushes and compactions on pools of background workers. Flush workers only flush memtables,
+// so a long compaction never holds up the flushes that writes may be stalled on. Compaction workers flush
+// too whenever a memtable is waiting and they're free, before starting another compaction. Compactions of
+// sstables and key ranges that don't overlap run at the same time. Workers back off after a flush or
+// compaction fails before retrying it
+type scheduler struct {
+	db *DB
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+	// flushPending and compactionPending are set when there may be work for the workers to pick up
+	flushPending      bool
+	compactionPending bool
+	stopping          bool
+	// stopped is closed once the scheduler is stopping, waking workers that are backing off
+	stopped chan struct{}
+	// retryDelay is how long to wait after the next failure. It's 0 until something fails
+	retryDelay time.Duration
+	workers    sync.WaitGroup
+}
+
+func newScheduler(db *DB) *scheduler {
+	s := &scheduler{db: db, stopped: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mutex)
+
+	return s
+}
+
+// start starts the flush and compaction workers
+func (s *scheduler) start(flushes int, compactions int) {
+	s.workers.Add(flushes + compactions)
+	for i := 0; i < flushes; i++ {
+		go s.flushWorker()
+	}
+	for i := 0; i < compactions; i++ {
+		go s.compactionWorker()
+	}
+}
+
+// stop stops the workers once they've finished the work they're doing
+func (s *scheduler) stop() {
+	s.mutex.Lock()
+	if !s.stopping {
+		close(s.stopped)
+	}
+	s.stopping = true
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+
+	s.workers.Wait()
+}
+
+// scheduleFlush wakes the workers to look for memtables to flush. Compaction workers are woken too in case
+// every flush worker is busy
+func (s *scheduler) scheduleFlush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.flushPending = true
+	s.compactionPending = true
+	s.cond.Broadcast()
+}
+
+// scheduleCompaction wakes the compaction workers to look for sstables to compact
+func (s *scheduler) scheduleCompaction() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.compactionPending = true
+	s.cond.Broadcast()
+}
+
+// wait blocks until pending is set, clearing it, and returns true. It returns false once the scheduler is
+// stopping
+func (s *scheduler) wait(pending *bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for !*pending && !s.stopping {
+		s.cond.Wait()
+	}
+	*pending = false
+
+	return !s.stopping
+}
+
+func (s *scheduler) flushWorker() {
+	defer s.workers.Done()
+
+	for s.wait(&s.flushPending) {
+		for s.runFlush() {
+		}
+	}
+}
+
+func (s *scheduler) compactionWorker() {
+	defer s.workers.Done()
+
+	for s.wait(&s.compactionPending) {
+		for s.runFlush() || s.runCompaction() {
+		}
+	}
+}
+
+// runFlush flushes one memtable, returning false if there were none that could be flushed or the flush failed
+func (s *scheduler) runFlush() bool {
+	flushed, err := s.db.flushNext()
+	if err != nil {
+		s.db.backgroundError("flush", err)
+		s.backoff(s.scheduleFlush)
+		return false
+	} else if flushed {
+		s.succeeded()
+	}
+
+	return flushed
+}
+
+// runCompaction runs one compaction, returning false if no column family needed one that could run alongside
+// those underway or the compaction failed
+func (s *scheduler) runCompaction() bool {
+	for _, family := range s.db.columnFamilies() {
+		compacted, err := s.db.compactNext(family)
+		if err != nil {
+			s.db.backgroundError("compaction", err)
+			s.backoff(s.scheduleCompaction)
+			return false
+		} else if compacted {
+			s.succeeded()
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff waits before work that failed is retried, twice as long as the last time if that failed too, and
+// then calls schedule to retry it. It returns without retrying once the scheduler is stopping
+func (s *scheduler) backoff(schedule func()) {
+	s.mutex.Lock()
+	if s.retryDelay == 0 {
+		s.retryDelay = initialRetryDelay
+	}
+	delay := s.retryDelay
+	if s.retryDelay *= 2; s.retryDelay > maxRetryDelay {
+		s.retryDelay = maxRetryDelay
+	}
+	s.mutex.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		schedule()
+	case <-s.stopped:
+	}
+}
+
+// succeeded resets the wait after the next failure once work has succeeded
+func (s *scheduler) succeeded() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.retryDelay = 0
+}
@@ -0,0 +1,180 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/compaction"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingListener holds up each compaction as it begins until it's released
+type blockingListener struct {
+	NoOpEventListener
+
+	begun   chan CompactionInfo
+	release chan bool
+}
+
+func (b *blockingListener) OnCompactionBegin(info CompactionInfo) {
+	b.begun <- info
+	<-b.release
+}
+
+func TestScheduler_FlushDuringCompaction(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	listener := &blockingListener{begun: make(chan CompactionInfo, 1), release: make(chan bool)}
+	db, err := New(dbName, DBOpts{DataDir: dir, L0CompactionTrigger: 2, EventListeners: []EventListener{listener}})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	for _, key := range []string{"a", "b"} {
+		assert.NoError(t, db.Put([]byte(key), []byte("value")))
+		assert.NoError(t, db.Flush(true))
+	}
+
+	compacting := <-listener.begun
+	assert.Equal(t, 0, compacting.Level)
+
+	// Flushes go ahead while the compaction is held up
+	flushed := make(chan error)
+	go func() {
+		assert.NoError(t, db.Put([]byte("c"), []byte("value")))
+		flushed <- db.Flush(true)
+	}()
+
+	select {
+	case err := <-flushed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "flush waited for compaction")
+	}
+
+	stats, err := db.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), stats.Flushes)
+	assert.Equal(t, int64(0), stats.Compactions)
+
+	close(listener.release)
+	assert.NoError(t, db.Close())
+
+	db, err = Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		value, err := db.Get([]byte(key))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), value)
+	}
+}
+
+func TestScheduler_ParallelJobs(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, MemTableSizeLimit: 256, L0CompactionTrigger: 2, LevelSizeBase: 1024,
+		MaxFileSize: 512, IndexInterval: 4, MaxBackgroundFlushes: 2, MaxBackgroundCompactions: 3,
+		MaxSubcompactions: 4})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		assert.NoError(t, db.Put(key, []byte("value")))
+		assert.NoError(t, users.Put(key, []byte("user")))
+	}
+	assert.NoError(t, db.Flush(true))
+	assert.NoError(t, db.doCompaction())
+
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		value, err := db.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), value)
+
+		value, err = users.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("user"), value)
+	}
+
+	stats, err := db.Stats()
+	assert.NoError(t, err)
+	assert.True(t, stats.Compactions > 0)
+	assert.Equal(t, int64(0), stats.BackgroundErrors)
+	assert.NoError(t, db.Close())
+}
+
+// failingCompactor always has a compaction to run, and running it always fails
+type failingCompactor struct {
+	compaction.Compactor
+
+	mutex sync.Mutex
+	runs  int
+}
+
+func (f *failingCompactor) Pick() (*compaction.Compaction, error) {
+	return &compaction.Compaction{}, nil
+}
+
+func (f *failingCompactor) Run(*compaction.Compaction, []uint64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.runs++
+	return errors.New("boom")
+}
+
+func (f *failingCompactor) Wait() bool {
+	return false
+}
+
+func TestScheduler_BacksOffAfterFailure(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, MaxBackgroundCompactions: 2})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	failing := &failingCompactor{Compactor: db.defaultFamily.compactor}
+	db.mutex.Lock()
+	db.defaultFamily.compactor = failing
+	db.mutex.Unlock()
+
+	db.scheduler.scheduleCompaction()
+	time.Sleep(time.Second)
+
+	// Retries wait twice as long each time, so only a handful fit in a second
+	failing.mutex.Lock()
+	runs := failing.runs
+	failing.mutex.Unlock()
+	assert.True(t, runs > 0)
+	assert.True(t, runs <= 10, "compaction retried %d times", runs)
+
+	stats, err := db.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(runs), stats.BackgroundErrors)
+
+	// Workers backing off don't hold up closing
+	closed := make(chan error)
+	go func() {
+		closed <- db.Close()
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "close waited for the retry")
+	}
+}
@@ -0,0 +1,51 @@
+package pkg
+
+// Snapshot is a consistent, point-in-time view of the database. Reads made with a snapshot
+// only see writes that completed before it was taken. Snapshots must be released with
+// DB.ReleaseSnapshot once done with so that compaction can discard the data they retain
+type Snapshot struct {
+	seq uint64
+}
+
+// GetSnapshot returns a snapshot of the current state of the database
+func (d *DB) GetSnapshot() *Snapshot {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	d.snapshotMutex.Lock()
+	defer d.snapshotMutex.Unlock()
+
+	// Sequence numbers only increase, so snapshots are kept in ascending order
+	snap := &Snapshot{seq: d.seq}
+	d.snapshots = append(d.snapshots, snap)
+
+	return snap
+}
+
+// ReleaseSnapshot releases the snapshot provided. The snapshot must not be used afterwards
+func (d *DB) ReleaseSnapshot(snap *Snapshot) {
+	d.snapshotMutex.Lock()
+	defer d.snapshotMutex.Unlock()
+
+	for i, s := range d.snapshots {
+		if s == snap {
+			d.snapshots = append(d.snapshots[:i], d.snapshots[i+1:]...)
+			return
+		}
+	}
+}
+
+// liveSnapshots returns the sequence numbers of every unreleased snapshot in ascending order
+func (d *DB) liveSnapshots() []uint64 {
+	d.snapshotMutex.Lock()
+	defer d.snapshotMutex.Unlock()
+
+	var seqs []uint64
+	for _, s := range d.snapshots {
+		if len(seqs) == 0 || seqs[len(seqs)-1] != s.seq {
+			seqs = append(seqs, s.seq)
+		}
+	}
+
+	return seqs
+}
@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot_Get(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, db.Put([]byte("baz"), []byte("bax")))
+
+	snap := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snap)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("new")))
+	assert.NoError(t, db.Put([]byte("howdy"), []byte("time")))
+
+	assertSnapshotReads := func() {
+		val, err := db.GetWithOpts([]byte("foo"), ReadOpts{Snapshot: snap})
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("bar"), val)
+
+		val, err = db.GetWithOpts([]byte("howdy"), ReadOpts{Snapshot: snap})
+		assert.Equal(t, ErrNotFound, err)
+		assert.Nil(t, val)
+
+		val, err = db.Get([]byte("foo"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("new"), val)
+	}
+
+	assertSnapshotReads()
+
+	// Versions visible to the snapshot survive flushing and compaction
+	flush(t, db)
+	assertSnapshotReads()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, db.Put([]byte("foo"), []byte("newer")))
+		flush(t, db)
+	}
+	assert.Empty(t, db.manifest.MetadataForLevel(0, 0))
+	assert.NotEmpty(t, db.manifest.MetadataForLevel(0, 1))
+
+	val, err := db.GetWithOpts([]byte("foo"), ReadOpts{Snapshot: snap})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), val)
+
+	val, err = db.Get([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("newer"), val)
+}
+
+func TestSnapshot_Iterator(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("a"), []byte("old")))
+	assert.NoError(t, db.Put([]byte("b"), []byte("old")))
+	flush(t, db)
+	assert.NoError(t, db.Put([]byte("c"), []byte("old")))
+
+	snap := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snap)
+
+	assert.NoError(t, db.Put([]byte("a"), []byte("new")))
+	assert.NoError(t, db.Delete([]byte("b")))
+	assert.NoError(t, db.Put([]byte("d"), []byte("new")))
+
+	iter, err := db.NewIterator(ReadOpts{Snapshot: snap})
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	iter.SeekToFirst()
+	assertIteration(t, iter, map[string]string{"a": "old", "b": "old", "c": "old"}, "a", "b", "c")
+
+	iter.SeekToLast()
+	for _, key := range []string{"c", "b", "a"} {
+		assert.True(t, iter.Valid())
+		assert.Equal(t, []byte(key), iter.Key())
+		assert.Equal(t, []byte("old"), iter.Value())
+		iter.Prev()
+	}
+	assert.False(t, iter.Valid())
+
+	// Iterators without a snapshot don't see writes made after they were created
+	latest, err := db.NewIterator(ReadOpts{})
+	assert.NoError(t, err)
+	defer latest.Close()
+
+	assert.NoError(t, db.Put([]byte("e"), []byte("new")))
+
+	latest.SeekToFirst()
+	assertIteration(t, latest, map[string]string{"a": "new", "c": "old", "d": "new"}, "a", "c", "d")
+}
+
+func TestSnapshot_Release(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	snap1 := db.GetSnapshot()
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	snap2 := db.GetSnapshot()
+	snap3 := db.GetSnapshot()
+
+	assert.Equal(t, []uint64{0, 1}, db.liveSnapshots())
+
+	db.ReleaseSnapshot(snap1)
+	db.ReleaseSnapshot(snap2)
+	assert.Equal(t, []uint64{1}, db.liveSnapshots())
+
+	db.ReleaseSnapshot(snap3)
+	assert.Empty(t, db.liveSnapshots())
+}
+
+func TestSnapshot_SeqRecovered(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, db.Put([]byte("baz"), []byte("bax")))
+	flush(t, db)
+	assert.NoError(t, db.Put([]byte("howdy"), []byte("time")))
+	assert.NoError(t, db.Close())
+
+	db2, err := Open(dbName, DBOpts{DataDir: dir})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), db2.seq)
+
+	// New writes must be ordered after everything written before reopening
+	assert.NoError(t, db2.Put([]byte("foo"), []byte("new")))
+	val, err := db2.Get([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), val)
+}
@@ -0,0 +1,446 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations whose counts and latencies are reported in Stats#Operations
+const (
+	OpGet         = "get"
+	OpMultiGet    = "multiget"
+	OpPut         = "put"
+	OpDelete      = "delete"
+	OpMerge       = "merge"
+	OpDeleteRange = "delete_range"
+	OpWrite       = "write"
+)
+
+// Properties that can be read with DB#GetProperty. Level properties are suffixed with the level number,
+// e.g. nbdb.num-files-at-level0. Properties of column families are summed across all of them
+const (
+	// PropertyStats is a human readable summary of every other property
+	PropertyStats                  = "nbdb.stats"
+	PropertyNumFilesAtLevel        = "nbdb.num-files-at-level"
+	PropertyBytesAtLevel           = "nbdb.bytes-at-level"
+	PropertyMemTableSize           = "nbdb.memtable-size"
+	PropertyImmutableMemTableSize  = "nbdb.immutable-memtable-size"
+	PropertyNumImmutableMemTables  = "nbdb.num-immutable-memtables"
+	PropertyWALSize                = "nbdb.wal-size"
+	PropertyPendingCompactionBytes = "nbdb.pending-compaction-bytes"
+	PropertyFlushBytesWritten      = "nbdb.flush-bytes-written"
+	PropertyCompactionBytesRead    = "nbdb.compaction-bytes-read"
+	PropertyCompactionBytesWritten = "nbdb.compaction-bytes-written"
+	PropertyWriteAmplification     = "nbdb.write-amplification"
+	// PropertyWriteStall is whether writes are being held back and why, e.g. "delayed (level 0 files)"
+	PropertyWriteStall = "nbdb.write-stall"
+)
+
+// LatencyBuckets are the upper bounds of the buckets latencies are counted in, doubling from 1µs to
+// roughly 16s. Latencies above the last bound are counted in a final, unbounded bucket
+var LatencyBuckets = func() []time.Duration {
+	buckets := make([]time.Duration, 25)
+	for i := range buckets {
+		buckets[i] = time.Microsecond << uint(i)
+	}
+	return buckets
+}()
+
+// Stats is a point-in-time view of the state of the database and the work it has done since it was opened
+type Stats struct {
+	ColumnFamilies []ColumnFamilyStats
+	// WALSize is the size in bytes of the WALs holding writes that haven't been flushed
+	WALSize uint64
+	// Flushes is the number of memtables flushed to level 0 sstables
+	Flushes int64
+	// FlushBytesWritten is the total size of the sstables written by flushes
+	FlushBytesWritten int64
+	// Compactions is the number of merges performed by compaction
+	Compactions int64
+	// CompactionBytesRead is the total size of the sstables merged by compaction
+	CompactionBytesRead int64
+	// CompactionBytesWritten is the total size of the sstables written by compaction
+	CompactionBytesWritten int64
+	// CompactionLatency holds how long each compaction that merged sstables took
+	CompactionLatency Histogram
+	// WALSyncLatency holds how long each write took to sync the WAL to disk
+	WALSyncLatency Histogram
+	// BackgroundErrors is the number of errors encountered flushing and compacting in the background
+	BackgroundErrors int64
+	// WriteAmplification is the number of bytes written to sstables for each byte flushed from memtables
+	WriteAmplification float64
+	// WriteStall is whether writes are currently being held back and why
+	WriteStall WriteStall
+	// DelayedWrites is the number of writes slowed down by a write stall
+	DelayedWrites int64
+	// StoppedWrites is the number of writes that had to wait for a write stall to end
+	StoppedWrites int64
+	// Operations holds the latencies of each operation, keyed by operation (e.g. OpGet)
+	Operations map[string]Histogram
+}
+
+// ColumnFamilyStats is a point-in-time view of the state of a column family
+type ColumnFamilyStats struct {
+	Name string
+	// MemTableSize is the size in bytes of the active memtable
+	MemTableSize uint32
+	// ImmutableMemTables is the number of memtables waiting to be flushed
+	ImmutableMemTables int
+	// ImmutableMemTableSize is the total size in bytes of the memtables waiting to be flushed
+	ImmutableMemTableSize uint32
+	// Levels holds the sstables in each level, starting with level 0
+	Levels []LevelStats
+	// PendingCompactionBytes estimates the number of bytes that need compacting before every level is
+	// back within its threshold
+	PendingCompactionBytes int64
+}
+
+// LevelStats describes the sstables in a single level
+type LevelStats struct {
+	Files int
+	Bytes int64
+	// Score is how far the level is past the point that calls for compacting it. It needs compacting once
+	// its score reaches 1, and the highest scoring level is compacted first
+	Score float64
+}
+
+// Histogram is a distribution of operation latencies
+type Histogram struct {
+	Count uint64
+	Sum   time.Duration
+	Max   time.Duration
+	// Buckets[i] is the number of latencies greater than LatencyBuckets[i-1] and no greater than
+	// LatencyBuckets[i]. The final bucket counts latencies greater than every bound
+	Buckets []uint64
+}
+
+// Mean returns the average latency
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Percentile returns an upper bound on the latency of the fastest p percent of operations
+func (h Histogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(float64(h.Count) * p / 100))
+	seen := uint64(0)
+	for i, count := range h.Buckets {
+		if seen += count; seen >= target && i < len(LatencyBuckets) && LatencyBuckets[i] < h.Max {
+			return LatencyBuckets[i]
+		} else if seen >= target {
+			break
+		}
+	}
+	return h.Max
+}
+
+// histogram records latencies into a Histogram
+type histogram struct {
+	mutex sync.Mutex
+	hist  Histogram
+}
+
+func newHistogram() *histogram {
+	return &histogram{hist: Histogram{Buckets: make([]uint64, len(LatencyBuckets)+1)}}
+}
+
+func (h *histogram) observe(latency time.Duration) {
+	bucket := sort.Search(len(LatencyBuckets), func(i int) bool {
+		return latency <= LatencyBuckets[i]
+	})
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.hist.Count++
+	h.hist.Sum += latency
+	if latency > h.hist.Max {
+		h.hist.Max = latency
+	}
+	h.hist.Buckets[bucket]++
+}
+
+func (h *histogram) snapshot() Histogram {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hist := h.hist
+	hist.Buckets = append([]uint64{}, h.hist.Buckets...)
+	return hist
+}
+
+// dbStats counts the work done by the database itself rather than its compactors
+type dbStats struct {
+	// operations is never modified once created so can be read without holding mutex
+	operations  map[string]*histogram
+	compactions *histogram
+	walSyncs    *histogram
+
+	mutex             sync.Mutex
+	flushes           int64
+	flushBytesWritten int64
+	backgroundErrors  int64
+	delayedWrites     int64
+	stoppedWrites     int64
+}
+
+func newDBStats() *dbStats {
+	operations := make(map[string]*histogram)
+	for _, op := range []string{OpGet, OpMultiGet, OpPut, OpDelete, OpMerge, OpDeleteRange, OpWrite} {
+		operations[op] = newHistogram()
+	}
+
+	return &dbStats{operations: operations, compactions: newHistogram(), walSyncs: newHistogram()}
+}
+
+// record records the latency of an operation that began at start
+func (s *dbStats) record(op string, start time.Time) {
+	s.operations[op].observe(time.Since(start))
+}
+
+func (s *dbStats) recordFlush(bytesWritten int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.flushes++
+	s.flushBytesWritten += bytesWritten
+}
+
+func (s *dbStats) recordBackgroundError() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.backgroundErrors++
+}
+
+func (s *dbStats) recordDelayedWrite() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.delayedWrites++
+}
+
+func (s *dbStats) recordStoppedWrite() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stoppedWrites++
+}
+
+// Stats returns the current state of the database and the work it has done since it was opened
+func (d *DB) Stats() (*Stats, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	stats := &Stats{WALSize: uint64(d.walog.Size()), Operations: make(map[string]Histogram)}
+	for _, immutable := range d.immutable {
+		if immutable.walog != nil {
+			stats.WALSize += uint64(immutable.walog.Size())
+		}
+	}
+
+	ids := make([]uint32, 0, len(d.families))
+	for id := range d.families {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		family := d.families[id]
+		familyStats, err := family.stats()
+		if err != nil {
+			return nil, fmt.Errorf("failed gathering stats for column family %s: %w", family.name, err)
+		}
+		stats.ColumnFamilies = append(stats.ColumnFamilies, familyStats)
+
+		compactorStats := family.compactor.Stats()
+		stats.Compactions += compactorStats.Compactions
+		stats.CompactionBytesRead += compactorStats.BytesRead
+		stats.CompactionBytesWritten += compactorStats.BytesWritten
+	}
+
+	d.stats.mutex.Lock()
+	stats.Flushes = d.stats.flushes
+	stats.FlushBytesWritten = d.stats.flushBytesWritten
+	stats.BackgroundErrors = d.stats.backgroundErrors
+	stats.DelayedWrites = d.stats.delayedWrites
+	stats.StoppedWrites = d.stats.stoppedWrites
+	d.stats.mutex.Unlock()
+
+	stats.WriteStall = d.writes.current()
+
+	stats.CompactionLatency = d.stats.compactions.snapshot()
+	stats.WALSyncLatency = d.stats.walSyncs.snapshot()
+
+	if stats.FlushBytesWritten > 0 {
+		stats.WriteAmplification = float64(stats.FlushBytesWritten+stats.CompactionBytesWritten) /
+			float64(stats.FlushBytesWritten)
+	}
+
+	for op, hist := range d.stats.operations {
+		stats.Operations[op] = hist.snapshot()
+	}
+
+	return stats, nil
+}
+
+// stats returns the current state of the column family. Must be called while holding the database's lock
+func (c *ColumnFamily) stats() (ColumnFamilyStats, error) {
+	stats := ColumnFamilyStats{Name: c.name, MemTableSize: c.memTable.Size()}
+	for _, memTable := range c.immutableMemTables() {
+		stats.ImmutableMemTables++
+		stats.ImmutableMemTableSize += memTable.Size()
+	}
+
+	scores, err := c.compactor.Scores()
+	if err != nil {
+		return stats, err
+	}
+
+	man := c.db.manifest
+	for level := 0; level < man.Levels(c.id); level++ {
+		size, err := c.compactor.LevelSize(level)
+		if err != nil {
+			return stats, err
+		}
+
+		lvl := LevelStats{Files: len(man.MetadataForLevel(c.id, level)), Bytes: size}
+		if level < len(scores) {
+			lvl.Score = scores[level]
+		}
+		stats.Levels = append(stats.Levels, lvl)
+	}
+
+	if stats.PendingCompactionBytes, err = c.compactor.PendingCompactionBytes(); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// GetProperty returns the value of the property provided. See the Property constants for those available
+func (d *DB) GetProperty(name string) (string, error) {
+	stats, err := d.Stats()
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(name, PropertyNumFilesAtLevel) || strings.HasPrefix(name, PropertyBytesAtLevel) {
+		return levelProperty(stats, name)
+	}
+
+	var value int64
+	switch name {
+	case PropertyStats:
+		return stats.String(), nil
+	case PropertyWALSize:
+		return strconv.FormatUint(stats.WALSize, 10), nil
+	case PropertyFlushBytesWritten:
+		value = stats.FlushBytesWritten
+	case PropertyCompactionBytesRead:
+		value = stats.CompactionBytesRead
+	case PropertyCompactionBytesWritten:
+		value = stats.CompactionBytesWritten
+	case PropertyWriteAmplification:
+		return strconv.FormatFloat(stats.WriteAmplification, 'f', 2, 64), nil
+	case PropertyWriteStall:
+		return stats.WriteStall.String(), nil
+	case PropertyMemTableSize, PropertyImmutableMemTableSize, PropertyNumImmutableMemTables,
+		PropertyPendingCompactionBytes:
+		for _, family := range stats.ColumnFamilies {
+			switch name {
+			case PropertyMemTableSize:
+				value += int64(family.MemTableSize)
+			case PropertyImmutableMemTableSize:
+				value += int64(family.ImmutableMemTableSize)
+			case PropertyNumImmutableMemTables:
+				value += int64(family.ImmutableMemTables)
+			case PropertyPendingCompactionBytes:
+				value += family.PendingCompactionBytes
+			}
+		}
+	default:
+		return "", fmt.Errorf("unknown property %s", name)
+	}
+
+	return strconv.FormatInt(value, 10), nil
+}
+
+func levelProperty(stats *Stats, name string) (string, error) {
+	prefix := PropertyNumFilesAtLevel
+	if strings.HasPrefix(name, PropertyBytesAtLevel) {
+		prefix = PropertyBytesAtLevel
+	}
+
+	level, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+	if err != nil || level < 0 {
+		return "", fmt.Errorf("unknown property %s", name)
+	}
+
+	var value int64
+	for _, family := range stats.ColumnFamilies {
+		if level >= len(family.Levels) {
+			continue
+		}
+
+		if prefix == PropertyNumFilesAtLevel {
+			value += int64(family.Levels[level].Files)
+		} else {
+			value += family.Levels[level].Bytes
+		}
+	}
+
+	return strconv.FormatInt(value, 10), nil
+}
+
+// String returns a human readable summary of the stats
+func (s *Stats) String() string {
+	var sb strings.Builder
+	for _, family := range s.ColumnFamilies {
+		sb.WriteString(fmt.Sprintf("column family %s\n", family.Name))
+		sb.WriteString(fmt.Sprintf("  memtable: %d bytes, immutable memtables: %d (%d bytes), "+
+			"pending compaction: %d bytes\n", family.MemTableSize, family.ImmutableMemTables,
+			family.ImmutableMemTableSize, family.PendingCompactionBytes))
+		for level, lvl := range family.Levels {
+			sb.WriteString(fmt.Sprintf("  level %d: %d files, %d bytes, score %.2f\n", level, lvl.Files, lvl.Bytes,
+				lvl.Score))
+		}
+	}
+
+	sb.WriteString(fmt.Sprintf("wal: %d bytes\n", s.WALSize))
+	sb.WriteString(fmt.Sprintf("flush: %d flushes, %d bytes written\n", s.Flushes, s.FlushBytesWritten))
+	sb.WriteString(fmt.Sprintf("compaction: %d compactions, %d bytes read, %d bytes written\n", s.Compactions,
+		s.CompactionBytesRead, s.CompactionBytesWritten))
+	sb.WriteString(fmt.Sprintf("write amplification: %.2f\n", s.WriteAmplification))
+	sb.WriteString(fmt.Sprintf("write stall: %s, %d delayed writes, %d stopped writes\n", s.WriteStall,
+		s.DelayedWrites, s.StoppedWrites))
+
+	ops := make([]string, 0, len(s.Operations))
+	for op := range s.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	for _, op := range ops {
+		hist := s.Operations[op]
+		sb.WriteString(fmt.Sprintf("%s: count %d, mean %s, p50 %s, p99 %s, max %s\n", op, hist.Count, hist.Mean(),
+			hist.Percentile(50), hist.Percentile(99), hist.Max))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/compaction"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Stats(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+
+	// Four flushes is enough to trigger compacting level 0 into level 1
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+		flush(t, db)
+	}
+	assert.NoError(t, db.Delete([]byte("key0")))
+	assert.NoError(t, users.Put([]byte("foo"), []byte("bar")))
+	_, err = db.Get([]byte("key1"))
+	assert.NoError(t, err)
+
+	stats, err := db.Stats()
+	assert.NoError(t, err)
+
+	assert.Len(t, stats.ColumnFamilies, 2)
+	defaultStats := stats.ColumnFamilies[0]
+	assert.Equal(t, DefaultColumnFamily, defaultStats.Name)
+	assert.Equal(t, db.defaultFamily.memTable.Size(), defaultStats.MemTableSize)
+	assert.Equal(t, uint32(0), defaultStats.ImmutableMemTableSize)
+	assert.Len(t, defaultStats.Levels, 2)
+	assert.Equal(t, 0, defaultStats.Levels[0].Files)
+	assert.Equal(t, 1, defaultStats.Levels[1].Files)
+	assert.Equal(t, stats.CompactionBytesWritten, defaultStats.Levels[1].Bytes)
+	assert.Equal(t, float64(0), defaultStats.Levels[0].Score)
+	assert.Equal(t, float64(defaultStats.Levels[1].Bytes)/float64(10*compaction.DefaultLevelSizeBase),
+		defaultStats.Levels[1].Score)
+	assert.Equal(t, int64(0), defaultStats.PendingCompactionBytes)
+
+	assert.Equal(t, "users", stats.ColumnFamilies[1].Name)
+	assert.Equal(t, users.memTable.Size(), stats.ColumnFamilies[1].MemTableSize)
+
+	assert.Equal(t, uint64(db.walog.Size()), stats.WALSize)
+	assert.Equal(t, int64(4), stats.Flushes)
+	assert.Equal(t, int64(1), stats.Compactions)
+	assert.Equal(t, uint64(1), stats.CompactionLatency.Count)
+	assert.Equal(t, uint64(6), stats.WALSyncLatency.Count)
+	assert.Equal(t, int64(0), stats.BackgroundErrors)
+	assert.Equal(t, stats.FlushBytesWritten, stats.CompactionBytesRead)
+	assert.Equal(t, float64(stats.FlushBytesWritten+stats.CompactionBytesWritten)/float64(stats.FlushBytesWritten),
+		stats.WriteAmplification)
+
+	assert.Equal(t, uint64(5), stats.Operations[OpPut].Count)
+	assert.Equal(t, uint64(1), stats.Operations[OpDelete].Count)
+	assert.Equal(t, uint64(1), stats.Operations[OpGet].Count)
+	assert.Equal(t, uint64(0), stats.Operations[OpWrite].Count)
+
+	for name, expected := range map[string]string{
+		PropertyNumFilesAtLevel + "0":  "0",
+		PropertyNumFilesAtLevel + "1":  "1",
+		PropertyNumFilesAtLevel + "5":  "0",
+		PropertyBytesAtLevel + "1":     strconv.FormatInt(stats.CompactionBytesWritten, 10),
+		PropertyMemTableSize:           strconv.Itoa(int(db.defaultFamily.memTable.Size() + users.memTable.Size())),
+		PropertyWALSize:                strconv.Itoa(int(db.walog.Size())),
+		PropertyFlushBytesWritten:      strconv.FormatInt(stats.FlushBytesWritten, 10),
+		PropertyCompactionBytesWritten: strconv.FormatInt(stats.CompactionBytesWritten, 10),
+	} {
+		value, err := db.GetProperty(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, value, name)
+	}
+
+	summary, err := db.GetProperty(PropertyStats)
+	assert.NoError(t, err)
+	assert.Contains(t, summary, "column family users")
+
+	_, err = db.GetProperty("nbdb.foo")
+	assert.EqualError(t, err, "unknown property nbdb.foo")
+	_, err = db.GetProperty(PropertyNumFilesAtLevel + "x")
+	assert.Error(t, err)
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	assert.Equal(t, time.Duration(0), h.snapshot().Percentile(50))
+
+	for i := 0; i < 98; i++ {
+		h.observe(3 * time.Microsecond)
+	}
+	h.observe(time.Millisecond)
+	h.observe(time.Minute)
+
+	hist := h.snapshot()
+	assert.Equal(t, uint64(100), hist.Count)
+	assert.Equal(t, time.Minute, hist.Max)
+	assert.Equal(t, (98*3*time.Microsecond+time.Millisecond+time.Minute)/100, hist.Mean())
+	assert.Equal(t, uint64(98), hist.Buckets[2])
+	assert.Equal(t, uint64(1), hist.Buckets[len(hist.Buckets)-1])
+
+	// Percentiles are reported as the upper bound of the bucket they fall in
+	assert.Equal(t, 4*time.Microsecond, hist.Percentile(50))
+	assert.Equal(t, 1024*time.Microsecond, hist.Percentile(99))
+	assert.Equal(t, time.Minute, hist.Percentile(100))
+}
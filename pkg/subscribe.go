@@ -0,0 +1,346 @@
+package pkg
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/storage"
+	"github.com/nbroyles/nbdb/internal/wal"
+)
+
+// ChangeType is the kind of update a Change made
+type ChangeType int8
+
+const (
+	ChangePut         ChangeType = iota // indicates that the change inserted or updated a key
+	ChangeDelete                        // indicates that the change deleted a key
+	ChangeDeleteRange                   // indicates that the change deleted every key from Key up to but not including Value
+	ChangeMerge                         // indicates that the change merged an operand into a key's value
+)
+
+// Change is a single update committed to the database
+type Change struct {
+	// Seq is the sequence number the update was committed with. Subscribing from Seq + 1 resumes
+	// with the change after this one
+	Seq          uint64
+	ColumnFamily string
+	Type         ChangeType
+	Key          []byte
+	// Value is the value of a put, the operand of a merge or the end of a range delete
+	Value []byte
+	// ExpiresAt is when a put made with a TTL expires. Zero if it never does
+	ExpiresAt time.Time
+}
+
+// Subscription streams the changes committed to a database. Changes are sent on the channel returned
+// by Changes in the order they were committed, with the changes made by a single write (e.g. a
+// WriteBatch) sent together. Keys and values in a change must not be modified
+type Subscription struct {
+	db   *DB
+	from uint64
+	// history holds readers over the retained WALs that are yet to be read, from oldest to newest
+	history []*wal.Reader
+	// names holds the name of each column family with changes in history, keyed by id
+	names map[uint32]string
+
+	changes chan []Change
+	notify  chan bool
+	done    chan bool
+	once    sync.Once
+
+	// mutex guards the fields below
+	mutex sync.Mutex
+	// pending holds changes committed since subscribing that haven't been sent yet
+	pending [][]Change
+	// ended is set once the database is closed, after which no more changes are committed
+	ended bool
+	err   error
+}
+
+// Subscribe returns a Subscription to every change committed with a sequence number of fromSeq or greater.
+// A fromSeq of 0 subscribes to changes committed from now on. Changes older than the ones still held in
+// memtables are only available while their WAL is retained (see DBOpts#WALRetention). If any change
+// from fromSeq onward is no longer available, Subscribe fails with ErrChangesUnavailable
+func (d *DB) Subscribe(fromSeq uint64) (*Subscription, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return nil, ErrClosed
+	}
+
+	if fromSeq == 0 {
+		fromSeq = d.seq + 1
+	}
+
+	sub := &Subscription{
+		db:      d,
+		from:    fromSeq,
+		changes: make(chan []Change),
+		notify:  make(chan bool, 1),
+		done:    make(chan bool),
+	}
+
+	var first []Change
+	if fromSeq <= d.seq {
+		var err error
+		if sub.history, err = d.openWALs(); err != nil {
+			return nil, err
+		}
+		sub.names = d.familyNames()
+
+		// The first retained change determines how far back the subscription can go
+		if first, err = sub.readHistory(); err != nil {
+			closeReaders(sub.history)
+			return nil, err
+		} else if len(first) == 0 || first[0].Seq > fromSeq {
+			closeReaders(sub.history)
+			return nil, fmt.Errorf("%w. requested changes from %d", ErrChangesUnavailable, fromSeq)
+		}
+	}
+
+	d.subscriptions[sub] = true
+	go sub.run(first)
+
+	return sub, nil
+}
+
+// openWALs returns readers over every retained WAL, from oldest to newest. Must be called while holding
+// the lock so that no WAL is archived or written to in the meantime
+func (d *DB) openWALs() ([]*wal.Reader, error) {
+	archived, err := wal.Archived(d.name, d.dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed finding retained WALs: %w", err)
+	}
+
+	var readers []*wal.Reader
+	for _, name := range archived {
+		reader, err := wal.OpenArchived(name)
+		if err != nil {
+			closeReaders(readers)
+			return nil, err
+		}
+		readers = append(readers, reader)
+	}
+
+	walogs := make([]*wal.WAL, 0, len(d.immutable)+1)
+	for _, immutable := range d.immutable {
+		walogs = append(walogs, immutable.walog)
+	}
+
+	for _, walog := range append(walogs, d.walog) {
+		if walog == nil {
+			continue
+		}
+
+		reader, err := walog.NewReader()
+		if err != nil {
+			closeReaders(readers)
+			return nil, err
+		}
+		readers = append(readers, reader)
+	}
+
+	return readers, nil
+}
+
+// familyNames returns the name of each column family keyed by id. Must be called while holding the lock
+func (d *DB) familyNames() map[uint32]string {
+	names := make(map[uint32]string, len(d.families))
+	for id, family := range d.families {
+		names[id] = family.name
+	}
+	return names
+}
+
+// publish queues the records just committed to be sent to every subscriber. Must be called while
+// holding the lock
+func (d *DB) publish(records []*storage.Record) {
+	if len(d.subscriptions) == 0 {
+		return
+	}
+
+	changes := toChanges(records, d.familyNames())
+	for sub := range d.subscriptions {
+		sub.push(changes)
+	}
+}
+
+// Changes returns the channel changes are sent on. It's closed once the subscription is closed, the
+// database is closed and every change committed before that has been sent, or an error occurs
+func (s *Subscription) Changes() <-chan []Change {
+	return s.changes
+}
+
+// Err returns the error that ended the subscription, if there was one
+func (s *Subscription) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.err
+}
+
+// Close stops sending changes and closes the channel returned by Changes
+func (s *Subscription) Close() {
+	s.db.mutex.Lock()
+	delete(s.db.subscriptions, s)
+	s.db.mutex.Unlock()
+
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *Subscription) push(changes []Change) {
+	s.mutex.Lock()
+	s.pending = append(s.pending, changes)
+	s.mutex.Unlock()
+
+	s.signal()
+}
+
+// end marks that no more changes will be pushed
+func (s *Subscription) end() {
+	s.mutex.Lock()
+	s.ended = true
+	s.mutex.Unlock()
+
+	s.signal()
+}
+
+func (s *Subscription) signal() {
+	select {
+	case s.notify <- true:
+	default:
+	}
+}
+
+// run sends the changes from the retained WALs, starting with first, followed by every change pushed
+// since subscribing
+func (s *Subscription) run(first []Change) {
+	defer close(s.changes)
+	defer func() {
+		closeReaders(s.history)
+	}()
+
+	for changes := first; len(changes) > 0; {
+		if !s.send(changes) {
+			return
+		}
+
+		var err error
+		if changes, err = s.readHistory(); err != nil {
+			s.mutex.Lock()
+			s.err = err
+			s.mutex.Unlock()
+			return
+		}
+	}
+
+	for {
+		s.mutex.Lock()
+		pending, ended := s.pending, s.ended
+		s.pending = nil
+		s.mutex.Unlock()
+
+		for _, changes := range pending {
+			if !s.send(changes) {
+				return
+			}
+		}
+
+		if ended {
+			return
+		} else if len(pending) > 0 {
+			continue
+		}
+
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// readHistory returns the changes from the next batch in the retained WALs that includes any the
+// subscription wants, or nothing once the WALs have been read. Readers are closed once they've been read
+func (s *Subscription) readHistory() ([]Change, error) {
+	for len(s.history) > 0 {
+		records, ok, err := s.history[0].Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading changes from WAL: %w", err)
+		} else if !ok {
+			s.history[0].Close()
+			s.history = s.history[1:]
+			continue
+		}
+
+		if changes := s.filter(toChanges(records, s.names)); len(changes) > 0 {
+			return changes, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// send sends the changes the subscription wants to the subscriber, returning false if the subscription
+// was closed first
+func (s *Subscription) send(changes []Change) bool {
+	if changes = s.filter(changes); len(changes) == 0 {
+		return true
+	}
+
+	select {
+	case s.changes <- changes:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// filter drops any changes from before the one the subscription started from
+func (s *Subscription) filter(changes []Change) []Change {
+	for len(changes) > 0 && changes[0].Seq < s.from {
+		changes = changes[1:]
+	}
+	return changes
+}
+
+func toChanges(records []*storage.Record, names map[uint32]string) []Change {
+	changes := make([]Change, len(records))
+	for i, record := range records {
+		change := Change{
+			Seq:          record.Seq,
+			ColumnFamily: names[record.ColumnFamily],
+			Key:          copyBytes(record.Key),
+			Value:        copyBytes(record.Value),
+		}
+
+		switch record.Type {
+		case storage.RecordUpdate:
+			change.Type = ChangePut
+		case storage.RecordDelete:
+			change.Type = ChangeDelete
+		case storage.RecordRangeDelete:
+			change.Type = ChangeDeleteRange
+		case storage.RecordMerge:
+			change.Type = ChangeMerge
+		}
+
+		if record.ExpiresAt != 0 {
+			change.ExpiresAt = time.Unix(0, record.ExpiresAt)
+		}
+
+		changes[i] = change
+	}
+
+	return changes
+}
+
+func closeReaders(readers []*wal.Reader) {
+	for _, reader := range readers {
+		reader.Close()
+	}
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Subscribe(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, MergeOperator: test.AppendOperator{}})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("old"), []byte("value")))
+
+	// Only changes committed after subscribing are sent
+	sub, err := db.Subscribe(0)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+
+	batch := NewWriteBatch()
+	batch.Delete([]byte("foo"))
+	batch.UseColumnFamily(users)
+	batch.Merge([]byte("baz"), []byte("bax"))
+	batch.DeleteRange([]byte("a"), []byte("c"))
+	assert.NoError(t, db.Write(batch))
+
+	assert.Equal(t, []Change{{Seq: 2, ColumnFamily: DefaultColumnFamily, Type: ChangePut, Key: []byte("foo"),
+		Value: []byte("bar")}}, receive(t, sub))
+	assert.Equal(t, []Change{
+		{Seq: 3, ColumnFamily: DefaultColumnFamily, Type: ChangeDelete, Key: []byte("foo")},
+		{Seq: 4, ColumnFamily: "users", Type: ChangeMerge, Key: []byte("baz"), Value: []byte("bax")},
+		{Seq: 5, ColumnFamily: "users", Type: ChangeDeleteRange, Key: []byte("a"), Value: []byte("c")},
+	}, receive(t, sub))
+
+	// Changes still in memtables are available to new subscribers
+	sub2, err := db.Subscribe(2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), receive(t, sub2)[0].Seq)
+	assert.Equal(t, uint64(3), receive(t, sub2)[0].Seq)
+	sub2.Close()
+
+	sub.Close()
+	_, ok := <-sub.Changes()
+	assert.False(t, ok)
+	assert.NoError(t, sub.Err())
+}
+
+func TestDB_SubscribeResume(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, WALRetention: time.Hour})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, db.Put([]byte("baz"), []byte("bax")))
+	flush(t, db)
+	assert.NoError(t, db.Put([]byte("bam"), []byte("boo")))
+	assert.NoError(t, db.Close())
+
+	// Retained WALs allow a subscriber to pick up where it left off after a restart
+	db, err = Open(dbName, DBOpts{DataDir: dir, WALRetention: time.Hour})
+	assert.NoError(t, err)
+
+	sub, err := db.Subscribe(2)
+	assert.NoError(t, err)
+	defer sub.Close()
+
+	assert.NoError(t, db.Put([]byte("bat"), []byte("man")))
+
+	for _, key := range []string{"baz", "bam", "bat"} {
+		changes := receive(t, sub)
+		assert.Len(t, changes, 1)
+		assert.Equal(t, []byte(key), changes[0].Key)
+	}
+}
+
+func TestDB_SubscribeUnavailable(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(t, db.Put([]byte("baz"), []byte("bax")))
+	flush(t, db)
+	assert.NoError(t, db.Put([]byte("bam"), []byte("boo")))
+
+	// WALs aren't retained once flushed by default
+	_, err = db.Subscribe(1)
+	assert.True(t, errors.Is(err, ErrChangesUnavailable))
+
+	sub, err := db.Subscribe(3)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bam"), receive(t, sub)[0].Key)
+
+	// Closing the database ends the subscription once every change committed beforehand is sent
+	assert.NoError(t, db.Put([]byte("bat"), []byte("man")))
+	assert.NoError(t, db.Close())
+
+	assert.Equal(t, []byte("bat"), receive(t, sub)[0].Key)
+	_, ok := <-sub.Changes()
+	assert.False(t, ok)
+}
+
+func receive(t *testing.T, sub *Subscription) []Change {
+	select {
+	case changes, ok := <-sub.Changes():
+		assert.True(t, ok)
+		return changes
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for changes")
+		return nil
+	}
+}
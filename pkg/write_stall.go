@@ -0,0 +1,252 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WriteStallCondition is how much writes are being held back to let flushes and compactions catch up
+type WriteStallCondition int8
+
+const (
+	WriteStallNone    WriteStallCondition = iota // indicates that writes are not being held back
+	WriteStallDelayed                            // indicates that writes are slowed to DBOpts#DelayedWriteRate
+	WriteStallStopped                            // indicates that writes wait until flushes or compactions catch up
+)
+
+func (c WriteStallCondition) String() string {
+	switch c {
+	case WriteStallDelayed:
+		return "delayed"
+	case WriteStallStopped:
+		return "stopped"
+	default:
+		return "none"
+	}
+}
+
+// WriteStallCause is what writes are being held back for
+type WriteStallCause int8
+
+const (
+	WriteStallCauseNone                   WriteStallCause = iota // indicates that writes are not being held back
+	WriteStallCauseMemTables                                     // indicates that too many memtables are waiting to be flushed
+	WriteStallCauseL0Files                                       // indicates that level 0 has too many sstables
+	WriteStallCausePendingCompactionBytes                        // indicates that too many bytes need compacting
+)
+
+func (c WriteStallCause) String() string {
+	switch c {
+	case WriteStallCauseMemTables:
+		return "memtables"
+	case WriteStallCauseL0Files:
+		return "level 0 files"
+	case WriteStallCausePendingCompactionBytes:
+		return "pending compaction bytes"
+	default:
+		return "none"
+	}
+}
+
+// WriteStall describes whether, and why, writes are being held back
+type WriteStall struct {
+	Condition WriteStallCondition
+	Cause     WriteStallCause
+}
+
+func (s WriteStall) String() string {
+	if s.Condition == WriteStallNone {
+		return s.Condition.String()
+	}
+
+	return fmt.Sprintf("%s (%s)", s.Condition, s.Cause)
+}
+
+// WriteStallInfo describes a change in whether writes are being held back
+type WriteStallInfo struct {
+	Previous WriteStall
+	Current  WriteStall
+}
+
+// WriteStall returns whether writes are currently being held back, and why
+func (d *DB) WriteStall() WriteStall {
+	return d.writes.current()
+}
+
+// writeController holds back writes while the database is stalled
+type writeController struct {
+	mutex sync.Mutex
+	stall WriteStall
+	// changed is closed, and replaced, whenever stall changes
+	changed chan struct{}
+	// rate is the number of bytes per second writes are slowed to while delayed
+	rate int64
+	// next is when the next delayed write can go ahead
+	next time.Time
+}
+
+func newWriteController(rate int64) *writeController {
+	return &writeController{changed: make(chan struct{}), rate: rate}
+}
+
+func (w *writeController) current() WriteStall {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.stall
+}
+
+// set changes the stall, waking any writes waiting for it to change, and returns the previous one
+func (w *writeController) set(stall WriteStall) WriteStall {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	previous := w.stall
+	if stall != previous {
+		w.stall = stall
+		close(w.changed)
+		w.changed = make(chan struct{})
+	}
+
+	return previous
+}
+
+// delay returns how long a write of size bytes must wait to keep delayed writes to the rate, or false if
+// writes aren't delayed. Delayed writes are spaced out so that together they don't exceed the rate
+func (w *writeController) delay(size int) (time.Duration, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stall.Condition != WriteStallDelayed {
+		return 0, false
+	}
+
+	now := time.Now()
+	if w.next.Before(now) {
+		w.next = now
+	}
+	wait := w.next.Sub(now)
+	w.next = w.next.Add(time.Duration(float64(size) / float64(w.rate) * float64(time.Second)))
+
+	return wait, true
+}
+
+// stopped returns a channel that's closed once the stall changes if writes are stopped, or nil otherwise
+func (w *writeController) stopped() <-chan struct{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stall.Condition != WriteStallStopped {
+		return nil
+	}
+	return w.changed
+}
+
+// throttle holds back a write of size bytes for as long as the database is stalled, or until ctx is done
+func (d *DB) throttle(ctx context.Context, size int) error {
+	stopped := false
+	for changed := d.writes.stopped(); changed != nil; changed = d.writes.stopped() {
+		if !stopped {
+			stopped = true
+			d.stats.recordStoppedWrite()
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	wait, delayed := d.writes.delay(size)
+	if !delayed {
+		return nil
+	}
+	d.stats.recordDelayedWrite()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// updateWriteStall works out whether writes need holding back from the memtables waiting to be flushed and
+// the most recent view of how much compaction has to catch up on. Must be called while holding the lock
+func (d *DB) updateWriteStall() {
+	queueFull := len(d.immutable) >= d.opts.MaxImmutableMemTables
+
+	stall := WriteStall{}
+	switch {
+	case queueFull && d.memTableFull():
+		stall = WriteStall{Condition: WriteStallStopped, Cause: WriteStallCauseMemTables}
+	case d.l0Files >= d.opts.L0StopWritesTrigger:
+		stall = WriteStall{Condition: WriteStallStopped, Cause: WriteStallCauseL0Files}
+	case d.pendingCompactionBytes >= d.opts.HardPendingCompactionBytesLimit:
+		stall = WriteStall{Condition: WriteStallStopped, Cause: WriteStallCausePendingCompactionBytes}
+	case queueFull:
+		stall = WriteStall{Condition: WriteStallDelayed, Cause: WriteStallCauseMemTables}
+	case d.l0Files >= d.opts.L0SlowdownWritesTrigger:
+		stall = WriteStall{Condition: WriteStallDelayed, Cause: WriteStallCauseL0Files}
+	case d.pendingCompactionBytes >= d.opts.SoftPendingCompactionBytesLimit:
+		stall = WriteStall{Condition: WriteStallDelayed, Cause: WriteStallCausePendingCompactionBytes}
+	}
+
+	previous := d.writes.set(stall)
+	if previous == stall {
+		return
+	}
+
+	if stall.Condition == WriteStallNone {
+		log.Infof("writes no longer held back")
+	} else {
+		log.Warnf("writes %s", stall)
+	}
+
+	info := WriteStallInfo{Previous: previous, Current: stall}
+	for _, listener := range d.opts.EventListeners {
+		listener.OnWriteStallChanged(info)
+	}
+}
+
+// refreshWriteStall updates how much compaction has to catch up on and whether writes need holding back
+// because of it
+func (d *DB) refreshWriteStall() error {
+	l0Files, pending := 0, int64(0)
+	for _, family := range d.columnFamilies() {
+		// FIFO compaction keeps every sstable in level 0, so only its size is held in check
+		files := len(d.manifest.MetadataForLevel(family.id, 0))
+		if d.opts.CompactionStrategy != CompactionFIFO && files > l0Files {
+			l0Files = files
+		}
+
+		familyPending, err := family.compactor.PendingCompactionBytes()
+		if err != nil {
+			return fmt.Errorf("failed calculating pending compaction bytes of column family %s: %w",
+				family.name, err)
+		}
+		if familyPending > pending {
+			pending = familyPending
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return nil
+	}
+
+	d.l0Files, d.pendingCompactionBytes = l0Files, pending
+	d.updateWriteStall()
+
+	return nil
+}
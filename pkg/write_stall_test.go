@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbroyles/nbdb/internal/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+type stallListener struct {
+	NoOpEventListener
+
+	mutex   sync.Mutex
+	changes []WriteStallInfo
+}
+
+func (s *stallListener) OnWriteStallChanged(info WriteStallInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.changes = append(s.changes, info)
+}
+
+func TestDB_WriteStall(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	listener := &stallListener{}
+	db, err := New(dbName, DBOpts{
+		DataDir:                 dir,
+		L0CompactionTrigger:     100,
+		L0SlowdownWritesTrigger: 1,
+		L0StopWritesTrigger:     2,
+		DelayedWriteRate:        1 << 30,
+		EventListeners:          []EventListener{listener},
+	})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.Equal(t, WriteStall{}, db.WriteStall())
+
+	// Writes slow down once level 0 reaches the slowdown trigger
+	assert.NoError(t, db.Put([]byte("a"), []byte("value")))
+	flush(t, db)
+	delayed := WriteStall{Condition: WriteStallDelayed, Cause: WriteStallCauseL0Files}
+	assert.Equal(t, delayed, db.WriteStall())
+
+	assert.NoError(t, db.Put([]byte("b"), []byte("value")))
+	stats, err := db.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), stats.DelayedWrites)
+	assert.Equal(t, int64(0), stats.StoppedWrites)
+
+	// And stop once it reaches the stop trigger
+	flush(t, db)
+	stopped := WriteStall{Condition: WriteStallStopped, Cause: WriteStallCauseL0Files}
+	assert.Equal(t, stopped, db.WriteStall())
+
+	value, err := db.GetProperty(PropertyWriteStall)
+	assert.NoError(t, err)
+	assert.Equal(t, "stopped (level 0 files)", value)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.Is(db.PutContext(ctx, []byte("c"), []byte("value")), context.DeadlineExceeded))
+
+	// Stopped writes go ahead once compaction catches up
+	done := make(chan error)
+	go func() {
+		done <- db.Put([]byte("c"), []byte("value"))
+	}()
+
+	waitForStoppedWrites(t, db, 2)
+	select {
+	case <-done:
+		assert.Fail(t, "write went ahead while writes were stopped")
+	default:
+	}
+
+	assert.NoError(t, db.CompactRange(nil, nil))
+	assert.NoError(t, <-done)
+	assert.Equal(t, WriteStall{}, db.WriteStall())
+
+	got, err := db.Get([]byte("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), got)
+
+	listener.mutex.Lock()
+	assert.Equal(t, []WriteStallInfo{
+		{Previous: WriteStall{}, Current: delayed},
+		{Previous: delayed, Current: stopped},
+		{Previous: stopped, Current: WriteStall{}},
+	}, listener.changes)
+	listener.mutex.Unlock()
+	assert.NoError(t, db.Close())
+}
+
+func TestDB_WriteStallMemTables(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+
+	dbName := "foo"
+	db, err := New(dbName, DBOpts{DataDir: dir, MaxImmutableMemTables: 1})
+	defer cleanup(dbName, dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Put([]byte("a"), []byte("old")))
+
+	// A full queue of immutable memtables slows writes down, and stops them once the active memtable fills up
+	waf, err := wal.CreateFile(db.name, db.dataDir)
+	assert.NoError(t, err)
+
+	db.mutex.Lock()
+	db.freezeMemTables(wal.New(waf))
+	db.updateWriteStall()
+	db.mutex.Unlock()
+	assert.Equal(t, WriteStall{Condition: WriteStallDelayed, Cause: WriteStallCauseMemTables}, db.WriteStall())
+
+	assert.NoError(t, db.Put([]byte("b"), []byte("new")))
+	db.mutex.Lock()
+	db.opts.MemTableSizeLimit = 1
+	db.updateWriteStall()
+	db.mutex.Unlock()
+	assert.Equal(t, WriteStall{Condition: WriteStallStopped, Cause: WriteStallCauseMemTables}, db.WriteStall())
+
+	// Reads see every memtable waiting to be flushed
+	for key, expected := range map[string]string{"a": "old", "b": "new"} {
+		value, err := db.Get([]byte(key))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(expected), value)
+	}
+
+	// Flushing the queue lets writes go ahead
+	assert.NoError(t, db.Flush(true))
+	assert.Equal(t, WriteStall{}, db.WriteStall())
+	assert.NoError(t, db.Put([]byte("c"), []byte("new")))
+	assert.NoError(t, db.Close())
+}
+
+// waitForStoppedWrites waits for count writes to have been stopped, failing if they take too long
+func waitForStoppedWrites(t *testing.T, db *DB, count int64) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		stats, err := db.Stats()
+		assert.NoError(t, err)
+		if stats.StoppedWrites >= count {
+			return
+		}
+	}
+	assert.Fail(t, "timed out waiting for stopped writes", "expected %d", count)
+}